@@ -1,37 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/go-playground/validator"
-	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type APIServer struct {
-	listenAddr string
-	store      Storage
+	listenAddr     string
+	store          Storage
+	ledger         *Ledger
+	cfg            *Config
+	loginLimiter   rateLimiter
+	signupLimiter  rateLimiter
+	ipLimiter      rateLimiter
+	accountLimiter rateLimiter
+	events         EventDispatcher
+	mailer         Mailer
+	logger         *slog.Logger
+	oauth          *oauthProviders
+	// now is the clock TOTP codes are checked against.
+	now func() time.Time
 }
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
-type APIError struct {
-	Error string `json:"error"`
-}
-
-var validate = validator.New()
-
-func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
+func (s *APIServer) makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, APIError{Error: err.Error()})
+			if errorStatus(err) == http.StatusInternalServerError {
+				s.logger.ErrorContext(r.Context(), "request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+			writeError(w, err)
 		}
 	}
 }
@@ -42,183 +61,1346 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
-func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+// maxRequestBodyBytes caps the size of JSON request bodies.
+const maxRequestBodyBytes = 1 << 20
+
+// decodeJSON decodes the request body into v, rejecting bodies over
+// maxRequestBodyBytes, fields v does not have and anything after the JSON
+// value.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	return decodeJSONLimit(w, r, v, maxRequestBodyBytes)
+}
+
+// decodeJSONLimit is decodeJSON for bodies of up to limit bytes.
+func decodeJSONLimit(w http.ResponseWriter, r *http.Request, v any, limit int64) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &maxBytesErr):
+		return &HTTPError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("request body must not exceed %d bytes", limit),
+		}
+	case errors.Is(err, io.EOF):
+		return badRequest("request body must not be empty")
+	default:
+		return badRequest("malformed request body: %v", err)
+	}
+}
+
+// writeNoContent answers with 204 and no body, as deletes do.
+func writeNoContent(w http.ResponseWriter) error {
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// writeRawJSON writes an already encoded JSON body.
+func writeRawJSON(w http.ResponseWriter, status int, body []byte) error {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
+
+// accessTokenCookie is the cookie login sets when Config.JWTCookie is on.
+const accessTokenCookie = "access_token"
+
+// tokenFromRequest returns the bearer token from the Authorization header or,
+// failing that, the access token cookie.
+func tokenFromRequest(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if len(header) < 7 || strings.ToUpper(header[:7]) != "BEARER " {
+			return "", false
+		}
+		return header[7:], true
+	}
+	if cookie, err := r.Cookie(accessTokenCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// authenticate returns the claims of tokenString if it is a valid access
+// token that has not been revoked, and errInvalidToken otherwise.
+func (s *APIServer) authenticate(ctx context.Context, tokenString string) (*AccountClaims, error) {
+	claims, err := validateAccessToken(tokenString)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	revoked, err := s.store.IsAccessTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errInvalidToken
+	}
+	if claims.SessionID != 0 {
+		if revoked, err = s.store.IsSessionRevoked(ctx, claims.SessionID); err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, errInvalidToken
+		}
+	}
+	return claims, nil
+}
+
+// withJWTAuth only lets requests with a valid access token through and
+// stores the token's claims in the request context.
+func (s *APIServer) withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString, ok := tokenFromRequest(r)
+		if !ok {
+			writeError(w, errMissingToken)
+			return
+		}
+		claims, err := s.authenticate(r.Context(), tokenString)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		handlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+// withAccountOwner only lets requests through when the authenticated account
+// is the one named by {id}, or is an admin. It must be wrapped by withJWTAuth.
+// Unauthenticated requests are answered with 401 and other accounts with 403.
+func withAccountOwner(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if len(tokenString) < 7 || strings.ToUpper(tokenString[:7]) != "BEARER "{
-			WriteJSON(w, http.StatusForbidden, APIError{Error: "invalid token"})
+		claims, ok := claimsFromContext(r.Context())
+		if !ok {
+			writeError(w, errMissingToken)
 			return
 		}
-		token, err := validateJWT(tokenString[7:])
-		if err != nil || !token.Valid {
-			WriteJSON(w, http.StatusForbidden, APIError{Error: "invalid token"})
+		if claims.Role != RoleAdmin && mux.Vars(r)["id"] != strconv.Itoa(claims.AccountID) {
+			writeError(w, errPermissionDenied)
 			return
 		}
-		claims := token.Claims.(jwt.MapClaims)
-		fmt.Println(claims)
 		handlerFunc(w, r)
 	}
 }
 
-func createJWT(account *Account) (string, error) {
-	claims := &jwt.MapClaims{
-		"expiresAt":     15000,
-		"accountId": account.ID,
+// withRole only lets requests through when the authenticated account has the
+// given role. It must be wrapped by withJWTAuth.
+func withRole(role string, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := claimsFromContext(r.Context())
+		if !ok {
+			writeError(w, errMissingToken)
+			return
+		}
+		if claims.Role != role {
+			writeError(w, errPermissionDenied)
+			return
+		}
+		handlerFunc(w, r)
 	}
+}
 
-	secret := os.Getenv("JWT_SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+type contextKey string
 
-	return token.SignedString([]byte(secret))
-}
+const claimsKey contextKey = "claims"
 
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
+// claimsFromContext returns the token claims withJWTAuth stored for the
+// authenticated request.
+func claimsFromContext(ctx context.Context) (*AccountClaims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*AccountClaims)
+	return claims, ok
 }
 
-func validatePassword(password, hashedPassword string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	return err == nil
+// accountIDFromContext returns the ID of the authenticated account.
+func accountIDFromContext(ctx context.Context) (int, bool) {
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return claims.AccountID, true
 }
 
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
+func NewAPIServer(listenAddr string, store Storage, cfg *Config, logger *slog.Logger) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:     listenAddr,
+		store:          store,
+		ledger:         NewLedger(store),
+		cfg:            cfg,
+		loginLimiter:   newRateLimiter("login", cfg.LoginRateLimit, cfg.LoginRateBurst),
+		signupLimiter:  newRateLimiter("signup", cfg.SignupRateLimit, cfg.SignupRateBurst),
+		ipLimiter:      newRateLimiter("ip", cfg.RateLimit, cfg.RateBurst),
+		accountLimiter: newRateLimiter("account", cfg.AccountRateLimit, cfg.AccountRateBurst),
+		events:         newEventDispatcher(cfg, logger),
+		mailer:         logMailer{logger},
+		logger:         logger,
+		oauth:          newOAuthProviders(cfg.OAuthProviders),
+		now:            time.Now,
 	}
 }
 
 func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
-	if r.Method != "POST"{
-		return fmt.Errorf("method not allowed: %s", r.Method)
-	}
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := decodeJSON(w, r, &req); err != nil {
 		return err
 	}
-	if err := validate.Struct(req); err != nil{
-		return fmt.Errorf("invalid login request format")
+	req.Email = normalizeEmail(req.Email)
+	if err := validate.Struct(req); err != nil {
+		return err
 	}
-	acc, err := s.store.GetAccountByEmail(req.Email)
-	if err!= nil {
-		return fmt.Errorf("account does not exist")
+	ip := clientIP(r)
+	if err := s.checkLoginLock(r.Context(), req.Email, ip); err != nil {
+		return err
+	}
+	// Unknown emails and wrong passwords get the same response so that
+	// logins cannot be used to find out which emails have accounts.
+	acc, err := s.store.GetAccountByEmail(r.Context(), req.Email)
+	if errors.Is(err, ErrAccountNotFound) {
+		return s.loginFailed(r.Context(), req.Email, ip, nil, unauthorized("INVALID_CREDENTIALS", "invalid email or password"))
+	}
+	if err != nil {
+		return err
 	}
 	if !validatePassword(req.Password, acc.EncryptedPassword) {
-		return fmt.Errorf("incorrect password")
+		s.recordLogin(r.Context(), acc, ip, r.UserAgent(), LoginResultFailure)
+		return s.loginFailed(r.Context(), req.Email, ip, acc, unauthorized("INVALID_CREDENTIALS", "invalid email or password"))
+	}
+	// With two-factor authentication on, failures are cleared once the second
+	// factor is checked too.
+	if !acc.TOTPEnabled {
+		if err := s.store.ClearLoginFailures(r.Context(), loginEmailKeyPrefix+req.Email); err != nil {
+			return err
+		}
+	}
+	s.rehashPassword(r.Context(), acc, req.Password)
+	if !acc.EmailVerified {
+		return forbidden("EMAIL_NOT_VERIFIED", "email address not verified, follow the link sent at signup")
 	}
-	token, err := createJWT(acc)
-	if err!= nil{
-		return fmt.Errorf("server error")
+	if acc.TOTPEnabled {
+		return s.writeTwoFactorChallenge(w, acc)
 	}
-	w.Header().Set("Authorization", "Bearer "+token)
-	return WriteJSON(w, http.StatusOK, req)
+	return s.writeLoginToken(w, r, acc)
 }
 
-func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
-	switch r.Method {
-	case "GET":
-		return s.handleGetAllAccounts(w, r)
-	case "POST":
-		return s.handleCreateAccount(w, r)
-	default:
-		return fmt.Errorf("method not allowed: %s", r.Method)
+// writeLoginToken starts a new refresh token family for acc and issues it
+// with an access token.
+func (s *APIServer) writeLoginToken(w http.ResponseWriter, r *http.Request, acc *Account) error {
+	refreshToken, refresh, err := s.newRefreshToken(acc.ID, "")
+	if err != nil {
+		return fmt.Errorf("could not create refresh token for account %d: %w", acc.ID, err)
+	}
+	if err := s.store.CreateRefreshToken(r.Context(), refresh); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "login succeeded", "account_id", acc.ID)
+	s.recordLogin(r.Context(), acc, clientIP(r), r.UserAgent(), LoginResultSuccess)
+	return s.writeTokens(w, r, acc, refreshToken, refresh)
+}
+
+// writeTokens records the use of refresh's session by the client making r
+// and issues an access token for the session along with refreshToken, as
+// cookies when Config.JWTCookie is on and in the body otherwise.
+func (s *APIServer) writeTokens(w http.ResponseWriter, r *http.Request, acc *Account, refreshToken string, refresh *RefreshToken) error {
+	session := newSession(r, refresh)
+	if err := s.store.UpsertSession(r.Context(), session); err != nil {
+		return err
+	}
+	token, expiresAt, err := createSessionJWT(acc, session.ID)
+	if err != nil {
+		return fmt.Errorf("could not sign token for account %d: %w", acc.ID, err)
+	}
+	resp := LoginResponse{AccountID: acc.ID, ExpiresAt: expiresAt.UTC(), RefreshExpiresAt: refresh.ExpiresAt}
+	if s.cfg.JWTCookie {
+		http.SetCookie(w, &http.Cookie{
+			Name:     accessTokenCookie,
+			Value:    token,
+			Path:     "/",
+			Expires:  expiresAt,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.SetCookie(w, &http.Cookie{
+			Name:     refreshTokenCookie,
+			Value:    refreshToken,
+			Path:     apiPrefix,
+			Expires:  refresh.ExpiresAt,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		if err := setCSRFCookie(w, refresh.ExpiresAt); err != nil {
+			return fmt.Errorf("could not create CSRF token for account %d: %w", acc.ID, err)
+		}
+	} else {
+		w.Header().Set("Authorization", "Bearer "+token)
+		resp.Token = token
+		resp.RefreshToken = refreshToken
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleLogout clears the token cookies, revokes the presented access token
+// and revokes the refresh token sent in the body or cookie, along with its
+// family and session.
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	if tokenString, ok := tokenFromRequest(r); ok {
+		if claims, err := validateAccessToken(tokenString); err == nil {
+			if err := s.store.RevokeAccessToken(r.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+				return err
+			}
+			s.logger.InfoContext(r.Context(), "access token revoked", "account_id", claims.AccountID)
+		}
+	}
+	refreshToken, err := refreshTokenFromRequest(w, r)
+	if err != nil {
+		return err
 	}
+	if refreshToken != "" {
+		if err := s.store.RevokeRefreshTokenFamily(r.Context(), hashOpaqueToken(refreshToken), s.now().UTC()); err != nil {
+			return err
+		}
+	}
+	for _, cookie := range []*http.Cookie{
+		{Name: accessTokenCookie, Path: "/", HttpOnly: true},
+		{Name: refreshTokenCookie, Path: apiPrefix, HttpOnly: true},
+		{Name: csrfCookie, Path: "/"},
+	} {
+		cookie.MaxAge = -1
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteStrictMode
+		http.SetCookie(w, cookie)
+	}
+	return WriteJSON(w, http.StatusOK, "OK")
+}
+
+func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
 }
 
-func (s *APIServer) handleAccountByID(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
 	id, err := s.getIDFromRequest(r)
 	if err != nil {
 		return err
 	}
+	if err := s.store.DeleteAccount(r.Context(), id); err != nil {
+		return err
+	}
+	return writeNoContent(w)
+}
+
+// handleHardDeleteAccount permanently removes an account and its history for
+// compliance purges. DELETE /account/{id} only soft deletes.
+func (s *APIServer) handleHardDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.HardDeleteAccount(r.Context(), id); err != nil {
+		return err
+	}
+	adminID, _ := accountIDFromContext(r.Context())
+	s.logger.InfoContext(r.Context(), "account purged", "account_id", id, "admin_id", adminID)
+	return writeNoContent(w)
+}
 
-	switch r.Method {
-	case "GET":
-		account, err := s.store.GetAccountByID(id)
+// handleRestoreAccount brings back an account soft deleted by DELETE
+// /account/{id} before the purge job removes it.
+func (s *APIServer) handleRestoreAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.RestoreAccount(r.Context(), id); err != nil {
+		return err
+	}
+	adminID, _ := accountIDFromContext(r.Context())
+	s.logger.InfoContext(r.Context(), "account restored", "account_id", id, "admin_id", adminID)
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// handleSetOverdraftLimit lets an admin set how far below zero an account
+// may go.
+func (s *APIServer) handleSetOverdraftLimit(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	req := new(SetOverdraftLimitRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	if err := s.store.SetOverdraftLimit(r.Context(), id, req.OverdraftLimit); err != nil {
+		return err
+	}
+	adminID, _ := accountIDFromContext(r.Context())
+	s.logger.InfoContext(r.Context(), "overdraft limit changed", "account_id", id, "overdraft_limit", req.OverdraftLimit, "admin_id", adminID)
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// handleSetTransferLimits lets an admin override the daily and per-transfer
+// limits of an account. Limits left out of the request go back to the
+// configured defaults.
+func (s *APIServer) handleSetTransferLimits(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	req := new(SetTransferLimitsRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	if err := s.store.SetTransferLimits(r.Context(), id, req.DailyTransferLimit, req.PerTransferLimit); err != nil {
+		return err
+	}
+	adminID, _ := accountIDFromContext(r.Context())
+	s.logger.InfoContext(r.Context(), "transfer limits changed", "account_id", id, "daily_transfer_limit", req.DailyTransferLimit, "per_transfer_limit", req.PerTransferLimit, "admin_id", adminID)
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// handleLedgerAdjustment lets an admin deposit into, withdraw from or charge
+// a fee to an account.
+func (s *APIServer) handleLedgerAdjustment(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	req := new(LedgerAdjustmentRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	var transaction *Transaction
+	switch req.Type {
+	case JournalDeposit:
+		transaction, err = s.ledger.Deposit(r.Context(), id, req.Amount)
+	case JournalWithdrawal:
+		transaction, err = s.ledger.Withdraw(r.Context(), id, req.Amount)
+	case JournalFee:
+		transaction, err = s.ledger.ChargeFee(r.Context(), id, req.Amount)
+	}
+	if err != nil {
+		return err
+	}
+	adminID, _ := accountIDFromContext(r.Context())
+	s.logger.InfoContext(r.Context(), "ledger adjustment posted", "account_id", id, "type", req.Type, "amount", req.Amount, "admin_id", adminID)
+	return WriteJSON(w, http.StatusCreated, transaction)
+}
+
+// handleGetMe returns the account the token was issued to, so clients do not
+// need to know their own account id.
+func (s *APIServer) handleGetMe(w http.ResponseWriter, r *http.Request) error {
+	id, _ := accountIDFromContext(r.Context())
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// handleSetAccountStatus returns an admin handler that moves an account to
+// status, e.g. freezing it while fraud is investigated.
+func (s *APIServer) handleSetAccountStatus(status string) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := s.getIDFromRequest(r)
 		if err != nil {
 			return err
 		}
-		WriteJSON(w, http.StatusOK, &account)
-
-	case "DELETE":
-		err = s.store.DeleteAccount(id)
+		if err := s.store.SetAccountStatus(r.Context(), id, status); err != nil {
+			return err
+		}
+		adminID, _ := accountIDFromContext(r.Context())
+		s.logger.InfoContext(r.Context(), "account status changed", "account_id", id, "status", status, "admin_id", adminID)
+		account, err := s.store.GetAccountByID(r.Context(), id)
 		if err != nil {
 			return err
 		}
-		return WriteJSON(w, http.StatusOK, "OK")
+		return WriteJSON(w, http.StatusOK, account)
+	}
+}
 
-	default:
-		return fmt.Errorf("method not allowed: %s", r.Method)
+func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
 	}
-	return nil
+	updateAccountReq := new(UpdateAccountRequest)
+	if err := decodeJSON(w, r, updateAccountReq); err != nil {
+		return err
+	}
+	if err := validate.Struct(updateAccountReq); err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	account.FirstName = updateAccountReq.FirstName
+	account.LastName = updateAccountReq.LastName
+	if updateAccountReq.Phone != nil {
+		account.Phone = *updateAccountReq.Phone
+	}
+	account.Version = updateAccountReq.Version
+
+	if err := s.store.UpdateAccount(r.Context(), account); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
 }
 
+// handleGetAllAccounts lists a page of the accounts matching the query's
+// filters, with how many match in total.
 func (s *APIServer) handleGetAllAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetAccounts()
+	limit, offset, err := getPaginationFromRequest(r)
 	if err != nil {
 		return err
 	}
-	WriteJSON(w, http.StatusOK, accounts)
-	return nil
+	limit, offset, pageNumber, err := getPageFromRequest(r, limit, offset)
+	if err != nil {
+		return err
+	}
+	after := 0
+	if v := r.URL.Query().Get("after"); v != "" {
+		after, err = strconv.Atoi(v)
+		if err != nil || after < 1 {
+			return badRequest("after %s must be a positive account id", v)
+		}
+	}
+	filter, err := getAccountFilterFromRequest(r)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := s.store.GetAccounts(r.Context(), filter, after, limit, offset)
+	if err != nil {
+		return err
+	}
+	total, err := s.store.CountAccounts(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, AccountsPage{
+		Accounts: accounts,
+		Total:    total,
+		Limit:    limit,
+		Offset:   offset,
+		After:    after,
+		Page:     pageNumber,
+	})
+}
+
+// getAccountFilterFromRequest reads the search, email, name, createdAfter
+// and minBalance query parameters.
+func getAccountFilterFromRequest(r *http.Request) (AccountFilter, error) {
+	query := r.URL.Query()
+	filter := AccountFilter{
+		Search: query.Get("search"),
+		Email:  query.Get("email"),
+		Name:   query.Get("name"),
+	}
+	createdAfter, err := getTimeFromQuery(r, "createdAfter")
+	if err != nil {
+		return AccountFilter{}, err
+	}
+	if createdAfter != nil {
+		filter.CreatedAfter = *createdAfter
+	}
+	if v := query.Get("minBalance"); v != "" {
+		minBalance, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return AccountFilter{}, badRequest("minBalance %s must be an integer amount in minor units", v)
+		}
+		filter.MinBalance = &minBalance
+	}
+	return filter, nil
 }
 
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
 	createAccountReq := new(CreateAccountRequest)
-	if err := json.NewDecoder(r.Body).Decode(createAccountReq); err != nil {
+	if err := decodeJSON(w, r, createAccountReq); err != nil {
 		return err
 	}
-	if err := validate.Struct(createAccountReq); err != nil{
-		return fmt.Errorf("invalid request format")
+	createAccountReq.Email = normalizeEmail(createAccountReq.Email)
+	if err := validate.Struct(createAccountReq); err != nil {
+		return err
+	}
+	existingAccount, err := s.store.GetAccountByEmail(r.Context(), createAccountReq.Email)
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		return err
 	}
-	existingAccount, _ := s.store.GetAccountByEmail(createAccountReq.Email)  
 
 	if existingAccount != nil {
-		return fmt.Errorf("account with email address %s already exists", createAccountReq.Email)
+		return &HTTPError{Status: http.StatusConflict, Code: "ACCOUNT_EXISTS", Message: fmt.Sprintf("account with email address %s already exists", createAccountReq.Email)}
 	}
 
 	account, err := NewAccount(createAccountReq.FirstName, createAccountReq.LastName, createAccountReq.Email, createAccountReq.Password)
 	if err != nil {
 		return err
 	}
+	if createAccountReq.Currency != "" {
+		account.Currency = createAccountReq.Currency
+	}
 
-	if err := s.store.CreateAccount(account); err != nil {
+	if err := s.store.CreateAccount(r.Context(), account); err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, account)
+	s.logger.InfoContext(r.Context(), "account created", "account_id", account.ID)
+	if err := s.sendVerification(r.Context(), account); err != nil {
+		return err
+	}
+	s.events.Dispatch(Event{Type: EventAccountCreated, AccountID: account.ID, Timestamp: account.CreatedAt})
+	w.Header().Set("Location", fmt.Sprintf("%s/account/%d", apiVersionPrefix, account.ID))
+	return WriteJSON(w, http.StatusCreated, account)
+}
+
+// sendVerification stores a fresh verification token for account and mails
+// it the link.
+func (s *APIServer) sendVerification(ctx context.Context, account *Account) error {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().UTC().Add(verificationTokenTTL)
+	if err := s.store.CreateVerificationToken(ctx, account.ID, hashOpaqueToken(token), expiresAt); err != nil {
+		return err
+	}
+	return s.mailer.SendVerificationEmail(ctx, account.Email, token)
+}
+
+// handleVerifyEmail consumes the token from a verification link.
+func (s *APIServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return badRequest("token is required")
+	}
+	id, err := s.store.ConsumeVerificationToken(r.Context(), hashOpaqueToken(token))
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "email verified", "account_id", id)
+	return WriteJSON(w, http.StatusOK, "email verified")
+}
+
+// handleBatchCreateAccounts opens every account in the request or none of
+// them. Validation runs on all entries before anything is stored, and the
+// response reports the outcome of each entry.
+func (s *APIServer) handleBatchCreateAccounts(w http.ResponseWriter, r *http.Request) error {
+	var reqs []CreateAccountRequest
+	if err := decodeJSON(w, r, &reqs); err != nil {
+		return err
+	}
+	if len(reqs) == 0 || len(reqs) > maxBatchAccounts {
+		return badRequest("batch must contain between 1 and %d accounts", maxBatchAccounts)
+	}
+
+	results := make([]BatchItemResult, len(reqs))
+	invalid := false
+	for i := range reqs {
+		reqs[i].Email = normalizeEmail(reqs[i].Email)
+		results[i] = BatchItemResult{Index: i}
+		if err := validate.Struct(&reqs[i]); err != nil {
+			results[i].Status = BatchItemInvalid
+			results[i].Fields = validationMessages(err)
+			invalid = true
+		}
+	}
+	if invalid {
+		for i := range results {
+			if results[i].Status == "" {
+				results[i].Status = BatchItemRolledBack
+			}
+		}
+		return WriteJSON(w, http.StatusUnprocessableEntity, BatchCreateAccountsResponse{Results: results})
+	}
+
+	accounts := make([]*Account, len(reqs))
+	for i, req := range reqs {
+		account, err := NewAccount(req.FirstName, req.LastName, req.Email, req.Password)
+		if err != nil {
+			return err
+		}
+		if req.Currency != "" {
+			account.Currency = req.Currency
+		}
+		accounts[i] = account
+	}
+
+	if err := s.store.CreateAccounts(r.Context(), accounts); err != nil {
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			return err
+		}
+		for i := range results {
+			results[i].Status = BatchItemRolledBack
+		}
+		results[batchErr.Index].Status = BatchItemFailed
+		results[batchErr.Index].Error = batchErr.Err.Error()
+		return WriteJSON(w, errorStatus(err), BatchCreateAccountsResponse{Results: results})
+	}
+
+	for i, account := range accounts {
+		results[i].Status = BatchItemCreated
+		results[i].Account = account
+		s.events.Dispatch(Event{Type: EventAccountCreated, AccountID: account.ID, Timestamp: account.CreatedAt})
+		if err := s.sendVerification(r.Context(), account); err != nil {
+			s.logger.ErrorContext(r.Context(), "could not send verification email", "account_id", account.ID, "error", err)
+		}
+	}
+	s.logger.InfoContext(r.Context(), "account batch created", "count", len(accounts))
+	return WriteJSON(w, http.StatusOK, BatchCreateAccountsResponse{Results: results})
+}
+
+var accountCSVHeader = []string{"id", "first_name", "last_name", "email", "balance", "currency", "created_at"}
+
+// handleExportAccounts streams every account as CSV. Rows are written as the
+// store yields them, so once the header is out a failure can only be logged
+// and the download ends short.
+func (s *APIServer) handleExportAccounts(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="accounts.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	err := cw.Write(accountCSVHeader)
+	if err == nil {
+		err = s.store.EachAccount(r.Context(), func(acc *Account) error {
+			return cw.Write([]string{
+				strconv.Itoa(acc.ID),
+				acc.FirstName,
+				acc.LastName,
+				acc.Email,
+				strconv.FormatInt(acc.Balance, 10),
+				acc.Currency,
+				acc.CreatedAt.UTC().Format(time.RFC3339),
+			})
+		})
+	}
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "account export failed", "error", err)
+	}
+	return nil
 }
 
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
 	tr := new(TransferRequest)
-	if err := json.NewDecoder(r.Body).Decode(tr); err != nil {
+	if err := decodeJSON(w, r, tr); err != nil {
+		return err
+	}
+	if err := validate.Struct(tr); err != nil {
+		return err
+	}
+
+	fromID, _ := accountIDFromContext(r.Context())
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	requestHash := hashTransferRequest(tr)
+	if idempotencyKey != "" {
+		result, err := s.store.GetIdempotentResult(r.Context(), fromID, idempotencyKey)
+		if err == nil {
+			if result.RequestHash != "" && result.RequestHash != requestHash {
+				return errIdempotencyKeyReused
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			return writeRawJSON(w, result.StatusCode, result.Body)
+		}
+		if !errors.Is(err, ErrIdempotentResultNotFound) {
+			return err
+		}
+	}
+
+	to, err := s.store.GetAccountByNumber(r.Context(), tr.ToAccount)
+	if err != nil {
+		return err
+	}
+
+	// the transfer and the result replayed for its Idempotency-Key are stored
+	// together, so a retry cannot move the money twice
+	var (
+		status    int
+		scheduled *ScheduledTransfer
+		debit     *Transaction
+		body      []byte
+	)
+	err = s.store.InTx(r.Context(), func(store Storage) error {
+		var result any
+		var err error
+		if tr.ExecuteAt != nil {
+			if scheduled, err = s.scheduleTransfer(r.Context(), store, fromID, to.ID, tr); err != nil {
+				return err
+			}
+			status, result = http.StatusAccepted, scheduled
+		} else {
+			if debit, err = store.Transfer(r.Context(), fromID, to.ID, tr.Amount); err != nil {
+				return err
+			}
+			status, result = http.StatusOK, debit
+		}
+		if body, err = json.Marshal(result); err != nil {
+			return err
+		}
+		if idempotencyKey == "" {
+			return nil
+		}
+		return store.StoreIdempotentResult(r.Context(), &IdempotentResult{
+			AccountID:   fromID,
+			Key:         idempotencyKey,
+			RequestHash: requestHash,
+			StatusCode:  status,
+			Body:        body,
+			CreatedAt:   time.Now().UTC(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if scheduled != nil {
+		s.logger.InfoContext(r.Context(), "transfer scheduled", "scheduled_transfer_id", scheduled.ID, "account_id", fromID, "to_account_id", to.ID, "amount", tr.Amount, "execute_at", scheduled.ExecuteAt)
+	} else {
+		s.logger.InfoContext(r.Context(), "transfer completed", "account_id", fromID, "to_account_id", to.ID, "amount", tr.Amount)
+		s.events.Dispatch(Event{
+			Type:                  EventTransferCompleted,
+			AccountID:             fromID,
+			CounterpartyAccountID: &to.ID,
+			Amount:                tr.Amount,
+			Timestamp:             debit.CreatedAt,
+		})
+	}
+	return writeRawJSON(w, status, body)
+}
+
+// hashTransferRequest fingerprints a decoded transfer so an Idempotency-Key
+// is only replayed for the request it was first used with, however the JSON
+// was formatted.
+func hashTransferRequest(tr *TransferRequest) string {
+	request := fmt.Sprintf("%d:%d", tr.ToAccount, tr.Amount)
+	if tr.ExecuteAt != nil {
+		request += ":" + tr.ExecuteAt.UTC().Format(time.RFC3339Nano)
+	}
+	sum := sha256.Sum256([]byte(request))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	req := new(ChangePasswordRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	acc, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if !validatePassword(req.CurrentPassword, acc.EncryptedPassword) {
+		return forbidden("INCORRECT_PASSWORD", "incorrect password")
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return badRequest("new password must be different from the current password")
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+	if err := s.store.UpdatePassword(r.Context(), id, hash); err != nil {
+		return err
+	}
+	// whoever knew the old password is logged out, but the caller stays
+	// logged in unless an admin changed someone else's password
+	keep := 0
+	if claims, ok := claimsFromContext(r.Context()); ok && claims.AccountID == id {
+		keep = claims.SessionID
+	}
+	if err := s.store.RevokeOtherSessions(r.Context(), id, keep, s.now().UTC()); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, "OK")
+}
+
+func (s *APIServer) handleGetBalance(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+
+	balance, err := s.store.GetBalance(r.Context(), id)
+	if err != nil {
 		return err
 	}
-	defer r.Body.Close()
+	return WriteJSON(w, http.StatusOK, BalanceResponse{
+		Balance:   balance.Amount,
+		Available: balance.Amount - balance.Held,
+		Held:      balance.Held,
+		Currency:  balance.Currency,
+		Formatted: balance.String(),
+	})
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	limit, offset, err := getPaginationFromRequest(r)
+	if err != nil {
+		return err
+	}
+	from, err := getTimeFromQuery(r, "from")
+	if err != nil {
+		return err
+	}
+	to, err := getTimeFromQuery(r, "to")
+	if err != nil {
+		return err
+	}
+	if from != nil && to != nil && !from.Before(*to) {
+		return badRequest("from %s must be before to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	var since, until time.Time
+	if from != nil {
+		since = *from
+	}
+	if to != nil {
+		until = *to
+	}
+	transactions, err := s.store.GetTransactions(r.Context(), id, since, until, limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, TransactionsPage{
+		Transactions: transactions,
+		Limit:        limit,
+		Offset:       offset,
+		From:         from,
+		To:           to,
+	})
+}
+
+// getTimeFromQuery parses the named RFC 3339 query parameter, returning nil
+// when it is absent.
+func getTimeFromQuery(r *http.Request, name string) (*time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, badRequest("%s %s must be an RFC 3339 timestamp such as 2024-01-31T00:00:00Z", name, v)
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// handleGetLedgerEntries lists the ledger entries posted to an account,
+// newest first.
+func (s *APIServer) handleGetLedgerEntries(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	limit, offset, err := getPaginationFromRequest(r)
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.store.GetLedgerEntries(r.Context(), id, limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, LedgerEntriesPage{
+		Entries: entries,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+// getPaginationFromRequest reads the limit and offset query parameters,
+// defaulting to the first defaultPageLimit results.
+func getPaginationFromRequest(r *http.Request) (int, int, error) {
+	limit, offset := defaultPageLimit, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, badRequest("limit %s must be an integer between 1 and %d", v, maxPageLimit)
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, badRequest("offset %s must be a non-negative integer", v)
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
 
-	return WriteJSON(w, http.StatusOK, tr)
+// getPageFromRequest applies the page and pageSize query parameters on top
+// of limit and offset, for clients that count in pages from 1 rather than in
+// rows. It also returns the page asked for, or 0 when there was none.
+func getPageFromRequest(r *http.Request, limit, offset int) (int, int, int, error) {
+	query := r.URL.Query()
+	if v := query.Get("pageSize"); v != "" {
+		if query.Has("limit") {
+			return 0, 0, 0, badRequest("pageSize and limit cannot be used together")
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, 0, badRequest("pageSize %s must be an integer between 1 and %d", v, maxPageLimit)
+		}
+		limit = n
+	}
+	page := 0
+	if v := query.Get("page"); v != "" {
+		if query.Has("offset") {
+			return 0, 0, 0, badRequest("page and offset cannot be used together")
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > math.MaxInt32 {
+			return 0, 0, 0, badRequest("page %s must be an integer between 1 and %d", v, math.MaxInt32)
+		}
+		page = n
+		offset = (page - 1) * limit
+	}
+	return limit, offset, page, nil
 }
 
+// getIDFromRequest returns the {id} route variable, rejecting anything that
+// is not a positive integer before it reaches the store.
 func (s *APIServer) getIDFromRequest(r *http.Request) (int, error) {
-	idStr := mux.Vars(r)["id"]
+	return getPositiveIntVar(r, "id")
+}
+
+// getPositiveIntVar returns the named route variable as a positive integer.
+func getPositiveIntVar(r *http.Request, name string) (int, error) {
+	idStr := mux.Vars(r)[name]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return 0, fmt.Errorf("id %s provided is not an integer: %v", idStr, err)
+		return 0, badRequest("%s %s provided is not an integer: %v", name, idStr, err)
+	}
+	if id < 1 {
+		return 0, badRequest("%s %s provided must be a positive integer", name, idStr)
 	}
 	return id, nil
 }
 
-func (s *APIServer) Run() {
+// apiPrefix is where every version of the API is mounted, each under its
+// own name, e.g. /api/v1.
+const apiPrefix = "/api"
+
+// currentAPIVersion is the version new clients should use, and the one
+// legacy paths are redirected to.
+const currentAPIVersion = "v1"
+
+// apiVersionPrefix is where the current version of the API is mounted.
+const apiVersionPrefix = apiPrefix + "/" + currentAPIVersion
+
+// apiVersion is one version of the API. Versions are served side by side so
+// that a breaking change can ship as a new version while clients move off
+// the old one.
+type apiVersion struct {
+	name   string
+	routes func(s *APIServer, r *mux.Router)
+	// deprecated is when the version was deprecated and sunset when it will
+	// be removed, both announced on every response it serves. They are zero
+	// while the version is supported.
+	deprecated time.Time
+	sunset     time.Time
+}
+
+// apiVersions lists the versions of the API being served.
+var apiVersions = []apiVersion{
+	{name: "v1", routes: (*APIServer).v1Routes},
+}
+
+// legacyPaths are the prefixes the API used to be served from, unversioned
+// and then without apiPrefix. Requests to them are redirected to the same
+// path under apiVersionPrefix.
+var legacyPaths = []string{"/v1", "/account", "/transfer", "/login"}
+
+func (s *APIServer) newRouter() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/account", makeHTTPHandleFunc(s.handleAccount))
-	router.HandleFunc("/account/{id}", withJWTAuth(makeHTTPHandleFunc(s.handleAccountByID)))
-	router.HandleFunc("/transfer", makeHTTPHandleFunc(s.handleTransfer))
-	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin))
 
-	log.Println("JSON API server running on port: ", s.listenAddr)
+	for _, v := range apiVersions {
+		sub := router.PathPrefix(apiPrefix + "/" + v.name).Subrouter()
+		sub.Use(withAPIVersion(v))
+		v.routes(s, sub)
+	}
+
+	router.HandleFunc("/.well-known/jwks.json", s.makeHTTPHandleFunc(s.handleJWKS)).Methods("GET")
+	router.HandleFunc("/openapi.json", s.makeHTTPHandleFunc(s.handleOpenAPISpec)).Methods("GET")
+	router.HandleFunc("/docs", s.makeHTTPHandleFunc(s.handleDocs)).Methods("GET")
+	for _, path := range legacyPaths {
+		router.PathPrefix(path).HandlerFunc(redirectToCurrentVersion)
+	}
+	router.NotFoundHandler = handleUnmatched(router)
+	router.MethodNotAllowedHandler = router.NotFoundHandler
+	return router
+}
+
+// v1Routes registers version 1 of the API on v1.
+func (s *APIServer) v1Routes(v1 *mux.Router) {
+	v1.HandleFunc("/account", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, withReplicaReads(s.makeHTTPHandleFunc(s.handleGetAllAccounts))))).Methods("GET")
+	v1.HandleFunc("/account", withRateLimit(s.signupLimiter, s.makeHTTPHandleFunc(s.handleCreateAccount))).Methods("POST")
+	v1.HandleFunc("/account/export", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleExportAccounts)))).Methods("GET")
+	v1.HandleFunc("/account/batch", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleBatchCreateAccounts)))).Methods("POST")
+	v1.HandleFunc("/account/import", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleImportAccounts)))).Methods("POST")
+	v1.HandleFunc("/account/{id}", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(withReplicaReads(s.makeHTTPHandleFunc(s.handleGetAccount))))).Methods("GET")
+	v1.HandleFunc("/account/{id}", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleUpdateAccount)))).Methods("PUT")
+	v1.HandleFunc("/account/{id}", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleDeleteAccount)))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/purge", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleHardDeleteAccount)))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/restore", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleRestoreAccount)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/freeze", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleSetAccountStatus(AccountStatusFrozen))))).Methods("POST")
+	v1.HandleFunc("/account/{id}/unlock", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleUnlockAccount)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/unfreeze", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleSetAccountStatus(AccountStatusActive))))).Methods("POST")
+	v1.HandleFunc("/account/{id}/overdraft", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleSetOverdraftLimit)))).Methods("PUT")
+	v1.HandleFunc("/account/{id}/limits", s.withAPIKeyAuth(ScopeWrite, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleSetTransferLimits)))).Methods("PUT")
+	v1.HandleFunc("/account/{id}/adjustments", s.withAPIKeyAuth(ScopeTransfer, withRole(RoleAdmin, s.makeHTTPHandleFunc(s.handleLedgerAdjustment)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/2fa", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleEnrollTwoFactor)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/2fa", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleDisableTwoFactor)))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/2fa/activate", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleActivateTwoFactor)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/passkeys", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handlePasskeys)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/passkeys/{passkeyID}", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleDeletePasskey)))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/passkeys/register/begin", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleBeginPasskeyRegistration)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/passkeys/register/finish", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleFinishPasskeyRegistration)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/api-keys", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleGetAPIKeys)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/api-keys", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleCreateAPIKey)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/api-keys/{keyID}", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleRevokeAPIKey)))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/password", s.withJWTAuth(withAccountOwner(s.makeHTTPHandleFunc(s.handleChangePassword)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/balance", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleGetBalance)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/transactions", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleGetTransactions)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/scheduled-transfers", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleGetScheduledTransfers)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/scheduled-transfers/{transferID}", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleCancelScheduledTransfer)))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/holds", s.withAPIKeyAuth(ScopeTransfer, withAccountOwner(s.makeHTTPHandleFunc(s.handleGetHolds)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/holds", s.withAPIKeyAuth(ScopeTransfer, withAccountOwner(s.makeHTTPHandleFunc(s.handleCreateHold)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/holds/{holdID}/capture", s.withAPIKeyAuth(ScopeTransfer, withAccountOwner(s.makeHTTPHandleFunc(s.handleCaptureHold)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/holds/{holdID}/release", s.withAPIKeyAuth(ScopeTransfer, withAccountOwner(s.makeHTTPHandleFunc(s.handleReleaseHold)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/standing-orders", s.withAPIKeyAuth(ScopeTransfer, withAccountOwner(s.makeHTTPHandleFunc(s.handleGetStandingOrders)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/standing-orders", s.withAPIKeyAuth(ScopeTransfer, withAccountOwner(s.makeHTTPHandleFunc(s.handleCreateStandingOrder)))).Methods("POST")
+	v1.HandleFunc("/account/{id}/standing-orders/{orderID}/pause", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleSetStandingOrderStatus(StandingOrderPaused))))).Methods("POST")
+	v1.HandleFunc("/account/{id}/standing-orders/{orderID}/resume", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleSetStandingOrderStatus(StandingOrderActive))))).Methods("POST")
+	v1.HandleFunc("/account/{id}/standing-orders/{orderID}", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleSetStandingOrderStatus(StandingOrderCancelled))))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/logins", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleGetLogins)))).Methods("GET")
+	v1.HandleFunc("/account/{id}/ledger", s.withAPIKeyAuth(ScopeWrite, withAccountOwner(s.makeHTTPHandleFunc(s.handleGetLedgerEntries)))).Methods("GET")
+	v1.HandleFunc("/me", s.withAPIKeyAuth(ScopeWrite, withReplicaReads(s.makeHTTPHandleFunc(s.handleGetMe)))).Methods("GET")
+	v1.HandleFunc("/sessions", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleGetSessions))).Methods("GET")
+	v1.HandleFunc("/sessions/{sessionID}", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleRevokeSession))).Methods("DELETE")
+	v1.HandleFunc("/transfer", s.withAPIKeyAuth(ScopeTransfer, s.makeHTTPHandleFunc(s.handleTransfer))).Methods("POST")
+	v1.HandleFunc("/transfer/{id}/reverse", s.withAPIKeyAuth(ScopeTransfer, s.makeHTTPHandleFunc(s.handleReverseTransfer))).Methods("POST")
+	v1.HandleFunc("/logout", s.makeHTTPHandleFunc(s.handleLogout)).Methods("POST")
+	v1.HandleFunc("/verify", s.makeHTTPHandleFunc(s.handleVerifyEmail)).Methods("GET")
+	v1.HandleFunc("/password/forgot", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleForgotPassword))).Methods("POST")
+	v1.HandleFunc("/password/reset", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleResetPassword))).Methods("POST")
+	v1.HandleFunc("/login", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleLogin))).Methods("POST")
+	v1.HandleFunc("/token/refresh", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleRefreshToken))).Methods("POST")
+	v1.HandleFunc("/login/2fa", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleLoginTwoFactor))).Methods("POST")
+	v1.HandleFunc("/login/passkey/begin", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleBeginPasskeyLogin))).Methods("POST")
+	v1.HandleFunc("/login/passkey/finish", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleFinishPasskeyLogin))).Methods("POST")
+	v1.HandleFunc("/oauth/{provider}/login", s.makeHTTPHandleFunc(s.handleOAuthLogin)).Methods("GET")
+	v1.HandleFunc("/oauth/{provider}/callback", withRateLimit(s.loginLimiter, s.makeHTTPHandleFunc(s.handleOAuthCallback))).Methods("GET")
+}
+
+// withAPIVersion names the version that served each response in the
+// API-Version header. Once v is deprecated it also sends the Deprecation
+// (RFC 9745) and Sunset (RFC 8594) headers, with a link to the current
+// version as its successor.
+func withAPIVersion(v apiVersion) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("API-Version", v.name)
+			if !v.deprecated.IsZero() {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(v.deprecated.Unix(), 10))
+				w.Header().Add("Link", "<"+apiVersionPrefix+">; rel=\"successor-version\"")
+			}
+			if !v.sunset.IsZero() {
+				w.Header().Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// redirectToCurrentVersion sends clients of the legacy paths to
+// apiVersionPrefix. 308 keeps the method and body, so POSTs survive it.
+func redirectToCurrentVersion(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.RequestURI(), "/v1")
+	http.Redirect(w, r, apiVersionPrefix+path, http.StatusPermanentRedirect)
+}
+
+// newHandler wraps the router with the middleware that must see every
+// request, including ones no route matches such as CORS preflights.
+func (s *APIServer) newHandler() http.Handler {
+	return withSecurityHeaders(s.cfg, withRequestID(withRequestLogging(s.logger, withCORS(s.cfg.CORSAllowedOrigins, s.cfg.CORSAllowCredentials, withRequestRateLimit(s.ipLimiter, s.accountLimiter, withCSRFProtection(s.cfg.JWTCookie, withRequestTimeout(s.cfg.RequestTimeout, s.newRouter())))))))
+}
+
+// shutdownTimeout bounds how long in-flight requests get to finish once the
+// server is asked to stop.
+const shutdownTimeout = 10 * time.Second
 
-	http.ListenAndServe(s.listenAddr, router)
-}
\ No newline at end of file
+// Run serves the API, the gRPC API and metrics when configured and the
+// purge job until SIGINT or SIGTERM, then stops them all.
+func (s *APIServer) Run() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		s.logger.Error("JSON API server stopped", "error", err)
+		return
+	}
+
+	var grpcLn net.Listener
+	if s.cfg.GRPCListenAddr != "" {
+		grpcLn, err = net.Listen("tcp", s.cfg.GRPCListenAddr)
+		if err != nil {
+			ln.Close()
+			s.logger.Error("gRPC server stopped", "error", err)
+			return
+		}
+		s.logger.Info("gRPC server listening", "addr", s.cfg.GRPCListenAddr)
+	}
+
+	var metricsLn net.Listener
+	if s.cfg.MetricsListenAddr != "" {
+		metricsLn, err = net.Listen("tcp", s.cfg.MetricsListenAddr)
+		if err != nil {
+			ln.Close()
+			if grpcLn != nil {
+				grpcLn.Close()
+			}
+			s.logger.Error("metrics server stopped", "error", err)
+			return
+		}
+		s.logger.Info("metrics server listening", "addr", s.cfg.MetricsListenAddr)
+	}
+
+	var wg sync.WaitGroup
+	if cache, ok := secrets.(*secretCache); ok && s.cfg.SecretRefreshInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.run(ctx, s.cfg.SecretRefreshInterval)
+		}()
+	}
+	if store, ok := unwrapStore(s.store).(*PostgresStore); ok && s.cfg.DBPingInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.monitor(ctx, s.cfg.DBPingInterval)
+		}()
+	}
+	if s.cfg.PurgeInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runPurgeJob(ctx, s.cfg.PurgeInterval)
+		}()
+	}
+	if s.cfg.ScheduledTransferInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runScheduledTransfers(ctx, s.cfg.ScheduledTransferInterval)
+		}()
+	}
+	if grpcLn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.serveGRPC(ctx, grpcLn); err != nil {
+				s.logger.Error("gRPC server stopped", "error", err)
+				stop()
+			}
+		}()
+	}
+	if metricsLn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.serveMetrics(ctx, metricsLn); err != nil {
+				s.logger.Error("metrics server stopped", "error", err)
+				stop()
+			}
+		}()
+	}
+	if err := s.serve(ctx, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("JSON API server stopped", "error", err)
+	}
+	stop()
+	wg.Wait()
+	s.logger.Info("JSON API server stopped")
+}
+
+// serve answers requests on ln, over TLS 1.2 or later when a certificate and
+// key are configured, until ctx is done.
+func (s *APIServer) serve(ctx context.Context, ln net.Listener) error {
+	server := &http.Server{
+		Handler:   s.newHandler(),
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		ErrorLog:  slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if s.cfg.TLSCertFile == "" || s.cfg.TLSKeyFile == "" {
+		s.logger.Warn("TLS is not configured, serving plaintext HTTP", "addr", ln.Addr().String())
+		return server.Serve(ln)
+	}
+	s.logger.Info("JSON API server running", "addr", ln.Addr().String(), "tls", true)
+	return server.ServeTLS(ln, s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+}
@@ -0,0 +1,1318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*APIServer, http.Handler) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("TOTP_ENCRYPTION_KEY", "test-totp-key")
+	server := NewAPIServer(":0", NewMemoryStore(), &Config{RefreshTokenTTL: defaultRefreshTokenTTL}, discardLogger)
+	return server, server.newHandler()
+}
+
+func doJSON(t *testing.T, router http.Handler, method, path string, body any, header http.Header) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		require.Nil(t, json.NewEncoder(&buf).Encode(body))
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// fakeMailer records the verification tokens it is asked to send by address.
+type fakeMailer struct {
+	tokens map[string]string
+}
+
+func (m *fakeMailer) SendVerificationEmail(ctx context.Context, to, token string) error {
+	m.tokens[to] = token
+	return nil
+}
+
+func (m *fakeMailer) SendPasswordResetEmail(ctx context.Context, to, token string) error {
+	m.tokens[to] = token
+	return nil
+}
+
+func TestCreateLoginAndGetAccount(t *testing.T) {
+	server, router := newTestServer(t)
+	mailer := &fakeMailer{tokens: map[string]string{}}
+	server.mailer = mailer
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "abc@abc.com",
+		Password:  "password123",
+	}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, "/api/v1/account/1", rec.Header().Get("Location"))
+	var created Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, 1, created.ID)
+	assert.False(t, created.EmailVerified)
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusForbidden, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "not verified")
+
+	rec = doJSON(t, router, "GET", "/api/v1/verify?token=wrong", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	token := mailer.tokens["abc@abc.com"]
+	require.NotEmpty(t, token)
+	rec = doJSON(t, router, "GET", "/api/v1/verify?token="+token, nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "GET", "/api/v1/verify?token="+token, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "tokens are single use")
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	token = rec.Header().Get("Authorization")
+	require.NotEmpty(t, token)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d", created.ID), nil, http.Header{"Authorization": {token}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var found Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&found))
+	assert.Equal(t, "abc@abc.com", found.Email)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d", created.ID), nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestCreateAccountRejectsWeakPassword(t *testing.T) {
+	_, router := newTestServer(t)
+
+	for _, password := range []string{"password", "12345678"} {
+		rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+			FirstName: "a",
+			LastName:  "b",
+			Email:     "abc@abc.com",
+			Password:  password,
+		}, nil)
+		require.Equal(t, http.StatusUnprocessableEntity, rec.Code, password)
+		var resp ValidationErrorResponse
+		require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, "must contain a letter and a digit", resp.Fields["password"], password)
+	}
+}
+
+func TestCreateAccountReportsEveryInvalidField(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		Email:     "not-an-email",
+		Password:  "short1",
+	}, nil)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	var resp ValidationErrorResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, map[string]string{
+		"lastName": "is required",
+		"email":    "must be a valid email",
+		"password": "min 8 characters",
+	}, resp.Fields)
+}
+
+func TestUpdateAccountWithStaleVersionConflicts(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	path := fmt.Sprintf("/api/v1/account/%d", acc.ID)
+
+	phone := int64(5551234567)
+	rec := doJSON(t, router, "PUT", path, UpdateAccountRequest{FirstName: "c", LastName: "d", Phone: &phone, Version: acc.Version}, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	updated, err := server.store.GetAccountByID(context.Background(), acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, phone, updated.Phone)
+
+	rec = doJSON(t, router, "PUT", path, UpdateAccountRequest{FirstName: "e", LastName: "f", Version: acc.Version}, header)
+	assert.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+}
+
+func TestTransferAndTransactionHistory(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), from))
+	require.Nil(t, server.store.CreateAccount(context.Background(), to))
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	rec := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 40}, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/transactions?limit=5", from.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page TransactionsPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	assert.Equal(t, 5, page.Limit)
+	require.Len(t, page.Transactions, 1)
+	assert.Equal(t, int64(40), page.Transactions[0].Amount)
+
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Format(time.RFC3339)
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/transactions?from=%s", from.ID, tomorrow), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	page = TransactionsPage{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	assert.Empty(t, page.Transactions)
+	require.NotNil(t, page.From)
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/transactions?to=%s", from.ID, tomorrow), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"amount":40`)
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/transactions?from=yesterday", from.ID), nil, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/transactions?from=%s&to=%s", from.ID, tomorrow, tomorrow), nil, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/transactions", to.ID), nil, header)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestListAccountsRequiresAdmin(t *testing.T) {
+	server, router := newTestServer(t)
+	user, err := NewAccount("a", "b", "user@abc.com", "password123")
+	require.Nil(t, err)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), user))
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	userToken, _, err := createJWT(user)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+
+	rec := doJSON(t, router, "GET", "/api/v1/account", nil, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d", admin.ID), nil, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "GET", "/api/v1/account", nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page AccountsPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	assert.Len(t, page.Accounts, 2)
+	assert.Equal(t, 2, page.Total)
+
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("/api/v1/account/%d", user.ID), nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	assert.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("/api/v1/account/%d", user.ID), nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	assert.Equal(t, http.StatusNotFound, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "DELETE", "/api/v1/account/9999", nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	assert.Equal(t, http.StatusNotFound, rec.Code, rec.Body.String())
+}
+
+func TestListAccountsPagination(t *testing.T) {
+	server, router := newTestServer(t)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	for i := 0; i < 4; i++ {
+		acc, err := NewAccount("a", "b", fmt.Sprintf("user%d@abc.com", i), "password123")
+		require.Nil(t, err)
+		require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	}
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + adminToken}}
+
+	rec := doJSON(t, router, "GET", "/api/v1/account?limit=2&offset=1", nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page AccountsPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Accounts, 2)
+	assert.Equal(t, "user0@abc.com", page.Accounts[0].Email)
+	assert.Equal(t, 5, page.Total)
+	assert.Equal(t, 2, page.Limit)
+	assert.Equal(t, 1, page.Offset)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account?limit=2&after=%d", page.Accounts[1].ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	page = AccountsPage{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Accounts, 2)
+	assert.Equal(t, "user2@abc.com", page.Accounts[0].Email)
+	assert.Equal(t, 5, page.Total)
+
+	rec = doJSON(t, router, "GET", "/api/v1/account?pageSize=2&page=3", nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	page = AccountsPage{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Accounts, 1)
+	assert.Equal(t, "user3@abc.com", page.Accounts[0].Email)
+	assert.Equal(t, 2, page.Limit)
+	assert.Equal(t, 4, page.Offset)
+	assert.Equal(t, 3, page.Page)
+
+	for _, query := range []string{"limit=0", "limit=101", "offset=-1", "after=0", "after=x", "page=0", "pageSize=101", "page=2&offset=1", "pageSize=2&limit=2"} {
+		rec = doJSON(t, router, "GET", "/api/v1/account?"+query, nil, header)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestFilterAccounts(t *testing.T) {
+	server, router := newTestServer(t)
+	admin, err := NewAccount("Root", "Admin", "root@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	rich, err := NewAccount("Alice", "Smith", "alice@abc.com", "password123")
+	require.Nil(t, err)
+	rich.Balance = 10000
+	require.Nil(t, server.store.CreateAccount(context.Background(), rich))
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + adminToken}}
+
+	yesterday := url.QueryEscape(time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339))
+	rec := doJSON(t, router, "GET", "/api/v1/account?name=alice&minBalance=5000&createdAfter="+yesterday, nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page AccountsPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Accounts, 1)
+	assert.Equal(t, rich.ID, page.Accounts[0].ID)
+	assert.Equal(t, 1, page.Total)
+
+	rec = doJSON(t, router, "GET", "/api/v1/account?email=ROOT@abc.com", nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	page = AccountsPage{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Accounts, 1)
+	assert.Equal(t, admin.ID, page.Accounts[0].ID)
+
+	for _, query := range []string{"minBalance=1.5", "createdAfter=yesterday"} {
+		rec = doJSON(t, router, "GET", "/api/v1/account?"+query, nil, header)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestGetBalance(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.Balance = 75
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	rec := doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/balance", acc.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"balance":75,"available":75,"held":0,"currency":"USD","formatted":"0.75 USD"}`, rec.Body.String())
+
+	require.Nil(t, server.store.DeleteAccount(context.Background(), acc.ID))
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/balance", acc.ID), nil, header)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestChangePassword(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	path := fmt.Sprintf("/api/v1/account/%d/password", acc.ID)
+
+	rec := doJSON(t, router, "POST", path, ChangePasswordRequest{CurrentPassword: "wrong1234", NewPassword: "newpassword1"}, header)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "password123"}, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "weakpassword"}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "newpassword1"}, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "newpassword1"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	login := func() LoginResponse {
+		rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp LoginResponse
+		require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+	current, other := login(), login()
+
+	rec := doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/password", acc.ID), ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "newpassword1"}, http.Header{"Authorization": {"Bearer " + current.Token}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"Authorization": {"Bearer " + other.Token}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "other sessions are ended")
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: other.RefreshToken}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"Authorization": {"Bearer " + current.Token}})
+	assert.Equal(t, http.StatusOK, rec.Code, "the session that changed the password stays")
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: current.RefreshToken}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+func TestLoginResponseNeverEchoesPassword(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "secretpassword1")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "secretpassword1"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NotContains(t, rec.Body.String(), "secretpassword1")
+	for _, values := range rec.Header() {
+		for _, v := range values {
+			assert.NotContains(t, v, "secretpassword1")
+		}
+	}
+
+	var resp LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, acc.ID, resp.AccountID)
+	assert.Equal(t, "Bearer "+resp.Token, rec.Header().Get("Authorization"))
+	assert.True(t, resp.ExpiresAt.After(time.Now()))
+}
+
+func TestLoginDoesNotRevealWhichEmailsExist(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	unknown := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "nobody@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusUnauthorized, unknown.Code, unknown.Body.String())
+	wrong := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "wrong-password"}, nil)
+	require.Equal(t, http.StatusUnauthorized, wrong.Code, wrong.Body.String())
+	assert.Equal(t, unknown.Body.String(), wrong.Body.String())
+	assert.Contains(t, wrong.Body.String(), "invalid email or password")
+}
+
+// emailLookupFailingStore cannot look accounts up by email.
+type emailLookupFailingStore struct {
+	*MemoryStore
+}
+
+func (f emailLookupFailingStore) GetAccountByEmail(context.Context, string) (*Account, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestLoginStoreErrorIsNotUnauthorized(t *testing.T) {
+	server, router := newTestServer(t)
+	server.store = emailLookupFailingStore{NewMemoryStore()}
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, rec.Body.String())
+}
+
+func TestTransferIdempotencyKeyMovesMoneyOnce(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), from))
+	require.Nil(t, server.store.CreateAccount(context.Background(), to))
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}, "Idempotency-Key": {"transfer-1"}}
+
+	first := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 25}, header)
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	second := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 25}, header)
+	require.Equal(t, http.StatusOK, second.Code, second.Body.String())
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	different := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 30}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, different.Code, different.Body.String())
+
+	balance, err := server.store.GetBalance(context.Background(), from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(75), balance.Amount)
+}
+
+// idempotencyFailingStore cannot store idempotent results.
+type idempotencyFailingStore struct {
+	*MemoryStore
+}
+
+func (f idempotencyFailingStore) StoreIdempotentResult(context.Context, *IdempotentResult) error {
+	return errors.New("disk full")
+}
+
+func (f idempotencyFailingStore) InTx(ctx context.Context, fn func(Storage) error) error {
+	return f.MemoryStore.InTx(ctx, func(tx Storage) error { return fn(idempotencyFailingStore{tx.(memoryTx).MemoryStore}) })
+}
+
+func TestTransferIsUndoneWhenIdempotentResultIsNotStored(t *testing.T) {
+	server, router := newTestServer(t)
+	store := NewMemoryStore()
+	server.store = idempotencyFailingStore{store}
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(context.Background(), from))
+	require.Nil(t, store.CreateAccount(context.Background(), to))
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}, "Idempotency-Key": {"transfer-1"}}
+
+	rec := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 25}, header)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, rec.Body.String())
+	balance, err := store.GetBalance(context.Background(), from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(100), balance.Amount, "the transfer is rolled back")
+	transactions, err := store.GetTransactions(context.Background(), from.ID, time.Time{}, time.Time{}, 10, 0)
+	require.Nil(t, err)
+	assert.Empty(t, transactions)
+}
+
+func TestSearchAccountsIsAdminOnly(t *testing.T) {
+	server, router := newTestServer(t)
+	user, err := NewAccount("Alice", "Smith", "alice@abc.com", "password123")
+	require.Nil(t, err)
+	admin, err := NewAccount("Root", "Admin", "root@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), user))
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	userToken, _, err := createJWT(user)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+
+	rec := doJSON(t, router, "GET", "/api/v1/account?search=smith", nil, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "GET", "/api/v1/account?search=smith", nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page AccountsPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Accounts, 1)
+	assert.Equal(t, user.ID, page.Accounts[0].ID)
+	assert.Equal(t, 1, page.Total)
+}
+
+func TestRoutesAreServedUnderV1(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "abc@abc.com",
+		Password:  "password123",
+	}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/login?next=1", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+	assert.Equal(t, "/api/v1/login?next=1", rec.Header().Get("Location"))
+
+	rec = doJSON(t, router, "GET", "/account/1/balance", nil, nil)
+	assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+	assert.Equal(t, "/api/v1/account/1/balance", rec.Header().Get("Location"))
+
+	rec = doJSON(t, router, "GET", "/v1/account/1/balance", nil, nil)
+	assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+	assert.Equal(t, "/api/v1/account/1/balance", rec.Header().Get("Location"))
+}
+
+func TestAPIVersionHeaders(t *testing.T) {
+	deprecated := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	apiVersions = append(apiVersions, apiVersion{name: "v0", routes: (*APIServer).v1Routes, deprecated: deprecated, sunset: sunset})
+	t.Cleanup(func() { apiVersions = apiVersions[:len(apiVersions)-1] })
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "GET", "/api/v1/me", nil, nil)
+	assert.Equal(t, "v1", rec.Header().Get("API-Version"))
+	assert.Empty(t, rec.Header().Get("Deprecation"))
+	assert.Empty(t, rec.Header().Get("Sunset"))
+
+	rec = doJSON(t, router, "GET", "/api/v0/me", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "old versions serve the same routes")
+	assert.Equal(t, "v0", rec.Header().Get("API-Version"))
+	assert.Equal(t, "@1767225600", rec.Header().Get("Deprecation"))
+	assert.Equal(t, "Wed, 01 Jul 2026 00:00:00 GMT", rec.Header().Get("Sunset"))
+	assert.Equal(t, `</api/v1>; rel="successor-version"`, rec.Header().Get("Link"))
+}
+
+func TestHardDeleteAccountRequiresAdmin(t *testing.T) {
+	server, router := newTestServer(t)
+	user, err := NewAccount("a", "b", "user@abc.com", "password123")
+	require.Nil(t, err)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), user))
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	userToken, _, err := createJWT(user)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	path := fmt.Sprintf("/api/v1/account/%d/purge", user.ID)
+
+	rec := doJSON(t, router, "DELETE", path, nil, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "DELETE", path, nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	assert.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "DELETE", path, nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRestoreAccount(t *testing.T) {
+	server, router := newTestServer(t)
+	user, err := NewAccount("a", "b", "user@abc.com", "password123")
+	require.Nil(t, err)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), user))
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	userToken, _, err := createJWT(user)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	path := fmt.Sprintf("/api/v1/account/%d/restore", user.ID)
+
+	rec := doJSON(t, router, "DELETE", fmt.Sprintf("/api/v1/account/%d", user.ID), nil, http.Header{"Authorization": {"Bearer " + userToken}})
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", path, nil, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var restored Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&restored))
+	assert.Equal(t, user.ID, restored.ID)
+	assert.Nil(t, restored.DeletedAt)
+
+	rec = doJSON(t, router, "POST", path, nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	assert.Equal(t, http.StatusNotFound, rec.Code, "the account is no longer deleted")
+}
+
+func TestCreateAccountWithCurrency(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "abc@abc.com",
+		Password:  "password123",
+		Currency:  "EUR",
+	}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, "EUR", created.Currency)
+
+	rec = doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "xyz@abc.com",
+		Password:  "password123",
+		Currency:  "XXX",
+	}, nil)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"currency"`)
+}
+
+func TestBatchCreateAccountsIsAllOrNothing(t *testing.T) {
+	server, router := newTestServer(t)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	token, _, err := createJWT(admin)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	newReq := func(email string) CreateAccountRequest {
+		return CreateAccountRequest{FirstName: "a", LastName: "b", Email: email, Password: "password123"}
+	}
+
+	rec := doJSON(t, router, "POST", "/api/v1/account/batch", []CreateAccountRequest{newReq("one@abc.com"), newReq("admin@abc.com")}, header)
+	require.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+	var resp BatchCreateAccountsResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Results, 2)
+	assert.Equal(t, BatchItemRolledBack, resp.Results[0].Status)
+	assert.Equal(t, BatchItemFailed, resp.Results[1].Status)
+	_, err = server.store.GetAccountByEmail(context.Background(), "one@abc.com")
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	rec = doJSON(t, router, "POST", "/api/v1/account/batch", []CreateAccountRequest{newReq("one@abc.com"), newReq("not-an-email")}, header)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code, rec.Body.String())
+	resp = BatchCreateAccountsResponse{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, BatchItemInvalid, resp.Results[1].Status)
+	assert.Contains(t, resp.Results[1].Fields, "email")
+
+	rec = doJSON(t, router, "POST", "/api/v1/account/batch", []CreateAccountRequest{newReq("one@abc.com"), newReq("two@abc.com")}, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	resp = BatchCreateAccountsResponse{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	for _, result := range resp.Results {
+		assert.Equal(t, BatchItemCreated, result.Status)
+		assert.NotZero(t, result.Account.ID)
+	}
+
+	tooMany := make([]CreateAccountRequest, maxBatchAccounts+1)
+	rec = doJSON(t, router, "POST", "/api/v1/account/batch", tooMany, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestExportAccountsCSV(t *testing.T) {
+	server, router := newTestServer(t)
+	admin, err := NewAccount("Ada", "Admin", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	admin.Balance = 1234
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	token, _, err := createJWT(admin)
+	require.Nil(t, err)
+
+	rec := doJSON(t, router, "GET", "/api/v1/account/export", nil, http.Header{"Authorization": {"Bearer " + token}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "attachment")
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	require.Nil(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, []string{"id", "first_name", "last_name", "email", "balance", "currency", "created_at"}, records[0])
+	assert.Equal(t, []string{
+		strconv.Itoa(admin.ID), "Ada", "Admin", "admin@abc.com", "1234", "USD", admin.CreatedAt.Format(time.RFC3339),
+	}, records[1])
+	assert.NotContains(t, rec.Body.String(), admin.EncryptedPassword)
+}
+
+func TestFreezeBlocksTransfers(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	admin, err := NewAccount("e", "f", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	for _, acc := range []*Account{from, to, admin} {
+		require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	}
+	fromToken, _, err := createJWT(from)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	fromHeader := http.Header{"Authorization": {"Bearer " + fromToken}}
+	adminHeader := http.Header{"Authorization": {"Bearer " + adminToken}}
+
+	rec := doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/freeze", from.ID), nil, fromHeader)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/freeze", from.ID), nil, adminHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 10}, fromHeader)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "frozen")
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d", from.ID), nil, fromHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"status":"frozen"`)
+
+	rec = doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/unfreeze", from.ID), nil, adminHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 10}, fromHeader)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gobank test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t, t.TempDir())
+	server, _ := newTestServer(t)
+	server.cfg = &Config{TLSCertFile: certFile, TLSKeyFile: keyFile}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.serve(ctx, ln)
+
+	url := "https://" + ln.Addr().String() + "/openapi.json"
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(url)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}}}
+	_, err = old.Get(url)
+	assert.NotNil(t, err)
+}
+
+func TestGetIDFromRequest(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, tc := range []struct {
+		id      string
+		want    int
+		wantErr bool
+	}{
+		{id: "abc", wantErr: true},
+		{id: "-1", wantErr: true},
+		{id: "0", wantErr: true},
+		{id: "42", want: 42},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"id": tc.id})
+			id, err := server.getIDFromRequest(req)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.want, id)
+		})
+	}
+}
+
+func TestAccountRoutesRejectNonPositiveIDs(t *testing.T) {
+	server, router := newTestServer(t)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	token, _, err := createJWT(admin)
+	require.Nil(t, err)
+
+	for _, id := range []string{"0", "-5"} {
+		rec := doJSON(t, router, "GET", "/api/v1/account/"+id, nil, http.Header{"Authorization": {"Bearer " + token}})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "positive integer")
+	}
+}
+
+func TestGetMe(t *testing.T) {
+	server, router := newTestServer(t)
+	other, err := NewAccount("c", "d", "other@abc.com", "password123")
+	require.Nil(t, err)
+	acc, err := NewAccount("a", "b", "me@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), other))
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	rec := doJSON(t, router, "GET", "/api/v1/me", nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var me Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&me))
+	assert.Equal(t, acc.ID, me.ID)
+	assert.Equal(t, "me@abc.com", me.Email)
+
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	expired, _, err := signJWT(acc, "", 0, -time.Minute)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"Authorization": {"Bearer " + expired}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "expired tokens are rejected")
+
+	require.Nil(t, server.store.DeleteAccount(context.Background(), acc.ID))
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, header)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRequestBodiesAreStrict(t *testing.T) {
+	_, router := newTestServer(t)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post("/api/v1/account", `{"firstName":"a","lastName":"b","email":"abc@abc.com","password":"password123","balnce":999}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "balnce")
+
+	rec = post("/api/v1/login", `{"email":"abc@abc.com","password":"`+strings.Repeat("x", maxRequestBodyBytes)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "must not exceed")
+
+	rec = post("/api/v1/login", `{"email":"abc@abc.com","password":"password123"} {}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = post("/api/v1/login", ``)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "empty")
+}
+
+func TestSetOverdraftLimitRequiresAdmin(t *testing.T) {
+	server, router := newTestServer(t)
+	user, err := NewAccount("a", "b", "user@abc.com", "password123")
+	require.Nil(t, err)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), user))
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	userToken, _, err := createJWT(user)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	path := fmt.Sprintf("/api/v1/account/%d/overdraft", user.ID)
+
+	rec := doJSON(t, router, "PUT", path, SetOverdraftLimitRequest{OverdraftLimit: 500}, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "PUT", path, SetOverdraftLimitRequest{OverdraftLimit: -1}, http.Header{"Authorization": {"Bearer " + adminToken}})
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = doJSON(t, router, "PUT", path, SetOverdraftLimitRequest{OverdraftLimit: 500}, http.Header{"Authorization": {"Bearer " + adminToken}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var updated Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&updated))
+	assert.Equal(t, int64(500), updated.OverdraftLimit)
+}
+
+func TestSetTransferLimits(t *testing.T) {
+	server, router := newTestServer(t)
+	user, err := NewAccount("a", "b", "user@abc.com", "password123")
+	require.Nil(t, err)
+	user.Balance = 1000
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), user))
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	userToken, _, err := createJWT(user)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	userHeader := http.Header{"Authorization": {"Bearer " + userToken}}
+	adminHeader := http.Header{"Authorization": {"Bearer " + adminToken}}
+	path := fmt.Sprintf("/api/v1/account/%d/limits", user.ID)
+	daily, perTransfer := int64(100), int64(60)
+	req := SetTransferLimitsRequest{DailyTransferLimit: &daily, PerTransferLimit: &perTransfer}
+
+	rec := doJSON(t, router, "PUT", path, req, userHeader)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	negative := int64(-1)
+	rec = doJSON(t, router, "PUT", path, SetTransferLimitsRequest{PerTransferLimit: &negative}, adminHeader)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = doJSON(t, router, "PUT", path, req, adminHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var updated Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&updated))
+	assert.Equal(t, daily, *updated.DailyTransferLimit)
+	assert.Equal(t, perTransfer, *updated.PerTransferLimit)
+
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: admin.Number, Amount: 60}, userHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: admin.Number, Amount: 50}, userHeader)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	var limitErr LimitExceededResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&limitErr))
+	assert.Equal(t, LimitDaily, limitErr.Limit)
+	assert.Equal(t, daily, limitErr.Max)
+	assert.Equal(t, int64(40), limitErr.Remaining)
+}
+
+func TestLoginWithCookie(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.cfg.JWTCookie = true
+	router := server.newHandler()
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Authorization"))
+	var login LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&login))
+	assert.Empty(t, login.Token)
+
+	assert.Empty(t, login.RefreshToken)
+
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 3)
+	cookie := cookies[0]
+	assert.Equal(t, accessTokenCookie, cookie.Name)
+	assert.Equal(t, refreshTokenCookie, cookies[1].Name)
+	assert.Equal(t, csrfCookie, cookies[2].Name)
+	for _, c := range cookies {
+		assert.Equal(t, c.Name != csrfCookie, c.HttpOnly, "only the CSRF token is readable by scripts")
+		assert.True(t, c.Secure)
+		assert.Equal(t, http.SameSiteStrictMode, c.SameSite)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/me", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "abc@abc.com")
+
+	req = httptest.NewRequest("POST", "/api/v1/token/refresh", nil)
+	req.AddCookie(cookies[1])
+	req.AddCookie(cookies[2])
+	req.Header.Set(csrfHeader, cookies[2].Value)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	refreshed := rec.Result().Cookies()
+	require.Len(t, refreshed, 3)
+	assert.NotEqual(t, cookies[1].Value, refreshed[1].Value)
+
+	req = httptest.NewRequest("POST", "/api/v1/logout", nil)
+	req.AddCookie(refreshed[1])
+	req.AddCookie(refreshed[2])
+	req.Header.Set(csrfHeader, refreshed[2].Value)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	cleared := rec.Result().Cookies()
+	require.Len(t, cleared, 3)
+	for i, name := range []string{accessTokenCookie, refreshTokenCookie, csrfCookie} {
+		assert.Equal(t, name, cleared[i].Name)
+		assert.Empty(t, cleared[i].Value)
+		assert.Negative(t, cleared[i].MaxAge)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/token/refresh", nil)
+	req.AddCookie(refreshed[1])
+	req.AddCookie(refreshed[2])
+	req.Header.Set(csrfHeader, refreshed[2].Value)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "logout revokes the refresh token")
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var login LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&login))
+	header := http.Header{"Authorization": {"Bearer " + login.Token}}
+	other, _, err := createJWT(acc)
+	require.Nil(t, err)
+
+	rec = doJSON(t, router, "POST", "/api/v1/logout", RefreshTokenRequest{RefreshToken: login.RefreshToken}, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, header)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "the presented token is revoked")
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: login.RefreshToken}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "and so is its refresh token")
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"Authorization": {"Bearer " + other}})
+	assert.Equal(t, http.StatusOK, rec.Code, "other tokens stay valid")
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var login LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&login))
+	require.NotEmpty(t, login.RefreshToken)
+	assert.True(t, login.RefreshExpiresAt.After(login.ExpiresAt))
+
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: "unknown"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: login.RefreshToken}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var refreshed LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&refreshed))
+	assert.Equal(t, acc.ID, refreshed.AccountID)
+	require.NotEmpty(t, refreshed.Token)
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"Authorization": {"Bearer " + refreshed.Token}})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// replaying the first token revokes the whole family, including the
+	// token it was rotated into
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: login.RefreshToken}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: refreshed.RefreshToken}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestUnsupportedMethodReturns405(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "PUT", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "POST", rec.Header().Get("Allow"))
+	assert.Contains(t, rec.Body.String(), "method not allowed: PUT")
+
+	rec = doJSON(t, router, "DELETE", "/api/v1/account", nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, POST", rec.Header().Get("Allow"))
+
+	rec = doJSON(t, router, "GET", "/api/v1/account/1/purge", nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code, "routes restricted by the router answer too")
+	assert.Equal(t, "DELETE", rec.Header().Get("Allow"))
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+}
+
+func TestOptionsListsAllowedMethods(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "OPTIONS", "/api/v1/account/1", nil, nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "GET, PUT, DELETE, OPTIONS", rec.Header().Get("Allow"))
+
+	rec = doJSON(t, router, "OPTIONS", "/api/v1/nope", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestUnknownRouteReturns404(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "GET", "/api/v1/nope", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), `"code":"NOT_FOUND"`)
+}
+
+func TestMissingTokenIsUnauthorized(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	rec := doJSON(t, router, "GET", "/api/v1/account", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"MISSING_TOKEN"`)
+
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "GET", "/api/v1/account", nil, http.Header{"Authorization": {"Bearer " + token}})
+	assert.Equal(t, http.StatusForbidden, rec.Code, "authenticated but not an admin")
+	assert.Contains(t, rec.Body.String(), `"code":"PERMISSION_DENIED"`)
+}
+
+func TestEmailIsCaseInsensitive(t *testing.T) {
+	server, router := newTestServer(t)
+	mailer := &fakeMailer{tokens: map[string]string{}}
+	server.mailer = mailer
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{FirstName: "a", LastName: "b", Email: " A@B.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created Account
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, "a@b.com", created.Email)
+	_, err := server.store.ConsumeVerificationToken(context.Background(), hashOpaqueToken(mailer.tokens["a@b.com"]))
+	require.Nil(t, err)
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "a@b.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "A@B.COM", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{FirstName: "c", LastName: "d", Email: "a@B.COM", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestLedgerAdjustments(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "owner@abc.com", "password123")
+	require.Nil(t, err)
+	admin, err := NewAccount("e", "f", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	for _, a := range []*Account{acc, admin} {
+		require.Nil(t, server.store.CreateAccount(context.Background(), a))
+	}
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	adminHeader := http.Header{"Authorization": {"Bearer " + adminToken}}
+	path := fmt.Sprintf("/api/v1/account/%d/adjustments", acc.ID)
+
+	rec := doJSON(t, router, "POST", path, LedgerAdjustmentRequest{Type: "deposit", Amount: 500}, header)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, LedgerAdjustmentRequest{Type: "deposit", Amount: 500}, adminHeader)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "POST", path, LedgerAdjustmentRequest{Type: "fee", Amount: 25}, adminHeader)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "POST", path, LedgerAdjustmentRequest{Type: "withdrawal", Amount: 1000}, adminHeader)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = doJSON(t, router, "POST", path, LedgerAdjustmentRequest{Type: "gift", Amount: 10}, adminHeader)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/balance", acc.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"balance":475`)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/ledger", acc.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page LedgerEntriesPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, JournalFee, page.Entries[0].Kind)
+	assert.Equal(t, JournalDeposit, page.Entries[1].Kind)
+}
+
+func TestReverseTransfer(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	for _, acc := range []*Account{from, to} {
+		require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	}
+	fromToken, _, err := createJWT(from)
+	require.Nil(t, err)
+	toToken, _, err := createJWT(to)
+	require.Nil(t, err)
+	fromHeader := http.Header{"Authorization": {"Bearer " + fromToken}}
+	toHeader := http.Header{"Authorization": {"Bearer " + toToken}}
+
+	rec := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 25}, fromHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var debit Transaction
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&debit))
+	path := fmt.Sprintf("/api/v1/transfer/%d/reverse", debit.ID)
+
+	// the sender cannot claw the money back on its own
+	rec = doJSON(t, router, "POST", path, nil, fromHeader)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, nil, toHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"type":"reversal_credit"`)
+
+	rec = doJSON(t, router, "POST", path, nil, toHeader)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doJSON(t, router, "POST", "/api/v1/transfer/999/reverse", nil, toHeader)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	balance, err := server.store.GetBalance(context.Background(), from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(100), balance.Amount)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// API key scopes. Keys with ScopeRead can use GET routes, ScopeWrite the
+// routes that change an account and ScopeTransfer the ones that move money.
+const (
+	ScopeRead     = "read"
+	ScopeWrite    = "write"
+	ScopeTransfer = "transfer"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// apiKeyPrefix marks our keys so they are recognisable, e.g. to secret
+	// scanners. apiKeyDisplayLen characters of each key are kept to tell
+	// them apart.
+	apiKeyPrefix     = "gbk_"
+	apiKeyDisplayLen = len(apiKeyPrefix) + 6
+)
+
+// ErrAPIKeyNotFound is returned when an account has no active API key with
+// the given id or hash.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey lets a backend integration call the API for an account without
+// logging in. Only the hash of the key is stored.
+type APIKey struct {
+	ID        int        `json:"id"`
+	AccountID int        `json:"accountId"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	KeyHash   string     `json:"-"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=read write transfer"`
+}
+
+// CreateAPIKeyResponse carries the key itself, which is only shown once.
+type CreateAPIKeyResponse struct {
+	Key    string  `json:"key"`
+	APIKey *APIKey `json:"apiKey"`
+}
+
+// withAPIKeyAuth accepts an X-API-Key header in place of an access token,
+// storing claims for the key's account in the request context. The key must
+// have ScopeRead for GET and HEAD requests and writeScope for anything else.
+// Requests without the header go through withJWTAuth.
+func (s *APIServer) withAPIKeyAuth(writeScope string, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	withJWT := s.withJWTAuth(handlerFunc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(apiKeyHeader)
+		if key == "" {
+			withJWT(w, r)
+			return
+		}
+		claims, scopes, err := s.authenticateAPIKey(r.Context(), key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		scope := writeScope
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			scope = ScopeRead
+		}
+		if !slices.Contains(scopes, scope) {
+			writeError(w, forbidden("INSUFFICIENT_SCOPE", "api key lacks the "+scope+" scope"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		handlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+// authenticateAPIKey returns claims for the account an active key belongs
+// to, with the role the account has now, and the key's scopes.
+func (s *APIServer) authenticateAPIKey(ctx context.Context, key string) (*AccountClaims, []string, error) {
+	apiKey, err := s.store.GetAPIKeyByHash(ctx, hashOpaqueToken(key))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, nil, unauthorized("INVALID_API_KEY", "invalid api key")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	acc, err := s.store.GetAccountByID(ctx, apiKey.AccountID)
+	if errors.Is(err, ErrAccountNotFound) {
+		return nil, nil, unauthorized("INVALID_API_KEY", "invalid api key")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	s.logger.DebugContext(ctx, "api key used", "account_id", acc.ID, "api_key_id", apiKey.ID)
+	return &AccountClaims{AccountID: acc.ID, Role: acc.Role}, apiKey.Scopes, nil
+}
+
+// handleGetAPIKeys lists an account's API keys.
+func (s *APIServer) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	keys, err := s.store.GetAPIKeys(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, keys)
+}
+
+// handleCreateAPIKey creates an API key for an account.
+func (s *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	req := new(CreateAPIKeyRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	key := apiKeyPrefix + token
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	apiKey := &APIKey{
+		AccountID: id,
+		Name:      req.Name,
+		Prefix:    key[:apiKeyDisplayLen],
+		Scopes:    slices.Compact(scopes),
+		KeyHash:   hashOpaqueToken(key),
+		CreatedAt: s.now().UTC(),
+	}
+	if err := s.store.CreateAPIKey(r.Context(), apiKey); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "api key created", "account_id", id, "api_key_id", apiKey.ID, "scopes", apiKey.Scopes)
+	return WriteJSON(w, http.StatusCreated, CreateAPIKeyResponse{Key: key, APIKey: apiKey})
+}
+
+// handleRevokeAPIKey stops an API key from being accepted.
+func (s *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	keyID, err := getPositiveIntVar(r, "keyID")
+	if err != nil {
+		return err
+	}
+	if err := s.store.RevokeAPIKey(r.Context(), id, keyID, s.now().UTC()); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "api key revoked", "account_id", id, "api_key_id", keyID)
+	return writeNoContent(w)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeys(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	require.Nil(t, server.store.CreateAccount(context.Background(), from))
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), to))
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	path := fmt.Sprintf("/api/v1/account/%d/api-keys", from.ID)
+
+	rec := doJSON(t, router, "POST", path, CreateAPIKeyRequest{Name: "payroll", Scopes: []string{"admin"}}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "unknown scope")
+
+	rec = doJSON(t, router, "POST", path, CreateAPIKeyRequest{Name: "reporting", Scopes: []string{ScopeRead, ScopeRead}}, header)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var readOnly CreateAPIKeyResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&readOnly))
+	assert.True(t, strings.HasPrefix(readOnly.Key, readOnly.APIKey.Prefix))
+	assert.Equal(t, []string{ScopeRead}, readOnly.APIKey.Scopes)
+	rec = doJSON(t, router, "POST", path, CreateAPIKeyRequest{Name: "payroll", Scopes: []string{ScopeRead, ScopeTransfer}}, header)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var payroll CreateAPIKeyResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&payroll))
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/balance", from.ID), nil, http.Header{"X-Api-Key": {readOnly.Key}})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/balance", to.ID), nil, http.Header{"X-Api-Key": {readOnly.Key}})
+	assert.Equal(t, http.StatusForbidden, rec.Code, "keys are bound to their account")
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 25}, http.Header{"X-Api-Key": {readOnly.Key}})
+	assert.Equal(t, http.StatusForbidden, rec.Code, "no transfer scope")
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 25}, http.Header{"X-Api-Key": {payroll.Key}})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "GET", path, nil, http.Header{"X-Api-Key": {payroll.Key}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "keys cannot manage keys")
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"X-Api-Key": {"gbk_made-up"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("%s/%d", path, payroll.APIKey.ID), nil, header)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"X-Api-Key": {payroll.Key}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "revoked")
+
+	rec = doJSON(t, router, "GET", path, nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NotContains(t, rec.Body.String(), payroll.Key)
+	var keys []APIKey
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&keys))
+	require.Len(t, keys, 2)
+	assert.Nil(t, keys[0].RevokedAt)
+	assert.NotNil(t, keys[1].RevokedAt)
+}
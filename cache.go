@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// accountCachePrefix namespaces the account cache in Redis.
+const accountCachePrefix = "gobank:account:"
+
+// cachedStore caches GetAccountByID and GetAccountByEmail in Redis, taking
+// the lookups made on every request, such as for API keys, off the database.
+// Every method that changes an account drops it from the cache once the
+// change is committed. A lookup racing a change can still put the old
+// account back, so entries also expire after ttl.
+//
+// Accounts are cached whole, password hash and sealed TOTP secret included,
+// so Redis must be trusted as much as the database. When it cannot be
+// reached, lookups go to the database.
+type cachedStore struct {
+	Storage
+	cache  *redisClient
+	ttl    time.Duration
+	logger *slog.Logger
+	// changed collects the accounts changed inside InTx, to be dropped once
+	// the transaction is over. It is nil outside transactions, where changes
+	// are dropped straight away.
+	changed *[]int
+}
+
+// withAccountCache wraps store in a cachedStore when
+// cfg.AccountCacheRedisURL is set.
+func withAccountCache(cfg *Config, store Storage, logger *slog.Logger) (Storage, error) {
+	if cfg.AccountCacheRedisURL == "" {
+		return store, nil
+	}
+	client, err := newRedisClient(cfg.AccountCacheRedisURL)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedStore{Storage: store, cache: client, ttl: cfg.AccountCacheTTL, logger: logger}, nil
+}
+
+// unwrapStore returns the store a cachedStore wraps, or store itself.
+func unwrapStore(store Storage) Storage {
+	if c, ok := store.(*cachedStore); ok {
+		return c.Storage
+	}
+	return store
+}
+
+func accountIDCacheKey(id int) string {
+	return accountCachePrefix + "id:" + strconv.Itoa(id)
+}
+
+func accountEmailCacheKey(email string) string {
+	return accountCachePrefix + "email:" + normalizeEmail(email)
+}
+
+func (c *cachedStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	if c.changed != nil {
+		return c.Storage.GetAccountByID(ctx, id)
+	}
+	if acc := c.cached(ctx, id); acc != nil {
+		return acc, nil
+	}
+	acc, err := c.Storage.GetAccountByID(ctx, id)
+	if err == nil {
+		c.put(ctx, acc)
+	}
+	return acc, err
+}
+
+// GetAccountByEmail looks the email up to an account id, then the account
+// by id. An id left behind by a deleted account, or one whose email has
+// changed, falls through to the database.
+func (c *cachedStore) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	if c.changed != nil {
+		return c.Storage.GetAccountByEmail(ctx, email)
+	}
+	reply, err := c.cache.do("GET", accountEmailCacheKey(email))
+	if err != nil {
+		c.logger.WarnContext(ctx, "account cache lookup failed", "error", err)
+	} else if s, ok := reply.(string); ok {
+		if id, err := strconv.Atoi(s); err == nil {
+			if acc := c.cached(ctx, id); acc != nil && normalizeEmail(acc.Email) == normalizeEmail(email) {
+				return acc, nil
+			}
+		}
+	}
+	acc, err := c.Storage.GetAccountByEmail(ctx, email)
+	if err == nil {
+		c.put(ctx, acc)
+	}
+	return acc, err
+}
+
+// cached returns the cached account with id, or nil on a miss.
+func (c *cachedStore) cached(ctx context.Context, id int) *Account {
+	reply, err := c.cache.do("GET", accountIDCacheKey(id))
+	if err != nil {
+		c.logger.WarnContext(ctx, "account cache lookup failed", "error", err)
+		return nil
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return nil
+	}
+	acc := new(Account)
+	if err := gob.NewDecoder(bytes.NewReader([]byte(s))).Decode(acc); err != nil {
+		c.logger.WarnContext(ctx, "could not decode cached account", "account_id", id, "error", err)
+		return nil
+	}
+	return acc
+}
+
+func (c *cachedStore) put(ctx context.Context, acc *Account) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(acc); err != nil {
+		c.logger.WarnContext(ctx, "could not encode account for the cache", "account_id", acc.ID, "error", err)
+		return
+	}
+	ttl := strconv.FormatInt(c.ttl.Milliseconds(), 10)
+	if _, err := c.cache.do("SET", accountIDCacheKey(acc.ID), buf.String(), "PX", ttl); err != nil {
+		c.logger.WarnContext(ctx, "account cache update failed", "error", err)
+		return
+	}
+	if _, err := c.cache.do("SET", accountEmailCacheKey(acc.Email), strconv.Itoa(acc.ID), "PX", ttl); err != nil {
+		c.logger.WarnContext(ctx, "account cache update failed", "error", err)
+	}
+}
+
+// invalidate drops the accounts with ids from the cache, or inside InTx
+// marks them to be dropped once the transaction is over.
+func (c *cachedStore) invalidate(ctx context.Context, ids ...int) {
+	if c.changed != nil {
+		*c.changed = append(*c.changed, ids...)
+		return
+	}
+	c.drop(ctx, ids...)
+}
+
+func (c *cachedStore) drop(ctx context.Context, ids ...int) {
+	if len(ids) == 0 {
+		return
+	}
+	args := []string{"DEL"}
+	for _, id := range ids {
+		args = append(args, accountIDCacheKey(id))
+	}
+	if _, err := c.cache.do(args...); err != nil {
+		c.logger.ErrorContext(ctx, "could not drop changed accounts from the cache, they may be stale until they expire", "account_ids", ids, "error", err)
+	}
+}
+
+// InTx hands fn a cachedStore that reads around the cache, as the cache
+// cannot see the transaction's changes, and drops the accounts it changes
+// once the outermost transaction is over.
+func (c *cachedStore) InTx(ctx context.Context, fn func(Storage) error) error {
+	changed := c.changed
+	if changed == nil {
+		changed = new([]int)
+		defer func() { c.drop(ctx, *changed...) }()
+	}
+	return c.Storage.InTx(ctx, func(tx Storage) error {
+		return fn(&cachedStore{Storage: tx, cache: c.cache, ttl: c.ttl, logger: c.logger, changed: changed})
+	})
+}
+
+func (c *cachedStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	defer c.invalidate(ctx, acc.ID)
+	return c.Storage.UpdateAccount(ctx, acc)
+}
+
+func (c *cachedStore) DeleteAccount(ctx context.Context, id int) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.DeleteAccount(ctx, id)
+}
+
+func (c *cachedStore) RestoreAccount(ctx context.Context, id int) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.RestoreAccount(ctx, id)
+}
+
+func (c *cachedStore) HardDeleteAccount(ctx context.Context, id int) ([]int, error) {
+	released, err := c.Storage.HardDeleteAccount(ctx, id)
+	c.invalidate(ctx, append([]int{id}, released...)...)
+	return released, err
+}
+
+func (c *cachedStore) UpdatePassword(ctx context.Context, id int, hash string) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.UpdatePassword(ctx, id, hash)
+}
+
+func (c *cachedStore) SetAccountStatus(ctx context.Context, id int, status string) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.SetAccountStatus(ctx, id, status)
+}
+
+func (c *cachedStore) SetOverdraftLimit(ctx context.Context, id int, limit int64) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.SetOverdraftLimit(ctx, id, limit)
+}
+
+func (c *cachedStore) SetTransferLimits(ctx context.Context, id int, daily, perTransfer *int64) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.SetTransferLimits(ctx, id, daily, perTransfer)
+}
+
+func (c *cachedStore) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.SetTOTPSecret(ctx, id, secret)
+}
+
+func (c *cachedStore) EnableTOTP(ctx context.Context, id int, backupCodeHashes []string) error {
+	defer c.invalidate(ctx, id)
+	return c.Storage.EnableTOTP(ctx, id, backupCodeHashes)
+}
+
+func (c *cachedStore) UseBackupCode(ctx context.Context, accountID int, codeHash string, now time.Time) error {
+	defer c.invalidate(ctx, accountID)
+	return c.Storage.UseBackupCode(ctx, accountID, codeHash, now)
+}
+
+func (c *cachedStore) Transfer(ctx context.Context, fromID, toID int, amount int64) (*Transaction, error) {
+	defer c.invalidate(ctx, fromID, toID)
+	return c.Storage.Transfer(ctx, fromID, toID, amount)
+}
+
+func (c *cachedStore) ReverseTransfer(ctx context.Context, debitID int) (*Transaction, error) {
+	t, err := c.Storage.ReverseTransfer(ctx, debitID)
+	if err == nil {
+		ids := []int{t.AccountID}
+		if t.CounterpartyAccountID != nil {
+			ids = append(ids, *t.CounterpartyAccountID)
+		}
+		c.invalidate(ctx, ids...)
+	}
+	return t, err
+}
+
+func (c *cachedStore) CreateHold(ctx context.Context, h *Hold) error {
+	defer c.invalidate(ctx, h.AccountID)
+	return c.Storage.CreateHold(ctx, h)
+}
+
+func (c *cachedStore) CaptureHold(ctx context.Context, accountID, id int) (*Hold, error) {
+	h, err := c.Storage.CaptureHold(ctx, accountID, id)
+	ids := []int{accountID}
+	if err == nil {
+		ids = append(ids, h.ToAccountID)
+	}
+	c.invalidate(ctx, ids...)
+	return h, err
+}
+
+func (c *cachedStore) ReleaseHold(ctx context.Context, accountID, id int) (*Hold, error) {
+	defer c.invalidate(ctx, accountID)
+	return c.Storage.ReleaseHold(ctx, accountID, id)
+}
+
+func (c *cachedStore) PostJournal(ctx context.Context, j *Journal) ([]*Transaction, error) {
+	var ids []int
+	for _, e := range j.Entries {
+		if e.AccountID != nil {
+			ids = append(ids, *e.AccountID)
+		}
+	}
+	defer c.invalidate(ctx, ids...)
+	return c.Storage.PostJournal(ctx, j)
+}
+
+func (c *cachedStore) ConsumeVerificationToken(ctx context.Context, tokenHash string) (int, error) {
+	id, err := c.Storage.ConsumeVerificationToken(ctx, tokenHash)
+	if err == nil {
+		c.invalidate(ctx, id)
+	}
+	return id, err
+}
+
+func (c *cachedStore) ResetPassword(ctx context.Context, tokenHash, hash string, now time.Time) (int, error) {
+	id, err := c.Storage.ResetPassword(ctx, tokenHash, hash, now)
+	if err == nil {
+		c.invalidate(ctx, id)
+	}
+	return id, err
+}
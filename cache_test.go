@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lookupCountingStore counts the account lookups that reach the store.
+type lookupCountingStore struct {
+	Storage
+	lookups int
+}
+
+func (s *lookupCountingStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	s.lookups++
+	return s.Storage.GetAccountByID(ctx, id)
+}
+
+func (s *lookupCountingStore) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	s.lookups++
+	return s.Storage.GetAccountByEmail(ctx, email)
+}
+
+func TestAccountCache(t *testing.T) {
+	ctx := context.Background()
+	_, addr := newFakeRedis(t, 1, 1)
+	backing := &lookupCountingStore{Storage: NewMemoryStore()}
+	store, err := withAccountCache(&Config{AccountCacheRedisURL: "redis://" + addr, AccountCacheTTL: time.Minute}, backing, discardLogger)
+	require.Nil(t, err)
+	require.IsType(t, &cachedStore{}, store)
+	assert.Same(t, backing, unwrapStore(store))
+
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.Balance = 100
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	other, err := NewAccount("c", "d", "other@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, other))
+
+	found, err := store.GetAccountByID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, 1, backing.lookups)
+	cached, err := store.GetAccountByID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, found, cached, "accounts are cached whole")
+	assert.Equal(t, acc.EncryptedPassword, cached.EncryptedPassword)
+	cached, err = store.GetAccountByEmail(ctx, "ABC@abc.com")
+	require.Nil(t, err)
+	assert.Equal(t, acc.ID, cached.ID)
+	assert.Equal(t, 1, backing.lookups, "both lookups were served from the cache")
+
+	found.FirstName = "renamed"
+	require.Nil(t, store.UpdateAccount(ctx, found))
+	cached, err = store.GetAccountByID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, "renamed", cached.FirstName, "updates drop the account from the cache")
+
+	require.Nil(t, store.InTx(ctx, func(tx Storage) error {
+		_, err := tx.Transfer(ctx, acc.ID, other.ID, 40)
+		return err
+	}))
+	cached, err = store.GetAccountByID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(60), cached.Balance, "transfers in a transaction drop the account once it commits")
+
+	require.Nil(t, store.DeleteAccount(ctx, acc.ID))
+	_, err = store.GetAccountByEmail(ctx, "abc@abc.com")
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+	_, err = store.GetAccountByID(ctx, acc.ID)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+}
+
+func TestAccountCacheHolds(t *testing.T) {
+	ctx := context.Background()
+	_, addr := newFakeRedis(t, 1, 1)
+	store, err := withAccountCache(&Config{AccountCacheRedisURL: "redis://" + addr, AccountCacheTTL: time.Minute}, NewMemoryStore(), discardLogger)
+	require.Nil(t, err)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	require.Nil(t, store.CreateAccount(ctx, from))
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, to))
+	now := time.Now().UTC()
+	hold := &Hold{AccountID: from.ID, ToAccountID: to.ID, Amount: 60, Status: HoldActive, CreatedAt: now, UpdatedAt: now}
+	require.Nil(t, store.CreateHold(ctx, hold))
+
+	_, err = store.GetAccountByID(ctx, to.ID)
+	require.Nil(t, err)
+	_, err = store.CaptureHold(ctx, from.ID, hold.ID)
+	require.Nil(t, err)
+	cached, err := store.GetAccountByID(ctx, to.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(60), cached.Balance, "captures drop the recipient too")
+
+	hold = &Hold{AccountID: from.ID, ToAccountID: to.ID, Amount: 30, Status: HoldActive, CreatedAt: now, UpdatedAt: now}
+	require.Nil(t, store.CreateHold(ctx, hold))
+	cached, err = store.GetAccountByID(ctx, from.ID)
+	require.Nil(t, err)
+	require.Equal(t, int64(30), cached.Held)
+	_, err = store.HardDeleteAccount(ctx, to.ID)
+	require.Nil(t, err)
+	cached, err = store.GetAccountByID(ctx, from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), cached.Held, "purges drop the accounts whose holds they release")
+}
+
+func TestAccountCacheFailsOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	store, err := withAccountCache(&Config{AccountCacheRedisURL: "redis://" + addr, AccountCacheTTL: time.Minute}, NewMemoryStore(), discardLogger)
+	require.Nil(t, err)
+
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(context.Background(), acc))
+	found, err := store.GetAccountByEmail(context.Background(), "abc@abc.com")
+	require.Nil(t, err)
+	assert.Equal(t, acc.ID, found.ID)
+
+	_, err = withAccountCache(&Config{AccountCacheRedisURL: "http://cache"}, NewMemoryStore(), discardLogger)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// ListenAddr is the address the API listens on, e.g. ":8080". The PORT
+	// environment variable takes precedence. See resolveListenAddr.
+	ListenAddr string `yaml:"listenAddr"`
+	// RequestTimeout cancels a JSON API request's context, and with it the
+	// database calls it is making, once it has run this long. Zero leaves
+	// requests unbounded, so long exports are not cut off.
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+
+	// GRPCListenAddr is where the gRPC API listens, e.g. ":50051". Leave
+	// empty to serve only the JSON API.
+	GRPCListenAddr string `yaml:"grpcListenAddr"`
+	// MetricsListenAddr is where Prometheus metrics are served at /metrics,
+	// e.g. ":9090". It should not be reachable from outside, as the metrics
+	// name the queries the server runs. Leave empty to serve no metrics.
+	MetricsListenAddr string `yaml:"metricsListenAddr"`
+
+	// Storage is where data is kept: StoragePostgres (the default), in the
+	// database described below, or StorageMemory, which needs no database
+	// but loses everything when the server stops.
+	Storage string `yaml:"storage"`
+
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	DBName   string `yaml:"dbName"`
+	Schema   string `yaml:"schema"`
+	// ReadReplicas lists hot standbys, as "host" or "host:port", that
+	// share the primary's credentials and database. Account reads made by
+	// GET requests are spread over them while they answer pings every
+	// DBPingInterval, and go to the primary when none do.
+	ReadReplicas []string `yaml:"readReplicas"`
+	// SkipMigrations stops the server from migrating the database when it
+	// starts, leaving that to "gobank migrate". It then refuses to start
+	// until the schema is up to date.
+	SkipMigrations bool `yaml:"skipMigrations"`
+	// AllowSeed lets "gobank seed" fill the database with fake accounts.
+	// Only set it in development configs.
+	AllowSeed bool `yaml:"allowSeed"`
+	// DBPasswordSecretName reads the database password from SecretProvider
+	// instead of Password. Each new connection uses the current value, so
+	// a rotated password is picked up as ConnMaxLifetime recycles the pool.
+	DBPasswordSecretName string `yaml:"dbPasswordSecretName"`
+
+	// SecretProvider is where secrets are read from: "env" (the default),
+	// the environment variable of the same name, "vault", a KV version 2
+	// engine mounted at VaultMount (default "secret") on VaultAddr, or
+	// "aws", Secrets Manager in AWSRegion. With vault and aws a secret name
+	// is "path#field" and the field is optional for aws. VAULT_ADDR,
+	// VAULT_TOKEN and AWS_REGION override the config, and AWS credentials
+	// come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN.
+	//
+	// Secrets from vault and aws are read again every SecretRefreshInterval
+	// (default 5m) so they can be rotated without a restart. Tokens signed
+	// with the JWT secret before its last rotation stay valid.
+	SecretProvider        string        `yaml:"secretProvider"`
+	SecretRefreshInterval time.Duration `yaml:"secretRefreshInterval"`
+	VaultAddr             string        `yaml:"vaultAddr"`
+	VaultToken            string        `yaml:"vaultToken"`
+	VaultMount            string        `yaml:"vaultMount"`
+	AWSRegion             string        `yaml:"awsRegion"`
+
+	// MaxOpenConns caps the connections open to postgres (default 25) and
+	// MinConns keeps that many open even when idle (default 0).
+	// ConnMaxLifetime (default 30m) and ConnMaxIdleTime (default 5m) recycle
+	// connections, and idle ones are checked every HealthCheckPeriod
+	// (default 1m), so ones dropped by the server or a proxy are not reused.
+	MaxOpenConns      int           `yaml:"maxOpenConns"`
+	MinConns          int           `yaml:"minConns"`
+	ConnMaxLifetime   time.Duration `yaml:"connMaxLifetime"`
+	ConnMaxIdleTime   time.Duration `yaml:"connMaxIdleTime"`
+	HealthCheckPeriod time.Duration `yaml:"healthCheckPeriod"`
+
+	// PasswordHash is the algorithm new passwords are hashed with, "argon2id"
+	// (the default) or "bcrypt". Passwords hashed otherwise keep working and
+	// are rehashed the next time their owner logs in.
+	PasswordHash string `yaml:"passwordHash"`
+	// Argon2Time, Argon2MemoryKiB and Argon2Threads tune argon2id and default
+	// to 2 passes over 19 MiB with 1 thread.
+	Argon2Time      uint32 `yaml:"argon2Time"`
+	Argon2MemoryKiB uint32 `yaml:"argon2MemoryKiB"`
+	Argon2Threads   uint8  `yaml:"argon2Threads"`
+	// BcryptCost is the work factor bcrypt hashes with. It can be
+	// overridden with BCRYPT_COST and defaults to bcrypt.DefaultCost.
+	BcryptCost int `yaml:"bcryptCost"`
+
+	// DailyTransferLimit caps the total an account can transfer out over any
+	// 24 hours, PerTransferLimit a single transfer, unless the account has its
+	// own limits. Zero means unlimited.
+	DailyTransferLimit int64 `yaml:"dailyTransferLimit"`
+	PerTransferLimit   int64 `yaml:"perTransferLimit"`
+
+	// CORSAllowedOrigins lists the browser origins allowed to call the API.
+	// "*" allows any origin but is never combined with credentials.
+	CORSAllowedOrigins []string `yaml:"corsAllowedOrigins"`
+	// CORSAllowCredentials lets listed origins send cookies and auth headers.
+	CORSAllowCredentials bool `yaml:"corsAllowCredentials"`
+
+	// LoginRateLimit is how many login attempts per second each client IP
+	// earns back, up to LoginRateBurst attempts in a row. Defaults to one
+	// attempt every ten seconds with a burst of five.
+	LoginRateLimit float64 `yaml:"loginRateLimit"`
+	LoginRateBurst int     `yaml:"loginRateBurst"`
+	// SignupRateLimit and SignupRateBurst limit account creation per client
+	// IP the same way. Defaults to one every ten seconds with a burst of
+	// five.
+	SignupRateLimit float64 `yaml:"signupRateLimit"`
+	SignupRateBurst int     `yaml:"signupRateBurst"`
+	// RateLimit and RateBurst limit every request per client IP, and
+	// AccountRateLimit and AccountRateBurst every request with an access
+	// token or API key per account or key. Both are off unless set.
+	RateLimit        float64 `yaml:"rateLimit"`
+	RateBurst        int     `yaml:"rateBurst"`
+	AccountRateLimit float64 `yaml:"accountRateLimit"`
+	AccountRateBurst int     `yaml:"accountRateBurst"`
+	// RateLimitRedisURL, redis://[user:password@]host[:port][/db], keeps the
+	// rate limit buckets in Redis so instances share them. Can be set with
+	// RATE_LIMIT_REDIS_URL. Buckets are kept in memory when unset.
+	RateLimitRedisURL string `yaml:"rateLimitRedisURL"`
+	// AccountCacheRedisURL, in the same form, caches account lookups in
+	// Redis for AccountCacheTTL, 1m by default. Can be set with
+	// ACCOUNT_CACHE_REDIS_URL. Accounts are not cached when unset.
+	AccountCacheRedisURL string        `yaml:"accountCacheRedisURL"`
+	AccountCacheTTL      time.Duration `yaml:"accountCacheTTL"`
+	// LoginLockoutThreshold is how many failed logins in a row lock an email
+	// address for LoginLockoutDuration, and LoginIPLockoutThreshold how many
+	// lock a client IP. Defaults to 5, 20 and 15m. A negative threshold
+	// disables that lock.
+	LoginLockoutThreshold   int           `yaml:"loginLockoutThreshold"`
+	LoginIPLockoutThreshold int           `yaml:"loginIPLockoutThreshold"`
+	LoginLockoutDuration    time.Duration `yaml:"loginLockoutDuration"`
+
+	// DBRetryAttempts is how many times a database operation hitting a
+	// serialization failure or deadlock is tried in total, waiting
+	// DBRetryBaseDelay and doubling it between attempts. Defaults to 3 and 50ms.
+	DBRetryAttempts  int           `yaml:"dbRetryAttempts"`
+	DBRetryBaseDelay time.Duration `yaml:"dbRetryBaseDelay"`
+	// DBConnectMaxWait is how long startup keeps trying to reach postgres,
+	// for when the server starts before the database does. The wait after
+	// each failure starts at DBConnectBaseDelay and doubles up to
+	// DBConnectMaxDelay, with jitter. Defaults to 1m, 500ms and 10s. A
+	// negative max wait tries once.
+	DBConnectMaxWait   time.Duration `yaml:"dbConnectMaxWait"`
+	DBConnectBaseDelay time.Duration `yaml:"dbConnectBaseDelay"`
+	DBConnectMaxDelay  time.Duration `yaml:"dbConnectMaxDelay"`
+	// DBPingInterval is how often the server checks postgres is still
+	// reachable, logging outages and replacing the pool's connections once
+	// the database is back. Defaults to 30s. A negative interval disables
+	// the check.
+	DBPingInterval time.Duration `yaml:"dbPingInterval"`
+	// SlowQueryThreshold is how long a database query, including reading
+	// its rows, can take before it is logged as slow. Defaults to 500ms. A
+	// negative threshold disables the log.
+	SlowQueryThreshold time.Duration `yaml:"slowQueryThreshold"`
+
+	// LogLevel is the minimum level logged: debug, info, warn or error. It
+	// can be overridden with LOG_LEVEL and defaults to info.
+	LogLevel string `yaml:"logLevel"`
+
+	// JWTAlgorithm is HS256 (the default), signing with the secret named
+	// JWTSecretName (default JWT_SECRET) in SecretProvider, or RS256 or ES256, signing with the PEM encoded
+	// RSA or P-256 key in JWTPrivateKeyFile. JWTPublicKeyFile is optional and
+	// otherwise derived from the private key. The public keys are served at
+	// /.well-known/jwks.json.
+	//
+	// To rotate keys, sign with the new key and list the public key of the
+	// old one in JWTPreviousPublicKeyFiles until the tokens it signed have
+	// expired.
+	JWTAlgorithm              string   `yaml:"jwtAlgorithm"`
+	JWTSecretName             string   `yaml:"jwtSecretName"`
+	JWTPrivateKeyFile         string   `yaml:"jwtPrivateKeyFile"`
+	JWTPublicKeyFile          string   `yaml:"jwtPublicKeyFile"`
+	JWTPreviousPublicKeyFiles []string `yaml:"jwtPreviousPublicKeyFiles"`
+	// JWTIssuer and JWTAudience are put in the iss and aud claims of every
+	// token, and tokens with other values are rejected. They default to
+	// "gobank" and "gobank-api". AccessTokenTTL is how long access tokens
+	// stay valid and defaults to 15m.
+	JWTIssuer      string        `yaml:"jwtIssuer"`
+	JWTAudience    string        `yaml:"jwtAudience"`
+	AccessTokenTTL time.Duration `yaml:"accessTokenTTL"`
+	// JWTCookie makes login hand out the access and refresh tokens as
+	// HttpOnly cookies instead of in the response, keeping them out of reach
+	// of page scripts. Requests authenticated by cookie that change state
+	// must then send the csrf_token cookie back in the X-CSRF-Token header.
+	JWTCookie bool `yaml:"jwtCookie"`
+	// RefreshTokenTTL is how long a refresh token from login can be used to
+	// get a new access token. Defaults to 30 days.
+	RefreshTokenTTL time.Duration `yaml:"refreshTokenTTL"`
+
+	// WebAuthnRPID enables passkey login for the given relying party id,
+	// the domain the web app is served from, e.g. "bank.example.com".
+	// WebAuthnRPOrigins lists the full origins allowed to use it, e.g.
+	// "https://bank.example.com". WebAuthnRPDisplayName is shown by the
+	// browser and defaults to "gobank".
+	WebAuthnRPID          string   `yaml:"webAuthnRPID"`
+	WebAuthnRPOrigins     []string `yaml:"webAuthnRPOrigins"`
+	WebAuthnRPDisplayName string   `yaml:"webAuthnRPDisplayName"`
+
+	// OAuthProviders enables "Sign in with ..." at
+	// /api/v1/oauth/{name}/login for each provider, keyed by name, e.g.
+	// "google". A provider's client secret can be set in the environment as
+	// OAUTH_<NAME>_CLIENT_SECRET instead.
+	OAuthProviders map[string]OAuthProviderConfig `yaml:"oauthProviders"`
+
+	// TLSCertFile and TLSKeyFile are PEM files for serving HTTPS. When either
+	// is empty the server falls back to plaintext HTTP.
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+
+	// HSTSMaxAge is sent in Strict-Transport-Security so browsers only reach
+	// the API over HTTPS. Defaults to a year; a negative value leaves the
+	// header out. ContentSecurityPolicy and FrameOptions default to
+	// "default-src 'none'; frame-ancestors 'none'" and "DENY", which suit a
+	// JSON API; "-" leaves either out.
+	HSTSMaxAge            time.Duration `yaml:"hstsMaxAge"`
+	ContentSecurityPolicy string        `yaml:"contentSecurityPolicy"`
+	FrameOptions          string        `yaml:"frameOptions"`
+
+	// WebhookURL receives a JSON POST for every account.created,
+	// account.locked, account.unlocked, transfer.completed and
+	// transfer.reversed event. Leave empty to disable webhooks. Failed
+	// deliveries are tried WebhookRetryAttempts times in total, waiting
+	// WebhookRetryBaseDelay and doubling it between attempts. Defaults to 3
+	// and 1s.
+	WebhookURL            string        `yaml:"webhookURL"`
+	WebhookRetryAttempts  int           `yaml:"webhookRetryAttempts"`
+	WebhookRetryBaseDelay time.Duration `yaml:"webhookRetryBaseDelay"`
+
+	// PurgeInterval is how often expired tokens, stale idempotency keys and
+	// accounts soft deleted more than DeletedAccountRetention ago are purged.
+	// Defaults to 1h and 30 days. A negative interval disables the job.
+	PurgeInterval           time.Duration `yaml:"purgeInterval"`
+	DeletedAccountRetention time.Duration `yaml:"deletedAccountRetention"`
+	// LoginHistoryRetention is how long login attempts are kept. Defaults to
+	// 90 days.
+	LoginHistoryRetention time.Duration `yaml:"loginHistoryRetention"`
+
+	// ScheduledTransferInterval is how often due scheduled transfers are made.
+	// Defaults to 1m. A negative interval disables the worker.
+	ScheduledTransferInterval time.Duration `yaml:"scheduledTransferInterval"`
+
+	// IdempotencyKeyTTL is how long the result of a transfer sent with an
+	// Idempotency-Key is replayed to retries. Defaults to 24h.
+	IdempotencyKeyTTL time.Duration `yaml:"idempotencyKeyTTL"`
+
+	// ExchangeRates enables transfers between accounts in different
+	// currencies, e.g. {USD: {EUR: 0.92}} credits 0.92 EUR per USD sent.
+	// Leave empty to reject them.
+	ExchangeRates map[string]map[string]float64 `yaml:"exchangeRates"`
+}
+
+// OAuthProviderConfig configures a "Sign in with ..." provider. Type is
+// OAuthProviderOIDC (the default), which discovers the endpoints from
+// Issuer, or OAuthProviderGitHub. RedirectURL must point at
+// /api/v1/oauth/{provider}/callback and be registered with the provider.
+type OAuthProviderConfig struct {
+	Type         string   `yaml:"type"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+const (
+	StoragePostgres = "postgres"
+	StorageMemory   = "memory"
+)
+
+func loadConfig(path string) (*Config, error) {
+	// get config details from yaml file
+	f, err := os.ReadFile(path)
+
+	if err != nil {
+		return &Config{}, fmt.Errorf("unable to open config yaml file %s: %s", path, err)
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(f, &cfg)
+	if err != nil {
+		return &Config{}, fmt.Errorf("unable to decode config yaml file %s: %s", path, err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return &Config{}, err
+	}
+	cfg.applyDefaults()
+
+	return &cfg, nil
+}
+
+// defaultListenAddr is used when neither PORT nor ListenAddr is set.
+const defaultListenAddr = ":3000"
+
+// resolveListenAddr returns the address to serve on: the PORT environment
+// variable, then the ListenAddr config field, then defaultListenAddr. A bare
+// port such as "8080" listens on all interfaces.
+func resolveListenAddr(cfg *Config) string {
+	addr := os.Getenv("PORT")
+	if addr == "" {
+		addr = cfg.ListenAddr
+	}
+	if addr == "" {
+		return defaultListenAddr
+	}
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	return addr
+}
+
+// applyEnv overrides config values with any set in the environment.
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("BCRYPT_COST"); v != "" {
+		cost, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("BCRYPT_COST %q is not an integer: %v", v, err)
+		}
+		c.BcryptCost = cost
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		c.LogLevel = v
+	}
+	if v := os.Getenv("RATE_LIMIT_REDIS_URL"); v != "" {
+		c.RateLimitRedisURL = v
+	}
+	if v := os.Getenv("ACCOUNT_CACHE_REDIS_URL"); v != "" {
+		c.AccountCacheRedisURL = v
+	}
+	if v := os.Getenv("VAULT_ADDR"); v != "" {
+		c.VaultAddr = v
+	}
+	if v := os.Getenv("VAULT_TOKEN"); v != "" {
+		c.VaultToken = v
+	}
+	if v := os.Getenv("AWS_REGION"); v != "" {
+		c.AWSRegion = v
+	}
+	for name, provider := range c.OAuthProviders {
+		if v := os.Getenv("OAUTH_" + strings.ToUpper(name) + "_CLIENT_SECRET"); v != "" {
+			provider.ClientSecret = v
+			c.OAuthProviders[name] = provider
+		}
+	}
+	return nil
+}
+
+func (c *Config) applyDefaults() {
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = 25
+	}
+	if c.ConnMaxLifetime == 0 {
+		c.ConnMaxLifetime = 30 * time.Minute
+	}
+	if c.ConnMaxIdleTime == 0 {
+		c.ConnMaxIdleTime = 5 * time.Minute
+	}
+	if c.HealthCheckPeriod == 0 {
+		c.HealthCheckPeriod = time.Minute
+	}
+	if c.BcryptCost == 0 {
+		c.BcryptCost = bcrypt.DefaultCost
+	}
+	if c.Argon2Time == 0 {
+		c.Argon2Time = defaultArgon2idParams.Time
+	}
+	if c.Argon2MemoryKiB == 0 {
+		c.Argon2MemoryKiB = defaultArgon2idParams.MemoryKiB
+	}
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = defaultArgon2idParams.Threads
+	}
+	if c.LoginRateLimit == 0 {
+		c.LoginRateLimit = 0.1
+	}
+	if c.LoginRateBurst == 0 {
+		c.LoginRateBurst = 5
+	}
+	if c.SignupRateLimit == 0 {
+		c.SignupRateLimit = 0.1
+	}
+	if c.SignupRateBurst == 0 {
+		c.SignupRateBurst = 5
+	}
+	if c.LoginLockoutThreshold == 0 {
+		c.LoginLockoutThreshold = 5
+	}
+	if c.LoginIPLockoutThreshold == 0 {
+		c.LoginIPLockoutThreshold = 20
+	}
+	if c.LoginLockoutDuration == 0 {
+		c.LoginLockoutDuration = 15 * time.Minute
+	}
+	if c.DBRetryAttempts == 0 {
+		c.DBRetryAttempts = 3
+	}
+	if c.DBRetryBaseDelay == 0 {
+		c.DBRetryBaseDelay = 50 * time.Millisecond
+	}
+	if c.DBConnectMaxWait == 0 {
+		c.DBConnectMaxWait = time.Minute
+	}
+	if c.DBConnectBaseDelay == 0 {
+		c.DBConnectBaseDelay = 500 * time.Millisecond
+	}
+	if c.DBConnectMaxDelay == 0 {
+		c.DBConnectMaxDelay = 10 * time.Second
+	}
+	if c.DBPingInterval == 0 {
+		c.DBPingInterval = 30 * time.Second
+	}
+	if c.AccountCacheTTL == 0 {
+		c.AccountCacheTTL = time.Minute
+	}
+	if c.SlowQueryThreshold == 0 {
+		c.SlowQueryThreshold = 500 * time.Millisecond
+	}
+	if c.PurgeInterval == 0 {
+		c.PurgeInterval = time.Hour
+	}
+	if c.DeletedAccountRetention == 0 {
+		c.DeletedAccountRetention = defaultDeletedAccountRetention
+	}
+	if c.LoginHistoryRetention == 0 {
+		c.LoginHistoryRetention = defaultLoginHistoryRetention
+	}
+	if c.SecretRefreshInterval == 0 {
+		c.SecretRefreshInterval = defaultSecretRefreshInterval
+	}
+	if c.HSTSMaxAge == 0 {
+		c.HSTSMaxAge = 365 * 24 * time.Hour
+	}
+	if c.ContentSecurityPolicy == "" {
+		c.ContentSecurityPolicy = defaultContentSecurityPolicy
+	}
+	if c.FrameOptions == "" {
+		c.FrameOptions = "DENY"
+	}
+	if c.ScheduledTransferInterval == 0 {
+		c.ScheduledTransferInterval = time.Minute
+	}
+	if c.RefreshTokenTTL == 0 {
+		c.RefreshTokenTTL = defaultRefreshTokenTTL
+	}
+	if c.IdempotencyKeyTTL == 0 {
+		c.IdempotencyKeyTTL = defaultIdempotencyKeyTTL
+	}
+	if c.WebhookRetryAttempts == 0 {
+		c.WebhookRetryAttempts = 3
+	}
+	if c.WebhookRetryBaseDelay == 0 {
+		c.WebhookRetryBaseDelay = time.Second
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigurePoolAppliesDefaults(t *testing.T) {
+	cfg := &Config{MaxOpenConns: 7}
+	cfg.applyDefaults()
+	assert.Equal(t, 7, cfg.MaxOpenConns)
+	assert.Equal(t, 30*time.Minute, cfg.ConnMaxLifetime)
+	assert.Equal(t, time.Minute, cfg.HealthCheckPeriod)
+
+	// postgresPoolConfig does not connect, so this needs no database
+	poolConfig, err := postgresPoolConfig(cfg, discardLogger)
+	require.Nil(t, err)
+	assert.Equal(t, int32(7), poolConfig.MaxConns)
+	assert.Equal(t, 5*time.Minute, poolConfig.MaxConnIdleTime)
+	assert.Equal(t, time.Minute, poolConfig.HealthCheckPeriod)
+}
+
+func TestResolveListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  string
+		cfg  string
+		want string
+	}{
+		{name: "default", want: ":3000"},
+		{name: "config", cfg: "127.0.0.1:9000", want: "127.0.0.1:9000"},
+		{name: "config port only", cfg: "9000", want: ":9000"},
+		{name: "env", env: "8080", want: ":8080"},
+		{name: "env wins over config", env: "8080", cfg: ":9000", want: ":8080"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("PORT", tc.env)
+			assert.Equal(t, tc.want, resolveListenAddr(&Config{ListenAddr: tc.cfg}))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// With Config.JWTCookie on, login also sets csrfCookie, which page scripts
+// can read, and state-changing requests authenticated by cookie must echo it
+// in csrfHeader. A cross-site page can make the browser send the cookies but
+// cannot read them, so it cannot forge the header.
+const (
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// errCSRFTokenInvalid answers a cookie-authenticated request without a
+// matching CSRF token.
+var errCSRFTokenInvalid = forbidden("CSRF_TOKEN_INVALID", "missing or invalid CSRF token")
+
+// setCSRFCookie issues a new CSRF token lasting until expiresAt.
+func setCSRFCookie(w http.ResponseWriter, expiresAt time.Time) error {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// withCSRFProtection refuses state-changing requests that carry a token
+// cookie unless csrfHeader matches csrfCookie. Requests authenticating with
+// a header, and safe methods, are let through. It does nothing unless
+// enabled.
+func withCSRFProtection(enabled bool, next http.Handler) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" || r.Header.Get(apiKeyHeader) != "" || !hasTokenCookie(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrfCookie)
+		header := r.Header.Get(csrfHeader)
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			writeError(w, errCSRFTokenInvalid)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasTokenCookie(r *http.Request) bool {
+	for _, name := range []string{accessTokenCookie, refreshTokenCookie} {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.cfg.JWTCookie = true
+	router := server.newHandler()
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.EmailVerified = true
+	from.Balance = 100
+	require.Nil(t, server.store.CreateAccount(context.Background(), from))
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), to))
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "from@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 3)
+	access, csrf := cookies[0], cookies[2]
+	transfer := func(csrfToken string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		header := http.Header{"Cookie": {cookieHeader(cookies...)}}
+		header.Set(csrfHeader, csrfToken)
+		return doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 10}, header)
+	}
+
+	rec = transfer("", access, csrf)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "no header")
+	rec = transfer("forged", access, csrf)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "a header not matching the cookie")
+	rec = transfer(csrf.Value, access)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "no cookie")
+	rec = transfer(csrf.Value, access, csrf)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	req := httptest.NewRequest("GET", "/api/v1/me", nil)
+	req.AddCookie(access)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, "safe methods need no token")
+
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 10}, http.Header{"Authorization": {"Bearer " + token}})
+	assert.Equal(t, http.StatusOK, rec.Code, "bearer tokens cannot be sent cross-site")
+}
+
+func cookieHeader(cookies ...*http.Cookie) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req.Header.Get("Cookie")
+}
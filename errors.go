@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+)
+
+// HTTPError is an error a handler returns to answer with a specific status.
+// Code is the machine-readable code of the response, by default one named
+// after Status. Headers are added to the response before it is written.
+type HTTPError struct {
+	Status  int
+	Code    string
+	Message string
+	Headers http.Header
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, args ...any) error {
+	return &HTTPError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func unauthorized(code, message string) error {
+	return &HTTPError{
+		Status:  http.StatusUnauthorized,
+		Code:    code,
+		Message: message,
+		Headers: http.Header{"Www-Authenticate": {"Bearer"}},
+	}
+}
+
+func forbidden(code, message string) error {
+	return &HTTPError{Status: http.StatusForbidden, Code: code, Message: message}
+}
+
+var (
+	errMissingToken     = unauthorized("MISSING_TOKEN", "missing token")
+	errInvalidToken     = unauthorized("INVALID_TOKEN", "invalid token")
+	errPermissionDenied = forbidden("PERMISSION_DENIED", "permission denied")
+	// errIdempotencyKeyReused answers a retry whose body differs from the
+	// request the key was first used with.
+	errIdempotencyKeyReused = &HTTPError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "IDEMPOTENCY_KEY_REUSED",
+		Message: "Idempotency-Key was already used for a different request",
+	}
+)
+
+// methodNotAllowed answers r with 405 and an Allow header listing the methods
+// the route supports.
+func methodNotAllowed(r *http.Request, allowed ...string) error {
+	return &HTTPError{
+		Status:  http.StatusMethodNotAllowed,
+		Message: fmt.Sprintf("method not allowed: %s", r.Method),
+		Headers: http.Header{"Allow": {strings.Join(allowed, ", ")}},
+	}
+}
+
+// handleUnmatched answers requests no route of router matches. When routes
+// at the path take other methods it answers OPTIONS with 204 and 405 to any
+// other method, both with an Allow header listing them, and 404 otherwise.
+// Subrouters lose track of method mismatches, so router is asked again with
+// each method rather than trusting mux.
+func handleUnmatched(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			req := r.Clone(r.Context())
+			req.Method = method
+			var match mux.RouteMatch
+			if method != r.Method && router.Match(req, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		if len(allowed) > 0 && r.Method == http.MethodOptions {
+			w.Header().Set("Allow", strings.Join(append(allowed, http.MethodOptions), ", "))
+			writeNoContent(w)
+			return
+		}
+		if len(allowed) > 0 {
+			writeError(w, methodNotAllowed(r, allowed...))
+			return
+		}
+		writeError(w, &HTTPError{Status: http.StatusNotFound, Message: fmt.Sprintf("no route for %s", r.URL.Path)})
+	})
+}
+
+// errorCodes are the errors the stores and handlers share, with the status
+// and code each is answered with. errors.Is picks the first that matches, so
+// an error must come before any it wraps.
+var errorCodes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrAccountNotFound, http.StatusNotFound, "ACCOUNT_NOT_FOUND"},
+	{ErrTransactionNotFound, http.StatusNotFound, "TRANSACTION_NOT_FOUND"},
+	{ErrScheduledTransferNotFound, http.StatusNotFound, "SCHEDULED_TRANSFER_NOT_FOUND"},
+	{ErrStandingOrderNotFound, http.StatusNotFound, "STANDING_ORDER_NOT_FOUND"},
+	{ErrHoldNotFound, http.StatusNotFound, "HOLD_NOT_FOUND"},
+	{ErrPasskeyNotFound, http.StatusNotFound, "PASSKEY_NOT_FOUND"},
+	{ErrAPIKeyNotFound, http.StatusNotFound, "API_KEY_NOT_FOUND"},
+	{ErrSessionNotFound, http.StatusNotFound, "SESSION_NOT_FOUND"},
+	{ErrAccountExists, http.StatusConflict, "ACCOUNT_EXISTS"},
+	{ErrConflict, http.StatusConflict, "CONCURRENT_MODIFICATION"},
+	{ErrAlreadyReversed, http.StatusConflict, "ALREADY_REVERSED"},
+	{ErrScheduledTransferNotPending, http.StatusConflict, "SCHEDULED_TRANSFER_NOT_PENDING"},
+	{ErrStandingOrderTransition, http.StatusConflict, "INVALID_STANDING_ORDER_TRANSITION"},
+	{ErrHoldNotActive, http.StatusConflict, "HOLD_NOT_ACTIVE"},
+	{ErrPasskeyExists, http.StatusConflict, "PASSKEY_EXISTS"},
+	{ErrAccountFrozen, http.StatusForbidden, "ACCOUNT_FROZEN"},
+	{ErrOverdraftLimitExceeded, http.StatusUnprocessableEntity, "OVERDRAFT_LIMIT_EXCEEDED"},
+	{ErrInsufficientFunds, http.StatusUnprocessableEntity, "INSUFFICIENT_FUNDS"},
+	{ErrCurrencyMismatch, http.StatusUnprocessableEntity, "CURRENCY_MISMATCH"},
+	{ErrVerificationTokenInvalid, http.StatusBadRequest, "VERIFICATION_TOKEN_INVALID"},
+	{ErrPasswordResetTokenInvalid, http.StatusBadRequest, "PASSWORD_RESET_TOKEN_INVALID"},
+	{ErrPasskeySessionInvalid, http.StatusBadRequest, "PASSKEY_SESSION_INVALID"},
+	{ErrRefreshTokenInvalid, http.StatusUnauthorized, "REFRESH_TOKEN_INVALID"},
+}
+
+// classifyError picks the response status and code for an error returned by
+// a handler. Errors it does not recognise are internal and answered with
+// 500.
+func classifyError(err error) (int, string) {
+	var httpErr *HTTPError
+	var validationErrs validator.ValidationErrors
+	var dailyLimitErr *DailyLimitError
+	var perTransferLimitErr *PerTransferLimitError
+	switch {
+	case errors.As(err, &httpErr):
+		if httpErr.Code != "" {
+			return httpErr.Status, httpErr.Code
+		}
+		return httpErr.Status, statusCode(httpErr.Status)
+	case errors.As(err, &validationErrs):
+		return http.StatusUnprocessableEntity, "VALIDATION_FAILED"
+	case errors.As(err, &dailyLimitErr):
+		return http.StatusUnprocessableEntity, "DAILY_LIMIT_EXCEEDED"
+	case errors.As(err, &perTransferLimitErr):
+		return http.StatusUnprocessableEntity, "PER_TRANSFER_LIMIT_EXCEEDED"
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.status, e.code
+		}
+	}
+	return http.StatusInternalServerError, statusCode(http.StatusInternalServerError)
+}
+
+// errorStatus picks the response status for an error returned by a handler.
+func errorStatus(err error) int {
+	status, _ := classifyError(err)
+	return status
+}
+
+// statusCode names status as an error code, e.g. NOT_FOUND for 404.
+func statusCode(status int) string {
+	return strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// APIError is the body of an error response: an RFC 7807 problem details
+// object, sent as application/problem+json, with the machine-readable Code
+// as an extension member. Error repeats Detail for clients written against
+// the bodies from before problem details.
+type APIError struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Code   string `json:"code"`
+	Error  string `json:"error"`
+}
+
+func newAPIError(status int, code, detail string) APIError {
+	return APIError{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+		Error:  detail,
+	}
+}
+
+// writeError answers with the status and code classifyError picks for err.
+// Validation failures list every invalid field, broken transfer limits say
+// how much is left, and internal errors are not echoed to the client.
+func writeError(w http.ResponseWriter, err error) error {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		for key, values := range httpErr.Headers {
+			w.Header()[key] = append([]string(nil), values...)
+		}
+	}
+	status, code := classifyError(err)
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return writeValidationErrors(w, err)
+	}
+	if resp, ok := limitExceeded(err); ok {
+		resp.APIError = newAPIError(status, code, err.Error())
+		return writeProblem(w, status, resp)
+	}
+	if status == http.StatusInternalServerError {
+		return writeProblem(w, status, newAPIError(status, code, "server error"))
+	}
+	return writeProblem(w, status, newAPIError(status, code, err.Error()))
+}
+
+// writeProblem writes v, a problem details object, with status.
+func writeProblem(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// limitExceeded describes err when it is a broken transfer limit.
+func limitExceeded(err error) (LimitExceededResponse, bool) {
+	var dailyLimitErr *DailyLimitError
+	if errors.As(err, &dailyLimitErr) {
+		return LimitExceededResponse{Limit: LimitDaily, Max: dailyLimitErr.Limit, Remaining: dailyLimitErr.Remaining}, true
+	}
+	var perTransferLimitErr *PerTransferLimitError
+	if errors.As(err, &perTransferLimitErr) {
+		return LimitExceededResponse{Limit: LimitPerTransfer, Max: perTransferLimitErr.Limit, Remaining: perTransferLimitErr.Limit}, true
+	}
+	return LimitExceededResponse{}, false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	validationErr := validate.Struct(LoginRequest{})
+	require.NotNil(t, validationErr)
+
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{badRequest("bad"), http.StatusBadRequest, "BAD_REQUEST"},
+		{unauthorized("WHO_ARE_YOU", "who are you"), http.StatusUnauthorized, "WHO_ARE_YOU"},
+		{forbidden("NO", "no"), http.StatusForbidden, "NO"},
+		{&HTTPError{Status: http.StatusRequestEntityTooLarge}, http.StatusRequestEntityTooLarge, "REQUEST_ENTITY_TOO_LARGE"},
+		{validationErr, http.StatusUnprocessableEntity, "VALIDATION_FAILED"},
+		{ErrAccountNotFound, http.StatusNotFound, "ACCOUNT_NOT_FOUND"},
+		{fmt.Errorf("lookup: %w", ErrAccountNotFound), http.StatusNotFound, "ACCOUNT_NOT_FOUND"},
+		{ErrAccountExists, http.StatusConflict, "ACCOUNT_EXISTS"},
+		{ErrConflict, http.StatusConflict, "CONCURRENT_MODIFICATION"},
+		{ErrAccountFrozen, http.StatusForbidden, "ACCOUNT_FROZEN"},
+		{ErrInsufficientFunds, http.StatusUnprocessableEntity, "INSUFFICIENT_FUNDS"},
+		{ErrOverdraftLimitExceeded, http.StatusUnprocessableEntity, "OVERDRAFT_LIMIT_EXCEEDED"},
+		{&DailyLimitError{Limit: 10}, http.StatusUnprocessableEntity, "DAILY_LIMIT_EXCEEDED"},
+		{&PerTransferLimitError{Limit: 10}, http.StatusUnprocessableEntity, "PER_TRANSFER_LIMIT_EXCEEDED"},
+		{ErrVerificationTokenInvalid, http.StatusBadRequest, "VERIFICATION_TOKEN_INVALID"},
+		{ErrPasswordResetTokenInvalid, http.StatusBadRequest, "PASSWORD_RESET_TOKEN_INVALID"},
+		{ErrPasskeySessionInvalid, http.StatusBadRequest, "PASSKEY_SESSION_INVALID"},
+		{ErrPasskeyNotFound, http.StatusNotFound, "PASSKEY_NOT_FOUND"},
+		{ErrAPIKeyNotFound, http.StatusNotFound, "API_KEY_NOT_FOUND"},
+		{ErrSessionNotFound, http.StatusNotFound, "SESSION_NOT_FOUND"},
+		{ErrPasskeyExists, http.StatusConflict, "PASSKEY_EXISTS"},
+		{ErrRefreshTokenReused, http.StatusUnauthorized, "REFRESH_TOKEN_INVALID"},
+		{errors.New("connection refused"), http.StatusInternalServerError, "INTERNAL_SERVER_ERROR"},
+	}
+	for _, tt := range tests {
+		status, code := classifyError(tt.err)
+		assert.Equal(t, tt.status, status, tt.err.Error())
+		assert.Equal(t, tt.code, code, tt.err.Error())
+		assert.Equal(t, tt.status, errorStatus(tt.err), tt.err.Error())
+	}
+}
+
+func TestWriteErrorHidesInternalErrors(t *testing.T) {
+	rec := httptest.NewRecorder()
+	require.Nil(t, writeError(rec, errors.New("pq: password authentication failed")))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"server error","code":"INTERNAL_SERVER_ERROR","error":"server error"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	require.Nil(t, writeError(rec, errInvalidToken))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestWriteErrorDescribesBrokenLimits(t *testing.T) {
+	rec := httptest.NewRecorder()
+	require.Nil(t, writeError(rec, fmt.Errorf("transfer: %w", &DailyLimitError{Limit: 100, Remaining: 40})))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Unprocessable Entity","status":422,"code":"DAILY_LIMIT_EXCEEDED",
+		"detail":"transfer: daily limit exceeded: 40 of 100 remaining in the last 24h","error":"transfer: daily limit exceeded: 40 of 100 remaining in the last 24h",
+		"limit":"daily","max":100,"remaining":40}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	require.Nil(t, writeError(rec, &PerTransferLimitError{Limit: 50}))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Unprocessable Entity","status":422,"code":"PER_TRANSFER_LIMIT_EXCEEDED",
+		"detail":"per-transfer limit exceeded: at most 50 per transfer","error":"per-transfer limit exceeded: at most 50 per transfer",
+		"limit":"per_transfer","max":50,"remaining":50}`, rec.Body.String())
+}
+
+// failingStore fails every account lookup as an unreachable database would.
+type failingStore struct {
+	Storage
+}
+
+func (failingStore) GetAccountByID(context.Context, int) (*Account, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestHandlerErrorStatuses(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	other, err := NewAccount("c", "d", "other@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), other))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	rec := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: 1, Amount: 10}, header)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "unknown account number")
+
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: other.Number, Amount: 10}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "insufficient funds")
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	var problem APIError
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&problem))
+	assert.Equal(t, "INSUFFICIENT_FUNDS", problem.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, problem.Status)
+
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "validation")
+
+	rec = doJSON(t, router, "PUT", fmt.Sprintf("/api/v1/account/%d", acc.ID), UpdateAccountRequest{FirstName: "x", LastName: "y", Version: acc.Version + 5}, header)
+	assert.Equal(t, http.StatusConflict, rec.Code, "stale version")
+
+	rec = doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{FirstName: "a", LastName: "b", Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, "duplicate email")
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "wrong1234"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "wrong password")
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d", other.ID), nil, header)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "another customer's account")
+
+	server.store = failingStore{server.store}
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d", acc.ID), nil, header)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "connection refused")
+}
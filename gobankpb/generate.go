@@ -0,0 +1,5 @@
+// Package gobankpb holds the protobuf messages and gRPC service generated
+// from gobank.proto.
+package gobankpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gobank.proto
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/praxpk/gobank/gobankpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer exposes the core operations of APIServer over gRPC, backed by
+// the same store, token signing and events as the JSON API.
+type grpcServer struct {
+	gobankpb.UnimplementedGoBankServer
+	api *APIServer
+}
+
+// grpcPublicMethods can be called without a token.
+var grpcPublicMethods = map[string]bool{
+	gobankpb.GoBank_Login_FullMethodName:         true,
+	gobankpb.GoBank_CreateAccount_FullMethodName: true,
+}
+
+// grpcAuthInterceptor validates the JWT in the "authorization" metadata and
+// stores its claims in the context, as withJWTAuth does for HTTP.
+func (s *APIServer) grpcAuthInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if grpcPublicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || len(values[0]) < 7 || strings.ToUpper(values[0][:7]) != "BEARER " {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	claims, err := s.authenticate(ctx, values[0][7:])
+	if errors.Is(err, errInvalidToken) {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return handler(context.WithValue(ctx, claimsKey, claims), req)
+}
+
+// newGRPCServer returns a gRPC server with the GoBank service registered.
+func (s *APIServer) newGRPCServer() *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(s.grpcAuthInterceptor))
+	gobankpb.RegisterGoBankServer(server, &grpcServer{api: s})
+	return server
+}
+
+// serveGRPC answers gRPC calls on ln until ctx is done.
+func (s *APIServer) serveGRPC(ctx context.Context, ln net.Listener) error {
+	server := s.newGRPCServer()
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	return server.Serve(ln)
+}
+
+// grpcError maps store errors to gRPC status codes. Anything unrecognised is
+// reported as Internal without its details.
+func grpcError(err error) error {
+	var httpErr *HTTPError
+	switch {
+	case errors.As(err, &httpErr) && httpErr.Status == http.StatusTooManyRequests:
+		return status.Error(codes.ResourceExhausted, httpErr.Message)
+	case errors.Is(err, ErrAccountNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrAccountExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrAccountFrozen):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrCurrencyMismatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.As(err, new(*DailyLimitError)), errors.As(err, new(*PerTransferLimitError)):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, "server error")
+	}
+}
+
+// peerIP is the client IP of a gRPC call, like clientIP is for HTTP.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// peerUserAgent returns the user agent the gRPC client sent, if any.
+func peerUserAgent(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ua := md.Get("user-agent"); len(ua) > 0 {
+		return ua[0]
+	}
+	return ""
+}
+
+func (g *grpcServer) Login(ctx context.Context, req *gobankpb.LoginRequest) (*gobankpb.LoginResponse, error) {
+	loginReq := LoginRequest{Email: normalizeEmail(req.GetEmail()), Password: req.GetPassword()}
+	if err := validate.Struct(loginReq); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ip := peerIP(ctx)
+	if err := g.api.checkLoginLock(ctx, loginReq.Email, ip); err != nil {
+		return nil, grpcError(err)
+	}
+	acc, err := g.api.store.GetAccountByEmail(ctx, loginReq.Email)
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		return nil, grpcError(err)
+	}
+	if err != nil || !validatePassword(loginReq.Password, acc.EncryptedPassword) {
+		if err == nil {
+			g.api.recordLogin(ctx, acc, ip, peerUserAgent(ctx), LoginResultFailure)
+		}
+		failed := status.Error(codes.Unauthenticated, "incorrect email or password")
+		if err := g.api.loginFailed(ctx, loginReq.Email, ip, acc, failed); err != failed {
+			return nil, grpcError(err)
+		}
+		return nil, failed
+	}
+	// Accounts with two-factor authentication log in over HTTP, which clears
+	// their failures once the second factor is checked.
+	if !acc.TOTPEnabled {
+		if err := g.api.store.ClearLoginFailures(ctx, loginEmailKeyPrefix+loginReq.Email); err != nil {
+			return nil, grpcError(err)
+		}
+	}
+	g.api.rehashPassword(ctx, acc, loginReq.Password)
+	if !acc.EmailVerified {
+		return nil, status.Error(codes.PermissionDenied, "email address not verified, follow the link sent at signup")
+	}
+	if acc.TOTPEnabled {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is enabled, log in over HTTP")
+	}
+	token, expiresAt, err := createJWT(acc)
+	if err != nil {
+		g.api.logger.ErrorContext(ctx, "could not sign token", "account_id", acc.ID, "error", err)
+		return nil, status.Error(codes.Internal, "server error")
+	}
+	g.api.logger.InfoContext(ctx, "login succeeded", "account_id", acc.ID, "transport", "grpc")
+	g.api.recordLogin(ctx, acc, ip, peerUserAgent(ctx), LoginResultSuccess)
+	return &gobankpb.LoginResponse{
+		Token:     token,
+		AccountId: int64(acc.ID),
+		ExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
+
+func (g *grpcServer) CreateAccount(ctx context.Context, req *gobankpb.CreateAccountRequest) (*gobankpb.Account, error) {
+	createReq := CreateAccountRequest{
+		FirstName: req.GetFirstName(),
+		LastName:  req.GetLastName(),
+		Email:     normalizeEmail(req.GetEmail()),
+		Password:  req.GetPassword(),
+		Currency:  req.GetCurrency(),
+	}
+	if err := validate.Struct(createReq); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	account, err := NewAccount(createReq.FirstName, createReq.LastName, createReq.Email, createReq.Password)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if createReq.Currency != "" {
+		account.Currency = createReq.Currency
+	}
+	if err := g.api.store.CreateAccount(ctx, account); err != nil {
+		return nil, grpcError(err)
+	}
+	g.api.logger.InfoContext(ctx, "account created", "account_id", account.ID, "transport", "grpc")
+	if err := g.api.sendVerification(ctx, account); err != nil {
+		g.api.logger.ErrorContext(ctx, "could not send verification email", "account_id", account.ID, "error", err)
+	}
+	g.api.events.Dispatch(Event{Type: EventAccountCreated, AccountID: account.ID, Timestamp: account.CreatedAt})
+	return accountToProto(account), nil
+}
+
+// GetAccount returns the caller's own account, or any account for admins.
+func (g *grpcServer) GetAccount(ctx context.Context, req *gobankpb.GetAccountRequest) (*gobankpb.Account, error) {
+	claims, _ := claimsFromContext(ctx)
+	if claims.Role != RoleAdmin && req.GetId() != int64(claims.AccountID) {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+	account, err := g.api.store.GetAccountByID(ctx, int(req.GetId()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return accountToProto(account), nil
+}
+
+// Transfer moves money from the caller's account to the account numbered
+// to_account.
+func (g *grpcServer) Transfer(ctx context.Context, req *gobankpb.TransferRequest) (*gobankpb.Transaction, error) {
+	tr := TransferRequest{ToAccount: req.GetToAccount(), Amount: req.GetAmount()}
+	if err := validate.Struct(tr); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	fromID, _ := accountIDFromContext(ctx)
+	to, err := g.api.store.GetAccountByNumber(ctx, tr.ToAccount)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	debit, err := g.api.store.Transfer(ctx, fromID, to.ID, tr.Amount)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	g.api.logger.InfoContext(ctx, "transfer completed", "account_id", fromID, "to_account_id", to.ID, "amount", tr.Amount, "transport", "grpc")
+	g.api.events.Dispatch(Event{
+		Type:                  EventTransferCompleted,
+		AccountID:             fromID,
+		CounterpartyAccountID: &to.ID,
+		Amount:                tr.Amount,
+		Timestamp:             debit.CreatedAt,
+	})
+	return transactionToProto(debit), nil
+}
+
+func accountToProto(acc *Account) *gobankpb.Account {
+	return &gobankpb.Account{
+		Id:            int64(acc.ID),
+		Number:        acc.Number,
+		FirstName:     acc.FirstName,
+		LastName:      acc.LastName,
+		Email:         acc.Email,
+		Balance:       acc.Balance,
+		Currency:      acc.Currency,
+		Role:          acc.Role,
+		Status:        acc.Status,
+		EmailVerified: acc.EmailVerified,
+		CreatedAt:     timestamppb.New(acc.CreatedAt),
+	}
+}
+
+func transactionToProto(tx *Transaction) *gobankpb.Transaction {
+	pb := &gobankpb.Transaction{
+		Id:        int64(tx.ID),
+		AccountId: int64(tx.AccountID),
+		Type:      tx.Type,
+		Amount:    tx.Amount,
+		CreatedAt: timestamppb.New(tx.CreatedAt),
+	}
+	if tx.CounterpartyAccountID != nil {
+		pb.CounterpartyAccountId = int64(*tx.CounterpartyAccountID)
+	}
+	return pb
+}
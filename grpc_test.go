@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/praxpk/gobank/gobankpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGRPCClient serves server over an in-process bufconn listener and
+// returns a client connected to it.
+func newTestGRPCClient(t *testing.T, server *APIServer) gobankpb.GoBankClient {
+	ln := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.serveGRPC(ctx, ln)
+	}()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		<-done
+	})
+	return gobankpb.NewGoBankClient(conn)
+}
+
+func TestGRPCGetAccount(t *testing.T) {
+	server, _ := newTestServer(t)
+	mailer := &fakeMailer{tokens: map[string]string{}}
+	server.mailer = mailer
+	client := newTestGRPCClient(t, server)
+	ctx := context.Background()
+
+	created, err := client.CreateAccount(ctx, &gobankpb.CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "abc@abc.com",
+		Password:  "password123",
+	})
+	require.Nil(t, err)
+	other, err := NewAccount("c", "d", "other@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), other))
+
+	_, err = client.GetAccount(ctx, &gobankpb.GetAccountRequest{Id: created.Id})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.Login(ctx, &gobankpb.LoginRequest{Email: "abc@abc.com", Password: "password123"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "email is not verified yet")
+
+	_, err = server.store.ConsumeVerificationToken(context.Background(), hashOpaqueToken(mailer.tokens["abc@abc.com"]))
+	require.Nil(t, err)
+	login, err := client.Login(ctx, &gobankpb.LoginRequest{Email: "abc@abc.com", Password: "password123"})
+	require.Nil(t, err)
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+login.Token)
+
+	got, err := client.GetAccount(authCtx, &gobankpb.GetAccountRequest{Id: created.Id})
+	require.Nil(t, err)
+	assert.Equal(t, "abc@abc.com", got.Email)
+	assert.Equal(t, created.Number, got.Number)
+	assert.Equal(t, DefaultCurrency, got.Currency)
+
+	_, err = client.GetAccount(authCtx, &gobankpb.GetAccountRequest{Id: int64(other.ID)})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
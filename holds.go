@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+)
+
+// ErrHoldNotFound is returned when no hold of the account matches a lookup.
+var ErrHoldNotFound = errors.New("hold not found")
+
+// ErrHoldNotActive is returned by CaptureHold and ReleaseHold once the hold
+// has already been captured or released.
+var ErrHoldNotActive = errors.New("hold is no longer active")
+
+// Hold reserves Amount of an account's balance for a transfer to ToAccountID.
+// While active the amount counts against the available balance but not the
+// booked one. Capturing the hold makes the transfer, releasing it frees the
+// amount again.
+type Hold struct {
+	ID          int    `json:"id"`
+	AccountID   int    `json:"accountId"`
+	ToAccountID int    `json:"toAccountId"`
+	Amount      int64  `json:"amount"`
+	Status      string `json:"status"`
+	// TransactionID is the sender's debit once the hold has been captured.
+	TransactionID *int      `json:"transactionId,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type HoldRequest struct {
+	// ToAccount is the account number the held money is for.
+	ToAccount int64 `json:"toAccount" validate:"required"`
+	Amount    int64 `json:"amount" validate:"required,min=1"`
+}
+
+type HoldsPage struct {
+	Holds  []*Hold `json:"holds"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+}
+
+// resolve moves an active hold to status, captured or released.
+func (h *Hold) resolve(status string, now time.Time) error {
+	if h.Status != HoldActive {
+		return fmt.Errorf("%w: hold %d is %s", ErrHoldNotActive, h.ID, h.Status)
+	}
+	h.Status = status
+	h.UpdatedAt = now
+	return nil
+}
+
+// checkHold checks that acc can reserve amount: it must not be frozen and
+// its available balance must cover the amount.
+func checkHold(acc *Account, amount int64) error {
+	if acc.Status == AccountStatusFrozen {
+		return fmt.Errorf("%w: id %d", ErrAccountFrozen, acc.ID)
+	}
+	return checkFunds(acc, amount)
+}
+
+// handleGetHolds lists an account's holds.
+func (s *APIServer) handleGetHolds(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	limit, offset, err := getPaginationFromRequest(r)
+	if err != nil {
+		return err
+	}
+	holds, err := s.store.GetHolds(r.Context(), id, limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, HoldsPage{Holds: holds, Limit: limit, Offset: offset})
+}
+
+// handleCreateHold reserves money of the account for a later transfer to
+// the account numbered req.ToAccount.
+func (s *APIServer) handleCreateHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	req := new(HoldRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	to, err := s.store.GetAccountByNumber(r.Context(), req.ToAccount)
+	if err != nil {
+		return err
+	}
+	if to.ID == id {
+		return badRequest("cannot hold money for the same account")
+	}
+	now := s.now().UTC()
+	hold := &Hold{
+		AccountID:   id,
+		ToAccountID: to.ID,
+		Amount:      req.Amount,
+		Status:      HoldActive,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := s.store.CreateHold(r.Context(), hold); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "hold placed", "hold_id", hold.ID, "account_id", id, "to_account_id", to.ID, "amount", hold.Amount)
+	return WriteJSON(w, http.StatusCreated, hold)
+}
+
+// handleCaptureHold makes the transfer an active hold reserved money for.
+func (s *APIServer) handleCaptureHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	holdID, err := getPositiveIntVar(r, "holdID")
+	if err != nil {
+		return err
+	}
+	hold, err := s.store.CaptureHold(r.Context(), id, holdID)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "hold captured", "hold_id", hold.ID, "account_id", id, "to_account_id", hold.ToAccountID, "amount", hold.Amount)
+	s.events.Dispatch(Event{
+		Type:                  EventTransferCompleted,
+		AccountID:             hold.AccountID,
+		CounterpartyAccountID: &hold.ToAccountID,
+		Amount:                hold.Amount,
+		Timestamp:             hold.UpdatedAt,
+	})
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+// handleReleaseHold frees the money an active hold reserved.
+func (s *APIServer) handleReleaseHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	holdID, err := getPositiveIntVar(r, "holdID")
+	if err != nil {
+		return err
+	}
+	hold, err := s.store.ReleaseHold(r.Context(), id, holdID)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "hold released", "hold_id", hold.ID, "account_id", id, "amount", hold.Amount)
+	return WriteJSON(w, http.StatusOK, hold)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHoldResolve(t *testing.T) {
+	now := time.Now().UTC()
+	h := &Hold{ID: 1, Status: HoldActive}
+	require.Nil(t, h.resolve(HoldReleased, now))
+	assert.Equal(t, HoldReleased, h.Status)
+	assert.Equal(t, now, h.UpdatedAt)
+	assert.ErrorIs(t, h.resolve(HoldCaptured, now), ErrHoldNotActive)
+}
+
+func TestHolds(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	for _, acc := range []*Account{from, to} {
+		require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	}
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	path := fmt.Sprintf("/api/v1/account/%d/holds", from.ID)
+
+	rec := doJSON(t, router, "POST", path, HoldRequest{ToAccount: from.Number, Amount: 10}, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "hold for the same account")
+	rec = doJSON(t, router, "POST", path, HoldRequest{ToAccount: to.Number, Amount: 101}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, HoldRequest{ToAccount: to.Number, Amount: 70}, header)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var hold Hold
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&hold))
+	assert.Equal(t, HoldActive, hold.Status)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/balance", from.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var balance BalanceResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&balance))
+	assert.Equal(t, int64(100), balance.Balance)
+	assert.Equal(t, int64(30), balance.Available)
+	assert.Equal(t, int64(70), balance.Held)
+
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 31}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "transfers may only spend the available balance")
+
+	rec = doJSON(t, router, "POST", fmt.Sprintf("%s/%d/capture", path, hold.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&hold))
+	assert.Equal(t, HoldCaptured, hold.Status)
+	assert.NotNil(t, hold.TransactionID)
+
+	rec = doJSON(t, router, "POST", fmt.Sprintf("%s/%d/release", path, hold.ID), nil, header)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doJSON(t, router, "POST", fmt.Sprintf("%s/%d/release", path, hold.ID+1), nil, header)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doJSON(t, router, "GET", path, nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page HoldsPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Holds, 1)
+
+	toAfter, err := server.store.GetAccountByID(context.Background(), to.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(70), toAfter.Balance)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// maxImportAccounts caps how many accounts one import may open. Every
+// password is hashed before anything is stored, which bounds the request
+// more than the database does.
+const maxImportAccounts = 1000
+
+// maxImportBodyBytes caps the size of an import, JSON or CSV.
+const maxImportBodyBytes = 10 << 20
+
+// accountImportCSVHeader names the columns an import CSV may have, in any
+// order. currency is optional and defaults to DefaultCurrency.
+var accountImportCSVHeader = []string{"first_name", "last_name", "email", "password", "currency"}
+
+// ImportAccountsResponse reports an import. Errors lists only the rows that
+// failed, by their index among the imported records; when it is not empty
+// nothing was imported.
+type ImportAccountsResponse struct {
+	Imported int               `json:"imported"`
+	Errors   []BatchItemResult `json:"errors,omitempty"`
+}
+
+// handleImportAccounts opens accounts migrated from another system, sent as
+// a JSON array of CreateAccountRequest or, with Content-Type text/csv, as CSV
+// with a header row of accountImportCSVHeader columns. Like a batch it stores
+// every account or none, but it takes up to maxImportAccounts and reports
+// only the rows that failed.
+func (s *APIServer) handleImportAccounts(w http.ResponseWriter, r *http.Request) error {
+	reqs, err := decodeAccountImport(w, r)
+	if err != nil {
+		return err
+	}
+	if len(reqs) == 0 || len(reqs) > maxImportAccounts {
+		return badRequest("import must contain between 1 and %d accounts", maxImportAccounts)
+	}
+
+	var failures []BatchItemResult
+	for i := range reqs {
+		reqs[i].Email = normalizeEmail(reqs[i].Email)
+		if err := validate.Struct(&reqs[i]); err != nil {
+			failures = append(failures, BatchItemResult{Index: i, Status: BatchItemInvalid, Fields: validationMessages(err)})
+		}
+	}
+	if len(failures) > 0 {
+		return WriteJSON(w, http.StatusUnprocessableEntity, ImportAccountsResponse{Errors: failures})
+	}
+
+	accounts, err := newAccounts(reqs)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateAccounts(r.Context(), accounts); err != nil {
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			return err
+		}
+		return WriteJSON(w, errorStatus(err), ImportAccountsResponse{Errors: []BatchItemResult{{
+			Index:  batchErr.Index,
+			Status: BatchItemFailed,
+			Error:  batchErr.Err.Error(),
+		}}})
+	}
+
+	for _, account := range accounts {
+		s.events.Dispatch(Event{Type: EventAccountCreated, AccountID: account.ID, Timestamp: account.CreatedAt})
+		if err := s.sendVerification(r.Context(), account); err != nil {
+			s.logger.ErrorContext(r.Context(), "could not send verification email", "account_id", account.ID, "error", err)
+		}
+	}
+	s.logger.InfoContext(r.Context(), "accounts imported", "count", len(accounts))
+	return WriteJSON(w, http.StatusOK, ImportAccountsResponse{Imported: len(accounts)})
+}
+
+// decodeAccountImport reads the accounts of an import from JSON or CSV,
+// depending on the request's Content-Type.
+func decodeAccountImport(w http.ResponseWriter, r *http.Request) ([]CreateAccountRequest, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/csv" {
+		var reqs []CreateAccountRequest
+		if err := decodeJSONLimit(w, r, &reqs, maxImportBodyBytes); err != nil {
+			return nil, err
+		}
+		return reqs, nil
+	}
+
+	cr := csv.NewReader(http.MaxBytesReader(w, r.Body, maxImportBodyBytes))
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, badRequest("request body must not be empty")
+	}
+	if err != nil {
+		return nil, csvImportError(err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if !slices.Contains(accountImportCSVHeader, name) {
+			return nil, badRequest("unknown CSV column %q, expected some of %v", name, accountImportCSVHeader)
+		}
+		columns[name] = i
+	}
+	for _, name := range accountImportCSVHeader[:4] {
+		if _, ok := columns[name]; !ok {
+			return nil, badRequest("CSV column %q is required", name)
+		}
+	}
+
+	var reqs []CreateAccountRequest
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return reqs, nil
+		}
+		if err != nil {
+			return nil, csvImportError(err)
+		}
+		if len(reqs) == maxImportAccounts {
+			return nil, badRequest("import must contain between 1 and %d accounts", maxImportAccounts)
+		}
+		req := CreateAccountRequest{
+			FirstName: record[columns["first_name"]],
+			LastName:  record[columns["last_name"]],
+			Email:     record[columns["email"]],
+			Password:  record[columns["password"]],
+		}
+		if i, ok := columns["currency"]; ok {
+			req.Currency = record[i]
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+// csvImportError turns a failure reading an import CSV into the error to
+// answer with.
+func csvImportError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &HTTPError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("request body must not exceed %d bytes", maxImportBodyBytes),
+		}
+	}
+	return badRequest("malformed CSV: %v", err)
+}
+
+// newAccounts builds an account for each of reqs, hashing the passwords on
+// every CPU as they dominate the time an import takes.
+func newAccounts(reqs []CreateAccountRequest) ([]*Account, error) {
+	accounts := make([]*Account, len(reqs))
+	errs := make([]error, len(reqs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < runtime.GOMAXPROCS(0); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				req := reqs[i]
+				accounts[i], errs[i] = NewAccount(req.FirstName, req.LastName, req.Email, req.Password)
+				if errs[i] == nil && req.Currency != "" {
+					accounts[i].Currency = req.Currency
+				}
+			}
+		}()
+	}
+	for i := range reqs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportAccounts(t *testing.T) {
+	server, router := newTestServer(t)
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	token, _, err := createJWT(admin)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	importCSV := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/account/import", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := doJSON(t, router, "POST", "/api/v1/account/import", []CreateAccountRequest{
+		{FirstName: "a", LastName: "b", Email: "One@abc.com", Password: "password123", Currency: "EUR"},
+		{FirstName: "a", LastName: "b", Email: "two@abc.com", Password: "password123"},
+	}, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"imported":2}`, rec.Body.String())
+	one, err := server.store.GetAccountByEmail(context.Background(), "one@abc.com")
+	require.Nil(t, err)
+	assert.Equal(t, "EUR", one.Currency)
+
+	rec = importCSV("email,password,last_name,first_name\nthree@abc.com,password123,Smith,Carol\nfour@abc.com,password123,Jones,Dan\n")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"imported":2}`, rec.Body.String())
+	three, err := server.store.GetAccountByEmail(context.Background(), "three@abc.com")
+	require.Nil(t, err)
+	assert.Equal(t, "Carol", three.FirstName)
+	assert.Equal(t, DefaultCurrency, three.Currency)
+	assert.True(t, validatePassword("password123", three.EncryptedPassword))
+
+	rec = importCSV("first_name,last_name,email,password\na,b,five@abc.com,password123\na,b,not-an-email,password123\na,b,six@abc.com,short\n")
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code, rec.Body.String())
+	var resp ImportAccountsResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Errors, 2, "only failed rows are reported")
+	assert.Equal(t, 1, resp.Errors[0].Index)
+	assert.Contains(t, resp.Errors[0].Fields, "email")
+	assert.Equal(t, 2, resp.Errors[1].Index)
+	assert.Contains(t, resp.Errors[1].Fields, "password")
+
+	rec = importCSV("first_name,last_name,email,password\na,b,five@abc.com,password123\na,b,two@abc.com,password123\n")
+	require.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+	resp = ImportAccountsResponse{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, 1, resp.Errors[0].Index)
+	assert.Equal(t, BatchItemFailed, resp.Errors[0].Status)
+	_, err = server.store.GetAccountByEmail(context.Background(), "five@abc.com")
+	assert.ErrorIs(t, err, ErrAccountNotFound, "nothing is imported when a row fails")
+
+	for _, body := range []string{"", "first_name,last_name,email\na,b,c@abc.com\n", "first_name,last_name,email,password,balance\n", "first_name,last_name,email,password\na,b\n"} {
+		rec = importCSV(body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+
+	user, err := NewAccount("a", "b", "user@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), user))
+	userToken, _, err := createJWT(user)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", "/api/v1/account/import", []CreateAccountRequest{{FirstName: "a", LastName: "b", Email: "seven@abc.com", Password: "password123"}}, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// AccountClaims are the claims carried by the access tokens we issue.
+type AccountClaims struct {
+	AccountID int    `json:"accountId"`
+	Role      string `json:"role"`
+	// Purpose is empty for access tokens. Tokens issued for anything else,
+	// such as twoFactorChallengePurpose, must not be accepted as access
+	// tokens.
+	Purpose string `json:"purpose,omitempty"`
+	// SessionID is the session an access token was issued to, or 0 for
+	// tokens that do not belong to one.
+	SessionID int `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// defaultAccessTokenTTL is how long tokens from createJWT stay valid unless
+// configured otherwise.
+const defaultAccessTokenTTL = 15 * time.Minute
+
+const (
+	defaultJWTIssuer   = "gobank"
+	defaultJWTAudience = "gobank-api"
+)
+
+// jwtKeySet is the algorithm and keys tokens are signed and verified with,
+// and the issuer and audience they must carry. Asymmetric keys are named by
+// their JWK thumbprint, which signed tokens carry in the kid header.
+type jwtKeySet struct {
+	method  jwt.SigningMethod
+	signKey crypto.Signer
+	keyID   string
+	// verifyKeys holds the public key of signKey and of any retired signing
+	// keys whose tokens are still accepted, by key id.
+	verifyKeys map[string]crypto.PublicKey
+	issuer     string
+	audience   string
+	accessTTL  time.Duration
+}
+
+// jwtKeys defaults to HS256 with the shared secret in JWT_SECRET.
+var jwtKeys = &jwtKeySet{
+	method:    jwt.SigningMethodHS256,
+	issuer:    defaultJWTIssuer,
+	audience:  defaultJWTAudience,
+	accessTTL: defaultAccessTokenTTL,
+}
+
+// configureJWT selects the signing algorithm from cfg, loading the PEM keys
+// when RS256 is chosen.
+func configureJWT(cfg *Config) error {
+	keys, err := loadJWTKeys(cfg)
+	if err != nil {
+		return err
+	}
+	jwtKeys = keys
+	return nil
+}
+
+func loadJWTKeys(cfg *Config) (*jwtKeySet, error) {
+	keys, err := loadSigningKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	keys.issuer, keys.audience, keys.accessTTL = defaultJWTIssuer, defaultJWTAudience, defaultAccessTokenTTL
+	if cfg.JWTIssuer != "" {
+		keys.issuer = cfg.JWTIssuer
+	}
+	if cfg.JWTAudience != "" {
+		keys.audience = cfg.JWTAudience
+	}
+	if cfg.AccessTokenTTL != 0 {
+		keys.accessTTL = cfg.AccessTokenTTL
+	}
+	return keys, nil
+}
+
+func loadSigningKeys(cfg *Config) (*jwtKeySet, error) {
+	var method jwt.SigningMethod
+	switch cfg.JWTAlgorithm {
+	case "", jwt.SigningMethodHS256.Alg():
+		if len(cfg.JWTPreviousPublicKeyFiles) > 0 {
+			return nil, fmt.Errorf("jwtPreviousPublicKeyFiles need an RS256 or ES256 signing key")
+		}
+		return &jwtKeySet{method: jwt.SigningMethodHS256}, nil
+	case jwt.SigningMethodRS256.Alg():
+		method = jwt.SigningMethodRS256
+	case jwt.SigningMethodES256.Alg():
+		method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm %q", cfg.JWTAlgorithm)
+	}
+
+	pem, err := os.ReadFile(cfg.JWTPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read jwt private key: %v", err)
+	}
+	var signKey crypto.Signer
+	if method == jwt.SigningMethodRS256 {
+		signKey, err = jwt.ParseRSAPrivateKeyFromPEM(pem)
+	} else {
+		signKey, err = jwt.ParseECPrivateKeyFromPEM(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse jwt private key: %v", err)
+	}
+	verifyKey := signKey.Public()
+	if cfg.JWTPublicKeyFile != "" {
+		if verifyKey, err = readJWTPublicKey(cfg.JWTPublicKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if jwtMethodFor(verifyKey) != method {
+		return nil, fmt.Errorf("jwt key does not suit %s", method.Alg())
+	}
+	keyID, err := jwkThumbprint(verifyKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := &jwtKeySet{method: method, signKey: signKey, keyID: keyID, verifyKeys: map[string]crypto.PublicKey{keyID: verifyKey}}
+	for _, path := range cfg.JWTPreviousPublicKeyFiles {
+		key, err := readJWTPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		id, err := jwkThumbprint(key)
+		if err != nil {
+			return nil, err
+		}
+		keys.verifyKeys[id] = key
+	}
+	return keys, nil
+}
+
+// readJWTPublicKey reads a PEM encoded RSA or P-256 public key.
+func readJWTPublicKey(path string) (crypto.PublicKey, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read jwt public key: %v", err)
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+	key, err := jwt.ParseECPublicKeyFromPEM(pem)
+	if err != nil || jwtMethodFor(key) == nil {
+		return nil, fmt.Errorf("unable to parse jwt public key %s: not an RSA or P-256 key", path)
+	}
+	return key, nil
+}
+
+// jwtMethodFor returns the algorithm tokens signed by key's private key use,
+// or nil for unsupported keys.
+func jwtMethodFor(key crypto.PublicKey) jwt.SigningMethod {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return jwt.SigningMethodES256
+		}
+	}
+	return nil
+}
+
+// jwk describes a public key as the members RFC 7517 defines for it.
+func jwk(key crypto.PublicKey) (map[string]string, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			break
+		}
+		return map[string]string{"kty": "EC", "crv": "P-256", "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}, nil
+	}
+	return nil, fmt.Errorf("unsupported jwt key type %T", key)
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of key, used as its key id. It
+// hashes the required members in lexicographic order, which is how
+// json.Marshal writes a map.
+func jwkThumbprint(key crypto.PublicKey) (string, error) {
+	members, err := jwk(key)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (k *jwtKeySet) signingKey() any {
+	if k.method == jwt.SigningMethodHS256 {
+		secret, err := secrets.Secret(jwtSecretName)
+		if err != nil {
+			return nil
+		}
+		return []byte(secret)
+	}
+	return k.signKey
+}
+
+// verifyingKey returns the key token must have been signed with: the shared
+// secret for HS256, or the secret it replaced when it has been rotated,
+// otherwise the key its kid names. Tokens without a kid,
+// signed before key ids were added, are checked against the current key.
+func (k *jwtKeySet) verifyingKey(token *jwt.Token) (any, error) {
+	if k.method == jwt.SigningMethodHS256 {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		secret, err := secrets.Secret(jwtSecretName)
+		if err != nil {
+			return nil, err
+		}
+		if cache, ok := secrets.(*secretCache); ok {
+			if previous := cache.previous(jwtSecretName); previous != "" {
+				return jwt.VerificationKeySet{Keys: []jwt.VerificationKey{[]byte(secret), []byte(previous)}}, nil
+			}
+		}
+		return []byte(secret), nil
+	}
+	keyID, _ := token.Header["kid"].(string)
+	if keyID == "" {
+		keyID = k.keyID
+	}
+	key, ok := k.verifyKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+	if jwtMethodFor(key) != token.Method {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return key, nil
+}
+
+// JSONWebKeySet is served at /.well-known/jwks.json so other services can
+// verify our tokens.
+type JSONWebKeySet struct {
+	Keys []map[string]string `json:"keys"`
+}
+
+// handleJWKS publishes the public keys tokens are verified with, including
+// retired keys whose tokens may still be in use. It is empty for HS256,
+// whose secret cannot be shared.
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	keys := jwtKeys
+	set := JSONWebKeySet{Keys: []map[string]string{}}
+	for id, key := range keys.verifyKeys {
+		members, err := jwk(key)
+		if err != nil {
+			return err
+		}
+		members["kid"] = id
+		members["alg"] = jwtMethodFor(key).Alg()
+		members["use"] = "sig"
+		set.Keys = append(set.Keys, members)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i]["kid"] < set.Keys[j]["kid"] })
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return WriteJSON(w, http.StatusOK, set)
+}
+
+// createJWT signs an access token for account and returns it with its expiry.
+func createJWT(account *Account) (string, time.Time, error) {
+	return signJWT(account, "", 0, jwtKeys.accessTTL)
+}
+
+// createSessionJWT is createJWT for a token that stops being accepted when
+// the session is revoked.
+func createSessionJWT(account *Account, sessionID int) (string, time.Time, error) {
+	return signJWT(account, "", sessionID, jwtKeys.accessTTL)
+}
+
+func signJWT(account *Account, purpose string, sessionID int, ttl time.Duration) (string, time.Time, error) {
+	keys := jwtKeys
+	id, err := newOpaqueToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	claims := &AccountClaims{
+		AccountID: account.ID,
+		Role:      account.Role,
+		Purpose:   purpose,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Issuer:    keys.issuer,
+			Subject:   strconv.Itoa(account.ID),
+			Audience:  jwt.ClaimStrings{keys.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(keys.method, claims)
+	if keys.keyID != "" {
+		token.Header["kid"] = keys.keyID
+	}
+
+	tokenString, err := token.SignedString(keys.signingKey())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt, nil
+}
+
+// validateAccessToken returns the claims of a valid access token.
+func validateAccessToken(tokenString string) (*AccountClaims, error) {
+	token, err := validateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(*AccountClaims)
+	if !token.Valid || claims.Purpose != "" {
+		return nil, fmt.Errorf("not an access token")
+	}
+	if claims.ID == "" {
+		return nil, fmt.Errorf("token has no id and cannot be revoked")
+	}
+	if claims.Subject != strconv.Itoa(claims.AccountID) {
+		return nil, fmt.Errorf("token subject %q does not match account %d", claims.Subject, claims.AccountID)
+	}
+	return claims, nil
+}
+
+// validateJWT parses a token signed with the configured algorithm, rejecting
+// it when it has expired or names another issuer or audience.
+func validateJWT(tokenString string) (*jwt.Token, error) {
+	keys := jwtKeys
+	return jwt.ParseWithClaims(tokenString, &AccountClaims{}, keys.verifyingKey,
+		jwt.WithExpirationRequired(), jwt.WithIssuer(keys.issuer), jwt.WithAudience(keys.audience))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTRoundTripsAccountID(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	tokenString, _, err := createJWT(&Account{ID: 42})
+	require.Nil(t, err)
+	token, err := validateJWT(tokenString)
+	require.Nil(t, err)
+	require.True(t, token.Valid)
+	assert.Equal(t, 42, token.Claims.(*AccountClaims).AccountID)
+
+	t.Setenv("JWT_SECRET", "other-secret")
+	_, err = validateJWT(tokenString)
+	assert.NotNil(t, err)
+}
+
+// useRS256 switches token signing to a freshly generated RSA key for the rest
+// of the test.
+func useRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	require.Nil(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+
+	previous := jwtKeys
+	t.Cleanup(func() { jwtKeys = previous })
+	require.Nil(t, configureJWT(&Config{JWTAlgorithm: "RS256", JWTPrivateKeyFile: path}))
+}
+
+func TestJWTRS256RoundTrip(t *testing.T) {
+	useRS256(t)
+
+	tokenString, _, err := createJWT(&Account{ID: 7, Role: RoleAdmin})
+	require.Nil(t, err)
+	token, err := validateJWT(tokenString)
+	require.Nil(t, err)
+	assert.Equal(t, "RS256", token.Method.Alg())
+	assert.Equal(t, 7, token.Claims.(*AccountClaims).AccountID)
+	assert.Equal(t, RoleAdmin, token.Claims.(*AccountClaims).Role)
+}
+
+func TestJWTRejectsOtherAlgorithm(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	hs256Token, _, err := createJWT(&Account{ID: 7})
+	require.Nil(t, err)
+
+	useRS256(t)
+	_, err = validateJWT(hs256Token)
+	assert.NotNil(t, err)
+
+	rs256Token, _, err := createJWT(&Account{ID: 7})
+	require.Nil(t, err)
+	require.Nil(t, configureJWT(&Config{}))
+	_, err = validateJWT(rs256Token)
+	assert.NotNil(t, err)
+}
+
+// writePEM writes a PEM block to a file in the test's temporary directory.
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.Nil(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+// newES256KeyFiles generates a P-256 key and returns the paths of its
+// private and public key files.
+func newES256KeyFiles(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.Nil(t, err)
+	return writePEM(t, "jwt.pem", "EC PRIVATE KEY", der), writePEM(t, "jwt.pub", "PUBLIC KEY", public)
+}
+
+func TestJWTES256KeyRotation(t *testing.T) {
+	previous := jwtKeys
+	t.Cleanup(func() { jwtKeys = previous })
+	oldKey, oldPublicKey := newES256KeyFiles(t)
+	newKey, _ := newES256KeyFiles(t)
+
+	require.Nil(t, configureJWT(&Config{JWTAlgorithm: "ES256", JWTPrivateKeyFile: oldKey}))
+	oldToken, _, err := createJWT(&Account{ID: 7})
+	require.Nil(t, err)
+	token, err := validateJWT(oldToken)
+	require.Nil(t, err)
+	assert.Equal(t, "ES256", token.Method.Alg())
+	assert.Equal(t, jwtKeys.keyID, token.Header["kid"])
+
+	require.Nil(t, configureJWT(&Config{JWTAlgorithm: "ES256", JWTPrivateKeyFile: newKey, JWTPreviousPublicKeyFiles: []string{oldPublicKey}}))
+	_, err = validateAccessToken(oldToken)
+	assert.Nil(t, err, "tokens of the previous key stay valid")
+	newToken, _, err := createJWT(&Account{ID: 7})
+	require.Nil(t, err)
+	_, err = validateAccessToken(newToken)
+	assert.Nil(t, err)
+
+	require.Nil(t, configureJWT(&Config{JWTAlgorithm: "ES256", JWTPrivateKeyFile: newKey}))
+	_, err = validateAccessToken(oldToken)
+	assert.NotNil(t, err, "the previous key was retired")
+}
+
+func TestJWTRejectsKeyOfOtherAlgorithm(t *testing.T) {
+	previous := jwtKeys
+	t.Cleanup(func() { jwtKeys = previous })
+	ecKey, _ := newES256KeyFiles(t)
+
+	assert.NotNil(t, configureJWT(&Config{JWTAlgorithm: "RS256", JWTPrivateKeyFile: ecKey}))
+	assert.NotNil(t, configureJWT(&Config{JWTPreviousPublicKeyFiles: []string{ecKey}}), "HS256 has no public keys")
+}
+
+func TestJWKS(t *testing.T) {
+	_, router := newTestServer(t)
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	oldPublic, err := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	require.Nil(t, err)
+	newKey, _ := newES256KeyFiles(t)
+	previous := jwtKeys
+	t.Cleanup(func() { jwtKeys = previous })
+	require.Nil(t, configureJWT(&Config{JWTAlgorithm: "ES256", JWTPrivateKeyFile: newKey,
+		JWTPreviousPublicKeyFiles: []string{writePEM(t, "old.pub", "PUBLIC KEY", oldPublic)}}))
+
+	rec := doJSON(t, router, "GET", "/.well-known/jwks.json", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var set JSONWebKeySet
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&set))
+	require.Len(t, set.Keys, 2)
+	byAlg := map[string]map[string]string{}
+	for _, key := range set.Keys {
+		byAlg[key["alg"]] = key
+	}
+	assert.Equal(t, jwtKeys.keyID, byAlg["ES256"]["kid"])
+	assert.Equal(t, "P-256", byAlg["ES256"]["crv"])
+	assert.Equal(t, "RSA", byAlg["RS256"]["kty"])
+	assert.Equal(t, "AQAB", byAlg["RS256"]["e"])
+
+	oldID, err := jwkThumbprint(&oldKey.PublicKey)
+	require.Nil(t, err)
+	assert.Equal(t, oldID, byAlg["RS256"]["kid"])
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// The example key and thumbprint of RFC 7638 section 3.1.
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	require.Nil(t, err)
+	thumbprint, err := jwkThumbprint(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+	require.Nil(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+}
+
+func TestLoadJWTKeysRejectsUnknownAlgorithm(t *testing.T) {
+	_, err := loadJWTKeys(&Config{JWTAlgorithm: "none"})
+	assert.NotNil(t, err)
+}
+
+func TestJWTCarriesRegisteredClaims(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	tokenString, expiresAt, err := createJWT(&Account{ID: 42})
+	require.Nil(t, err)
+	claims, err := validateAccessToken(tokenString)
+	require.Nil(t, err)
+	assert.Equal(t, defaultJWTIssuer, claims.Issuer)
+	assert.Equal(t, jwt.ClaimStrings{defaultJWTAudience}, claims.Audience)
+	assert.Equal(t, "42", claims.Subject)
+	assert.WithinDuration(t, expiresAt, claims.ExpiresAt.Time, time.Second)
+	assert.WithinDuration(t, time.Now().Add(defaultAccessTokenTTL), expiresAt, time.Minute)
+}
+
+func TestJWTRejectsExpiredAndForeignTokens(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	previous := jwtKeys
+	t.Cleanup(func() { jwtKeys = previous })
+
+	expired, _, err := signJWT(&Account{ID: 1}, "", 0, -time.Minute)
+	require.Nil(t, err)
+	_, err = validateAccessToken(expired)
+	assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	require.Nil(t, configureJWT(&Config{JWTIssuer: "other", JWTAudience: "other-api", AccessTokenTTL: time.Hour}))
+	foreign, expiresAt, err := createJWT(&Account{ID: 1})
+	require.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+	_, err = validateAccessToken(foreign)
+	require.Nil(t, err)
+
+	require.Nil(t, configureJWT(&Config{JWTIssuer: "other"}))
+	_, err = validateAccessToken(foreign)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidAudience)
+
+	require.Nil(t, configureJWT(&Config{JWTAudience: "other-api"}))
+	_, err = validateAccessToken(foreign)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+}
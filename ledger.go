@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Ledger entry directions. Customer accounts are what the bank owes, so a
+// credit raises their balance and a debit lowers it.
+const (
+	LedgerDebit  = "debit"
+	LedgerCredit = "credit"
+)
+
+// Journal kinds record what moved the money.
+const (
+	JournalOpening    = "opening"
+	JournalTransfer   = "transfer"
+	JournalDeposit    = "deposit"
+	JournalWithdrawal = "withdrawal"
+	JournalFee        = "fee"
+	JournalReversal   = "reversal"
+)
+
+// System ledger accounts are the bank's side of entries that do not move
+// money between customers.
+const (
+	// SystemAccountEquity balances the opening balances of accounts created
+	// with money already in them.
+	SystemAccountEquity = "equity"
+	// SystemAccountCash is where deposits come from and withdrawals go.
+	SystemAccountCash      = "cash"
+	SystemAccountFeeIncome = "fee_income"
+	// SystemAccountFX takes one currency and pays out another in
+	// cross-currency transfers.
+	SystemAccountFX = "fx"
+)
+
+// ErrUnbalancedJournal is returned when a journal's debits and credits
+// differ in some currency.
+var ErrUnbalancedJournal = errors.New("journal does not balance")
+
+// LedgerEntry is one side of a balance change. Exactly one of AccountID and
+// SystemAccount is set.
+type LedgerEntry struct {
+	ID            int       `json:"id"`
+	JournalID     int64     `json:"journalId"`
+	Kind          string    `json:"kind"`
+	AccountID     *int      `json:"accountId,omitempty"`
+	SystemAccount string    `json:"systemAccount,omitempty"`
+	Direction     string    `json:"direction"`
+	Amount        int64     `json:"amount"`
+	Currency      string    `json:"currency"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// balanceChange is the entry's effect on the balance of its account.
+func (e *LedgerEntry) balanceChange() int64 {
+	if e.Direction == LedgerDebit {
+		return -e.Amount
+	}
+	return e.Amount
+}
+
+// Journal is a set of ledger entries posted together. Its debits and credits
+// must be equal in every currency.
+type Journal struct {
+	Kind    string
+	Entries []*LedgerEntry
+}
+
+func newJournal(kind string) *Journal {
+	return &Journal{Kind: kind}
+}
+
+func (j *Journal) account(direction string, id int, amount int64, currency string) *Journal {
+	j.Entries = append(j.Entries, &LedgerEntry{Kind: j.Kind, AccountID: &id, Direction: direction, Amount: amount, Currency: currency})
+	return j
+}
+
+func (j *Journal) system(direction, name string, amount int64, currency string) *Journal {
+	j.Entries = append(j.Entries, &LedgerEntry{Kind: j.Kind, SystemAccount: name, Direction: direction, Amount: amount, Currency: currency})
+	return j
+}
+
+// validate checks that j balances and every entry moves a positive amount.
+func (j *Journal) validate() error {
+	net := make(map[string]int64)
+	for _, e := range j.Entries {
+		if e.Amount <= 0 {
+			return fmt.Errorf("%w: entry amounts must be positive, got %d", ErrUnbalancedJournal, e.Amount)
+		}
+		net[e.Currency] += e.balanceChange()
+	}
+	for currency, n := range net {
+		if n != 0 {
+			return fmt.Errorf("%w: %s is off by %d", ErrUnbalancedJournal, currency, n)
+		}
+	}
+	return nil
+}
+
+// balanceChanges totals the journal's effect on each customer account.
+func (j *Journal) balanceChanges() map[int]int64 {
+	changes := make(map[int]int64)
+	for _, e := range j.Entries {
+		if e.AccountID != nil {
+			changes[*e.AccountID] += e.balanceChange()
+		}
+	}
+	return changes
+}
+
+// stamp sets the journal id and time on every entry.
+func (j *Journal) stamp(id int64, now time.Time) {
+	for _, e := range j.Entries {
+		e.JournalID = id
+		e.CreatedAt = now
+	}
+}
+
+// checkJournal validates an adjustment journal against the accounts it
+// touches, which the caller has locked: they must exist, be active, hold the
+// entry's currency and afford any net debit.
+func checkJournal(j *Journal, locked map[int]*Account) error {
+	if _, ok := adjustmentTransactionTypes[j.Kind]; !ok {
+		return fmt.Errorf("%s journals cannot be posted directly", j.Kind)
+	}
+	if err := j.validate(); err != nil {
+		return err
+	}
+	for _, e := range j.Entries {
+		if e.AccountID == nil {
+			continue
+		}
+		acc, ok := locked[*e.AccountID]
+		if !ok {
+			return fmt.Errorf("%w: id %d", ErrAccountNotFound, *e.AccountID)
+		}
+		if acc.Status == AccountStatusFrozen {
+			return fmt.Errorf("%w: id %d", ErrAccountFrozen, acc.ID)
+		}
+		if acc.Currency != e.Currency {
+			return fmt.Errorf("%w: account with id %d holds %s, not %s", ErrCurrencyMismatch, acc.ID, acc.Currency, e.Currency)
+		}
+	}
+	for id, change := range j.balanceChanges() {
+		if change < 0 {
+			if err := checkFunds(locked[id], -change); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// journalTransactions returns the history entry an adjustment journal leaves
+// on each customer account it touches.
+func journalTransactions(j *Journal, now time.Time) []*Transaction {
+	var transactions []*Transaction
+	for _, e := range j.Entries {
+		if e.AccountID != nil {
+			transactions = append(transactions, &Transaction{
+				AccountID: *e.AccountID,
+				Type:      adjustmentTransactionTypes[j.Kind],
+				Amount:    e.Amount,
+				CreatedAt: now,
+				Status:    TransactionStatusCompleted,
+			})
+		}
+	}
+	return transactions
+}
+
+// openingJournal records the balance acc was created with, or returns nil
+// when it starts empty.
+func openingJournal(acc *Account) *Journal {
+	switch {
+	case acc.Balance > 0:
+		return newJournal(JournalOpening).
+			system(LedgerDebit, SystemAccountEquity, acc.Balance, acc.Currency).
+			account(LedgerCredit, acc.ID, acc.Balance, acc.Currency)
+	case acc.Balance < 0:
+		return newJournal(JournalOpening).
+			account(LedgerDebit, acc.ID, -acc.Balance, acc.Currency).
+			system(LedgerCredit, SystemAccountEquity, -acc.Balance, acc.Currency)
+	default:
+		return nil
+	}
+}
+
+// transferJournal records the ledger side of the transfer described by the
+// debit and credit transactions from transferEntries. A conversion passes
+// through SystemAccountFX so each currency balances on its own.
+func transferJournal(debit, credit *Transaction, fromCurrency, toCurrency string) *Journal {
+	return movementJournal(JournalTransfer, debit, credit, fromCurrency, toCurrency)
+}
+
+// movementJournal debits debit.Amount from debit's account and credits
+// credit.Amount to credit's account, converting through SystemAccountFX when
+// the currencies differ.
+func movementJournal(kind string, debit, credit *Transaction, fromCurrency, toCurrency string) *Journal {
+	j := newJournal(kind).account(LedgerDebit, debit.AccountID, debit.Amount, fromCurrency)
+	if fromCurrency != toCurrency {
+		j.system(LedgerCredit, SystemAccountFX, debit.Amount, fromCurrency).
+			system(LedgerDebit, SystemAccountFX, credit.Amount, toCurrency)
+	}
+	return j.account(LedgerCredit, credit.AccountID, credit.Amount, toCurrency)
+}
+
+// adjustmentTransactionTypes maps the journal kinds Ledger posts for a
+// single account to the transaction type shown in its history.
+var adjustmentTransactionTypes = map[string]string{
+	JournalDeposit:    TransactionDeposit,
+	JournalWithdrawal: TransactionWithdrawal,
+	JournalFee:        TransactionFee,
+}
+
+// Ledger posts deposits, withdrawals and fees as balanced journals.
+// Transfers are posted by Storage.Transfer, which also enforces limits.
+type Ledger struct {
+	store Storage
+}
+
+func NewLedger(store Storage) *Ledger {
+	return &Ledger{store: store}
+}
+
+// Deposit credits amount, in minor units of the account's currency, from
+// cash.
+func (l *Ledger) Deposit(ctx context.Context, accountID int, amount int64) (*Transaction, error) {
+	return l.post(ctx, JournalDeposit, accountID, amount)
+}
+
+// Withdraw debits amount to cash, subject to the balance and overdraft
+// limit.
+func (l *Ledger) Withdraw(ctx context.Context, accountID int, amount int64) (*Transaction, error) {
+	return l.post(ctx, JournalWithdrawal, accountID, amount)
+}
+
+// ChargeFee debits amount to fee income, subject to the balance and
+// overdraft limit.
+func (l *Ledger) ChargeFee(ctx context.Context, accountID int, amount int64) (*Transaction, error) {
+	return l.post(ctx, JournalFee, accountID, amount)
+}
+
+func (l *Ledger) post(ctx context.Context, kind string, accountID int, amount int64) (*Transaction, error) {
+	acc, err := l.store.GetAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	j := newJournal(kind)
+	switch kind {
+	case JournalDeposit:
+		j.system(LedgerDebit, SystemAccountCash, amount, acc.Currency).account(LedgerCredit, accountID, amount, acc.Currency)
+	case JournalWithdrawal:
+		j.account(LedgerDebit, accountID, amount, acc.Currency).system(LedgerCredit, SystemAccountCash, amount, acc.Currency)
+	case JournalFee:
+		j.account(LedgerDebit, accountID, amount, acc.Currency).system(LedgerCredit, SystemAccountFeeIncome, amount, acc.Currency)
+	}
+	transactions, err := l.store.PostJournal(ctx, j)
+	if err != nil {
+		return nil, err
+	}
+	return transactions[0], nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalValidate(t *testing.T) {
+	balanced := newJournal(JournalDeposit).
+		system(LedgerDebit, SystemAccountCash, 50, "USD").
+		account(LedgerCredit, 1, 50, "USD")
+	assert.Nil(t, balanced.validate())
+
+	unbalanced := newJournal(JournalDeposit).
+		system(LedgerDebit, SystemAccountCash, 50, "USD").
+		account(LedgerCredit, 1, 40, "USD")
+	assert.ErrorIs(t, unbalanced.validate(), ErrUnbalancedJournal)
+
+	// equal totals in different currencies do not balance each other
+	mixed := newJournal(JournalDeposit).
+		system(LedgerDebit, SystemAccountCash, 50, "USD").
+		account(LedgerCredit, 1, 50, "EUR")
+	assert.ErrorIs(t, mixed.validate(), ErrUnbalancedJournal)
+
+	zero := newJournal(JournalFee).
+		account(LedgerDebit, 1, 0, "USD").
+		system(LedgerCredit, SystemAccountFeeIncome, 0, "USD")
+	assert.ErrorIs(t, zero.validate(), ErrUnbalancedJournal)
+}
+
+func TestTransferJournal(t *testing.T) {
+	debit := &Transaction{AccountID: 1, Amount: 100}
+	credit := &Transaction{AccountID: 2, Amount: 92}
+
+	j := transferJournal(debit, credit, "USD", "EUR")
+	require.Nil(t, j.validate())
+	assert.Len(t, j.Entries, 4)
+	assert.Equal(t, map[int]int64{1: -100, 2: 92}, j.balanceChanges())
+
+	credit.Amount = 100
+	j = transferJournal(debit, credit, "USD", "USD")
+	require.Nil(t, j.validate())
+	assert.Len(t, j.Entries, 2)
+}
+
+func TestOpeningJournal(t *testing.T) {
+	assert.Nil(t, openingJournal(&Account{ID: 1, Currency: "USD"}))
+
+	j := openingJournal(&Account{ID: 1, Balance: -25, Currency: "USD"})
+	require.Nil(t, j.validate())
+	assert.Equal(t, map[int]int64{1: -25}, j.balanceChanges())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Failed logins are counted separately for the email address tried and for
+// the client IP, so guessing one account's password and trying one password
+// on many accounts are both slowed down.
+const (
+	loginEmailKeyPrefix = "email:"
+	loginIPKeyPrefix    = "ip:"
+)
+
+type loginLock struct {
+	key       string
+	threshold int
+}
+
+// loginLocks returns the locks guarding a login for email from ip, leaving
+// out any disabled in the config.
+func (s *APIServer) loginLocks(email, ip string) []loginLock {
+	var locks []loginLock
+	if s.cfg.LoginLockoutThreshold > 0 {
+		locks = append(locks, loginLock{key: loginEmailKeyPrefix + email, threshold: s.cfg.LoginLockoutThreshold})
+	}
+	if s.cfg.LoginIPLockoutThreshold > 0 {
+		locks = append(locks, loginLock{key: loginIPKeyPrefix + ip, threshold: s.cfg.LoginIPLockoutThreshold})
+	}
+	return locks
+}
+
+// loginLocked answers a login while its email or IP is locked, saying when
+// to try again.
+func loginLocked(retryAfter time.Duration) error {
+	return &HTTPError{
+		Status:  http.StatusTooManyRequests,
+		Code:    "LOGIN_LOCKED_OUT",
+		Message: "too many failed logins, try again later",
+		Headers: http.Header{"Retry-After": {strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))}},
+	}
+}
+
+// checkLoginLock refuses a login for email from ip while either is locked.
+func (s *APIServer) checkLoginLock(ctx context.Context, email, ip string) error {
+	now := s.now()
+	for _, lock := range s.loginLocks(email, ip) {
+		lockedUntil, err := s.store.LoginLockedUntil(ctx, lock.key, now)
+		if err != nil {
+			return err
+		}
+		if !lockedUntil.IsZero() {
+			return loginLocked(lockedUntil.Sub(now))
+		}
+	}
+	return nil
+}
+
+// loginFailed counts a failed login for email from ip and returns the error
+// to answer it with: errFailed, or loginLocked when this failure locked the
+// email or IP. acc is the account the email belongs to, if any.
+func (s *APIServer) loginFailed(ctx context.Context, email, ip string, acc *Account, errFailed error) error {
+	now := s.now()
+	var lockedUntil time.Time
+	for _, lock := range s.loginLocks(email, ip) {
+		until, err := s.store.RecordLoginFailure(ctx, lock.key, lock.threshold, s.cfg.LoginLockoutDuration, now)
+		if err != nil {
+			return err
+		}
+		if until.IsZero() {
+			continue
+		}
+		lockedUntil = until
+		if lock.key == loginIPKeyPrefix+ip {
+			s.logger.WarnContext(ctx, "login locked for client", "ip", ip, "locked_until", until)
+		} else if acc != nil {
+			s.logger.WarnContext(ctx, "account locked", "account_id", acc.ID, "locked_until", until)
+			s.events.Dispatch(Event{Type: EventAccountLocked, AccountID: acc.ID, Timestamp: now})
+		}
+	}
+	if !lockedUntil.IsZero() {
+		return loginLocked(lockedUntil.Sub(now))
+	}
+	return errFailed
+}
+
+// handleUnlockAccount lifts the login lock on an account and forgets its
+// failed logins.
+func (s *APIServer) handleUnlockAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.ClearLoginFailures(r.Context(), loginEmailKeyPrefix+normalizeEmail(account.Email)); err != nil {
+		return err
+	}
+	adminID, _ := accountIDFromContext(r.Context())
+	s.logger.InfoContext(r.Context(), "account unlocked", "account_id", id, "admin_id", adminID)
+	s.events.Dispatch(Event{Type: EventAccountUnlocked, AccountID: id, Timestamp: s.now()})
+	return WriteJSON(w, http.StatusOK, account)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLockout(t *testing.T) {
+	server, router := newTestServer(t)
+	server.cfg.LoginLockoutThreshold = 3
+	server.cfg.LoginIPLockoutThreshold = 10
+	server.cfg.LoginLockoutDuration = time.Minute
+	now := time.Now()
+	server.now = func() time.Time { return now }
+	events := &fakeDispatcher{}
+	server.events = events
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	admin, err := NewAccount("c", "d", "admin@abc.com", "password123")
+	require.Nil(t, err)
+	admin.Role = RoleAdmin
+	require.Nil(t, server.store.CreateAccount(context.Background(), admin))
+	adminToken, _, err := createJWT(admin)
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "wrong-password"}, nil)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, "a success starts the count over")
+
+	for i := 0; i < 2; i++ {
+		rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "wrong-password"}, nil)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "ABC@abc.com", Password: "wrong-password"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	locked := events.ofType(EventAccountLocked)
+	require.Len(t, locked, 1)
+	assert.Equal(t, acc.ID, locked[0].AccountID)
+
+	now = now.Add(30 * time.Second)
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the right password does not help while locked")
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+
+	rec = doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/unlock", acc.ID), nil, http.Header{"Authorization": {"Bearer " + adminToken}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Len(t, events.ofType(EventAccountUnlocked), 1)
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	userToken, _, err := createJWT(acc)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/unlock", acc.ID), nil, http.Header{"Authorization": {"Bearer " + userToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code, "admins only")
+}
+
+func TestLoginLockoutByClientIP(t *testing.T) {
+	server, router := newTestServer(t)
+	server.cfg.LoginLockoutThreshold = 3
+	server.cfg.LoginIPLockoutThreshold = 4
+	server.cfg.LoginLockoutDuration = time.Minute
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	for i := 0; i < 3; i++ {
+		rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: fmt.Sprintf("guess%d@abc.com", i), Password: "password123"}, nil)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "guess3@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "every email is refused from a locked IP")
+}
+
+func TestLoginLockoutCoversSecondFactor(t *testing.T) {
+	server, router := newTestServer(t)
+	server.cfg.LoginLockoutThreshold = 3
+	server.cfg.LoginIPLockoutThreshold = 10
+	server.cfg.LoginLockoutDuration = time.Minute
+	now := time.Now()
+	server.now = func() time.Time { return now }
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: acc.Email})
+	require.Nil(t, err)
+	sealed, err := sealTOTPSecret(acc.ID, key.Secret())
+	require.Nil(t, err)
+	require.Nil(t, server.store.SetTOTPSecret(context.Background(), acc.ID, sealed))
+	require.Nil(t, server.store.EnableTOTP(context.Background(), acc.ID, nil))
+
+	challenge := func() string {
+		rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+		require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+		var resp TwoFactorChallengeResponse
+		require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp.Challenge
+	}
+	first := challenge()
+	for i := 0; i < 2; i++ {
+		rec := doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: first, Code: "000000"}, nil)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	// the right password must not start the count over
+	rec := doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: challenge(), Code: "000000"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, rec.Body.String())
+
+	code, err := totp.GenerateCodeCustom(key.Secret(), now, totpOptions)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: first, Code: code}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the right code does not help while locked")
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	now = now.Add(time.Minute)
+	code, err = totp.GenerateCodeCustom(key.Secret(), now, totpOptions)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: challenge(), Code: code}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var discardLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+func TestHandlersLogStructuredJSON(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info")
+	require.Nil(t, err)
+	router := NewAPIServer(":0", NewMemoryStore(), &Config{}, logger).newHandler()
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "abc@abc.com",
+		Password:  "password123",
+	}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record map[string]any
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+	}
+	require.Len(t, records, 2)
+	assert.Equal(t, "INFO", records[0]["level"])
+	assert.Equal(t, "account created", records[0]["msg"])
+	assert.Equal(t, float64(1), records[0]["account_id"])
+	assert.Equal(t, "request served", records[1]["msg"])
+	assert.Equal(t, float64(http.StatusCreated), records[1]["status"])
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn")
+	require.Nil(t, err)
+	logger.Info("dropped")
+	logger.Warn("kept")
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Contains(t, buf.String(), "kept")
+
+	_, err = newLogger(&buf, "loud")
+	assert.NotNil(t, err)
+}
+
+func TestRequestIDInResponseAndLogs(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info")
+	require.Nil(t, err)
+	router := NewAPIServer(":0", NewMemoryStore(), &Config{}, logger).newHandler()
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "abc@abc.com",
+		Password:  "password123",
+	}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	id := rec.Header().Get("X-Request-ID")
+	_, err = uuid.Parse(id)
+	require.Nil(t, err, id)
+
+	scanner := bufio.NewScanner(&buf)
+	lines := 0
+	for scanner.Scan() {
+		var record map[string]any
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		assert.Equal(t, id, record["request_id"], record["msg"])
+		lines++
+	}
+	assert.Equal(t, 2, lines)
+}
+
+func TestRequestIDReusesCallerHeader(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	for _, tc := range []struct {
+		header string
+		reused bool
+	}{
+		{"trace-123", true},
+		{"", false},
+		{"has spaces", false},
+		{strings.Repeat("x", maxRequestIDLength+1), false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", tc.header)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, seen, rec.Header().Get("X-Request-ID"))
+		if tc.reused {
+			assert.Equal(t, tc.header, seen)
+		} else {
+			assert.NotEqual(t, tc.header, seen)
+			assert.NotEmpty(t, seen)
+		}
+	}
+	assert.Empty(t, RequestIDFromContext(context.Background()))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Results of a login attempt.
+const (
+	LoginResultSuccess = "success"
+	LoginResultFailure = "failure"
+)
+
+// defaultLoginHistoryRetention is how long login attempts are kept before
+// the purge job removes them.
+const defaultLoginHistoryRetention = 90 * 24 * time.Hour
+
+// LoginAttempt records a login to an account, successful or not. Attempts
+// for emails without an account are not recorded.
+type LoginAttempt struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"accountId"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Result    string    `json:"result"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type LoginHistoryPage struct {
+	Logins []*LoginAttempt `json:"logins"`
+	Limit  int             `json:"limit"`
+	Offset int             `json:"offset"`
+}
+
+// recordLogin adds a login to acc from ip to its history. A successful login
+// from an IP the account never logged in from before raises
+// EventLoginFromNewIP, unless it is the account's first. Failing to record
+// is only logged, so the history cannot stop anyone from logging in.
+func (s *APIServer) recordLogin(ctx context.Context, acc *Account, ip, userAgent, result string) {
+	now := s.now().UTC()
+	var known []string
+	var err error
+	if result == LoginResultSuccess {
+		known, err = s.store.GetLoginIPs(ctx, acc.ID)
+	}
+	if err == nil {
+		err = s.store.CreateLoginAttempt(ctx, &LoginAttempt{
+			AccountID: acc.ID,
+			IP:        ip,
+			UserAgent: truncateUserAgent(userAgent),
+			Result:    result,
+			CreatedAt: now,
+		})
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "could not record login", "account_id", acc.ID, "error", err)
+		return
+	}
+	if len(known) > 0 && !slices.Contains(known, ip) {
+		s.logger.InfoContext(ctx, "login from new IP", "account_id", acc.ID, "ip", ip)
+		s.events.Dispatch(Event{Type: EventLoginFromNewIP, AccountID: acc.ID, IP: ip, Timestamp: now})
+	}
+}
+
+// handleGetLogins lists an account's login history, newest first.
+func (s *APIServer) handleGetLogins(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	limit, offset, err := getPaginationFromRequest(r)
+	if err != nil {
+		return err
+	}
+	logins, err := s.store.GetLoginAttempts(r.Context(), id, limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, LoginHistoryPage{
+		Logins: logins,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
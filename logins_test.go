@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginHistory(t *testing.T) {
+	server, router := newTestServer(t)
+	events := &fakeDispatcher{}
+	server.events = events
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	login := func(password, remoteAddr string) int {
+		body, err := json.Marshal(LoginRequest{Email: "abc@abc.com", Password: password})
+		require.Nil(t, err)
+		req := httptest.NewRequest("POST", "/api/v1/login", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "Firefox")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, login("wrong-password", "192.0.2.1:1234"))
+	require.Equal(t, http.StatusOK, login("password123", "192.0.2.1:1234"))
+	assert.Empty(t, events.ofType(EventLoginFromNewIP), "the first login is not an alert")
+	require.Equal(t, http.StatusOK, login("password123", "192.0.2.1:5678"))
+	assert.Empty(t, events.ofType(EventLoginFromNewIP))
+	require.Equal(t, http.StatusOK, login("password123", "198.51.100.7:1234"))
+	alerts := events.ofType(EventLoginFromNewIP)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, acc.ID, alerts[0].AccountID)
+	assert.Equal(t, "198.51.100.7", alerts[0].IP)
+
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	rec := doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/logins?limit=3", acc.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page LoginHistoryPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Logins, 3)
+	assert.Equal(t, "198.51.100.7", page.Logins[0].IP, "newest first")
+	assert.Equal(t, LoginResultSuccess, page.Logins[0].Result)
+	assert.Equal(t, "Firefox", page.Logins[0].UserAgent)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/logins?offset=3", acc.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Logins, 1)
+	assert.Equal(t, LoginResultFailure, page.Logins[0].Result)
+
+	other, err := NewAccount("c", "d", "other@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), other))
+	otherToken, _, err := createJWT(other)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/logins", acc.ID), nil, http.Header{"Authorization": {"Bearer " + otherToken}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -1,19 +1,124 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 )
 
 func main() {
-	fmt.Println("Starting Server")
-	store, err := NewPostgresStore()
+	cfg, err := loadConfig("config.yml")
 	if err != nil {
-		log.Fatal(err)
+		fatal(slog.Default(), err)
 	}
-	if err = store.Init(); err != nil {
-		log.Fatal(err)
+	logger, err := newLogger(os.Stdout, cfg.LogLevel)
+	if err != nil {
+		fatal(slog.Default(), err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(cfg, logger, os.Args[2:]); err != nil {
+			logger.Error("migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		if err := seed(cfg, logger, os.Args[2:]); err != nil {
+			logger.Error("seeding failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	logger.Info("starting server")
+	if err := configureSecrets(cfg, logger); err != nil {
+		fatal(logger, err)
+	}
+	if err := configurePasswordHasher(cfg); err != nil {
+		fatal(logger, err)
+	}
+	if err := configureJWT(cfg); err != nil {
+		fatal(logger, err)
+	}
+	if err := configureRateLimiting(cfg, logger); err != nil {
+		fatal(logger, err)
 	}
-	server := NewAPIServer(":3000", store)
+	store, err := newStore(cfg, logger)
+	if err != nil {
+		fatal(logger, err)
+	}
+	if store, err = withAccountCache(cfg, store, logger); err != nil {
+		fatal(logger, err)
+	}
+	addr := resolveListenAddr(cfg)
+	logger.Info("listen address resolved", "addr", addr)
+	server := NewAPIServer(addr, store, cfg, logger)
 	server.Run()
 }
+
+// newStore opens the storage selected by cfg.Storage, migrating Postgres to
+// the latest schema.
+func newStore(cfg *Config, logger *slog.Logger) (Storage, error) {
+	switch cfg.Storage {
+	case "", StoragePostgres:
+		store, err := NewPostgresStore(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		if !cfg.SkipMigrations {
+			if err := store.Init(); err != nil {
+				return nil, err
+			}
+			return store, nil
+		}
+		pending, err := store.PendingMigrations()
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) > 0 {
+			return nil, fmt.Errorf("%d migrations are pending, run gobank migrate", len(pending))
+		}
+		return store, nil
+	case StorageMemory:
+		logger.Warn("using in-memory storage, all data is lost when the server stops")
+		return NewMemoryStoreFromConfig(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported storage %q", cfg.Storage)
+	}
+}
+
+// migrate runs the migrate subcommand against the configured database.
+func migrate(cfg *Config, logger *slog.Logger, args []string) error {
+	if err := configureSecrets(cfg, logger); err != nil {
+		return err
+	}
+	store, err := NewPostgresStore(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer store.pool.Close()
+	return runMigrateCommand(store, args, os.Stdout)
+}
+
+// seed runs the seed subcommand against the configured storage.
+func seed(cfg *Config, logger *slog.Logger, args []string) error {
+	if !cfg.AllowSeed {
+		return errSeedDisabled
+	}
+	if err := configureSecrets(cfg, logger); err != nil {
+		return err
+	}
+	if err := configurePasswordHasher(cfg); err != nil {
+		return err
+	}
+	store, err := newStore(cfg, logger)
+	if err != nil {
+		return err
+	}
+	return runSeedCommand(context.Background(), cfg, store, args, os.Stdout)
+}
+
+func fatal(logger *slog.Logger, err error) {
+	logger.Error("server failed to start", "error", err)
+	os.Exit(1)
+}
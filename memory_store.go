@@ -0,0 +1,1784 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Storage backed by a map, intended for tests and local
+// development where a Postgres server is not available.
+type MemoryStore struct {
+	mu sync.RWMutex
+	memoryState
+	dailyTransferLimit int64
+	perTransferLimit   int64
+	// deletedAccountRetention is how long soft deleted accounts are kept
+	// before PurgeExpired removes them.
+	deletedAccountRetention time.Duration
+	loginHistoryRetention   time.Duration
+	idempotencyKeyTTL       time.Duration
+	// rates converts cross-currency transfers. Nil rejects them.
+	rates RateProvider
+}
+
+// memoryState is the data a MemoryStore holds, kept apart from its settings
+// so InTx can work on a copy of it.
+type memoryState struct {
+	accounts           map[int]*Account
+	nextID             int
+	transactions       []*Transaction
+	ledger             []*LedgerEntry
+	scheduled          []*ScheduledTransfer
+	standingOrders     []*StandingOrder
+	holds              []*Hold
+	nextJournalID      int64
+	idempotentResults  map[idempotencyKey]*IdempotentResult
+	verificationTokens map[string]verificationToken
+	resetTokens        map[string]verificationToken
+	refreshTokens      map[string]*RefreshToken
+	sessions           []*Session
+	nextSessionID      int
+	loginAttempts      []*LoginAttempt
+	nextLoginAttemptID int
+	// backupCodes holds the hashes of each account's unused backup codes.
+	backupCodes     map[int]map[string]bool
+	passkeys        []*Passkey
+	apiKeys         []*APIKey
+	nextAPIKeyID    int
+	nextPasskeyID   int
+	passkeySessions map[string]*PasskeySession
+	loginFailures   map[string]*loginFailures
+	// revokedTokens maps the jti of each revoked access token to its expiry.
+	revokedTokens map[string]time.Time
+}
+
+type verificationToken struct {
+	accountID int
+	expiresAt time.Time
+}
+
+type loginFailures struct {
+	failures    int
+	lockedUntil time.Time
+	expiresAt   time.Time
+}
+
+type idempotencyKey struct {
+	accountID int
+	key       string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		memoryState: memoryState{
+			accounts:           make(map[int]*Account),
+			nextID:             1,
+			idempotentResults:  make(map[idempotencyKey]*IdempotentResult),
+			verificationTokens: make(map[string]verificationToken),
+			resetTokens:        make(map[string]verificationToken),
+			refreshTokens:      make(map[string]*RefreshToken),
+			backupCodes:        make(map[int]map[string]bool),
+			passkeySessions:    make(map[string]*PasskeySession),
+			loginFailures:      make(map[string]*loginFailures),
+			revokedTokens:      make(map[string]time.Time),
+		},
+
+		deletedAccountRetention: defaultDeletedAccountRetention,
+		loginHistoryRetention:   defaultLoginHistoryRetention,
+		idempotencyKeyTTL:       defaultIdempotencyKeyTTL,
+	}
+}
+
+// NewMemoryStoreFromConfig returns a MemoryStore enforcing the transfer
+// limits, retention periods and exchange rates in cfg, as NewPostgresStore
+// does.
+func NewMemoryStoreFromConfig(cfg *Config) (*MemoryStore, error) {
+	rates, err := newRateProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := NewMemoryStore()
+	s.dailyTransferLimit = cfg.DailyTransferLimit
+	s.perTransferLimit = cfg.PerTransferLimit
+	s.rates = rates
+	if cfg.DeletedAccountRetention != 0 {
+		s.deletedAccountRetention = cfg.DeletedAccountRetention
+	}
+	if cfg.LoginHistoryRetention != 0 {
+		s.loginHistoryRetention = cfg.LoginHistoryRetention
+	}
+	if cfg.IdempotencyKeyTTL != 0 {
+		s.idempotencyKeyTTL = cfg.IdempotencyKeyTTL
+	}
+	return s, nil
+}
+
+// InTx runs fn against a copy of the data s holds and keeps the copy only if
+// fn succeeds, so a rollback undoes the transaction's own writes and nothing
+// else. Calls made outside the transaction wait until it is over, which also
+// serializes InTx calls. fn must use the Storage it is handed, as calling s
+// directly would wait on the transaction itself.
+func (s *MemoryStore) InTx(ctx context.Context, fn func(Storage) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.withState(s.memoryState.clone())
+	if err := fn(memoryTx{tx}); err != nil {
+		return err
+	}
+	s.memoryState = tx.memoryState
+	return nil
+}
+
+// withState returns a MemoryStore holding state with the settings of s.
+func (s *MemoryStore) withState(state memoryState) *MemoryStore {
+	return &MemoryStore{
+		memoryState:             state,
+		dailyTransferLimit:      s.dailyTransferLimit,
+		perTransferLimit:        s.perTransferLimit,
+		deletedAccountRetention: s.deletedAccountRetention,
+		loginHistoryRetention:   s.loginHistoryRetention,
+		idempotencyKeyTTL:       s.idempotencyKeyTTL,
+		rates:                   s.rates,
+	}
+}
+
+// memoryTx is the Storage MemoryStore.InTx hands fn. Transactions started
+// on it join the one already running.
+type memoryTx struct {
+	*MemoryStore
+}
+
+func (tx memoryTx) InTx(ctx context.Context, fn func(Storage) error) error {
+	return fn(tx)
+}
+
+// clone copies st deeply enough that writes to either copy leave the other
+// unchanged.
+func (st *memoryState) clone() memoryState {
+	c := *st
+	c.accounts = clonePointerMap(st.accounts)
+	c.transactions = clonePointers(st.transactions)
+	c.ledger = clonePointers(st.ledger)
+	c.scheduled = clonePointers(st.scheduled)
+	c.standingOrders = clonePointers(st.standingOrders)
+	c.holds = clonePointers(st.holds)
+	c.idempotentResults = clonePointerMap(st.idempotentResults)
+	c.verificationTokens = maps.Clone(st.verificationTokens)
+	c.resetTokens = maps.Clone(st.resetTokens)
+	c.refreshTokens = clonePointerMap(st.refreshTokens)
+	c.sessions = clonePointers(st.sessions)
+	c.loginAttempts = clonePointers(st.loginAttempts)
+	c.backupCodes = make(map[int]map[string]bool, len(st.backupCodes))
+	for id, codes := range st.backupCodes {
+		c.backupCodes[id] = maps.Clone(codes)
+	}
+	c.passkeys = clonePointers(st.passkeys)
+	c.apiKeys = clonePointers(st.apiKeys)
+	c.passkeySessions = clonePointerMap(st.passkeySessions)
+	c.loginFailures = clonePointerMap(st.loginFailures)
+	c.revokedTokens = maps.Clone(st.revokedTokens)
+	return c
+}
+
+func clonePointers[T any](items []*T) []*T {
+	if items == nil {
+		return nil
+	}
+	c := make([]*T, len(items))
+	for i, item := range items {
+		copied := *item
+		c[i] = &copied
+	}
+	return c
+}
+
+func clonePointerMap[K comparable, V any](m map[K]*V) map[K]*V {
+	c := make(map[K]*V, len(m))
+	for k, v := range m {
+		copied := *v
+		c[k] = &copied
+	}
+	return c
+}
+
+func (s *MemoryStore) CreateAccount(ctx context.Context, acc *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.accounts {
+		if normalizeEmail(existing.Email) == normalizeEmail(acc.Email) {
+			return fmt.Errorf("%w: %s", ErrAccountExists, acc.Email)
+		}
+	}
+	for attempt := 1; s.numberTaken(acc.Number); attempt++ {
+		if attempt == maxAccountNumberAttempts {
+			return fmt.Errorf("could not create account for %s %s: account number collision", acc.FirstName, acc.LastName)
+		}
+		number, err := newAccountNumber()
+		if err != nil {
+			return err
+		}
+		acc.Number = number
+	}
+
+	acc.ID = s.nextID
+	s.nextID++
+	stored := *acc
+	s.accounts[acc.ID] = &stored
+	if j := openingJournal(acc); j != nil {
+		s.postLedger(j, acc.CreatedAt)
+	}
+	return nil
+}
+
+// CreateAccounts stores all of accounts or, on a *BatchError, none of them.
+func (s *MemoryStore) CreateAccounts(ctx context.Context, accounts []*Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emails := make(map[string]bool)
+	for _, existing := range s.accounts {
+		emails[normalizeEmail(existing.Email)] = true
+	}
+	numbers := make(map[int64]bool)
+	for i, acc := range accounts {
+		email := normalizeEmail(acc.Email)
+		if emails[email] {
+			return &BatchError{Index: i, Err: fmt.Errorf("%w: %s", ErrAccountExists, acc.Email)}
+		}
+		emails[email] = true
+		for attempt := 1; numbers[acc.Number] || s.numberTaken(acc.Number); attempt++ {
+			if attempt == maxAccountNumberAttempts {
+				return &BatchError{Index: i, Err: fmt.Errorf("could not create account for %s %s: account number collision", acc.FirstName, acc.LastName)}
+			}
+			number, err := newAccountNumber()
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+			acc.Number = number
+		}
+		numbers[acc.Number] = true
+	}
+
+	for _, acc := range accounts {
+		acc.ID = s.nextID
+		s.nextID++
+		stored := *acc
+		s.accounts[acc.ID] = &stored
+		if j := openingJournal(acc); j != nil {
+			s.postLedger(j, acc.CreatedAt)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteAccount(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	deletedAt := time.Now().UTC()
+	acc.DeletedAt = &deletedAt
+	return nil
+}
+
+func (s *MemoryStore) RestoreAccount(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok || acc.DeletedAt == nil {
+		return fmt.Errorf("%w: deleted id %d", ErrAccountNotFound, id)
+	}
+	acc.DeletedAt = nil
+	return nil
+}
+
+func (s *MemoryStore) HardDeleteAccount(ctx context.Context, id int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[id]; !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	delete(s.accounts, id)
+	delete(s.backupCodes, id)
+	apiKeys := s.apiKeys[:0]
+	for _, k := range s.apiKeys {
+		if k.AccountID != id {
+			apiKeys = append(apiKeys, k)
+		}
+	}
+	s.apiKeys = apiKeys
+	passkeys := s.passkeys[:0]
+	for _, p := range s.passkeys {
+		if p.AccountID != id {
+			passkeys = append(passkeys, p)
+		}
+	}
+	s.passkeys = passkeys
+	for hash, session := range s.passkeySessions {
+		if session.AccountID == id {
+			delete(s.passkeySessions, hash)
+		}
+	}
+	for key := range s.idempotentResults {
+		if key.accountID == id {
+			delete(s.idempotentResults, key)
+		}
+	}
+	for hash, token := range s.verificationTokens {
+		if token.accountID == id {
+			delete(s.verificationTokens, hash)
+		}
+	}
+	for hash, token := range s.resetTokens {
+		if token.accountID == id {
+			delete(s.resetTokens, hash)
+		}
+	}
+	for hash, token := range s.refreshTokens {
+		if token.AccountID == id {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	sessions := s.sessions[:0]
+	for _, sess := range s.sessions {
+		if sess.AccountID != id {
+			sessions = append(sessions, sess)
+		}
+	}
+	s.sessions = sessions
+	logins := s.loginAttempts[:0]
+	for _, a := range s.loginAttempts {
+		if a.AccountID != id {
+			logins = append(logins, a)
+		}
+	}
+	s.loginAttempts = logins
+	scheduled := s.scheduled[:0]
+	for _, st := range s.scheduled {
+		if st.AccountID != id && st.ToAccountID != id {
+			scheduled = append(scheduled, st)
+		}
+	}
+	s.scheduled = scheduled
+	orders := s.standingOrders[:0]
+	for _, o := range s.standingOrders {
+		if o.AccountID != id && o.ToAccountID != id {
+			orders = append(orders, o)
+		}
+	}
+	s.standingOrders = orders
+	var released []int
+	holds := s.holds[:0]
+	for _, h := range s.holds {
+		if h.ToAccountID == id && h.Status == HoldActive {
+			if acc, ok := s.accounts[h.AccountID]; ok {
+				acc.Held -= h.Amount
+				if !slices.Contains(released, h.AccountID) {
+					released = append(released, h.AccountID)
+				}
+			}
+		}
+		if h.AccountID != id && h.ToAccountID != id {
+			holds = append(holds, h)
+		}
+	}
+	s.holds = holds
+	removed := make(map[int]bool)
+	transactions := s.transactions[:0]
+	for _, t := range s.transactions {
+		if t.AccountID == id {
+			removed[t.ID] = true
+			continue
+		}
+		if t.CounterpartyAccountID != nil && *t.CounterpartyAccountID == id {
+			t.CounterpartyAccountID = nil
+		}
+		transactions = append(transactions, t)
+	}
+	s.transactions = transactions
+	for _, t := range s.transactions {
+		if t.ReversalOf != nil && removed[*t.ReversalOf] {
+			t.ReversalOf = nil
+		}
+	}
+	return released, nil
+}
+
+// live returns the account with id unless it is missing or soft deleted. It
+// must be called with s.mu held.
+func (s *MemoryStore) live(id int) (*Account, bool) {
+	acc, ok := s.accounts[id]
+	if !ok || acc.DeletedAt != nil {
+		return nil, false
+	}
+	return acc, true
+}
+
+func (s *MemoryStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.live(acc.ID)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, acc.ID)
+	}
+	if stored.Version != acc.Version {
+		return fmt.Errorf("%w: account with id %d is no longer at version %d", ErrConflict, acc.ID, acc.Version)
+	}
+	for _, existing := range s.accounts {
+		if existing.ID != acc.ID && normalizeEmail(existing.Email) == normalizeEmail(acc.Email) {
+			return fmt.Errorf("%w: %s", ErrAccountExists, acc.Email)
+		}
+	}
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	stored.FirstName = acc.FirstName
+	stored.LastName = acc.LastName
+	stored.Email = acc.Email
+	stored.Phone = acc.Phone
+	stored.UpdatedAt = acc.UpdatedAt
+	stored.Version = acc.Version
+	return nil
+}
+
+func (s *MemoryStore) UpdatePassword(ctx context.Context, id int, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	acc.EncryptedPassword = hash
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	return nil
+}
+
+func (s *MemoryStore) SetAccountStatus(ctx context.Context, id int, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	acc.Status = status
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	return nil
+}
+
+func (s *MemoryStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	found := *acc
+	return &found, nil
+}
+
+func (s *MemoryStore) GetBalance(ctx context.Context, id int) (Balance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return Balance{}, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	balance := Balance{Money: Money{Currency: acc.Currency}, Held: acc.Held}
+	for _, e := range s.ledger {
+		if e.AccountID != nil && *e.AccountID == id {
+			balance.Amount += e.balanceChange()
+		}
+	}
+	return balance, nil
+}
+
+func (s *MemoryStore) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, acc := range s.accounts {
+		if normalizeEmail(acc.Email) == normalizeEmail(email) && acc.DeletedAt == nil {
+			found := *acc
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: email %s", ErrAccountNotFound, email)
+}
+
+func (s *MemoryStore) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, acc := range s.accounts {
+		if acc.Number == number && acc.DeletedAt == nil {
+			found := *acc
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: number %d", ErrAccountNotFound, number)
+}
+
+// liveAccounts returns copies of the accounts that are not deleted, in id
+// order.
+func (s *MemoryStore) liveAccounts() []*Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var accounts []*Account
+	for _, acc := range s.accounts {
+		if acc.DeletedAt != nil {
+			continue
+		}
+		found := *acc
+		accounts = append(accounts, &found)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	return accounts
+}
+
+func (s *MemoryStore) GetAccounts(ctx context.Context, filter AccountFilter, afterID, limit, offset int) ([]*Account, error) {
+	accounts := []*Account{}
+	for _, acc := range s.liveAccounts() {
+		if acc.ID <= afterID || !filter.matches(acc) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(accounts) == limit {
+			break
+		}
+		accounts = append(accounts, acc)
+	}
+	return accounts, nil
+}
+
+func (s *MemoryStore) CountAccounts(ctx context.Context, filter AccountFilter) (int, error) {
+	total := 0
+	for _, acc := range s.liveAccounts() {
+		if filter.matches(acc) {
+			total++
+		}
+	}
+	return total, nil
+}
+
+// matches reports whether f selects acc, as AccountFilter.where does in SQL.
+func (f AccountFilter) matches(acc *Account) bool {
+	if f.Search != "" {
+		term := strings.ToLower(f.Search)
+		if !strings.Contains(strings.ToLower(acc.FirstName), term) &&
+			!strings.Contains(strings.ToLower(acc.LastName), term) &&
+			!strings.Contains(strings.ToLower(acc.Email), term) {
+			return false
+		}
+	}
+	if f.Email != "" && normalizeEmail(acc.Email) != normalizeEmail(f.Email) {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(acc.FirstName+" "+acc.LastName), strings.ToLower(f.Name)) {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !acc.CreatedAt.After(f.CreatedAfter) {
+		return false
+	}
+	if f.MinBalance != nil && acc.Balance < *f.MinBalance {
+		return false
+	}
+	return true
+}
+
+func (s *MemoryStore) EachAccount(ctx context.Context, fn func(*Account) error) error {
+	for _, acc := range s.liveAccounts() {
+		if err := fn(acc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) numberTaken(number int64) bool {
+	for _, acc := range s.accounts {
+		if acc.Number == number {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) Transfer(ctx context.Context, fromID, toID int, amount int64) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.transfer(fromID, toID, amount, 0)
+}
+
+// transfer moves amount from fromID to toID, capturing released of the
+// sender's held money. The caller must hold s.mu.
+func (s *MemoryStore) transfer(fromID, toID int, amount, released int64) (*Transaction, error) {
+	if fromID == toID {
+		return nil, fmt.Errorf("cannot transfer to the same account")
+	}
+	from, ok := s.live(fromID)
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, fromID)
+	}
+	to, ok := s.live(toID)
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, toID)
+	}
+	for _, acc := range []*Account{from, to} {
+		if acc.Status == AccountStatusFrozen {
+			return nil, fmt.Errorf("%w: id %d", ErrAccountFrozen, acc.ID)
+		}
+	}
+	now := time.Now().UTC()
+	debit, credit, err := transferEntries(from, to, amount, s.rates, now)
+	if err != nil {
+		return nil, err
+	}
+	available := *from
+	available.Held -= released
+	if err := checkFunds(&available, amount); err != nil {
+		return nil, err
+	}
+
+	if err := checkPerTransferLimit(from, s.perTransferLimit, amount); err != nil {
+		return nil, err
+	}
+	var spent int64
+	for _, t := range s.transactions {
+		if t.AccountID == fromID && t.Type == TransactionTransferDebit && t.CreatedAt.After(now.Add(-transferLimitWindow)) {
+			spent += t.Amount
+		}
+	}
+	if err := checkDailyLimit(from, s.dailyTransferLimit, spent, amount); err != nil {
+		return nil, err
+	}
+	from.Balance -= amount
+	from.Held -= released
+	to.Balance += credit.Amount
+	for _, acc := range []*Account{from, to} {
+		acc.UpdatedAt = now
+		acc.Version++
+	}
+
+	stored := s.insertTransaction(debit)
+	s.insertTransaction(credit)
+	s.postLedger(transferJournal(debit, credit, from.Currency, to.Currency), now)
+	found := *stored
+	return &found, nil
+}
+
+// PostJournal posts a deposit, withdrawal or fee journal built by Ledger,
+// recording a transaction for each customer entry, and returns those
+// transactions.
+func (s *MemoryStore) PostJournal(ctx context.Context, j *Journal) ([]*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := j.balanceChanges()
+	locked := make(map[int]*Account)
+	for id := range changes {
+		if acc, ok := s.live(id); ok {
+			locked[id] = acc
+		}
+	}
+	if err := checkJournal(j, locked); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for id, change := range changes {
+		locked[id].Balance += change
+		locked[id].UpdatedAt = now
+		locked[id].Version++
+	}
+	var transactions []*Transaction
+	for _, t := range journalTransactions(j, now) {
+		found := *s.insertTransaction(t)
+		transactions = append(transactions, &found)
+	}
+	s.postLedger(j, now)
+	return transactions, nil
+}
+
+// postLedger stamps j with the next journal id and appends its entries. It
+// must be called with s.mu held for writing.
+func (s *MemoryStore) postLedger(j *Journal, now time.Time) {
+	s.nextJournalID++
+	j.stamp(s.nextJournalID, now)
+	for _, e := range j.Entries {
+		e.ID = len(s.ledger) + 1
+		s.ledger = append(s.ledger, e)
+	}
+}
+
+func (s *MemoryStore) GetLedgerEntries(ctx context.Context, accountID, limit, offset int) ([]*LedgerEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []*LedgerEntry{}
+	for i := len(s.ledger) - 1; i >= 0; i-- {
+		e := s.ledger[i]
+		if e.AccountID == nil || *e.AccountID != accountID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(entries) == limit {
+			break
+		}
+		found := *e
+		entries = append(entries, &found)
+	}
+	return entries, nil
+}
+
+// insertTransaction must be called with s.mu held for writing.
+func (s *MemoryStore) insertTransaction(t *Transaction) *Transaction {
+	t.ID = 1
+	if n := len(s.transactions); n > 0 {
+		t.ID = s.transactions[n-1].ID + 1
+	}
+	s.transactions = append(s.transactions, t)
+	return t
+}
+
+func (s *MemoryStore) GetTransactions(ctx context.Context, accountID int, since, until time.Time, limit, offset int) ([]*Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	transactions := []*Transaction{}
+	for i := len(s.transactions) - 1; i >= 0; i-- {
+		t := s.transactions[i]
+		if t.AccountID != accountID {
+			continue
+		}
+		if (!since.IsZero() && t.CreatedAt.Before(since)) || (!until.IsZero() && !t.CreatedAt.Before(until)) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(transactions) == limit {
+			break
+		}
+		found := *t
+		transactions = append(transactions, &found)
+	}
+	return transactions, nil
+}
+
+func (s *MemoryStore) GetTransaction(ctx context.Context, id int) (*Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.transactions {
+		if t.ID == id {
+			found := *t
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: id %d", ErrTransactionNotFound, id)
+}
+
+// ReverseTransfer undoes the transfer whose sender debit has id debitID and
+// returns the sender's compensating credit.
+func (s *MemoryStore) ReverseTransfer(ctx context.Context, debitID int) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var debit, credit *Transaction
+	for _, t := range s.transactions {
+		switch {
+		case t.ID == debitID && t.Type == TransactionTransferDebit:
+			debit = t
+		case debit != nil && t.Type == TransactionTransferCredit && debit.CounterpartyAccountID != nil &&
+			t.AccountID == *debit.CounterpartyAccountID && t.CreatedAt.Equal(debit.CreatedAt):
+			credit = t
+		}
+		if credit != nil {
+			break
+		}
+	}
+	if debit == nil {
+		return nil, fmt.Errorf("%w: no transfer with id %d", ErrTransactionNotFound, debitID)
+	}
+	if credit == nil {
+		return nil, fmt.Errorf("%w: the recipient of transfer %d was purged", ErrAccountNotFound, debitID)
+	}
+	sender, ok := s.live(debit.AccountID)
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, debit.AccountID)
+	}
+	recipient, ok := s.live(credit.AccountID)
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, credit.AccountID)
+	}
+	if err := checkReversal(debit, sender, recipient, credit.Amount); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	reversalDebit, reversalCredit := reversalEntries(debit, credit, now)
+	recipient.Balance -= credit.Amount
+	sender.Balance += debit.Amount
+	for _, acc := range []*Account{sender, recipient} {
+		acc.UpdatedAt = now
+		acc.Version++
+	}
+	debit.Status = TransactionStatusReversed
+	credit.Status = TransactionStatusReversed
+	s.insertTransaction(reversalDebit)
+	stored := s.insertTransaction(reversalCredit)
+	s.postLedger(movementJournal(JournalReversal, reversalDebit, reversalCredit, recipient.Currency, sender.Currency), now)
+	found := *stored
+	return &found, nil
+}
+
+func (s *MemoryStore) CreateScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insertScheduledTransfer(st)
+	return nil
+}
+
+// insertScheduledTransfer must be called with s.mu held for writing.
+func (s *MemoryStore) insertScheduledTransfer(st *ScheduledTransfer) {
+	st.ID = 1
+	if n := len(s.scheduled); n > 0 {
+		st.ID = s.scheduled[n-1].ID + 1
+	}
+	stored := *st
+	s.scheduled = append(s.scheduled, &stored)
+}
+
+func (s *MemoryStore) GetScheduledTransfers(ctx context.Context, accountID, limit, offset int) ([]*ScheduledTransfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	transfers := []*ScheduledTransfer{}
+	for i := len(s.scheduled) - 1; i >= 0; i-- {
+		if s.scheduled[i].AccountID != accountID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(transfers) == limit {
+			break
+		}
+		found := *s.scheduled[i]
+		transfers = append(transfers, &found)
+	}
+	return transfers, nil
+}
+
+func (s *MemoryStore) CancelScheduledTransfer(ctx context.Context, accountID, id int) (*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.scheduled {
+		if st.ID != id || st.AccountID != accountID {
+			continue
+		}
+		if st.Status != ScheduledTransferPending {
+			return nil, fmt.Errorf("%w: scheduled transfer %d is %s", ErrScheduledTransferNotPending, id, st.Status)
+		}
+		st.Status = ScheduledTransferCancelled
+		st.UpdatedAt = time.Now().UTC()
+		found := *st
+		return &found, nil
+	}
+	return nil, fmt.Errorf("%w: id %d", ErrScheduledTransferNotFound, id)
+}
+
+func (s *MemoryStore) ClaimDueScheduledTransfers(ctx context.Context, now time.Time, limit int) ([]*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*ScheduledTransfer
+	for _, st := range s.scheduled {
+		if st.Status == ScheduledTransferPending && !st.ExecuteAt.After(now) {
+			due = append(due, st)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].ExecuteAt.Before(due[j].ExecuteAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	claimed := []*ScheduledTransfer{}
+	for _, st := range due {
+		st.Status = ScheduledTransferProcessing
+		st.UpdatedAt = now
+		found := *st
+		claimed = append(claimed, &found)
+	}
+	return claimed, nil
+}
+
+func (s *MemoryStore) FinishScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error {
+	if err := checkScheduledTransferOutcome(st); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.UpdatedAt = time.Now().UTC()
+	for _, stored := range s.scheduled {
+		if stored.ID == st.ID && stored.Status == ScheduledTransferProcessing {
+			stored.Status = st.Status
+			stored.TransactionID = st.TransactionID
+			stored.FailureReason = st.FailureReason
+			stored.UpdatedAt = st.UpdatedAt
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateStandingOrder(ctx context.Context, o *StandingOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o.ID = 1
+	if n := len(s.standingOrders); n > 0 {
+		o.ID = s.standingOrders[n-1].ID + 1
+	}
+	stored := *o
+	s.standingOrders = append(s.standingOrders, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetStandingOrders(ctx context.Context, accountID, limit, offset int) ([]*StandingOrder, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := []*StandingOrder{}
+	for i := len(s.standingOrders) - 1; i >= 0; i-- {
+		if s.standingOrders[i].AccountID != accountID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(orders) == limit {
+			break
+		}
+		found := *s.standingOrders[i]
+		orders = append(orders, &found)
+	}
+	return orders, nil
+}
+
+func (s *MemoryStore) SetStandingOrderStatus(ctx context.Context, accountID, id int, status string, now time.Time) (*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, o := range s.standingOrders {
+		if o.ID != id || o.AccountID != accountID {
+			continue
+		}
+		if err := o.transition(status, now); err != nil {
+			return nil, err
+		}
+		found := *o
+		return &found, nil
+	}
+	return nil, fmt.Errorf("%w: id %d", ErrStandingOrderNotFound, id)
+}
+
+func (s *MemoryStore) QueueDueStandingOrders(ctx context.Context, now time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*StandingOrder
+	for _, o := range s.standingOrders {
+		if o.Status == StandingOrderActive && !o.NextRunAt.After(now) {
+			due = append(due, o)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextRunAt.Before(due[j].NextRunAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, o := range due {
+		s.insertScheduledTransfer(o.queueRun(now))
+	}
+	return len(due), nil
+}
+
+func (s *MemoryStore) CreateHold(ctx context.Context, h *Hold) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(h.AccountID)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, h.AccountID)
+	}
+	if err := checkHold(acc, h.Amount); err != nil {
+		return err
+	}
+	acc.Held += h.Amount
+	acc.UpdatedAt = h.CreatedAt
+	acc.Version++
+	h.ID = 1
+	if n := len(s.holds); n > 0 {
+		h.ID = s.holds[n-1].ID + 1
+	}
+	stored := *h
+	s.holds = append(s.holds, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetHolds(ctx context.Context, accountID, limit, offset int) ([]*Hold, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	holds := []*Hold{}
+	for i := len(s.holds) - 1; i >= 0; i-- {
+		if s.holds[i].AccountID != accountID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(holds) == limit {
+			break
+		}
+		found := *s.holds[i]
+		holds = append(holds, &found)
+	}
+	return holds, nil
+}
+
+// hold returns the account's stored hold with id. The caller must hold s.mu.
+func (s *MemoryStore) hold(accountID, id int) (*Hold, error) {
+	for _, h := range s.holds {
+		if h.ID == id && h.AccountID == accountID {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: id %d", ErrHoldNotFound, id)
+}
+
+func (s *MemoryStore) CaptureHold(ctx context.Context, accountID, id int) (*Hold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.hold(accountID, id)
+	if err != nil {
+		return nil, err
+	}
+	h := *stored
+	if err := h.resolve(HoldCaptured, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	debit, err := s.transfer(h.AccountID, h.ToAccountID, h.Amount, h.Amount)
+	if err != nil {
+		return nil, err
+	}
+	h.TransactionID = &debit.ID
+	*stored = h
+	return &h, nil
+}
+
+func (s *MemoryStore) ReleaseHold(ctx context.Context, accountID, id int) (*Hold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.hold(accountID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := stored.resolve(HoldReleased, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if acc, ok := s.accounts[stored.AccountID]; ok {
+		acc.Held -= stored.Amount
+		acc.UpdatedAt = stored.UpdatedAt
+		acc.Version++
+	}
+	found := *stored
+	return &found, nil
+}
+
+func (s *MemoryStore) SetOverdraftLimit(ctx context.Context, id int, limit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	acc.OverdraftLimit = limit
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	return nil
+}
+
+func (s *MemoryStore) SetTransferLimits(ctx context.Context, id int, daily, perTransfer *int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	acc.DailyTransferLimit = copyLimit(daily)
+	acc.PerTransferLimit = copyLimit(perTransfer)
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	return nil
+}
+
+// copyLimit keeps a stored account from sharing a limit with the caller.
+func copyLimit(limit *int64) *int64 {
+	if limit == nil {
+		return nil
+	}
+	v := *limit
+	return &v
+}
+
+func (s *MemoryStore) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(id)
+	if !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	acc.TOTPSecret = secret
+	acc.TOTPEnabled = false
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	delete(s.backupCodes, id)
+	return nil
+}
+
+func (s *MemoryStore) EnableTOTP(ctx context.Context, id int, backupCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.live(id)
+	if !ok || acc.TOTPSecret == "" {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	acc.TOTPEnabled = true
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	codes := make(map[string]bool, len(backupCodeHashes))
+	for _, hash := range backupCodeHashes {
+		codes[hash] = true
+	}
+	s.backupCodes[id] = codes
+	return nil
+}
+
+func (s *MemoryStore) UseBackupCode(ctx context.Context, accountID int, codeHash string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.backupCodes[accountID][codeHash] {
+		return ErrBackupCodeInvalid
+	}
+	delete(s.backupCodes[accountID], codeHash)
+	return nil
+}
+
+func (s *MemoryStore) CreateVerificationToken(ctx context.Context, accountID int, tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, accountID)
+	}
+	s.verificationTokens[tokenHash] = verificationToken{accountID: accountID, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemoryStore) ConsumeVerificationToken(ctx context.Context, tokenHash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.verificationTokens[tokenHash]
+	if !ok || !time.Now().Before(token.expiresAt) {
+		return 0, ErrVerificationTokenInvalid
+	}
+	delete(s.verificationTokens, tokenHash)
+	acc, ok := s.live(token.accountID)
+	if !ok {
+		return 0, ErrVerificationTokenInvalid
+	}
+	acc.EmailVerified = true
+	acc.UpdatedAt = time.Now().UTC()
+	acc.Version++
+	return acc.ID, nil
+}
+
+func (s *MemoryStore) CreatePasswordResetToken(ctx context.Context, accountID int, tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, accountID)
+	}
+	s.resetTokens[tokenHash] = verificationToken{accountID: accountID, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemoryStore) ResetPassword(ctx context.Context, tokenHash, hash string, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.resetTokens[tokenHash]
+	if !ok || !now.Before(token.expiresAt) {
+		return 0, ErrPasswordResetTokenInvalid
+	}
+	delete(s.resetTokens, tokenHash)
+	acc, ok := s.live(token.accountID)
+	if !ok {
+		return 0, ErrPasswordResetTokenInvalid
+	}
+	acc.EncryptedPassword = hash
+	acc.UpdatedAt = now
+	acc.Version++
+	for h, t := range s.resetTokens {
+		if t.accountID == acc.ID {
+			delete(s.resetTokens, h)
+		}
+	}
+	s.revokeAccountSessions(acc.ID, 0, now)
+	return acc.ID, nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(ctx context.Context, t *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[t.AccountID]; !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, t.AccountID)
+	}
+	stored := *t
+	s.refreshTokens[t.TokenHash] = &stored
+	return nil
+}
+
+func (s *MemoryStore) RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return ErrRefreshTokenInvalid
+	}
+	next.AccountID, next.FamilyID = t.AccountID, t.FamilyID
+	if err := t.checkRotation(next.CreatedAt); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			s.revokeRefreshTokenFamily(t.FamilyID, next.CreatedAt)
+		}
+		return err
+	}
+	usedAt := next.CreatedAt
+	t.UsedAt = &usedAt
+	stored := *next
+	s.refreshTokens[next.TokenHash] = &stored
+	return nil
+}
+
+func (s *MemoryStore) RevokeRefreshTokenFamily(ctx context.Context, tokenHash string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.refreshTokens[tokenHash]; ok {
+		s.revokeRefreshTokenFamily(t.FamilyID, now)
+	}
+	return nil
+}
+
+// revokeRefreshTokenFamily revokes every token of family not revoked yet and
+// the family's session. The caller must hold s.mu.
+func (s *MemoryStore) revokeRefreshTokenFamily(family string, now time.Time) {
+	for _, t := range s.refreshTokens {
+		if t.FamilyID == family && t.RevokedAt == nil {
+			revokedAt := now
+			t.RevokedAt = &revokedAt
+		}
+	}
+	for _, sess := range s.sessions {
+		if sess.FamilyID == family && sess.RevokedAt == nil {
+			revokedAt := now
+			sess.RevokedAt = &revokedAt
+		}
+	}
+}
+
+func (s *MemoryStore) UpsertSession(ctx context.Context, sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.sessions {
+		if stored.FamilyID == sess.FamilyID {
+			stored.UserAgent, stored.IP = sess.UserAgent, sess.IP
+			stored.LastUsedAt, stored.ExpiresAt = sess.LastUsedAt, sess.ExpiresAt
+			sess.ID, sess.CreatedAt = stored.ID, stored.CreatedAt
+			return nil
+		}
+	}
+	if _, ok := s.accounts[sess.AccountID]; !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, sess.AccountID)
+	}
+	s.nextSessionID++
+	sess.ID = s.nextSessionID
+	stored := *sess
+	s.sessions = append(s.sessions, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetSessions(ctx context.Context, accountID int, now time.Time) ([]*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := []*Session{}
+	for _, sess := range s.sessions {
+		if sess.AccountID == accountID && sess.RevokedAt == nil && now.Before(sess.ExpiresAt) {
+			found := *sess
+			sessions = append(sessions, &found)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// revokeAccountSessions revokes every refresh token and session of an
+// account that is not revoked yet, except the session keep and its refresh
+// tokens. A keep of 0 spares none. The caller must hold s.mu.
+func (s *MemoryStore) revokeAccountSessions(accountID, keep int, now time.Time) {
+	keepFamily := ""
+	for _, sess := range s.sessions {
+		if keep != 0 && sess.ID == keep {
+			keepFamily = sess.FamilyID
+		}
+	}
+	for _, t := range s.refreshTokens {
+		if t.AccountID == accountID && t.RevokedAt == nil && (keepFamily == "" || t.FamilyID != keepFamily) {
+			revokedAt := now
+			t.RevokedAt = &revokedAt
+		}
+	}
+	for _, sess := range s.sessions {
+		if sess.AccountID == accountID && sess.ID != keep && sess.RevokedAt == nil {
+			revokedAt := now
+			sess.RevokedAt = &revokedAt
+		}
+	}
+}
+
+func (s *MemoryStore) RevokeSession(ctx context.Context, accountID, id int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.ID == id && sess.AccountID == accountID && sess.RevokedAt == nil {
+			s.revokeRefreshTokenFamily(sess.FamilyID, now)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: id %d", ErrSessionNotFound, id)
+}
+
+func (s *MemoryStore) RevokeOtherSessions(ctx context.Context, accountID, keep int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeAccountSessions(accountID, keep, now)
+	return nil
+}
+
+func (s *MemoryStore) IsSessionRevoked(ctx context.Context, id int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, sess := range s.sessions {
+		if sess.ID == id {
+			return sess.RevokedAt != nil, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, revoked := s.revokedTokens[jti]
+	return revoked, nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(ctx context.Context, key string, threshold int, lockout time.Duration, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.loginFailures[key]
+	if !ok {
+		f = &loginFailures{}
+		s.loginFailures[key] = f
+	}
+	if !now.Before(f.expiresAt) {
+		f.failures = 0
+	}
+	f.failures++
+	f.expiresAt = now.Add(lockout)
+	if f.failures < threshold {
+		return time.Time{}, nil
+	}
+	f.failures = 0
+	f.lockedUntil = f.expiresAt
+	return f.lockedUntil, nil
+}
+
+func (s *MemoryStore) LoginLockedUntil(ctx context.Context, key string, now time.Time) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if f, ok := s.loginFailures[key]; ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (s *MemoryStore) ClearLoginFailures(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginFailures, key)
+	return nil
+}
+
+func (s *MemoryStore) CreateLoginAttempt(ctx context.Context, a *LoginAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[a.AccountID]; !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, a.AccountID)
+	}
+	s.nextLoginAttemptID++
+	a.ID = s.nextLoginAttemptID
+	stored := *a
+	s.loginAttempts = append(s.loginAttempts, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetLoginAttempts(ctx context.Context, accountID, limit, offset int) ([]*LoginAttempt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	logins := []*LoginAttempt{}
+	for i := len(s.loginAttempts) - 1; i >= 0 && len(logins) < limit; i-- {
+		if a := s.loginAttempts[i]; a.AccountID == accountID {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			found := *a
+			logins = append(logins, &found)
+		}
+	}
+	return logins, nil
+}
+
+func (s *MemoryStore) GetLoginIPs(ctx context.Context, accountID int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ips []string
+	for _, a := range s.loginAttempts {
+		if a.AccountID == accountID && a.Result == LoginResultSuccess && !slices.Contains(ips, a.IP) {
+			ips = append(ips, a.IP)
+		}
+	}
+	return ips, nil
+}
+
+func (s *MemoryStore) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.live(k.AccountID); !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, k.AccountID)
+	}
+	s.nextAPIKeyID++
+	k.ID = s.nextAPIKeyID
+	stored := *k
+	s.apiKeys = append(s.apiKeys, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []*APIKey{}
+	for _, k := range s.apiKeys {
+		if k.AccountID == accountID {
+			found := *k
+			keys = append(keys, &found)
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, k := range s.apiKeys {
+		if k.KeyHash == keyHash && k.RevokedAt == nil {
+			found := *k
+			return &found, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, accountID, id int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.apiKeys {
+		if k.ID == id && k.AccountID == accountID && k.RevokedAt == nil {
+			k.RevokedAt = &now
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: id %d", ErrAPIKeyNotFound, id)
+}
+
+func (s *MemoryStore) CreatePasskey(ctx context.Context, p *Passkey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.live(p.AccountID); !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, p.AccountID)
+	}
+	for _, existing := range s.passkeys {
+		if bytes.Equal(existing.Credential.ID, p.Credential.ID) {
+			return ErrPasskeyExists
+		}
+	}
+	s.nextPasskeyID++
+	p.ID = s.nextPasskeyID
+	stored := *p
+	s.passkeys = append(s.passkeys, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetPasskeys(ctx context.Context, accountID int) ([]*Passkey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	passkeys := []*Passkey{}
+	for _, p := range s.passkeys {
+		if p.AccountID == accountID {
+			found := *p
+			passkeys = append(passkeys, &found)
+		}
+	}
+	return passkeys, nil
+}
+
+func (s *MemoryStore) UpdatePasskey(ctx context.Context, p *Passkey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.passkeys {
+		if existing.ID == p.ID && existing.AccountID == p.AccountID {
+			existing.Credential = p.Credential
+			existing.LastUsedAt = p.LastUsedAt
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: id %d", ErrPasskeyNotFound, p.ID)
+}
+
+func (s *MemoryStore) DeletePasskey(ctx context.Context, accountID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, p := range s.passkeys {
+		if p.ID == id && p.AccountID == accountID {
+			s.passkeys = append(s.passkeys[:i], s.passkeys[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: id %d", ErrPasskeyNotFound, id)
+}
+
+func (s *MemoryStore) CreatePasskeySession(ctx context.Context, session *PasskeySession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[session.AccountID]; !ok {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, session.AccountID)
+	}
+	stored := *session
+	s.passkeySessions[session.TokenHash] = &stored
+	return nil
+}
+
+func (s *MemoryStore) ConsumePasskeySession(ctx context.Context, tokenHash, purpose string, now time.Time) (*PasskeySession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.passkeySessions[tokenHash]
+	if !ok || session.Purpose != purpose || !now.Before(session.ExpiresAt) {
+		return nil, ErrPasskeySessionInvalid
+	}
+	delete(s.passkeySessions, tokenHash)
+	return session, nil
+}
+
+func (s *MemoryStore) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	purged := 0
+	for hash, token := range s.verificationTokens {
+		if !now.Before(token.expiresAt) {
+			delete(s.verificationTokens, hash)
+			purged++
+		}
+	}
+	for hash, token := range s.resetTokens {
+		if !now.Before(token.expiresAt) {
+			delete(s.resetTokens, hash)
+			purged++
+		}
+	}
+	for hash, token := range s.refreshTokens {
+		if !now.Before(token.ExpiresAt) {
+			delete(s.refreshTokens, hash)
+			purged++
+		}
+	}
+	sessions := s.sessions[:0]
+	for _, sess := range s.sessions {
+		if now.Before(sess.ExpiresAt) {
+			sessions = append(sessions, sess)
+		} else {
+			purged++
+		}
+	}
+	s.sessions = sessions
+	for jti, expiresAt := range s.revokedTokens {
+		if !now.Before(expiresAt) {
+			delete(s.revokedTokens, jti)
+			purged++
+		}
+	}
+	for hash, session := range s.passkeySessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(s.passkeySessions, hash)
+			purged++
+		}
+	}
+	for key, f := range s.loginFailures {
+		if !now.Before(f.expiresAt) {
+			delete(s.loginFailures, key)
+			purged++
+		}
+	}
+	for key, result := range s.idempotentResults {
+		if !now.Add(-s.idempotencyKeyTTL).Before(result.CreatedAt) {
+			delete(s.idempotentResults, key)
+			purged++
+		}
+	}
+	logins := s.loginAttempts[:0]
+	for _, a := range s.loginAttempts {
+		if now.Add(-s.loginHistoryRetention).Before(a.CreatedAt) {
+			logins = append(logins, a)
+		} else {
+			purged++
+		}
+	}
+	s.loginAttempts = logins
+	var ids []int
+	cutoff := now.Add(-s.deletedAccountRetention)
+	for id, acc := range s.accounts {
+		if acc.DeletedAt != nil && !cutoff.Before(*acc.DeletedAt) {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		if _, err := s.HardDeleteAccount(ctx, id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (s *MemoryStore) GetIdempotentResult(ctx context.Context, accountID int, key string) (*IdempotentResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result, ok := s.idempotentResults[idempotencyKey{accountID, key}]
+	if !ok || time.Since(result.CreatedAt) >= s.idempotencyKeyTTL {
+		return nil, ErrIdempotentResultNotFound
+	}
+	found := *result
+	return &found, nil
+}
+
+func (s *MemoryStore) StoreIdempotentResult(ctx context.Context, result *IdempotentResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *result
+	s.idempotentResults[idempotencyKey{result.AccountID, result.Key}] = &stored
+	return nil
+}
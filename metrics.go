@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// queryLatencyBuckets are the upper bounds, in seconds, of the
+// gobank_db_query_duration_seconds histogram.
+var queryLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// queryHistogram counts the queries that took at most each of
+// queryLatencyBuckets, cumulatively, as Prometheus expects.
+type queryHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// queryMetrics records how long each distinct SQL statement takes.
+type queryMetrics struct {
+	mu      sync.Mutex
+	queries map[string]*queryHistogram
+}
+
+// dbQueryMetrics is shared by every pool, so the primary and the read
+// replicas add up to one histogram per statement.
+var dbQueryMetrics = newQueryMetrics()
+
+func newQueryMetrics() *queryMetrics {
+	return &queryMetrics{queries: map[string]*queryHistogram{}}
+}
+
+func (m *queryMetrics) observe(query string, d time.Duration) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.queries[query]
+	if !ok {
+		h = &queryHistogram{buckets: make([]uint64, len(queryLatencyBuckets))}
+		m.queries[query] = h
+	}
+	for i, bound := range queryLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// writeTo writes the histograms in the Prometheus text exposition format.
+func (m *queryMetrics) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queries := make([]string, 0, len(m.queries))
+	for query := range m.queries {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+
+	var b strings.Builder
+	b.WriteString("# HELP gobank_db_query_duration_seconds Time taken by database queries, including reading their rows.\n")
+	b.WriteString("# TYPE gobank_db_query_duration_seconds histogram\n")
+	for _, query := range queries {
+		h := m.queries[query]
+		label := prometheusLabelEscaper.Replace(query)
+		for i, bound := range queryLatencyBuckets {
+			fmt.Fprintf(&b, "gobank_db_query_duration_seconds_bucket{query=\"%s\",le=\"%g\"} %d\n", label, bound, h.buckets[i])
+		}
+		fmt.Fprintf(&b, "gobank_db_query_duration_seconds_bucket{query=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(&b, "gobank_db_query_duration_seconds_sum{query=\"%s\"} %g\n", label, h.sum)
+		fmt.Fprintf(&b, "gobank_db_query_duration_seconds_count{query=\"%s\"} %d\n", label, h.count)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+const queryTraceKey contextKey = "query_trace"
+
+// queryTrace is what TraceQueryStart leaves in the context for
+// TraceQueryEnd.
+type queryTrace struct {
+	query string
+	start time.Time
+}
+
+// queryTracer feeds every query a pool runs into metrics, and logs the ones
+// taking slowThreshold or longer. Arguments are never logged, as they hold
+// password hashes and personal details.
+type queryTracer struct {
+	metrics       *queryMetrics
+	slowThreshold time.Duration
+	logger        *slog.Logger
+}
+
+func (t *queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryTraceKey, queryTrace{query: normalizeQuery(data.SQL), start: time.Now()})
+}
+
+func (t *queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	trace, ok := ctx.Value(queryTraceKey).(queryTrace)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(trace.start)
+	t.metrics.observe(trace.query, elapsed)
+	if t.slowThreshold > 0 && elapsed >= t.slowThreshold {
+		t.logger.WarnContext(ctx, "slow query", "query", trace.query, "duration", elapsed, "error", data.Err)
+	}
+}
+
+// normalizeQuery collapses the whitespace in sql, so statements written
+// over several lines read as one in logs and metric labels.
+func normalizeQuery(sql string) string {
+	return strings.Join(strings.Fields(sql), " ")
+}
+
+// serveMetrics answers GET /metrics on ln until ctx is done. It is kept off
+// the API listener so scrapers need no credentials and the SQL in the labels
+// is not exposed to clients.
+func (s *APIServer) serveMetrics(ctx context.Context, ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := dbQueryMetrics.writeTo(w); err != nil {
+			s.logger.WarnContext(r.Context(), "writing metrics failed", "error", err)
+		}
+	})
+	server := &http.Server{
+		Handler:  mux,
+		ErrorLog: slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
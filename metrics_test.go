@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryMetrics(t *testing.T) {
+	m := newQueryMetrics()
+	m.observe("SELECT 1", 3*time.Millisecond)
+	m.observe("SELECT 1", 2*time.Second)
+	m.observe(`SELECT "a\b"`, time.Millisecond)
+
+	var buf bytes.Buffer
+	require.Nil(t, m.writeTo(&buf))
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE gobank_db_query_duration_seconds histogram\n")
+	assert.Contains(t, out, `gobank_db_query_duration_seconds_bucket{query="SELECT 1",le="0.001"} 0`+"\n")
+	assert.Contains(t, out, `gobank_db_query_duration_seconds_bucket{query="SELECT 1",le="0.005"} 1`+"\n")
+	assert.Contains(t, out, `gobank_db_query_duration_seconds_bucket{query="SELECT 1",le="2.5"} 2`+"\n")
+	assert.Contains(t, out, `gobank_db_query_duration_seconds_bucket{query="SELECT 1",le="+Inf"} 2`+"\n")
+	assert.Contains(t, out, `gobank_db_query_duration_seconds_sum{query="SELECT 1"} 2.003`+"\n")
+	assert.Contains(t, out, `gobank_db_query_duration_seconds_count{query="SELECT 1"} 2`+"\n")
+	assert.Contains(t, out, `gobank_db_query_duration_seconds_count{query="SELECT \"a\\b\""} 1`+"\n", "labels are escaped")
+}
+
+func TestQueryTracerLogsSlowQueries(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info")
+	require.Nil(t, err)
+	tracer := &queryTracer{metrics: newQueryMetrics(), slowThreshold: time.Hour, logger: logger}
+
+	ctx := tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT *\n\tFROM account WHERE email = $1", Args: []any{"abc@abc.com"}})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+	assert.Empty(t, buf.String())
+	assert.Equal(t, uint64(1), tracer.metrics.queries["SELECT * FROM account WHERE email = $1"].count)
+
+	tracer.slowThreshold = time.Nanosecond
+	ctx = tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT *\n\tFROM account WHERE email = $1", Args: []any{"abc@abc.com"}})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: errors.New("boom")})
+	assert.Contains(t, buf.String(), `"msg":"slow query"`)
+	assert.Contains(t, buf.String(), `"query":"SELECT * FROM account WHERE email = $1"`)
+	assert.Contains(t, buf.String(), `"error":"boom"`)
+	assert.NotContains(t, buf.String(), "abc@abc.com", "arguments are not logged")
+}
+
+func TestServeMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewAPIServer(":0", NewMemoryStore(), &Config{}, discardLogger)
+	done := make(chan error)
+	go func() { done <- server.serveMetrics(ctx, ln) }()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	assert.Contains(t, string(body), "gobank_db_query_duration_seconds")
+
+	cancel()
+	assert.Nil(t, <-done)
+}
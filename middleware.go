@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	corsAllowedMethods = strings.Join([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}, ", ")
+	corsAllowedHeaders = strings.Join([]string{"Authorization", "Content-Type", csrfHeader, requestIDHeader}, ", ")
+	corsExposedHeaders = strings.Join([]string{requestIDHeader}, ", ")
+)
+
+// withCORS sets the CORS response headers for requests from an allowed origin
+// and answers preflight requests with 204 without reaching next.
+func withCORS(allowedOrigins []string, allowCredentials bool, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+			switch {
+			case allowed[origin]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if allowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			case allowed["*"]:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// defaultContentSecurityPolicy lets responses load nothing and be framed by
+// nothing, since the API serves JSON rather than pages.
+const defaultContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+
+// serverIdentityHeaders name the software serving a response, which only
+// helps an attacker pick exploits.
+var serverIdentityHeaders = []string{"Server", "X-Powered-By"}
+
+// withSecurityHeaders sets the hardening headers configured in cfg on every
+// response and strips serverIdentityHeaders. Handlers may still override a
+// header, e.g. to relax the Content-Security-Policy of a page.
+func withSecurityHeaders(cfg *Config, next http.Handler) http.Handler {
+	headers := http.Header{"X-Content-Type-Options": {"nosniff"}}
+	if cfg.HSTSMaxAge > 0 {
+		headers.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(cfg.HSTSMaxAge.Seconds())))
+	}
+	for name, value := range map[string]string{
+		"Content-Security-Policy": cfg.ContentSecurityPolicy,
+		"X-Frame-Options":         cfg.FrameOptions,
+	} {
+		if value != "" && value != "-" {
+			headers.Set(name, value)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range headers {
+			w.Header()[name] = values
+		}
+		next.ServeHTTP(&identityStripper{ResponseWriter: w}, r)
+	})
+}
+
+// identityStripper drops serverIdentityHeaders just before the response
+// headers are written.
+type identityStripper struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *identityStripper) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for _, name := range serverIdentityHeaders {
+			w.Header().Del(name)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *identityStripper) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// withRequestTimeout cancels each request's context after timeout. Storage
+// calls take the request context, so a client that disconnects or a request
+// that runs too long stops its queries. Zero disables the timeout.
+func withRequestTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
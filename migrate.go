@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+	// down undoes sql. It is empty when the migration cannot be rolled back.
+	down string
+}
+
+// loadMigrations reads the embedded migrations ordered by version. Files are
+// named <version>_<description>.sql, e.g. 0001_create_account_table.sql,
+// and may be paired with a <version>_<description>.down.sql rolling them
+// back.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("could not read migrations: %v", err)
+	}
+
+	seen := make(map[int]string)
+	downs := make(map[int]string)
+	var migrations []migration
+	for _, entry := range entries {
+		name := entry.Name()
+		up, isDown := strings.CutSuffix(name, ".down.sql")
+		prefix, _, ok := strings.Cut(up, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<description>.sql", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has a non numeric version: %v", name, err)
+		}
+		body, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %s: %v", name, err)
+		}
+		if isDown {
+			downs[version] = string(body)
+			continue
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, version)
+		}
+		seen[version] = name
+		migrations = append(migrations, migration{version: version, name: name, sql: string(body)})
+	}
+	for i, m := range migrations {
+		migrations[i].down = downs[m.version]
+		delete(downs, m.version)
+	}
+	if len(downs) > 0 {
+		var orphans []int
+		for version := range downs {
+			orphans = append(orphans, version)
+		}
+		sort.Ints(orphans)
+		return nil, fmt.Errorf("down migrations for versions %v have no migration", orphans)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// appliedMigrations returns the versions recorded in schema_migrations,
+// creating the table if needed.
+func (s *PostgresStore) appliedMigrations() (map[int]bool, error) {
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int primary key,
+		applied_at timestamp not null default now()
+	)`
+	ctx := context.Background()
+	if _, err := s.db.Exec(ctx, query); err != nil {
+		return nil, fmt.Errorf("could not create schema_migrations table: %v", err)
+	}
+
+	rows, err := s.db.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("could not read applied migrations: %v", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("could not read applied migrations: %v", err)
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// PendingMigrations returns the embedded migrations not yet applied.
+func (s *PostgresStore) PendingMigrations() ([]migration, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies every embedded migration that is not yet recorded in
+// schema_migrations, each inside its own transaction.
+func (s *PostgresStore) Migrate() error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := s.applyMigration(m, m.sql, "INSERT INTO schema_migrations (version) VALUES ($1)"); err != nil {
+			return err
+		}
+		s.logger.Info("applied migration", "migration", m.name, "version", m.version)
+	}
+	return nil
+}
+
+// MigrateDown rolls back the latest steps applied migrations, newest first,
+// each inside its own transaction. It stops at the first migration without
+// a down migration.
+func (s *PostgresStore) MigrateDown(steps int) error {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if !applied[m.version] {
+			continue
+		}
+		if m.down == "" {
+			return fmt.Errorf("migration %s cannot be rolled back", m.name)
+		}
+		if err := s.applyMigration(m, m.down, "DELETE FROM schema_migrations WHERE version = $1"); err != nil {
+			return err
+		}
+		s.logger.Info("rolled back migration", "migration", m.name, "version", m.version)
+		steps--
+	}
+	return nil
+}
+
+// applyMigration runs sql, one direction of m, and records it with record.
+func (s *PostgresStore) applyMigration(m migration, sql, record string) error {
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start transaction for migration %s: %v", m.name, err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Exec without arguments uses the simple protocol, so a migration may hold
+	// several statements.
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("could not apply migration %s: %v", m.name, err)
+	}
+	if _, err := tx.Exec(ctx, record, m.version); err != nil {
+		return fmt.Errorf("could not record migration %s: %v", m.name, err)
+	}
+	return tx.Commit(ctx)
+}
+
+// runMigrateCommand runs "gobank migrate [up | down [steps] | status]".
+// up, the default, applies pending migrations, down rolls back the latest
+// steps (default 1) and status lists the migrations not yet applied.
+func runMigrateCommand(store *PostgresStore, args []string, out io.Writer) error {
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch {
+	case command == "up" && len(args) == 0:
+		return store.Migrate()
+	case command == "down" && len(args) <= 1:
+		steps := 1
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return fmt.Errorf("migrate down takes a positive number of steps, got %q", args[0])
+			}
+			steps = n
+		}
+		return store.MigrateDown(steps)
+	case command == "status" && len(args) == 0:
+		pending, err := store.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			fmt.Fprintln(out, "database is up to date")
+		}
+		for _, m := range pending {
+			fmt.Fprintln(out, "pending", m.name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("usage: gobank migrate [up | down [steps] | status]")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	require.Nil(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, m.name)
+		assert.NotEmpty(t, m.sql, m.name)
+		assert.NotEmpty(t, m.down, m.name)
+	}
+}
+
+func TestMigrateCommandUsage(t *testing.T) {
+	for _, args := range [][]string{{"sideways"}, {"down", "0"}, {"down", "two"}, {"up", "1"}, {"status", "all"}} {
+		assert.NotNil(t, runMigrateCommand(nil, args, &bytes.Buffer{}), args)
+	}
+}
+
+// TestMigrateDown needs a disposable database described by config.yml.
+func TestMigrateDown(t *testing.T) {
+	if os.Getenv("GOBANK_TEST_POSTGRES") == "" {
+		t.Skip("set GOBANK_TEST_POSTGRES to run against the database in config.yml")
+	}
+	cfg, err := loadConfig("config.yml")
+	require.Nil(t, err)
+	store, err := NewPostgresStore(cfg, discardLogger)
+	require.Nil(t, err)
+	t.Cleanup(func() { store.pool.Close() })
+	require.Nil(t, store.Migrate())
+
+	require.Nil(t, runMigrateCommand(store, []string{"down", "2"}, &bytes.Buffer{}))
+	var out bytes.Buffer
+	require.Nil(t, runMigrateCommand(store, []string{"status"}, &out))
+	migrations, err := loadMigrations()
+	require.Nil(t, err)
+	last := migrations[len(migrations)-2:]
+	assert.Equal(t, "pending "+last[0].name+"\npending "+last[1].name+"\n", out.String())
+
+	require.Nil(t, runMigrateCommand(store, nil, &bytes.Buffer{}))
+	out.Reset()
+	require.Nil(t, runMigrateCommand(store, []string{"status"}, &out))
+	assert.Equal(t, "database is up to date\n", out.String())
+}
+
+// baselineSchema is the account table gobank created before it had
+// migrations. Databases built by it must still migrate to the current schema.
+const baselineSchema = `CREATE TABLE IF NOT EXISTS account (
+	id serial primary key,
+	first_name varchar(50),
+	last_name varchar(50),
+	email varchar(50),
+	encrypted_password text,
+	balance numeric,
+	created_at timestamp
+)`
+
+// resetDatabase drops everything in the database described by config.yml.
+func resetDatabase(t *testing.T) *PostgresStore {
+	cfg, err := loadConfig("config.yml")
+	require.Nil(t, err)
+	store, err := NewPostgresStore(cfg, discardLogger)
+	require.Nil(t, err)
+	t.Cleanup(func() { store.pool.Close() })
+	_, err = store.db.Exec(context.Background(), "DROP SCHEMA public CASCADE; CREATE SCHEMA public")
+	require.Nil(t, err)
+	return store
+}
+
+// resetToBaseline recreates the baseline schema with two accounts in it.
+func resetToBaseline(t *testing.T) *PostgresStore {
+	store := resetDatabase(t)
+	ctx := context.Background()
+	_, err := store.db.Exec(ctx, baselineSchema)
+	require.Nil(t, err)
+	_, err = store.db.Exec(ctx, "INSERT INTO account (first_name, last_name, email, encrypted_password, balance, created_at) VALUES ('a', 'b', 'old1@abc.com', 'x', 10, now()), ('c', 'd', 'old2@abc.com', 'x', 20, now())")
+	require.Nil(t, err)
+	return store
+}
+
+// schemaOf describes the columns, constraints and indexes of store's tables.
+func schemaOf(t *testing.T, store *PostgresStore) []string {
+	rows, err := store.db.Query(context.Background(), `
+		SELECT table_name || '.' || column_name || ' ' || data_type || ' ' || is_nullable || ' ' || coalesce(column_default, '')
+		FROM information_schema.columns WHERE table_schema = 'public'
+		UNION ALL
+		SELECT conrelid::regclass || ' ' || conname || ' ' || pg_get_constraintdef(oid)
+		FROM pg_constraint WHERE connamespace = 'public'::regnamespace
+		UNION ALL
+		SELECT indexdef FROM pg_indexes WHERE schemaname = 'public'
+		ORDER BY 1`)
+	require.Nil(t, err)
+	defer rows.Close()
+	var schema []string
+	for rows.Next() {
+		var line string
+		require.Nil(t, rows.Scan(&line))
+		schema = append(schema, line)
+	}
+	require.Nil(t, rows.Err())
+	return schema
+}
+
+// TestMigrateFromBaselineSchema needs a disposable database described by
+// config.yml.
+func TestMigrateFromBaselineSchema(t *testing.T) {
+	if os.Getenv("GOBANK_TEST_POSTGRES") == "" {
+		t.Skip("set GOBANK_TEST_POSTGRES to run against the database in config.yml")
+	}
+	store := resetToBaseline(t)
+	require.Nil(t, store.Migrate())
+
+	ctx := context.Background()
+	old1, err := store.GetAccountByEmail(ctx, "old1@abc.com")
+	require.Nil(t, err)
+	old2, err := store.GetAccountByEmail(ctx, "old2@abc.com")
+	require.Nil(t, err)
+	for _, acc := range []*Account{old1, old2} {
+		assert.GreaterOrEqual(t, acc.Number, int64(minAccountNumber))
+		assert.LessOrEqual(t, acc.Number, int64(maxAccountNumber))
+	}
+	assert.NotEqual(t, old1.Number, old2.Number)
+
+	acc, err := NewAccount("first", "last", "new@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	found, err := store.GetAccountByNumber(ctx, acc.Number)
+	require.Nil(t, err)
+	assert.Equal(t, acc.ID, found.ID)
+}
+
+// TestMigrateSchemaParity needs a disposable database described by
+// config.yml.
+func TestMigrateSchemaParity(t *testing.T) {
+	if os.Getenv("GOBANK_TEST_POSTGRES") == "" {
+		t.Skip("set GOBANK_TEST_POSTGRES to run against the database in config.yml")
+	}
+	store := resetDatabase(t)
+	require.Nil(t, store.Migrate())
+	fresh := schemaOf(t, store)
+
+	store = resetToBaseline(t)
+	require.Nil(t, store.Migrate())
+	assert.Equal(t, fresh, schemaOf(t, store), "a baseline database should migrate to the schema of a new one")
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS account (
+	id serial primary key,
+	first_name varchar(50),
+	last_name varchar(50),
+	email varchar(50),
+	encrypted_password text,
+	balance numeric,
+	created_at timestamp
+);
@@ -0,0 +1,2 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS updated_at timestamp;
+UPDATE account SET updated_at = created_at WHERE updated_at IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS version int not null default 1;
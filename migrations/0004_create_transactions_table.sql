@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS transactions (
+	id serial primary key,
+	account_id int not null references account(id),
+	type varchar(20) not null,
+	amount bigint not null,
+	counterparty_account_id int references account(id),
+	created_at timestamp not null
+);
+CREATE INDEX IF NOT EXISTS transactions_account_id_created_at_idx ON transactions (account_id, created_at);
@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS daily_transfer_limit bigint;
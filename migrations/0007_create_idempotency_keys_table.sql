@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	account_id int not null references account(id),
+	key varchar(255) not null,
+	status_code int not null,
+	body bytea not null,
+	created_at timestamp not null,
+	primary key (account_id, key)
+);
@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS currency char(3) not null default 'USD';
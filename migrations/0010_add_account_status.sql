@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS status varchar(20) not null default 'active';
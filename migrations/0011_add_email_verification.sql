@@ -0,0 +1,8 @@
+-- accounts that existed before verification was introduced stay usable
+ALTER TABLE account ADD COLUMN IF NOT EXISTS email_verified boolean not null default true;
+ALTER TABLE account ALTER COLUMN email_verified SET DEFAULT false;
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+	token_hash char(64) primary key,
+	account_id int not null references account(id),
+	expires_at timestamp not null
+);
@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS overdraft_limit bigint not null default 0;
@@ -0,0 +1,3 @@
+-- emails stay lower cased
+DROP INDEX IF EXISTS account_email_key;
+ALTER TABLE account ADD CONSTRAINT account_email_key UNIQUE (email);
@@ -0,0 +1,6 @@
+-- emails are unique whatever their case. Databases that ran 0001 back when
+-- it declared email unique still have that constraint, which the index
+-- replaces.
+UPDATE account SET email = lower(btrim(email)) WHERE email <> lower(btrim(email));
+ALTER TABLE account DROP CONSTRAINT IF EXISTS account_email_key;
+CREATE UNIQUE INDEX IF NOT EXISTS account_email_key ON account (lower(email));
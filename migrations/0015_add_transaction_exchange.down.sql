@@ -0,0 +1,3 @@
+ALTER TABLE transactions DROP COLUMN IF EXISTS exchange_rate;
+ALTER TABLE transactions DROP COLUMN IF EXISTS original_amount;
+ALTER TABLE transactions DROP COLUMN IF EXISTS original_currency;
@@ -0,0 +1,3 @@
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS exchange_rate double precision;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS original_amount bigint;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS original_currency char(3);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS ledger_entries;
+DROP SEQUENCE IF EXISTS ledger_journal_id_seq;
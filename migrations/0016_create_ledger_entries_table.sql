@@ -0,0 +1,27 @@
+CREATE SEQUENCE IF NOT EXISTS ledger_journal_id_seq;
+-- account_id has no foreign key: entries outlive purged accounts so the
+-- books keep balancing.
+CREATE TABLE IF NOT EXISTS ledger_entries (
+	id bigserial primary key,
+	journal_id bigint not null,
+	kind varchar(20) not null,
+	account_id int,
+	system_account varchar(20),
+	direction varchar(6) not null check (direction IN ('debit', 'credit')),
+	amount bigint not null check (amount > 0),
+	currency char(3) not null,
+	created_at timestamp not null,
+	check ((account_id IS NULL) <> (system_account IS NULL))
+);
+CREATE INDEX IF NOT EXISTS ledger_entries_account_id_idx ON ledger_entries (account_id, id);
+CREATE INDEX IF NOT EXISTS ledger_entries_journal_id_idx ON ledger_entries (journal_id);
+
+-- Existing balances become opening journals against equity.
+WITH opening AS (
+	SELECT id, balance, currency, nextval('ledger_journal_id_seq') AS journal_id
+	FROM account WHERE balance <> 0
+)
+INSERT INTO ledger_entries (journal_id, kind, account_id, system_account, direction, amount, currency, created_at)
+SELECT journal_id, 'opening', id, NULL, CASE WHEN balance > 0 THEN 'credit' ELSE 'debit' END, abs(balance), currency, now() at time zone 'utc' FROM opening
+UNION ALL
+SELECT journal_id, 'opening', NULL, 'equity', CASE WHEN balance > 0 THEN 'debit' ELSE 'credit' END, abs(balance), currency, now() at time zone 'utc' FROM opening;
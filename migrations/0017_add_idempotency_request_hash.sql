@@ -0,0 +1,3 @@
+-- Keys stored before this column existed have an empty hash and replay for
+-- any request, as they always did.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS request_hash varchar(64) not null default '';
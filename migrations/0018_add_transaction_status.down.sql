@@ -0,0 +1,2 @@
+ALTER TABLE transactions DROP COLUMN IF EXISTS reversal_of;
+ALTER TABLE transactions DROP COLUMN IF EXISTS status;
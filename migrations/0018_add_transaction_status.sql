@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS status varchar(20) not null default 'completed';
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reversal_of int references transactions(id);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS scheduled_transfers (
+	id serial primary key,
+	account_id int not null references account(id),
+	to_account_id int not null references account(id),
+	amount bigint not null check (amount > 0),
+	execute_at timestamp not null,
+	status varchar(20) not null,
+	transaction_id int references transactions(id),
+	failure_reason text not null default '',
+	created_at timestamp not null,
+	updated_at timestamp not null
+);
+CREATE INDEX IF NOT EXISTS scheduled_transfers_account_id_idx ON scheduled_transfers (account_id, id);
+CREATE INDEX IF NOT EXISTS scheduled_transfers_due_idx ON scheduled_transfers (execute_at) WHERE status = 'pending';
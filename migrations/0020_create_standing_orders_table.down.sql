@@ -0,0 +1,2 @@
+ALTER TABLE scheduled_transfers DROP COLUMN IF EXISTS standing_order_id;
+DROP TABLE IF EXISTS standing_orders;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS standing_orders (
+	id serial primary key,
+	account_id int not null references account(id),
+	to_account_id int not null references account(id),
+	amount bigint not null check (amount > 0),
+	frequency varchar(10) not null,
+	start_at timestamp not null,
+	next_run_at timestamp not null,
+	end_at timestamp,
+	max_runs int,
+	runs int not null default 0,
+	status varchar(20) not null,
+	created_at timestamp not null,
+	updated_at timestamp not null
+);
+CREATE INDEX IF NOT EXISTS standing_orders_account_id_idx ON standing_orders (account_id, id);
+CREATE INDEX IF NOT EXISTS standing_orders_due_idx ON standing_orders (next_run_at) WHERE status = 'active';
+
+ALTER TABLE scheduled_transfers ADD COLUMN IF NOT EXISTS standing_order_id int references standing_orders(id);
@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS per_transfer_limit bigint;
@@ -0,0 +1,13 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS held bigint not null default 0;
+
+CREATE TABLE IF NOT EXISTS holds (
+	id serial primary key,
+	account_id int not null references account(id),
+	to_account_id int not null references account(id),
+	amount bigint not null check (amount > 0),
+	status varchar(20) not null,
+	transaction_id int references transactions(id),
+	created_at timestamp not null,
+	updated_at timestamp not null
+);
+CREATE INDEX IF NOT EXISTS holds_account_id_idx ON holds (account_id, id);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash char(64) primary key,
+	account_id int not null references account(id),
+	family_id varchar(64) not null,
+	expires_at timestamp not null,
+	created_at timestamp not null,
+	used_at timestamp,
+	revoked_at timestamp
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS revoked_access_tokens (
+	jti varchar(64) primary key,
+	expires_at timestamp not null
+);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	token_hash char(64) primary key,
+	account_id int not null references account(id),
+	expires_at timestamp not null
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS totp_backup_codes;
+ALTER TABLE account DROP COLUMN IF EXISTS totp_enabled;
@@ -0,0 +1,9 @@
+-- secrets enrolled before activation was introduced were in use straight away
+ALTER TABLE account ADD COLUMN IF NOT EXISTS totp_enabled boolean not null default false;
+UPDATE account SET totp_enabled = true WHERE totp_secret <> '';
+CREATE TABLE IF NOT EXISTS totp_backup_codes (
+	account_id int not null references account(id),
+	code_hash char(64) not null,
+	used_at timestamp,
+	primary key (account_id, code_hash)
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS passkeys (
+	id serial primary key,
+	account_id int not null references account(id),
+	credential_id bytea not null unique,
+	credential jsonb not null,
+	created_at timestamp not null,
+	last_used_at timestamp
+);
+CREATE INDEX IF NOT EXISTS passkeys_account_id_idx ON passkeys (account_id);
+CREATE TABLE IF NOT EXISTS passkey_sessions (
+	token_hash char(64) primary key,
+	account_id int not null references account(id),
+	purpose varchar(16) not null,
+	data jsonb not null,
+	expires_at timestamp not null
+);
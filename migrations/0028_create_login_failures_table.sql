@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+	key varchar(320) primary key,
+	failures int not null default 0,
+	locked_until timestamp,
+	expires_at timestamp not null
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	id serial primary key,
+	account_id int not null references account(id),
+	name varchar(100) not null,
+	prefix varchar(16) not null,
+	scopes text[] not null,
+	key_hash char(64) not null unique,
+	created_at timestamp not null,
+	revoked_at timestamp
+);
+CREATE INDEX IF NOT EXISTS api_keys_account_id_idx ON api_keys (account_id);
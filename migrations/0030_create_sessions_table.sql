@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS sessions (
+	id serial primary key,
+	account_id int not null references account(id),
+	family_id varchar(64) not null unique,
+	user_agent varchar(512) not null,
+	ip varchar(64) not null,
+	created_at timestamp not null,
+	last_used_at timestamp not null,
+	expires_at timestamp not null,
+	revoked_at timestamp
+);
+CREATE INDEX IF NOT EXISTS sessions_account_id_idx ON sessions (account_id);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id serial primary key,
+	account_id int not null references account(id),
+	ip varchar(64) not null,
+	user_agent varchar(512) not null,
+	result varchar(16) not null,
+	created_at timestamp not null
+);
+CREATE INDEX IF NOT EXISTS login_attempts_account_id_idx ON login_attempts (account_id, id);
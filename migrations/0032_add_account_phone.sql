@@ -0,0 +1 @@
+ALTER TABLE account ADD COLUMN IF NOT EXISTS phone bigint NOT NULL DEFAULT 0;
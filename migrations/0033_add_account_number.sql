@@ -0,0 +1,25 @@
+-- accounts get a number separate from the serial id, see newAccountNumber
+ALTER TABLE account ADD COLUMN IF NOT EXISTS number bigint;
+
+-- give existing accounts random 10 digit numbers, drawing again for any that
+-- collide
+DO $$
+BEGIN
+	LOOP
+		UPDATE account SET number = 1000000000 + floor(random() * 9000000000)::bigint WHERE number IS NULL;
+		UPDATE account SET number = NULL WHERE id IN (
+			SELECT id FROM (
+				SELECT id, row_number() OVER (PARTITION BY number ORDER BY id) AS n FROM account
+			) numbered WHERE n > 1
+		);
+		EXIT WHEN NOT EXISTS (SELECT 1 FROM account WHERE number IS NULL);
+	END LOOP;
+END $$;
+
+ALTER TABLE account ALTER COLUMN number SET NOT NULL;
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'account_number_key') THEN
+		ALTER TABLE account ADD CONSTRAINT account_number_key UNIQUE (number);
+	END IF;
+END $$;
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultCurrency is used for accounts opened without a currency.
+const DefaultCurrency = "USD"
+
+// currencyMinorUnits maps the supported ISO 4217 codes to the number of
+// decimal places of their minor unit. Balances and amounts are always stored
+// in minor units, e.g. cents for USD.
+var currencyMinorUnits = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KWD": 3,
+	"USD": 2,
+}
+
+func isSupportedCurrency(code string) bool {
+	_, ok := currencyMinorUnits[code]
+	return ok
+}
+
+// supportedCurrencies returns the supported codes in sorted order.
+func supportedCurrencies() []string {
+	codes := make([]string, 0, len(currencyMinorUnits))
+	for code := range currencyMinorUnits {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Money is an amount in the minor units of Currency.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// String formats m in major units followed by the currency code, e.g.
+// "12.34 USD" for 1234 cents.
+func (m Money) String() string {
+	digits := currencyMinorUnits[m.Currency]
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if digits == 0 {
+		return fmt.Sprintf("%s%d %s", sign, amount, m.Currency)
+	}
+	scale := int64(1)
+	for i := 0; i < digits; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/scale, digits, amount%scale, m.Currency)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoneyString(t *testing.T) {
+	for _, tc := range []struct {
+		money Money
+		want  string
+	}{
+		{Money{Amount: 1234, Currency: "USD"}, "12.34 USD"},
+		{Money{Amount: 5, Currency: "EUR"}, "0.05 EUR"},
+		{Money{Amount: -1050, Currency: "GBP"}, "-10.50 GBP"},
+		{Money{Amount: 500, Currency: "JPY"}, "500 JPY"},
+		{Money{Amount: 1001, Currency: "KWD"}, "1.001 KWD"},
+	} {
+		assert.Equal(t, tc.want, tc.money.String())
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+const (
+	OAuthProviderOIDC   = "oidc"
+	OAuthProviderGitHub = "github"
+
+	// oauthStateCookie carries the state, nonce and PKCE verifier of a
+	// social login from the redirect to the provider back to the callback.
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = 10 * time.Minute
+
+	defaultGitHubAPIURL = "https://api.github.com"
+)
+
+// socialIdentity is what a provider vouches for about the person logging in.
+// Email is only set when the provider has verified it.
+type socialIdentity struct {
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+// oauthProvider runs the provider specific parts of a social login.
+type oauthProvider interface {
+	authCodeURL(state, nonce, verifier string) string
+	// identity exchanges the code from the callback and returns who logged
+	// in.
+	identity(ctx context.Context, code, nonce, verifier string) (*socialIdentity, error)
+}
+
+// oauthProviders builds the configured providers on first use, since OIDC
+// discovery needs the provider to be reachable.
+type oauthProviders struct {
+	mu        sync.Mutex
+	cfg       map[string]OAuthProviderConfig
+	providers map[string]oauthProvider
+}
+
+func newOAuthProviders(cfg map[string]OAuthProviderConfig) *oauthProviders {
+	return &oauthProviders{cfg: cfg, providers: make(map[string]oauthProvider)}
+}
+
+func (o *oauthProviders) get(ctx context.Context, name string) (oauthProvider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if p, ok := o.providers[name]; ok {
+		return p, nil
+	}
+	cfg, ok := o.cfg[name]
+	if !ok {
+		return nil, &HTTPError{Status: http.StatusNotFound, Code: "LOGIN_PROVIDER_NOT_FOUND", Message: fmt.Sprintf("unknown login provider %q", name)}
+	}
+	oauthCfg := oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
+		Scopes:       cfg.Scopes,
+	}
+	var p oauthProvider
+	switch cfg.Type {
+	case "", OAuthProviderOIDC:
+		provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("could not discover login provider %q: %w", name, err)
+		}
+		oauthCfg.Endpoint = provider.Endpoint()
+		if len(oauthCfg.Scopes) == 0 {
+			oauthCfg.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+		}
+		p = &oidcProvider{config: oauthCfg, verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID})}
+	case OAuthProviderGitHub:
+		oauthCfg.Endpoint = github.Endpoint
+		if len(oauthCfg.Scopes) == 0 {
+			oauthCfg.Scopes = []string{"read:user", "user:email"}
+		}
+		p = &githubProvider{config: oauthCfg, apiURL: defaultGitHubAPIURL}
+	default:
+		return nil, fmt.Errorf("login provider %q has unknown type %q", name, cfg.Type)
+	}
+	o.providers[name] = p
+	return p, nil
+}
+
+// oidcProvider logs in with any OpenID Connect provider, such as Google.
+type oidcProvider struct {
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func (p *oidcProvider) authCodeURL(state, nonce, verifier string) string {
+	return p.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+func (p *oidcProvider) identity(ctx context.Context, code, nonce, verifier string) (*socialIdentity, error) {
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("provider returned no id token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		GivenName     string `json:"given_name"`
+		FamilyName    string `json:"family_name"`
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("invalid id token claims: %w", err)
+	}
+	identity := &socialIdentity{FirstName: claims.GivenName, LastName: claims.FamilyName}
+	if identity.FirstName == "" {
+		identity.FirstName, identity.LastName, _ = strings.Cut(claims.Name, " ")
+	}
+	if claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	return identity, nil
+}
+
+// githubProvider logs in with GitHub, which speaks plain OAuth2, so the
+// verified email comes from its API.
+type githubProvider struct {
+	config oauth2.Config
+	apiURL string
+}
+
+func (p *githubProvider) authCodeURL(state, _, verifier string) string {
+	return p.config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+}
+
+func (p *githubProvider) identity(ctx context.Context, code, _, verifier string) (*socialIdentity, error) {
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange code: %w", err)
+	}
+	client := p.config.Client(ctx, token)
+	var user struct {
+		Name  string `json:"name"`
+		Login string `json:"login"`
+	}
+	if err := getGitHubJSON(client, p.apiURL+"/user", &user); err != nil {
+		return nil, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getGitHubJSON(client, p.apiURL+"/user/emails", &emails); err != nil {
+		return nil, err
+	}
+	identity := &socialIdentity{}
+	identity.FirstName, identity.LastName, _ = strings.Cut(user.Name, " ")
+	if identity.FirstName == "" {
+		identity.FirstName = user.Login
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			identity.Email = e.Email
+		}
+	}
+	return identity, nil
+}
+
+func getGitHubJSON(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("could not call github: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("github answered %s for %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// handleOAuthLogin redirects to the provider's consent page.
+func (s *APIServer) handleOAuthLogin(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["provider"]
+	provider, err := s.oauth.get(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	state, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	nonce, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	verifier := oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    strings.Join([]string{state, nonce, verifier}, "."),
+		Path:     apiVersionPrefix + "/oauth",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// the callback is a cross-site navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.authCodeURL(state, nonce, verifier), http.StatusFound)
+	return nil
+}
+
+// handleOAuthCallback finishes a social login. The account with the email
+// the provider verified is logged in, or opened when there is none yet.
+func (s *APIServer) handleOAuthCallback(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["provider"]
+	provider, err := s.oauth.get(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		return badRequest("login session not found, start again")
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: apiVersionPrefix + "/oauth", MaxAge: -1, HttpOnly: true, Secure: true})
+	parts := strings.Split(cookie.Value, ".")
+	query := r.URL.Query()
+	if len(parts) != 3 || query.Get("state") != parts[0] {
+		return badRequest("login session does not match, start again")
+	}
+	if reason := query.Get("error"); reason != "" {
+		return unauthorized("OAUTH_LOGIN_DENIED", "login was not granted: "+reason)
+	}
+	if query.Get("code") == "" {
+		return badRequest("code is required")
+	}
+
+	identity, err := provider.identity(r.Context(), query.Get("code"), parts[1], parts[2])
+	if err != nil {
+		s.logger.WarnContext(r.Context(), "social login failed", "provider", name, "error", err)
+		return unauthorized("OAUTH_LOGIN_INVALID", "login could not be verified")
+	}
+	if identity.Email == "" {
+		return forbidden("EMAIL_NOT_VERIFIED", "the provider did not share a verified email address")
+	}
+	acc, err := s.socialAccount(r.Context(), name, identity)
+	if err != nil {
+		return err
+	}
+	if acc.TOTPEnabled {
+		return s.writeTwoFactorChallenge(w, acc)
+	}
+	return s.writeLoginToken(w, r, acc)
+}
+
+// socialAccount returns the account with the identity's email, opening one
+// with an unusable password when there is none. Accounts whose own email is
+// unverified are not matched, as whoever opened them may not own the address.
+func (s *APIServer) socialAccount(ctx context.Context, provider string, identity *socialIdentity) (*Account, error) {
+	email := normalizeEmail(identity.Email)
+	acc, err := s.store.GetAccountByEmail(ctx, email)
+	if err == nil {
+		if !acc.EmailVerified {
+			return nil, forbidden("EMAIL_NOT_VERIFIED", "email address not verified, follow the link sent at signup")
+		}
+		return acc, nil
+	}
+	if !errors.Is(err, ErrAccountNotFound) {
+		return nil, err
+	}
+
+	password, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	firstName, lastName := identity.FirstName, identity.LastName
+	if firstName == "" {
+		firstName, _, _ = strings.Cut(email, "@")
+	}
+	acc, err = NewAccount(firstName, lastName, email, password)
+	if err != nil {
+		return nil, err
+	}
+	acc.EmailVerified = true
+	if err := s.store.CreateAccount(ctx, acc); err != nil {
+		return nil, err
+	}
+	s.logger.InfoContext(ctx, "account created", "account_id", acc.ID, "provider", provider)
+	s.events.Dispatch(Event{Type: EventAccountCreated, AccountID: acc.ID, Timestamp: acc.CreatedAt})
+	return acc, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// fakeOIDCProvider is an OpenID Connect provider that signs in whoever its
+// claims describe.
+type fakeOIDCProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// nonce is sent back in the id token, as the provider would after
+	// the authorization redirect.
+	nonce  string
+	claims jwt.MapClaims
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	p := &fakeOIDCProvider{t: t, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   b64(key.N.Bytes()),
+			"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") == "" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":   p.server.URL,
+			"aud":   "client",
+			"sub":   "1234",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": p.nonce,
+		}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		require.Nil(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// signIn runs a social login through router, answering the provider's side
+// with code.
+func signIn(t *testing.T, router http.Handler, provider, code string, onRedirect func(query url.Values)) *httptest.ResponseRecorder {
+	rec := doJSON(t, router, "GET", "/api/v1/oauth/"+provider+"/login", nil, nil)
+	require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.Nil(t, err)
+	query := location.Query()
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	if onRedirect != nil {
+		onRedirect(query)
+	}
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	callback := "/api/v1/oauth/" + provider + "/callback?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	return doJSON(t, router, "GET", callback, nil, http.Header{"Cookie": {cookies[0].String()}})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	server, router := newTestServer(t)
+	provider := newFakeOIDCProvider(t)
+	server.oauth = newOAuthProviders(map[string]OAuthProviderConfig{
+		"google": {Issuer: provider.server.URL, ClientID: "client", ClientSecret: "secret", RedirectURL: "https://bank.example.com/api/v1/oauth/google/callback"},
+	})
+	rememberNonce := func(query url.Values) { provider.nonce = query.Get("nonce") }
+
+	rec := doJSON(t, router, "GET", "/api/v1/oauth/github/login", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "not configured")
+
+	provider.claims = jwt.MapClaims{"email": "new@abc.com", "email_verified": false}
+	rec = signIn(t, router, "google", "good-code", rememberNonce)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "an unverified email is not trusted")
+
+	provider.claims = jwt.MapClaims{"email": "New@abc.com", "email_verified": true, "given_name": "Ada", "family_name": "Lovelace"}
+	rec = signIn(t, router, "google", "bad-code", rememberNonce)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = signIn(t, router, "google", "good-code", func(url.Values) { provider.nonce = "replayed" })
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "the nonce must match")
+
+	rec = signIn(t, router, "google", "good-code", rememberNonce)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var login LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&login))
+	acc, err := server.store.GetAccountByEmail(context.Background(), "new@abc.com")
+	require.Nil(t, err)
+	assert.Equal(t, acc.ID, login.AccountID)
+	assert.Equal(t, "Ada", acc.FirstName)
+	assert.True(t, acc.EmailVerified)
+
+	rec = signIn(t, router, "google", "good-code", rememberNonce)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&login))
+	assert.Equal(t, acc.ID, login.AccountID, "the same account is matched again")
+}
+
+func TestOIDCLoginDoesNotMatchUnverifiedAccounts(t *testing.T) {
+	server, router := newTestServer(t)
+	provider := newFakeOIDCProvider(t)
+	server.oauth = newOAuthProviders(map[string]OAuthProviderConfig{
+		"google": {Issuer: provider.server.URL, ClientID: "client"},
+	})
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	provider.claims = jwt.MapClaims{"email": "abc@abc.com", "email_verified": true}
+
+	rec := signIn(t, router, "google", "good-code", func(query url.Values) { provider.nonce = query.Get("nonce") })
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestOAuthCallbackChecksState(t *testing.T) {
+	server, router := newTestServer(t)
+	provider := newFakeOIDCProvider(t)
+	server.oauth = newOAuthProviders(map[string]OAuthProviderConfig{
+		"google": {Issuer: provider.server.URL, ClientID: "client"},
+	})
+
+	rec := doJSON(t, router, "GET", "/api/v1/oauth/google/callback?code=good-code&state=abc", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "no login was started")
+
+	rec = doJSON(t, router, "GET", "/api/v1/oauth/google/login", nil, nil)
+	require.Equal(t, http.StatusFound, rec.Code)
+	cookie := rec.Result().Cookies()[0].String()
+	rec = doJSON(t, router, "GET", "/api/v1/oauth/google/callback?code=good-code&state=abc", nil, http.Header{"Cookie": {cookie}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the state must match")
+}
+
+func TestGitHubLogin(t *testing.T) {
+	server, router := newTestServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "bearer"})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"login": "octocat", "name": "Mona Lisa"})
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer access", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode([]map[string]any{
+			{"email": "unverified@abc.com", "primary": false, "verified": false},
+			{"email": "mona@abc.com", "primary": true, "verified": true},
+		})
+	})
+	github := httptest.NewServer(mux)
+	defer github.Close()
+	server.oauth = newOAuthProviders(nil)
+	server.oauth.providers["github"] = &githubProvider{
+		config: oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{
+			AuthURL:  github.URL + "/login/oauth/authorize",
+			TokenURL: github.URL + "/login/oauth/access_token",
+		}},
+		apiURL: github.URL,
+	}
+
+	rec := signIn(t, router, "github", "good-code", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	acc, err := server.store.GetAccountByEmail(context.Background(), "mona@abc.com")
+	require.Nil(t, err)
+	assert.Equal(t, "Mona", acc.FirstName)
+	assert.Equal(t, "Lisa", acc.LastName)
+}
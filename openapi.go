@@ -0,0 +1,566 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPISchemas are the request and response types published in the spec.
+// Their schemas are derived from the json and validate tags so the document
+// stays in step with the structs.
+var openAPISchemas = []any{
+	APIError{},
+	ValidationErrorResponse{},
+	CreateAccountRequest{},
+	UpdateAccountRequest{},
+	ChangePasswordRequest{},
+	LoginRequest{},
+	LoginResponse{},
+	RefreshTokenRequest{},
+	ForgotPasswordRequest{},
+	ResetPasswordRequest{},
+	TwoFactorChallengeResponse{},
+	TwoFactorLoginRequest{},
+	TwoFactorEnrollment{},
+	ActivateTwoFactorRequest{},
+	TwoFactorActivation{},
+	Passkey{},
+	PasskeyCeremony{},
+	PasskeyFinishRequest{},
+	PasskeyLoginRequest{},
+	APIKey{},
+	CreateAPIKeyRequest{},
+	CreateAPIKeyResponse{},
+	Session{},
+	DisableTwoFactorRequest{},
+	TransferRequest{},
+	SetOverdraftLimitRequest{},
+	SetTransferLimitsRequest{},
+	LimitExceededResponse{},
+	LedgerAdjustmentRequest{},
+	BatchItemResult{},
+	BatchCreateAccountsResponse{},
+	ImportAccountsResponse{},
+	Account{},
+	Transaction{},
+	TransactionsPage{},
+	LedgerEntry{},
+	LedgerEntriesPage{},
+	AccountsPage{},
+	LoginAttempt{},
+	LoginHistoryPage{},
+	ScheduledTransfer{},
+	ScheduledTransfersPage{},
+	StandingOrder{},
+	StandingOrderRequest{},
+	StandingOrdersPage{},
+	Hold{},
+	HoldRequest{},
+	HoldsPage{},
+	BalanceResponse{},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor describes a struct type as an OpenAPI schema object.
+func schemaFor(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		// embedded structs are flattened, as encoding/json does
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := schemaFor(field.Type)
+			for k, v := range embedded["properties"].(map[string]any) {
+				properties[k] = v
+			}
+			if r, ok := embedded["required"].([]string); ok {
+				required = append(required, r...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := typeSchema(field.Type)
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			tag, param, _ := strings.Cut(rule, "=")
+			switch tag {
+			case "required":
+				required = append(required, name)
+			case "email":
+				property["format"] = "email"
+			case "min", "max":
+				n, err := strconv.Atoi(param)
+				if err != nil {
+					continue
+				}
+				key := tag + "imum"
+				if property["type"] == "string" {
+					key = tag + "Length"
+				}
+				property[key] = n
+			case "len":
+				n, err := strconv.Atoi(param)
+				if err != nil || property["type"] != "string" {
+					continue
+				}
+				property["minLength"] = n
+				property["maxLength"] = n
+			case "numeric":
+				property["pattern"] = "^[0-9]+$"
+			case "oneof":
+				property["enum"] = strings.Fields(param)
+			case "currency":
+				property["enum"] = supportedCurrencies()
+			case "strongpassword":
+				property["pattern"] = `\p{L}.*\p{Nd}|\p{Nd}.*\p{L}`
+				property["description"] = "must contain a letter and a digit"
+			}
+		}
+		properties[name] = property
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := typeSchema(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]any{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case t.Kind() == reflect.Struct:
+		return schemaRef(t.Name())
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() == reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	default:
+		return map[string]any{}
+	}
+}
+
+func schemaRef(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// problemContent describes an error response, which is sent as
+// application/problem+json.
+func problemContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/problem+json": map[string]any{"schema": schema}}
+}
+
+// operation describes one route. Authenticated operations get the bearer
+// security requirement and 401 and 403 responses.
+func operation(summary string, request any, status int, response any, authenticated bool, params ...map[string]any) map[string]any {
+	responses := map[string]any{
+		"400": map[string]any{"description": "Bad request", "content": problemContent(schemaRef("APIError"))},
+		"500": map[string]any{"description": "Internal server error", "content": problemContent(schemaRef("APIError"))},
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if response != nil {
+		success["content"] = jsonContent(typeSchema(reflect.TypeOf(response)))
+	}
+	responses[strconv.Itoa(status)] = success
+
+	op := map[string]any{"summary": summary, "responses": responses}
+	if request != nil {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content":  jsonContent(schemaRef(reflect.TypeOf(request).Name())),
+		}
+		responses["422"] = map[string]any{"description": "Validation failed", "content": problemContent(schemaRef("ValidationErrorResponse"))}
+	}
+	if authenticated {
+		op["security"] = []any{map[string]any{"bearerAuth": []any{}}, map[string]any{"cookieAuth": []any{}}, map[string]any{"apiKeyAuth": []any{}}}
+		responses["401"] = map[string]any{"description": "Missing or invalid token", "content": problemContent(schemaRef("APIError"))}
+		responses["403"] = map[string]any{"description": "Forbidden", "content": problemContent(schemaRef("APIError"))}
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	return op
+}
+
+// sessionOnly drops API keys from the accepted credentials of op, for the
+// routes that manage how an account logs in.
+func sessionOnly(op map[string]any) map[string]any {
+	op["security"] = []any{map[string]any{"bearerAuth": []any{}}, map[string]any{"cookieAuth": []any{}}}
+	return op
+}
+
+// loginOperation documents POST /login, which answers with a challenge
+// instead of a token when two-factor authentication is enabled.
+func loginOperation() map[string]any {
+	op := operation("Log in with email and password", LoginRequest{}, http.StatusOK, LoginResponse{}, false)
+	op["responses"].(map[string]any)["202"] = map[string]any{
+		"description": "Two-factor authentication required; send the challenge and a code to /login/2fa",
+		"content":     jsonContent(schemaRef("TwoFactorChallengeResponse")),
+	}
+	op["responses"].(map[string]any)["429"] = map[string]any{
+		"description": "Too many failed logins for the email or client IP; retry after the Retry-After header's seconds",
+		"content":     problemContent(schemaRef("APIError")),
+	}
+	return op
+}
+
+// batchCreateOperation documents POST /account/batch, whose body is an array
+// rather than a single named schema.
+func batchCreateOperation() map[string]any {
+	op := operation("Create up to "+strconv.Itoa(maxBatchAccounts)+" accounts atomically (admin only)", nil, http.StatusOK, BatchCreateAccountsResponse{}, true)
+	op["requestBody"] = map[string]any{
+		"required": true,
+		"content": jsonContent(map[string]any{
+			"type":     "array",
+			"minItems": 1,
+			"maxItems": maxBatchAccounts,
+			"items":    schemaRef("CreateAccountRequest"),
+		}),
+	}
+	responses := op["responses"].(map[string]any)
+	results := jsonContent(schemaRef("BatchCreateAccountsResponse"))
+	responses["409"] = map[string]any{"description": "An email is already registered; nothing was created", "content": results}
+	responses["422"] = map[string]any{"description": "Validation failed; nothing was created", "content": results}
+	return op
+}
+
+// importOperation documents POST /account/import, which takes a JSON array
+// or CSV.
+func importOperation() map[string]any {
+	op := operation("Import up to "+strconv.Itoa(maxImportAccounts)+" accounts atomically from JSON or CSV (admin only)", nil, http.StatusOK, ImportAccountsResponse{}, true)
+	op["requestBody"] = map[string]any{
+		"required": true,
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": map[string]any{
+				"type":     "array",
+				"minItems": 1,
+				"maxItems": maxImportAccounts,
+				"items":    schemaRef("CreateAccountRequest"),
+			}},
+			"text/csv": map[string]any{
+				"schema": map[string]any{
+					"type":        "string",
+					"description": "A header row naming some of " + strings.Join(accountImportCSVHeader, ",") + ", in any order, then one row per account. currency may be left out.",
+				},
+			},
+		},
+	}
+	responses := op["responses"].(map[string]any)
+	results := jsonContent(schemaRef("ImportAccountsResponse"))
+	responses["409"] = map[string]any{"description": "An email is already registered; nothing was imported", "content": results}
+	responses["422"] = map[string]any{"description": "Validation failed; nothing was imported", "content": results}
+	return op
+}
+
+// transferOperation documents POST /transfer, which answers a broken transfer
+// limit with a LimitExceededResponse.
+func transferOperation() map[string]any {
+	op := operation("Transfer money to another account. With executeAt the transfer is scheduled instead and answered with 202 and a ScheduledTransfer", TransferRequest{}, http.StatusOK, Transaction{}, true,
+		parameter("Idempotency-Key", "header", "Replays the first result for repeated requests with the same body; a different body is refused with 422", map[string]any{"type": "string"}))
+	responses := op["responses"].(map[string]any)
+	responses["422"] = map[string]any{
+		"description": "Validation failed, or the transfer breaks a limit",
+		"content": problemContent(map[string]any{
+			"oneOf": []any{schemaRef("ValidationErrorResponse"), schemaRef("LimitExceededResponse"), schemaRef("APIError")},
+		}),
+	}
+	return op
+}
+
+// csvExportOperation documents GET /account/export, which answers with CSV
+// instead of JSON.
+func csvExportOperation() map[string]any {
+	op := operation("Download all accounts as CSV (admin only)", nil, http.StatusOK, nil, true)
+	op["responses"].(map[string]any)["200"] = map[string]any{
+		"description": "One row per account after a header row of " + strings.Join(accountCSVHeader, ","),
+		"content":     map[string]any{"text/csv": map[string]any{"schema": map[string]any{"type": "string"}}},
+	}
+	return op
+}
+
+func parameter(name, in, description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"in":          in,
+		"description": description,
+		"required":    in == "path",
+		"schema":      schema,
+	}
+}
+
+func buildOpenAPISpec() map[string]any {
+	schemas := map[string]any{}
+	for _, v := range openAPISchemas {
+		t := reflect.TypeOf(v)
+		schemas[t.Name()] = schemaFor(t)
+	}
+
+	integer := map[string]any{"type": "integer"}
+	id := parameter("id", "path", "Account ID", integer)
+	orderID := parameter("orderID", "path", "Standing order ID", integer)
+	holdID := parameter("holdID", "path", "Hold ID", integer)
+	passkeyID := parameter("passkeyID", "path", "Passkey ID", integer)
+	keyID := parameter("keyID", "path", "API key ID", integer)
+	sessionID := parameter("sessionID", "path", "Session ID", integer)
+	provider := parameter("provider", "path", "Login provider name from the config, e.g. google", map[string]any{"type": "string"})
+	limit := parameter("limit", "query", "Maximum results to return", map[string]any{"type": "integer", "minimum": 1, "maximum": maxPageLimit, "default": defaultPageLimit})
+	offset := parameter("offset", "query", "Results to skip", map[string]any{"type": "integer", "minimum": 0, "default": 0})
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "gobank",
+			"version": "1.0.0",
+		},
+		"servers": []any{map[string]any{"url": apiVersionPrefix}},
+		"paths": map[string]any{
+			"/login": map[string]any{
+				"post": loginOperation(),
+			},
+			"/login/2fa": map[string]any{
+				"post": operation("Exchange a login challenge and a TOTP or backup code for a token", TwoFactorLoginRequest{}, http.StatusOK, LoginResponse{}, false),
+			},
+			"/login/passkey/begin": map[string]any{
+				"post": operation("Start a passkey login, returning the options for navigator.credentials.get. Answers 404 when the account has no passkey", PasskeyLoginRequest{}, http.StatusOK, PasskeyCeremony{}, false),
+			},
+			"/oauth/{provider}/login": map[string]any{
+				"get": operation("Redirect to the provider to sign in", nil, http.StatusFound, nil, false, provider),
+			},
+			"/oauth/{provider}/callback": map[string]any{
+				"get": operation("Finish signing in with a provider, opening an account for a new verified email", nil, http.StatusOK, LoginResponse{}, false, provider,
+					parameter("code", "query", "Authorization code from the provider", map[string]any{"type": "string"}),
+					parameter("state", "query", "State from the login redirect", map[string]any{"type": "string"})),
+			},
+			"/login/passkey/finish": map[string]any{
+				"post": operation("Finish a passkey login with the assertion the browser produced", PasskeyFinishRequest{}, http.StatusOK, LoginResponse{}, false),
+			},
+			"/token/refresh": map[string]any{
+				"post": operation("Exchange a refresh token, from the body or cookie, for a new token pair. Replaying a used refresh token revokes every token issued from the same login", RefreshTokenRequest{}, http.StatusOK, LoginResponse{}, false),
+			},
+			"/logout": map[string]any{
+				"post": operation("Clear the token cookies and revoke the presented access token and the refresh token sent in the body or cookie", RefreshTokenRequest{}, http.StatusOK, "", false),
+			},
+			"/verify": map[string]any{
+				"get": operation("Verify an email address with the token from the signup email", nil, http.StatusOK, "", false,
+					parameter("token", "query", "Token from the verification link", map[string]any{"type": "string"})),
+			},
+			"/password/forgot": map[string]any{
+				"post": operation("Email a password reset link. The response does not reveal whether the email belongs to an account", ForgotPasswordRequest{}, http.StatusAccepted, "", false),
+			},
+			"/password/reset": map[string]any{
+				"post": operation("Set a new password with the token from a reset link, ending every session of the account", ResetPasswordRequest{}, http.StatusOK, "", false),
+			},
+			"/account": map[string]any{
+				"get": operation("List or search accounts (admin only)", nil, http.StatusOK, AccountsPage{}, true,
+					parameter("search", "query", "Case-insensitive match on name or email", map[string]any{"type": "string"}),
+					parameter("email", "query", "Only the account with this email, ignoring case", map[string]any{"type": "string"}),
+					parameter("name", "query", "Case-insensitive match on the full name", map[string]any{"type": "string"}),
+					parameter("createdAfter", "query", "Only accounts opened after this RFC 3339 timestamp", map[string]any{"type": "string", "format": "date-time"}),
+					parameter("minBalance", "query", "Only accounts with at least this balance, in minor units", map[string]any{"type": "integer"}),
+					limit, offset,
+					parameter("pageSize", "query", "Accounts per page, instead of limit", map[string]any{"type": "integer", "minimum": 1, "maximum": maxPageLimit, "default": defaultPageLimit}),
+					parameter("page", "query", "Page to return, counting from 1, instead of offset", map[string]any{"type": "integer", "minimum": 1, "maximum": math.MaxInt32}),
+					parameter("after", "query", "Start after this account id instead of skipping offset accounts", map[string]any{"type": "integer", "minimum": 1})),
+				"post": operation("Create an account. Its URL is returned in the Location header", CreateAccountRequest{}, http.StatusCreated, Account{}, false),
+			},
+			"/account/export": map[string]any{
+				"get": csvExportOperation(),
+			},
+			"/account/batch": map[string]any{
+				"post": batchCreateOperation(),
+			},
+			"/account/import": map[string]any{
+				"post": importOperation(),
+			},
+			"/me": map[string]any{
+				"get": operation("Get the account the token was issued to", nil, http.StatusOK, Account{}, true),
+			},
+			"/sessions": map[string]any{
+				"get": sessionOnly(operation("List the devices the account is logged in on", nil, http.StatusOK, []Session{}, true)),
+			},
+			"/sessions/{sessionID}": map[string]any{
+				"delete": sessionOnly(operation("Log a device out, revoking its refresh and access tokens", nil, http.StatusNoContent, nil, true, sessionID)),
+			},
+			"/account/{id}": map[string]any{
+				"get":    operation("Get an account", nil, http.StatusOK, Account{}, true, id),
+				"put":    operation("Update an account", UpdateAccountRequest{}, http.StatusOK, Account{}, true, id),
+				"delete": operation("Delete an account", nil, http.StatusNoContent, nil, true, id),
+			},
+			"/account/{id}/purge": map[string]any{
+				"delete": operation("Permanently delete an account and its history (admin only)", nil, http.StatusNoContent, nil, true, id),
+			},
+			"/account/{id}/restore": map[string]any{
+				"post": operation("Restore a deleted account before it is purged (admin only)", nil, http.StatusOK, Account{}, true, id),
+			},
+			"/account/{id}/freeze": map[string]any{
+				"post": operation("Freeze an account so it cannot send or receive money (admin only)", nil, http.StatusOK, Account{}, true, id),
+			},
+			"/account/{id}/unfreeze": map[string]any{
+				"post": operation("Unfreeze an account (admin only)", nil, http.StatusOK, Account{}, true, id),
+			},
+			"/account/{id}/unlock": map[string]any{
+				"post": operation("Lift the lock failed logins put on an account (admin only)", nil, http.StatusOK, Account{}, true, id),
+			},
+			"/account/{id}/overdraft": map[string]any{
+				"put": operation("Set how far below zero an account may go (admin only)", SetOverdraftLimitRequest{}, http.StatusOK, Account{}, true, id),
+			},
+			"/account/{id}/limits": map[string]any{
+				"put": operation("Override an account's daily and per-transfer limits; a limit left out reverts to the default (admin only)", SetTransferLimitsRequest{}, http.StatusOK, Account{}, true, id),
+			},
+			"/account/{id}/adjustments": map[string]any{
+				"post": operation("Deposit into, withdraw from or charge a fee to an account (admin only)", LedgerAdjustmentRequest{}, http.StatusCreated, Transaction{}, true, id),
+			},
+			"/account/{id}/2fa": map[string]any{
+				"post":   sessionOnly(operation("Enroll in two-factor authentication. It is required at login once activated", nil, http.StatusOK, TwoFactorEnrollment{}, true, id)),
+				"delete": sessionOnly(operation("Disable two-factor authentication with an app or backup code", DisableTwoFactorRequest{}, http.StatusNoContent, nil, true, id)),
+			},
+			"/account/{id}/passkeys": map[string]any{
+				"get": sessionOnly(operation("List the passkeys registered to an account", nil, http.StatusOK, []Passkey{}, true, id)),
+			},
+			"/account/{id}/passkeys/{passkeyID}": map[string]any{
+				"delete": sessionOnly(operation("Remove a passkey", nil, http.StatusNoContent, nil, true, id, passkeyID)),
+			},
+			"/account/{id}/passkeys/register/begin": map[string]any{
+				"post": sessionOnly(operation("Start registering a passkey, returning the options for navigator.credentials.create", nil, http.StatusOK, PasskeyCeremony{}, true, id)),
+			},
+			"/account/{id}/passkeys/register/finish": map[string]any{
+				"post": sessionOnly(operation("Finish registering a passkey with the credential the browser created", PasskeyFinishRequest{}, http.StatusCreated, Passkey{}, true, id)),
+			},
+			"/account/{id}/2fa/activate": map[string]any{
+				"post": sessionOnly(operation("Activate two-factor authentication with a code from the app, returning single-use backup codes", ActivateTwoFactorRequest{}, http.StatusOK, TwoFactorActivation{}, true, id)),
+			},
+			"/account/{id}/balance": map[string]any{
+				"get": operation("Get an account's balance", nil, http.StatusOK, BalanceResponse{}, true, id),
+			},
+			"/account/{id}/api-keys": map[string]any{
+				"get":  sessionOnly(operation("List an account's API keys", nil, http.StatusOK, []APIKey{}, true, id)),
+				"post": sessionOnly(operation("Create an API key for backend integrations. The key is only returned now; send it in the X-API-Key header", CreateAPIKeyRequest{}, http.StatusCreated, CreateAPIKeyResponse{}, true, id)),
+			},
+			"/account/{id}/api-keys/{keyID}": map[string]any{
+				"delete": sessionOnly(operation("Revoke an API key", nil, http.StatusNoContent, nil, true, id, keyID)),
+			},
+			"/account/{id}/password": map[string]any{
+				"post": sessionOnly(operation("Change an account's password", ChangePasswordRequest{}, http.StatusOK, "", true, id)),
+			},
+			"/account/{id}/transactions": map[string]any{
+				"get": operation("List an account's transactions, optionally within a date range", nil, http.StatusOK, TransactionsPage{}, true, id, limit, offset,
+					parameter("from", "query", "Only transactions created at or after this time", map[string]any{"type": "string", "format": "date-time"}),
+					parameter("to", "query", "Only transactions created before this time", map[string]any{"type": "string", "format": "date-time"})),
+			},
+			"/account/{id}/scheduled-transfers": map[string]any{
+				"get": operation("List an account's scheduled transfers", nil, http.StatusOK, ScheduledTransfersPage{}, true, id, limit, offset),
+			},
+			"/account/{id}/scheduled-transfers/{transferID}": map[string]any{
+				"delete": operation("Cancel a scheduled transfer that has not been made yet", nil, http.StatusOK, ScheduledTransfer{}, true, id,
+					parameter("transferID", "path", "Scheduled transfer ID", integer)),
+			},
+			"/account/{id}/standing-orders": map[string]any{
+				"get":  operation("List an account's standing orders", nil, http.StatusOK, StandingOrdersPage{}, true, id, limit, offset),
+				"post": operation("Create a weekly or monthly standing order", StandingOrderRequest{}, http.StatusCreated, StandingOrder{}, true, id),
+			},
+			"/account/{id}/holds": map[string]any{
+				"get":  operation("List an account's holds", nil, http.StatusOK, HoldsPage{}, true, id, limit, offset),
+				"post": operation("Reserve money for a later transfer, reducing the available but not the booked balance", HoldRequest{}, http.StatusCreated, Hold{}, true, id),
+			},
+			"/account/{id}/holds/{holdID}/capture": map[string]any{
+				"post": operation("Make the transfer an active hold reserved money for", nil, http.StatusOK, Hold{}, true, id, holdID),
+			},
+			"/account/{id}/holds/{holdID}/release": map[string]any{
+				"post": operation("Release an active hold, freeing its money", nil, http.StatusOK, Hold{}, true, id, holdID),
+			},
+			"/account/{id}/standing-orders/{orderID}": map[string]any{
+				"delete": operation("Cancel a standing order", nil, http.StatusOK, StandingOrder{}, true, id, orderID),
+			},
+			"/account/{id}/standing-orders/{orderID}/pause": map[string]any{
+				"post": operation("Pause a standing order", nil, http.StatusOK, StandingOrder{}, true, id, orderID),
+			},
+			"/account/{id}/standing-orders/{orderID}/resume": map[string]any{
+				"post": operation("Resume a paused standing order from its next run after now", nil, http.StatusOK, StandingOrder{}, true, id, orderID),
+			},
+			"/account/{id}/logins": map[string]any{
+				"get": operation("List an account's successful and failed logins, newest first", nil, http.StatusOK, LoginHistoryPage{}, true, id, limit, offset),
+			},
+			"/account/{id}/ledger": map[string]any{
+				"get": operation("List the double-entry ledger entries posted to an account", nil, http.StatusOK, LedgerEntriesPage{}, true, id, limit, offset),
+			},
+			"/transfer": map[string]any{
+				"post": transferOperation(),
+			},
+			"/transfer/{id}/reverse": map[string]any{
+				"post": operation("Reverse a transfer (recipient or admin only)", nil, http.StatusOK, Transaction{}, true,
+					parameter("id", "path", "ID of the transfer's debit transaction", integer)),
+			},
+		},
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"cookieAuth": map[string]any{"type": "apiKey", "in": "cookie", "name": accessTokenCookie},
+				"apiKeyAuth": map[string]any{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+			},
+		},
+	}
+}
+
+func (s *APIServer) handleOpenAPISpec(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, buildOpenAPISpec())
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>gobank API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = () => SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+// docsContentSecurityPolicy lets the docs page load Swagger UI from unpkg
+// and fetch the spec.
+const docsContentSecurityPolicy = "default-src 'none'; script-src https://unpkg.com 'unsafe-inline'; style-src https://unpkg.com; img-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"
+
+func (s *APIServer) handleDocs(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", docsContentSecurityPolicy)
+	_, err := w.Write([]byte(swaggerUIPage))
+	return err
+}
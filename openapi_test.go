@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPISpecIsValid(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "GET", "/openapi.json", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	doc, err := openapi3.NewLoader().LoadFromData(rec.Body.Bytes())
+	require.Nil(t, err)
+	require.Nil(t, doc.Validate(context.Background()))
+
+	transfer := doc.Components.Schemas["TransferRequest"].Value
+	assert.ElementsMatch(t, []string{"toAccount", "amount"}, transfer.Required)
+	require.NotNil(t, transfer.Properties["amount"].Value.Min)
+	assert.Equal(t, 1.0, *transfer.Properties["amount"].Value.Min)
+
+	create := doc.Components.Schemas["CreateAccountRequest"].Value
+	assert.Equal(t, "email", create.Properties["email"].Value.Format)
+	assert.Equal(t, uint64(8), create.Properties["password"].Value.MinLength)
+
+	assert.Equal(t, "/api/v1", doc.Servers[0].URL)
+	assert.NotNil(t, doc.Paths.Find("/account/{id}/transactions"))
+	assert.NotNil(t, doc.Paths.Find("/transfer").Post.RequestBody)
+}
+
+func TestDocsServesSwaggerUI(t *testing.T) {
+	_, router := newTestServer(t)
+
+	rec := doJSON(t, router, "GET", "/docs", nil, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "/openapi.json")
+}
+
+// TestOpenAPISpecCoversRoutes keeps the spec in sync with the router: every
+// route of the current version, and every method it is restricted to, must
+// be documented.
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	server, _ := newTestServer(t)
+	paths := buildOpenAPISpec()["paths"].(map[string]any)
+
+	err := server.newRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, apiVersionPrefix+"/") {
+			return nil
+		}
+		path := strings.TrimPrefix(tpl, apiVersionPrefix)
+		ops, ok := paths[path].(map[string]any)
+		if !assert.True(t, ok, "%s is not documented", path) {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			assert.Contains(t, ops, strings.ToLower(method), "%s %s is not documented", method, path)
+		}
+		return nil
+	})
+	require.Nil(t, err)
+}
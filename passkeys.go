@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	// passkeySessionTTL is how long a registration or login ceremony can
+	// take between its begin and finish steps.
+	passkeySessionTTL = 5 * time.Minute
+
+	passkeyRegistration = "registration"
+	passkeyLogin        = "login"
+)
+
+var (
+	// ErrPasskeyNotFound is returned when an account has no passkey with
+	// the given id.
+	ErrPasskeyNotFound = errors.New("passkey not found")
+	// ErrPasskeyExists is returned by CreatePasskey when the credential is
+	// already registered.
+	ErrPasskeyExists = errors.New("passkey is already registered")
+	// ErrPasskeySessionInvalid is returned by ConsumePasskeySession when the
+	// session is unknown, already used, expired or for another ceremony.
+	ErrPasskeySessionInvalid = errors.New("passkey session is invalid or expired")
+)
+
+// errPasskeysDisabled answers passkey requests when no relying party is
+// configured.
+var errPasskeysDisabled = &HTTPError{Status: http.StatusNotImplemented, Code: "PASSKEYS_DISABLED", Message: "passkeys are not enabled"}
+
+// Passkey is a WebAuthn credential registered to an account. Only its
+// public key is kept.
+type Passkey struct {
+	ID         int                 `json:"id"`
+	AccountID  int                 `json:"accountId"`
+	Credential webauthn.Credential `json:"-"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	LastUsedAt *time.Time          `json:"lastUsedAt,omitempty"`
+}
+
+// PasskeySession holds the challenge of a registration or login ceremony
+// until the authenticator's response comes back.
+type PasskeySession struct {
+	TokenHash string
+	AccountID int
+	Purpose   string
+	Data      webauthn.SessionData
+	ExpiresAt time.Time
+}
+
+// PasskeyCeremony is returned by the begin endpoints. Options are passed to
+// navigator.credentials.create or .get, and the session is sent back with
+// the result.
+type PasskeyCeremony struct {
+	Session string `json:"session"`
+	Options any    `json:"options"`
+}
+
+// PasskeyFinishRequest completes a ceremony with the PublicKeyCredential the
+// browser produced, serialized as JSON.
+type PasskeyFinishRequest struct {
+	Session    string         `json:"session" validate:"required"`
+	Credential map[string]any `json:"credential" validate:"required"`
+}
+
+type PasskeyLoginRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// passkeyUser presents an account and its passkeys to the webauthn library.
+type passkeyUser struct {
+	acc      *Account
+	passkeys []*Passkey
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.acc.ID))
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	return u.acc.Email
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return u.acc.FirstName + " " + u.acc.LastName
+}
+
+func (u passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+	for i, p := range u.passkeys {
+		credentials[i] = p.Credential
+	}
+	return credentials
+}
+
+// passkeyFor returns the passkey of u with the credential id.
+func (u passkeyUser) passkeyFor(credentialID []byte) (*Passkey, bool) {
+	for _, p := range u.passkeys {
+		if bytes.Equal(p.Credential.ID, credentialID) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// relyingParty returns the WebAuthn relying party from the config, or
+// errPasskeysDisabled when WebAuthnRPID is not set.
+func (s *APIServer) relyingParty() (*webauthn.WebAuthn, error) {
+	if s.cfg.WebAuthnRPID == "" {
+		return nil, errPasskeysDisabled
+	}
+	displayName := s.cfg.WebAuthnRPDisplayName
+	if displayName == "" {
+		displayName = totpIssuer
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          s.cfg.WebAuthnRPID,
+		RPDisplayName: displayName,
+		RPOrigins:     s.cfg.WebAuthnRPOrigins,
+	})
+}
+
+func (s *APIServer) passkeyUser(ctx context.Context, acc *Account) (passkeyUser, error) {
+	passkeys, err := s.store.GetPasskeys(ctx, acc.ID)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+	return passkeyUser{acc: acc, passkeys: passkeys}, nil
+}
+
+// startPasskeySession stores the ceremony state and answers with the
+// options for the browser.
+func (s *APIServer) startPasskeySession(ctx context.Context, w http.ResponseWriter, accountID int, purpose string, data *webauthn.SessionData, options any) error {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return fmt.Errorf("could not create passkey session: %w", err)
+	}
+	session := &PasskeySession{
+		TokenHash: hashOpaqueToken(token),
+		AccountID: accountID,
+		Purpose:   purpose,
+		Data:      *data,
+		ExpiresAt: s.now().UTC().Add(passkeySessionTTL),
+	}
+	if err := s.store.CreatePasskeySession(ctx, session); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, PasskeyCeremony{Session: token, Options: options})
+}
+
+// finishPasskeySession decodes a finish request and consumes its session.
+// The credential is returned re-encoded for the webauthn parsers.
+func (s *APIServer) finishPasskeySession(w http.ResponseWriter, r *http.Request, purpose string) (*PasskeySession, []byte, error) {
+	req := new(PasskeyFinishRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return nil, nil, err
+	}
+	if err := validate.Struct(req); err != nil {
+		return nil, nil, err
+	}
+	credential, err := json.Marshal(req.Credential)
+	if err != nil {
+		return nil, nil, badRequest("invalid credential")
+	}
+	session, err := s.store.ConsumePasskeySession(r.Context(), hashOpaqueToken(req.Session), purpose, s.now().UTC())
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, credential, nil
+}
+
+// handlePasskeys lists the passkeys of an account.
+func (s *APIServer) handlePasskeys(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	passkeys, err := s.store.GetPasskeys(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, passkeys)
+}
+
+// handleDeletePasskey removes a passkey from an account.
+func (s *APIServer) handleDeletePasskey(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	passkeyID, err := getPositiveIntVar(r, "passkeyID")
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeletePasskey(r.Context(), id, passkeyID); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "passkey removed", "account_id", id, "passkey_id", passkeyID)
+	return writeNoContent(w)
+}
+
+// handleBeginPasskeyRegistration starts registering a passkey for an
+// account. Its existing passkeys are excluded so an authenticator is not
+// registered twice.
+func (s *APIServer) handleBeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) error {
+	rp, err := s.relyingParty()
+	if err != nil {
+		return err
+	}
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	user, err := s.passkeyUser(r.Context(), acc)
+	if err != nil {
+		return err
+	}
+	exclusions := make([]protocol.CredentialDescriptor, len(user.passkeys))
+	for i, p := range user.passkeys {
+		exclusions[i] = p.Credential.Descriptor()
+	}
+	options, data, err := rp.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred))
+	if err != nil {
+		return fmt.Errorf("could not begin passkey registration for account %d: %w", id, err)
+	}
+	return s.startPasskeySession(r.Context(), w, id, passkeyRegistration, data, options)
+}
+
+// handleFinishPasskeyRegistration verifies the authenticator's attestation
+// and stores the new passkey.
+func (s *APIServer) handleFinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) error {
+	rp, err := s.relyingParty()
+	if err != nil {
+		return err
+	}
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	session, body, err := s.finishPasskeySession(w, r, passkeyRegistration)
+	if err != nil {
+		return err
+	}
+	if session.AccountID != id {
+		return ErrPasskeySessionInvalid
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	user, err := s.passkeyUser(r.Context(), acc)
+	if err != nil {
+		return err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		return badRequest("invalid credential: %v", err)
+	}
+	credential, err := rp.CreateCredential(user, session.Data, parsed)
+	if err != nil {
+		return badRequest("passkey could not be verified: %v", err)
+	}
+	passkey := &Passkey{AccountID: id, Credential: *credential, CreatedAt: s.now().UTC()}
+	if err := s.store.CreatePasskey(r.Context(), passkey); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "passkey registered", "account_id", id, "passkey_id", passkey.ID)
+	return WriteJSON(w, http.StatusCreated, passkey)
+}
+
+// handleBeginPasskeyLogin starts a passkey login for the account with the
+// email. Accounts without passkeys get a 404 and log in with their password
+// and, when enabled, a TOTP code instead.
+func (s *APIServer) handleBeginPasskeyLogin(w http.ResponseWriter, r *http.Request) error {
+	rp, err := s.relyingParty()
+	if err != nil {
+		return err
+	}
+	req := new(PasskeyLoginRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	req.Email = normalizeEmail(req.Email)
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByEmail(r.Context(), req.Email)
+	if errors.Is(err, ErrAccountNotFound) {
+		return ErrPasskeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	user, err := s.passkeyUser(r.Context(), acc)
+	if err != nil {
+		return err
+	}
+	if len(user.passkeys) == 0 {
+		return ErrPasskeyNotFound
+	}
+	options, data, err := rp.BeginLogin(user)
+	if err != nil {
+		return fmt.Errorf("could not begin passkey login for account %d: %w", acc.ID, err)
+	}
+	return s.startPasskeySession(r.Context(), w, acc.ID, passkeyLogin, data, options)
+}
+
+// handleFinishPasskeyLogin verifies the authenticator's assertion and logs
+// the account in. A passkey that did not verify the user only stands in for
+// the password, so accounts with two-factor authentication still need a
+// TOTP code.
+func (s *APIServer) handleFinishPasskeyLogin(w http.ResponseWriter, r *http.Request) error {
+	rp, err := s.relyingParty()
+	if err != nil {
+		return err
+	}
+	session, body, err := s.finishPasskeySession(w, r, passkeyLogin)
+	if errors.Is(err, ErrPasskeySessionInvalid) {
+		return unauthorized("PASSKEY_SESSION_INVALID", "invalid or expired passkey session")
+	}
+	if err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), session.AccountID)
+	if err != nil {
+		return unauthorized("PASSKEY_SESSION_INVALID", "invalid or expired passkey session")
+	}
+	user, err := s.passkeyUser(r.Context(), acc)
+	if err != nil {
+		return err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		return badRequest("invalid credential: %v", err)
+	}
+	credential, err := rp.ValidateLogin(user, session.Data, parsed)
+	if err != nil {
+		return unauthorized("PASSKEY_INVALID", "passkey could not be verified")
+	}
+	if credential.Authenticator.CloneWarning {
+		s.logger.WarnContext(r.Context(), "passkey signature counter went backwards, possible cloned authenticator", "account_id", acc.ID)
+		return unauthorized("PASSKEY_INVALID", "passkey could not be verified")
+	}
+	passkey, ok := user.passkeyFor(credential.ID)
+	if !ok {
+		return unauthorized("PASSKEY_INVALID", "passkey could not be verified")
+	}
+	passkey.Credential = *credential
+	now := s.now().UTC()
+	passkey.LastUsedAt = &now
+	if err := s.store.UpdatePasskey(r.Context(), passkey); err != nil {
+		return err
+	}
+	if !acc.EmailVerified {
+		return forbidden("EMAIL_NOT_VERIFIED", "email address not verified, follow the link sent at signup")
+	}
+	if acc.TOTPEnabled && !credential.Flags.UserVerified {
+		return s.writeTwoFactorChallenge(w, acc)
+	}
+	return s.writeLoginToken(w, r, acc)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "https://localhost"
+)
+
+// softAuthenticator is a software passkey producing the responses a browser
+// would hand back from navigator.credentials.
+type softAuthenticator struct {
+	t         *testing.T
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+	// userVerified sets the UV flag, as when the user entered a PIN or used
+	// a fingerprint.
+	userVerified bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	require.Nil(t, err)
+	return &softAuthenticator{t: t, key: key, id: id, userVerified: true}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// challenge pulls the challenge out of the options of a ceremony.
+func (a *softAuthenticator) challenge(ceremony PasskeyCeremony) string {
+	options := ceremony.Options.(map[string]any)["publicKey"].(map[string]any)
+	return options["challenge"].(string)
+}
+
+func (a *softAuthenticator) clientData(kind, challenge string) []byte {
+	data, err := json.Marshal(map[string]any{"type": kind, "challenge": challenge, "origin": testOrigin})
+	require.Nil(a.t, err)
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	flags |= 0x01 // user present
+	if a.userVerified {
+		flags |= 0x04
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+// register answers a registration ceremony with a "none" attestation.
+func (a *softAuthenticator) register(ceremony PasskeyCeremony) map[string]any {
+	publicKey, err := cbor.Marshal(map[int]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	require.Nil(a.t, err)
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(append(attested, a.id...), publicKey...)
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(0x40, attested),
+	})
+	require.Nil(a.t, err)
+	return map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", a.challenge(ceremony))),
+			"attestationObject": b64(attestation),
+		},
+	}
+}
+
+// assert answers a login ceremony, signing with the passkey's key.
+func (a *softAuthenticator) assert(ceremony PasskeyCeremony) map[string]any {
+	a.signCount++
+	authData := a.authData(0, nil)
+	clientData := a.clientData("webauthn.get", a.challenge(ceremony))
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.Nil(a.t, err)
+	return map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+		},
+	}
+}
+
+func decodeCeremony(t *testing.T, body []byte) PasskeyCeremony {
+	var ceremony PasskeyCeremony
+	require.Nil(t, json.Unmarshal(body, &ceremony))
+	require.NotEmpty(t, ceremony.Session)
+	return ceremony
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	server, router := newTestServer(t)
+	server.cfg.WebAuthnRPID = testRPID
+	server.cfg.WebAuthnRPOrigins = []string{testOrigin}
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	path := fmt.Sprintf("/api/v1/account/%d/passkeys", acc.ID)
+	authenticator := newSoftAuthenticator(t)
+
+	rec := doJSON(t, router, "POST", "/api/v1/login/passkey/begin", PasskeyLoginRequest{Email: "abc@abc.com"}, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "without a passkey the password is used")
+
+	rec = doJSON(t, router, "POST", path+"/register/begin", nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	ceremony := decodeCeremony(t, rec.Body.Bytes())
+	credential := authenticator.register(ceremony)
+	rec = doJSON(t, router, "POST", path+"/register/finish", PasskeyFinishRequest{Session: "wrong", Credential: credential}, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doJSON(t, router, "POST", path+"/register/finish", PasskeyFinishRequest{Session: ceremony.Session, Credential: credential}, header)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var passkey Passkey
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&passkey))
+	assert.Equal(t, acc.ID, passkey.AccountID)
+	rec = doJSON(t, router, "POST", path+"/register/finish", PasskeyFinishRequest{Session: ceremony.Session, Credential: credential}, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "sessions are single use")
+
+	rec = doJSON(t, router, "POST", "/api/v1/login/passkey/begin", PasskeyLoginRequest{Email: "ABC@abc.com"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	ceremony = decodeCeremony(t, rec.Body.Bytes())
+	rec = doJSON(t, router, "POST", "/api/v1/login/passkey/finish", PasskeyFinishRequest{Session: ceremony.Session, Credential: newSoftAuthenticator(t).assert(ceremony)}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "an unregistered passkey")
+
+	rec = doJSON(t, router, "POST", "/api/v1/login/passkey/begin", PasskeyLoginRequest{Email: "abc@abc.com"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	ceremony = decodeCeremony(t, rec.Body.Bytes())
+	rec = doJSON(t, router, "POST", "/api/v1/login/passkey/finish", PasskeyFinishRequest{Session: ceremony.Session, Credential: authenticator.assert(ceremony)}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var login LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&login))
+	assert.Equal(t, acc.ID, login.AccountID)
+
+	rec = doJSON(t, router, "GET", path, nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var passkeys []Passkey
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&passkeys))
+	require.Len(t, passkeys, 1)
+	assert.NotNil(t, passkeys[0].LastUsedAt)
+
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("%s/%d", path, passkey.ID), nil, header)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("%s/%d", path, passkey.ID), nil, header)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPasskeyWithoutUserVerificationStillNeedsTOTP(t *testing.T) {
+	server, router := newTestServer(t)
+	server.cfg.WebAuthnRPID = testRPID
+	server.cfg.WebAuthnRPOrigins = []string{testOrigin}
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	require.Nil(t, server.store.SetTOTPSecret(context.Background(), acc.ID, "JBSWY3DPEHPK3PXP"))
+	require.Nil(t, server.store.EnableTOTP(context.Background(), acc.ID, nil))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	authenticator := newSoftAuthenticator(t)
+	authenticator.userVerified = false
+
+	rec := doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/passkeys/register/begin", acc.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	ceremony := decodeCeremony(t, rec.Body.Bytes())
+	rec = doJSON(t, router, "POST", fmt.Sprintf("/api/v1/account/%d/passkeys/register/finish", acc.ID), PasskeyFinishRequest{Session: ceremony.Session, Credential: authenticator.register(ceremony)}, header)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/api/v1/login/passkey/begin", PasskeyLoginRequest{Email: "abc@abc.com"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	ceremony = decodeCeremony(t, rec.Body.Bytes())
+	rec = doJSON(t, router, "POST", "/api/v1/login/passkey/finish", PasskeyFinishRequest{Session: ceremony.Session, Credential: authenticator.assert(ceremony)}, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var challenge TwoFactorChallengeResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&challenge))
+	assert.True(t, challenge.TwoFactorRequired)
+}
+
+func TestPasskeysDisabledWithoutRelyingParty(t *testing.T) {
+	_, router := newTestServer(t)
+	rec := doJSON(t, router, "POST", "/api/v1/login/passkey/begin", PasskeyLoginRequest{Email: "abc@abc.com"}, nil)
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
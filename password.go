@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+
+	argon2idPrefix = "$argon2id$"
+	argon2SaltLen  = 16
+	argon2KeyLen   = 32
+)
+
+// PasswordHasher hashes passwords with one algorithm and set of parameters.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify reports whether password matches hash. It is false for hashes
+	// made by another algorithm.
+	Verify(password, hash string) bool
+	// NeedsRehash reports whether hash was made by another algorithm or with
+	// other parameters, and should be replaced the next time the password is
+	// known.
+	NeedsRehash(hash string) bool
+}
+
+// passwordHasher hashes new passwords. Stored hashes are checked by
+// validatePassword whichever algorithm made them, so changing it only
+// affects new and rehashed passwords.
+var passwordHasher PasswordHasher = argon2idHasher{defaultArgon2idParams}
+
+// defaultArgon2idParams follow the OWASP recommendation of 19 MiB of memory
+// and two passes.
+var defaultArgon2idParams = argon2idParams{Time: 2, MemoryKiB: 19 * 1024, Threads: 1}
+
+// configurePasswordHasher sets passwordHasher from cfg.PasswordHash and the
+// parameters of that algorithm.
+func configurePasswordHasher(cfg *Config) error {
+	switch cfg.PasswordHash {
+	case "", PasswordHashArgon2id:
+		params := argon2idParams{Time: cfg.Argon2Time, MemoryKiB: cfg.Argon2MemoryKiB, Threads: cfg.Argon2Threads}
+		if params.Time == 0 || params.MemoryKiB < 8*uint32(params.Threads) || params.Threads == 0 {
+			return fmt.Errorf("argon2id needs a time and threads of at least 1 and at least 8 KiB of memory per thread, got %+v", params)
+		}
+		passwordHasher = argon2idHasher{params}
+	case PasswordHashBcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost %d must be between %d and %d", cfg.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		passwordHasher = bcryptHasher{cost: cfg.BcryptCost}
+	default:
+		return fmt.Errorf("unknown password hash %q, use %q or %q", cfg.PasswordHash, PasswordHashArgon2id, PasswordHashBcrypt)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// validatePassword checks password against a hash made by any supported
+// algorithm.
+func validatePassword(password, hashedPassword string) bool {
+	if strings.HasPrefix(hashedPassword, argon2idPrefix) {
+		return argon2idHasher{}.Verify(password, hashedPassword)
+	}
+	return bcryptHasher{}.Verify(password, hashedPassword)
+}
+
+// rehashPassword replaces acc's password hash when it was made by another
+// algorithm or with other parameters than passwordHasher, now that the
+// password is known after a successful login. Failing to is only logged.
+func (s *APIServer) rehashPassword(ctx context.Context, acc *Account, password string) {
+	if !passwordHasher.NeedsRehash(acc.EncryptedPassword) {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err == nil {
+		err = s.store.UpdatePassword(ctx, acc.ID, hash)
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "could not rehash password", "account_id", acc.ID, "error", err)
+		return
+	}
+	acc.EncryptedPassword = hash
+	s.logger.InfoContext(ctx, "password rehashed", "account_id", acc.ID)
+}
+
+type argon2idParams struct {
+	Time      uint32
+	MemoryKiB uint32
+	Threads   uint8
+}
+
+// argon2idHasher encodes hashes in the PHC string format,
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>, so they
+// carry the parameters they were made with.
+type argon2idHasher struct {
+	params argon2idParams
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.params.Time, h.params.MemoryKiB, h.params.Threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		h.params.MemoryKiB, h.params.Time, h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h argon2idHasher) Verify(password, hash string) bool {
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.MemoryKiB, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (h argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := decodeArgon2idHash(hash)
+	return err != nil || params != h.params
+}
+
+func decodeArgon2idHash(hash string) (params argon2idParams, salt, key []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2idPrefix), "$")
+	if !strings.HasPrefix(hash, argon2idPrefix) || len(parts) != 4 {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[0])
+	}
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters %q: %v", parts[1], err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key: %v", err)
+	}
+	return params, salt, key, nil
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	encpw, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(encpw), nil
+}
+
+func (h bcryptHasher) Verify(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (h bcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// passwordResetTokenTTL is how long a password reset link stays valid.
+const passwordResetTokenTTL = time.Hour
+
+// ErrPasswordResetTokenInvalid is returned by ResetPassword when the token is
+// unknown, already used or expired.
+var ErrPasswordResetTokenInvalid = errors.New("password reset token is invalid or expired")
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,strongpassword"`
+}
+
+// handleForgotPassword mails a password reset link to the account with the
+// given email. The response is the same whether or not such an account
+// exists, so the endpoint cannot be used to find out who banks here.
+func (s *APIServer) handleForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	req := new(ForgotPasswordRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	acc, err := s.store.GetAccountByEmail(r.Context(), normalizeEmail(req.Email))
+	switch {
+	case errors.Is(err, ErrAccountNotFound):
+		s.logger.InfoContext(r.Context(), "password reset requested for unknown email")
+	case err != nil:
+		return err
+	default:
+		token, err := newOpaqueToken()
+		if err != nil {
+			return fmt.Errorf("could not create password reset token: %w", err)
+		}
+		expiresAt := s.now().UTC().Add(passwordResetTokenTTL)
+		if err := s.store.CreatePasswordResetToken(r.Context(), acc.ID, hashOpaqueToken(token), expiresAt); err != nil {
+			return err
+		}
+		if err := s.mailer.SendPasswordResetEmail(r.Context(), acc.Email, token); err != nil {
+			return err
+		}
+		s.logger.InfoContext(r.Context(), "password reset requested", "account_id", acc.ID)
+	}
+	return WriteJSON(w, http.StatusAccepted, "if the email belongs to an account, a reset link has been sent")
+}
+
+// handleResetPassword sets a new password with the token from a reset link.
+// Every refresh token of the account is revoked, so sessions opened before
+// the reset end once their access token expires.
+func (s *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	req := new(ResetPasswordRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	id, err := s.store.ResetPassword(r.Context(), hashOpaqueToken(req.Token), hash, s.now().UTC())
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "password reset", "account_id", id)
+	return WriteJSON(w, http.StatusOK, "OK")
+}
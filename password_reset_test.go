@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordReset(t *testing.T) {
+	server, router := newTestServer(t)
+	mailer := &fakeMailer{tokens: map[string]string{}}
+	server.mailer = mailer
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var login LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&login))
+	accessHeader := http.Header{"Authorization": {"Bearer " + login.Token}}
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, accessHeader)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/api/v1/password/forgot", ForgotPasswordRequest{Email: "nobody@abc.com"}, nil)
+	assert.Equal(t, http.StatusAccepted, rec.Code, "unknown emails look the same")
+	assert.Empty(t, mailer.tokens)
+
+	rec = doJSON(t, router, "POST", "/api/v1/password/forgot", ForgotPasswordRequest{Email: "ABC@abc.com"}, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	token := mailer.tokens["abc@abc.com"]
+	require.NotEmpty(t, token)
+
+	rec = doJSON(t, router, "POST", "/api/v1/password/reset", ResetPasswordRequest{Token: token, Password: "short"}, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = doJSON(t, router, "POST", "/api/v1/password/reset", ResetPasswordRequest{Token: "wrong", Password: "newpassword456"}, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doJSON(t, router, "POST", "/api/v1/password/reset", ResetPasswordRequest{Token: token, Password: "newpassword456"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "POST", "/api/v1/password/reset", ResetPasswordRequest{Token: token, Password: "newpassword789"}, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the token can only be used once")
+
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: login.RefreshToken}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "sessions from before the reset are ended")
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, accessHeader)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "so are their access tokens")
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "newpassword456"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
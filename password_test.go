@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useBcrypt hashes new passwords with bcrypt at cost for the rest of t.
+func useBcrypt(t *testing.T, cost int) {
+	previous := passwordHasher
+	t.Cleanup(func() { passwordHasher = previous })
+	require.Nil(t, configurePasswordHasher(&Config{PasswordHash: PasswordHashBcrypt, BcryptCost: cost}))
+}
+
+func TestBcryptCostRoundTrip(t *testing.T) {
+	useBcrypt(t, bcrypt.DefaultCost+1)
+
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	assert.Nil(t, err)
+	cost, err := bcrypt.Cost([]byte(acc.EncryptedPassword))
+	assert.Nil(t, err)
+	assert.Equal(t, bcrypt.DefaultCost+1, cost)
+	assert.True(t, validatePassword("password123", acc.EncryptedPassword))
+
+	assert.NotNil(t, configurePasswordHasher(&Config{PasswordHash: PasswordHashBcrypt, BcryptCost: bcrypt.MaxCost + 1}))
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := argon2idHasher{argon2idParams{Time: 1, MemoryKiB: 64, Threads: 1}}
+	hash, err := hasher.Hash("password123")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$"), hash)
+	assert.True(t, validatePassword("password123", hash))
+	assert.False(t, validatePassword("password124", hash))
+	assert.False(t, validatePassword("password123", hash[:len(hash)-2]), "a truncated hash")
+
+	other, err := hasher.Hash("password123")
+	require.Nil(t, err)
+	assert.NotEqual(t, hash, other, "hashes are salted")
+
+	assert.False(t, hasher.NeedsRehash(hash))
+	assert.True(t, argon2idHasher{argon2idParams{Time: 2, MemoryKiB: 64, Threads: 1}}.NeedsRehash(hash))
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.Nil(t, err)
+	assert.True(t, hasher.NeedsRehash(string(bcryptHash)))
+	assert.True(t, bcryptHasher{cost: bcrypt.MinCost}.NeedsRehash(hash))
+
+	assert.NotNil(t, configurePasswordHasher(&Config{Argon2Time: 1, Argon2MemoryKiB: 64}), "no threads")
+	assert.NotNil(t, configurePasswordHasher(&Config{PasswordHash: "md5"}))
+}
+
+func TestLoginRehashesBcryptPassword(t *testing.T) {
+	server, router := newTestServer(t)
+	useBcrypt(t, bcrypt.MinCost)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	passwordHasher = argon2idHasher{defaultArgon2idParams}
+
+	rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	found, err := server.store.GetAccountByID(context.Background(), acc.ID)
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(found.EncryptedPassword, argon2idPrefix))
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "the new hash works")
+}
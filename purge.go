@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// defaultDeletedAccountRetention is how long soft deleted accounts are kept
+// before the purge job removes them for good.
+const defaultDeletedAccountRetention = 30 * 24 * time.Hour
+
+// runPurgeJob calls Storage.PurgeExpired every interval until ctx is done.
+func (s *APIServer) runPurgeJob(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			purged, err := s.store.PurgeExpired(ctx, now.UTC())
+			if err != nil {
+				s.logger.Error("purge failed", "purged", purged, "error", err)
+				continue
+			}
+			s.logger.Info("purged expired rows", "purged", purged)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per key. Each bucket holds up to burst
+// tokens and refills at rate tokens per second.
+type rateLimiter interface {
+	// take takes a token from key's bucket.
+	take(key string) rateLimit
+}
+
+// rateLimit is the state of a bucket after a take, as reported in the
+// RateLimit-* response headers.
+type rateLimit struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is how long until the bucket is full again.
+	reset time.Duration
+	// retryAfter is how long until the next token when the take was not
+	// allowed.
+	retryAfter time.Duration
+}
+
+// bucketRateLimit describes a bucket holding tokens after a take.
+func bucketRateLimit(allowed bool, tokens, rate float64, burst int) rateLimit {
+	l := rateLimit{
+		allowed:   allowed,
+		limit:     burst,
+		remaining: int(math.Max(0, math.Floor(tokens))),
+		reset:     time.Duration((float64(burst) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		l.retryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return l
+}
+
+// rateLimitRedis shares buckets between instances when set by
+// configureRateLimiting. Buckets are kept in memory otherwise.
+var rateLimitRedis *redisClient
+
+// rateLimitLogger reports Redis failures, during which requests are let
+// through rather than refused.
+var rateLimitLogger = slog.Default()
+
+// configureRateLimiting sets up the Redis backend for rate limits when
+// cfg.RateLimitRedisURL is set.
+func configureRateLimiting(cfg *Config, logger *slog.Logger) error {
+	rateLimitLogger = logger
+	rateLimitRedis = nil
+	if cfg.RateLimitRedisURL == "" {
+		return nil
+	}
+	client, err := newRedisClient(cfg.RateLimitRedisURL)
+	if err != nil {
+		return err
+	}
+	rateLimitRedis = client
+	return nil
+}
+
+// newRateLimiter returns a limiter for the buckets called name, or nil,
+// which allows everything, when rate or burst is zero.
+func newRateLimiter(name string, rate float64, burst int) rateLimiter {
+	if burst <= 0 || rate <= 0 {
+		return nil
+	}
+	if rateLimitRedis != nil {
+		return &redisRateLimiter{client: rateLimitRedis, prefix: "gobank:ratelimit:" + name + ":", rate: rate, burst: burst, now: time.Now}
+	}
+	return newMemoryRateLimiter(rate, burst)
+}
+
+// memoryRateLimiter keeps its buckets in memory, so each instance limits
+// on its own.
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newMemoryRateLimiter(rate float64, burst int) *memoryRateLimiter {
+	return &memoryRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (l *memoryRateLimiter) take(key string) rateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return bucketRateLimit(allowed, b.tokens, l.rate, int(l.burst))
+}
+
+// sweep drops buckets that have been idle long enough to refill completely,
+// since they are indistinguishable from a new bucket.
+func (l *memoryRateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// redisTokenBucket refills and takes from the bucket at KEYS[1] atomically.
+// ARGV holds the rate per second, the burst and the time in milliseconds.
+// The bucket expires once it would be full again.
+const redisTokenBucket = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens, last = tonumber(state[1]) or burst, tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(tokens)}
+`
+
+// redisRateLimiter keeps its buckets in Redis, so instances sharing it
+// limit together.
+type redisRateLimiter struct {
+	client *redisClient
+	prefix string
+	rate   float64
+	burst  int
+	now    func() time.Time
+}
+
+// take lets the request through when Redis cannot be reached, so an outage
+// there does not take the API down with it.
+func (l *redisRateLimiter) take(key string) rateLimit {
+	allowed, tokens, err := l.eval(key)
+	if err != nil {
+		rateLimitLogger.Error("rate limit check failed, allowing request", "error", err)
+		return rateLimit{allowed: true, limit: l.burst, remaining: l.burst}
+	}
+	return bucketRateLimit(allowed, tokens, l.rate, l.burst)
+}
+
+func (l *redisRateLimiter) eval(key string) (bool, float64, error) {
+	reply, err := l.client.do("EVAL", redisTokenBucket, "1", l.prefix+key,
+		strconv.FormatFloat(l.rate, 'f', -1, 64), strconv.Itoa(l.burst), strconv.FormatInt(l.now().UnixMilli(), 10))
+	if err != nil {
+		return false, 0, err
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, ok := items[0].(int64)
+	tokens, err := strconv.ParseFloat(fmt.Sprint(items[1]), 64)
+	if !ok || err != nil {
+		return false, 0, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	return allowed == 1, tokens, nil
+}
+
+// setRateLimitHeaders describes l in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, adding Retry-After when
+// the request was refused.
+func setRateLimitHeaders(w http.ResponseWriter, l rateLimit) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(l.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(l.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(l.reset.Seconds()))))
+	if !l.allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(l.retryAfter.Seconds()))))
+	}
+}
+
+// writeRateLimited answers a request refused by l with 429.
+func writeRateLimited(w http.ResponseWriter, l rateLimit) {
+	setRateLimitHeaders(w, l)
+	writeError(w, &HTTPError{Status: http.StatusTooManyRequests, Code: "RATE_LIMITED", Message: "too many requests"})
+}
+
+// withRateLimit rejects requests with 429 once the client's IP has used up
+// its bucket. A nil limiter disables limiting.
+func withRateLimit(limiter rateLimiter, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	if limiter == nil {
+		return handlerFunc
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l := limiter.take(clientIP(r)); !l.allowed {
+			writeRateLimited(w, l)
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+// withRequestRateLimit limits every request by client IP with ipLimiter and,
+// when it carries an access token or API key, by account or key with
+// accountLimiter. The RateLimit headers describe whichever bucket has fewer
+// tokens left. Nil limiters are skipped.
+func withRequestRateLimit(ipLimiter, accountLimiter rateLimiter, next http.Handler) http.Handler {
+	if ipLimiter == nil && accountLimiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var limits []rateLimit
+		if ipLimiter != nil {
+			limits = append(limits, ipLimiter.take(clientIP(r)))
+		}
+		if key := rateLimitAccountKey(r); accountLimiter != nil && key != "" {
+			limits = append(limits, accountLimiter.take(key))
+		}
+		if len(limits) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tightest := limits[0]
+		for _, l := range limits[1:] {
+			if !l.allowed || (tightest.allowed && l.remaining < tightest.remaining) {
+				tightest = l
+			}
+		}
+		if !tightest.allowed {
+			writeRateLimited(w, tightest)
+			return
+		}
+		setRateLimitHeaders(w, tightest)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitAccountKey returns the bucket of the account whose valid access
+// token r carries, or of the API key it carries. API keys are not looked up,
+// so each key gets its own bucket. It is empty for anonymous requests.
+func rateLimitAccountKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return "key:" + hashOpaqueToken(key)
+	}
+	if tokenString, ok := tokenFromRequest(r); ok {
+		if claims, err := validateAccessToken(tokenString); err == nil {
+			return "account:" + strconv.Itoa(claims.AccountID)
+		}
+	}
+	return ""
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// RateProvider supplies exchange rates for cross-currency transfers. Rate
+// returns how many units of to one unit of from buys.
+type RateProvider interface {
+	Rate(from, to string) (float64, error)
+}
+
+// staticRates serves the rates from Config.ExchangeRates, keyed by source
+// then destination currency. A pair configured only the other way round is
+// served as the inverse.
+type staticRates map[string]map[string]float64
+
+func (r staticRates) Rate(from, to string) (float64, error) {
+	if rate, ok := r[from][to]; ok {
+		return rate, nil
+	}
+	if rate, ok := r[to][from]; ok {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("no exchange rate from %s to %s", from, to)
+}
+
+// newRateProvider returns the configured rates, or nil when none are set and
+// cross-currency transfers stay disabled.
+func newRateProvider(cfg *Config) (RateProvider, error) {
+	if len(cfg.ExchangeRates) == 0 {
+		return nil, nil
+	}
+	for from, rates := range cfg.ExchangeRates {
+		for to, rate := range rates {
+			if !isSupportedCurrency(from) || !isSupportedCurrency(to) {
+				return nil, fmt.Errorf("exchange rate %s/%s uses an unsupported currency", from, to)
+			}
+			if !(rate > 0) {
+				return nil, fmt.Errorf("exchange rate %s/%s must be positive, got %v", from, to, rate)
+			}
+		}
+	}
+	return staticRates(cfg.ExchangeRates), nil
+}
+
+// convertAmount converts amount, in minor units of from, to minor units of to
+// at rate. Half a minor unit or more rounds away from zero.
+func convertAmount(amount int64, from, to string, rate float64) int64 {
+	r := new(big.Rat).SetInt64(amount)
+	r.Mul(r, new(big.Rat).SetFloat64(rate))
+	shift := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(currencyMinorUnits[to]-currencyMinorUnits[from]))), nil)
+	if currencyMinorUnits[to] > currencyMinorUnits[from] {
+		r.Mul(r, new(big.Rat).SetInt(shift))
+	} else {
+		r.Quo(r, new(big.Rat).SetInt(shift))
+	}
+
+	// round half away from zero
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(m), big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(r.Sign())))
+	}
+	return q.Int64()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// transferEntries checks that amount can go from one account to the other
+// and returns the ledger entries recording it. Accounts in different
+// currencies are rejected with ErrCurrencyMismatch unless rates is set, in
+// which case the credit is converted and both entries record the rate and
+// what was sent.
+func transferEntries(from, to *Account, amount int64, rates RateProvider, now time.Time) (debit, credit *Transaction, err error) {
+	debit = &Transaction{AccountID: from.ID, Type: TransactionTransferDebit, Amount: amount, CounterpartyAccountID: &to.ID, CreatedAt: now, Status: TransactionStatusCompleted}
+	credit = &Transaction{AccountID: to.ID, Type: TransactionTransferCredit, Amount: amount, CounterpartyAccountID: &from.ID, CreatedAt: now, Status: TransactionStatusCompleted}
+	if from.Currency == to.Currency {
+		return debit, credit, nil
+	}
+	if rates == nil {
+		return nil, nil, fmt.Errorf("%w: cannot send %s to a %s account", ErrCurrencyMismatch, from.Currency, to.Currency)
+	}
+	rate, err := rates.Rate(from.Currency, to.Currency)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCurrencyMismatch, err)
+	}
+	credit.Amount = convertAmount(amount, from.Currency, to.Currency, rate)
+	if credit.Amount <= 0 {
+		return nil, nil, fmt.Errorf("%w: %s is worth nothing in %s", ErrCurrencyMismatch, Money{amount, from.Currency}, to.Currency)
+	}
+	currency := from.Currency
+	for _, t := range []*Transaction{debit, credit} {
+		t.ExchangeRate = &rate
+		t.OriginalAmount = &amount
+		t.OriginalCurrency = &currency
+	}
+	return debit, credit, nil
+}
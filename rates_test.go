@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRates serves fixed rates from one source currency.
+type fakeRates map[string]float64
+
+func (f fakeRates) Rate(from, to string) (float64, error) {
+	return staticRates{DefaultCurrency: f}.Rate(from, to)
+}
+
+func TestConvertAmount(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		from, to string
+		rate     float64
+		want     int64
+	}{
+		{1000, "USD", "EUR", 0.92, 920},
+		{105, "USD", "EUR", 0.5, 53},
+		{-105, "USD", "EUR", 0.5, -53},
+		{104, "USD", "EUR", 0.5, 52},
+		{150, "USD", "JPY", 149.5, 224},
+		{1, "USD", "JPY", 149.5, 1},
+		{1000, "JPY", "USD", 0.0067, 670},
+		{1234, "USD", "KWD", 0.307, 3788},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, convertAmount(tt.amount, tt.from, tt.to, tt.rate), "%d %s -> %s at %v", tt.amount, tt.from, tt.to, tt.rate)
+	}
+}
+
+func TestStaticRates(t *testing.T) {
+	rates, err := newRateProvider(&Config{ExchangeRates: map[string]map[string]float64{"USD": {"EUR": 0.8}}})
+	require.Nil(t, err)
+
+	rate, err := rates.Rate("USD", "EUR")
+	require.Nil(t, err)
+	assert.Equal(t, 0.8, rate)
+	rate, err = rates.Rate("EUR", "USD")
+	require.Nil(t, err)
+	assert.Equal(t, 1.25, rate)
+	_, err = rates.Rate("USD", "GBP")
+	assert.NotNil(t, err)
+
+	rates, err = newRateProvider(&Config{})
+	require.Nil(t, err)
+	assert.Nil(t, rates)
+
+	_, err = newRateProvider(&Config{ExchangeRates: map[string]map[string]float64{"USD": {"EUR": 0}}})
+	assert.NotNil(t, err)
+	_, err = newRateProvider(&Config{ExchangeRates: map[string]map[string]float64{"USD": {"XYZ": 1}}})
+	assert.NotNil(t, err)
+}
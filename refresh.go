@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultRefreshTokenTTL is how long a refresh token can be exchanged for a
+// new access token unless configured otherwise.
+const defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// refreshTokenCookie is the cookie login sets for the refresh token when
+// Config.JWTCookie is on.
+const refreshTokenCookie = "refresh_token"
+
+// ErrRefreshTokenInvalid is returned by RotateRefreshToken when the token is
+// unknown, expired or revoked.
+var ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+
+// ErrRefreshTokenReused is returned by RotateRefreshToken when a token that
+// was already rotated is presented again. The replay suggests the token was
+// stolen, so its whole family has been revoked.
+var ErrRefreshTokenReused = fmt.Errorf("refresh token was already used: %w", ErrRefreshTokenInvalid)
+
+// RefreshToken is a stored refresh token. Every login starts a new family;
+// each refresh replaces the presented token with a new one of the same
+// family, so replaying an old token can revoke everything issued after it.
+type RefreshToken struct {
+	TokenHash string
+	AccountID int
+	FamilyID  string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	// UsedAt is set once the token has been rotated.
+	UsedAt *time.Time
+	// RevokedAt is set on every token of a family that was logged out or
+	// replayed.
+	RevokedAt *time.Time
+}
+
+type RefreshTokenRequest struct {
+	// RefreshToken may be left out when it is sent as a cookie.
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+// checkRotation checks that t may be exchanged for a new token at now.
+func (t *RefreshToken) checkRotation(now time.Time) error {
+	switch {
+	case t.RevokedAt != nil, !now.Before(t.ExpiresAt):
+		return ErrRefreshTokenInvalid
+	case t.UsedAt != nil:
+		return ErrRefreshTokenReused
+	default:
+		return nil
+	}
+}
+
+// newRefreshToken returns a refresh token for the family, or a new family
+// when family is empty, along with the stored record.
+func (s *APIServer) newRefreshToken(accountID int, family string) (string, *RefreshToken, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+	if family == "" {
+		if family, err = newOpaqueToken(); err != nil {
+			return "", nil, err
+		}
+	}
+	now := s.now().UTC()
+	return token, &RefreshToken{
+		TokenHash: hashOpaqueToken(token),
+		AccountID: accountID,
+		FamilyID:  family,
+		ExpiresAt: now.Add(s.cfg.RefreshTokenTTL),
+		CreatedAt: now,
+	}, nil
+}
+
+// refreshTokenFromRequest returns the refresh token in the body of r or,
+// failing that, the refresh token cookie.
+func refreshTokenFromRequest(w http.ResponseWriter, r *http.Request) (string, error) {
+	if r.ContentLength != 0 {
+		req := new(RefreshTokenRequest)
+		if err := decodeJSON(w, r, req); err != nil {
+			return "", err
+		}
+		if req.RefreshToken != "" {
+			return req.RefreshToken, nil
+		}
+	}
+	if cookie, err := r.Cookie(refreshTokenCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	return "", nil
+}
+
+// handleRefreshToken exchanges a refresh token for a new access token and a
+// new refresh token. The presented token cannot be used again.
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	presented, err := refreshTokenFromRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if presented == "" {
+		return unauthorized("REFRESH_TOKEN_REQUIRED", "refresh token required")
+	}
+	token, next, err := s.newRefreshToken(0, "")
+	if err != nil {
+		return fmt.Errorf("could not create refresh token: %w", err)
+	}
+	if err := s.store.RotateRefreshToken(r.Context(), hashOpaqueToken(presented), next); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			s.logger.WarnContext(r.Context(), "refresh token replayed, token family revoked", "account_id", next.AccountID)
+		}
+		return err
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), next.AccountID)
+	if errors.Is(err, ErrAccountNotFound) {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "token refreshed", "account_id", acc.ID)
+	return s.writeTokens(w, r, acc, token, next)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// replicaReadsKey marks a context whose account reads may be served by a
+// read replica, which can lag the primary.
+const replicaReadsKey contextKey = "replica_reads"
+
+// withReplicaReads lets GET and HEAD requests read accounts from a replica.
+// Other methods write, and must see their own writes, so they stay on the
+// primary.
+func withReplicaReads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			r = r.WithContext(context.WithValue(r.Context(), replicaReadsKey, true))
+		}
+		next(w, r)
+	}
+}
+
+func replicaReadsAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(replicaReadsKey).(bool)
+	return allowed
+}
+
+// readReplica is a pool on one of Config.ReadReplicas. Reads are only sent
+// to it while it is healthy.
+type readReplica struct {
+	addr    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+// replicaSet spreads reads over the healthy replicas in turn.
+type replicaSet struct {
+	replicas []*readReplica
+	next     atomic.Uint64
+}
+
+// newReplicaSet opens a pool on every replica in cfg.ReadReplicas, which
+// share the primary's credentials, database and schema. A replica that does
+// not answer at startup is left out of rotation until the monitor sees it
+// come up. It returns nil when no replicas are configured.
+func newReplicaSet(cfg *Config, logger *slog.Logger) (*replicaSet, error) {
+	if len(cfg.ReadReplicas) == 0 {
+		return nil, nil
+	}
+	rs := &replicaSet{}
+	for _, addr := range cfg.ReadReplicas {
+		replicaConfig := *cfg
+		replicaConfig.Host = addr
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			replicaConfig.Host = host
+			if replicaConfig.Port, err = strconv.Atoi(port); err != nil {
+				rs.close()
+				return nil, fmt.Errorf("invalid read replica %q: %v", addr, err)
+			}
+		}
+		poolConfig, err := postgresPoolConfig(&replicaConfig, logger)
+		if err != nil {
+			rs.close()
+			return nil, err
+		}
+		pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+		if err != nil {
+			rs.close()
+			return nil, fmt.Errorf("error creating pool for read replica %s: %v", addr, err)
+		}
+		r := &readReplica{addr: addr, pool: pool}
+		if err := pool.Ping(context.Background()); err != nil {
+			logger.Warn("read replica is unreachable", "replica", addr, "error", err)
+		} else {
+			r.healthy.Store(true)
+		}
+		rs.replicas = append(rs.replicas, r)
+	}
+	return rs, nil
+}
+
+// pick returns the next healthy replica, or nil when there is none.
+func (rs *replicaSet) pick() *readReplica {
+	if rs == nil {
+		return nil
+	}
+	start := rs.next.Add(1)
+	for i := range rs.replicas {
+		r := rs.replicas[(start+uint64(i))%uint64(len(rs.replicas))]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// check pings every replica, taking ones that fail out of rotation and
+// putting ones that answer again back.
+func (rs *replicaSet) check(ctx context.Context, timeout time.Duration, logger *slog.Logger) {
+	if rs == nil {
+		return
+	}
+	for _, r := range rs.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := r.pool.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			r.markDown(logger, err)
+		} else if !r.healthy.Swap(true) {
+			logger.Info("read replica is back in rotation", "replica", r.addr)
+		}
+	}
+}
+
+func (r *readReplica) markDown(logger *slog.Logger, err error) {
+	if r.healthy.Swap(false) {
+		logger.Error("read replica taken out of rotation", "replica", r.addr, "error", err)
+	}
+}
+
+func (rs *replicaSet) close() {
+	if rs == nil {
+		return
+	}
+	for _, r := range rs.replicas {
+		r.pool.Close()
+	}
+}
+
+// queryRead runs a read-only query on a healthy replica when ctx allows it,
+// falling back to the primary when there is none or the replica cannot be
+// reached.
+func (s *PostgresStore) queryRead(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if replicaReadsAllowed(ctx) {
+		if r := s.replicas.pick(); r != nil {
+			rows, err := r.pool.Query(ctx, sql, args...)
+			if err == nil || ctx.Err() != nil {
+				return rows, err
+			}
+			r.markDown(s.logger, err)
+		}
+	}
+	return s.db.Query(ctx, sql, args...)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaSetPick(t *testing.T) {
+	var rs *replicaSet
+	assert.Nil(t, rs.pick(), "no replicas configured")
+
+	a, b, c := &readReplica{addr: "a"}, &readReplica{addr: "b"}, &readReplica{addr: "c"}
+	for _, r := range []*readReplica{a, b, c} {
+		r.healthy.Store(true)
+	}
+	rs = &replicaSet{replicas: []*readReplica{a, b, c}}
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		seen[rs.pick().addr]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2, "c": 2}, seen, "reads are spread over the replicas")
+
+	b.markDown(discardLogger, assert.AnError)
+	for i := 0; i < 3; i++ {
+		assert.NotEqual(t, "b", rs.pick().addr, "replicas that are down are skipped")
+	}
+	a.markDown(discardLogger, assert.AnError)
+	c.markDown(discardLogger, assert.AnError)
+	assert.Nil(t, rs.pick(), "reads go to the primary when every replica is down")
+}
+
+func TestNewReplicaSet(t *testing.T) {
+	rs, err := newReplicaSet(&Config{}, discardLogger)
+	require.Nil(t, err)
+	assert.Nil(t, rs)
+
+	_, err = newReplicaSet(&Config{ReadReplicas: []string{"replica:db"}}, discardLogger)
+	assert.ErrorContains(t, err, "invalid read replica")
+}
+
+func TestWithReplicaReads(t *testing.T) {
+	var allowed bool
+	handler := withReplicaReads(func(w http.ResponseWriter, r *http.Request) {
+		allowed = replicaReadsAllowed(r.Context())
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/me", nil))
+	assert.True(t, allowed)
+	handler(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/v1/account/1", nil))
+	assert.False(t, allowed, "writes stay on the primary")
+}
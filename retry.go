@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// retryableCodes are the postgres error codes worth retrying: the transaction
+// lost a race and running it again is expected to succeed.
+var retryableCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+}
+
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && retryableCodes[pgErr.Code]
+}
+
+// retryPolicy reruns an operation that failed with a retryable error, doubling
+// the delay after each attempt. retryable defaults to isRetryable.
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	sleep     func(time.Duration)
+	retryable func(error) bool
+}
+
+func (p retryPolicy) do(op func() error) error {
+	retryable := p.retryable
+	if retryable == nil {
+		retryable = isRetryable
+	}
+	delay := p.baseDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !retryable(err) || attempt >= p.attempts {
+			return err
+		}
+		p.sleep(delay)
+		delay *= 2
+	}
+}
+
+// backoff spaces out attempts to reach something that is down. The delay
+// starts at base and doubles up to max, and each one is cut by up to half at
+// random so instances started together do not retry in lockstep.
+type backoff struct {
+	base, max time.Duration
+	// jitter returns a number in [0, 1). It defaults to rand.Float64.
+	jitter func() float64
+	sleep  func(time.Duration)
+	now    func() time.Time
+}
+
+func (b backoff) delay(attempt int) time.Duration {
+	d := b.base
+	for i := 0; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	jitter := b.jitter
+	if jitter == nil {
+		jitter = rand.Float64
+	}
+	return d - time.Duration(jitter()*float64(d)/2)
+}
+
+// retryUntil calls op until it succeeds, giving up with op's last error
+// when the next attempt would start more than maxWait after the first.
+func (b backoff) retryUntil(maxWait time.Duration, op func() error) error {
+	deadline := b.now().Add(maxWait)
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		delay := b.delay(attempt)
+		if b.now().Add(delay).After(deadline) {
+			return err
+		}
+		b.sleep(delay)
+	}
+}
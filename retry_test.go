@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var slept []time.Duration
+	policy := retryPolicy{
+		attempts:  3,
+		baseDelay: 10 * time.Millisecond,
+		sleep:     func(d time.Duration) { slept = append(slept, d) },
+	}
+
+	calls := 0
+	err := policy.do(func() error {
+		calls++
+		if calls == 1 {
+			return fmt.Errorf("could not commit transfer: %w", &pgconn.PgError{Code: "40001"})
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond}, slept)
+
+	calls, slept = 0, nil
+	err = policy.do(func() error {
+		calls++
+		return &pgconn.PgError{Code: "40P01"}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, slept)
+
+	calls = 0
+	err = policy.do(func() error {
+		calls++
+		return errors.New("insufficient funds")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{base: 100 * time.Millisecond, max: time.Second, jitter: func() float64 { return 0 }}
+	var delays []time.Duration
+	for attempt := 0; attempt < 6; attempt++ {
+		delays = append(delays, b.delay(attempt))
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}, delays)
+	b.jitter = func() float64 { return 0.5 }
+	assert.Equal(t, 750*time.Millisecond, b.delay(4), "jitter takes up to half off")
+
+	now := time.Unix(0, 0)
+	b.jitter = func() float64 { return 0 }
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) { now = now.Add(d) }
+	calls := 0
+	err := b.retryUntil(time.Second, func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, calls, "a fifth attempt would start after 1.5s")
+
+	calls = 0
+	err = b.retryUntil(time.Minute, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = b.retryUntil(-1, func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrTransactionNotFound is returned when no transaction matches a lookup.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// ErrAlreadyReversed is returned by ReverseTransfer when the transfer has
+// been reversed before.
+var ErrAlreadyReversed = errors.New("transfer was already reversed")
+
+// reversalEntries returns the compensating transactions for a transfer:
+// the recipient gives back what it received and the sender gets back what
+// it sent, in their own currencies, so a conversion is undone at the
+// original rate.
+func reversalEntries(debit, credit *Transaction, now time.Time) (reversalDebit, reversalCredit *Transaction) {
+	reversalDebit = &Transaction{
+		AccountID:             credit.AccountID,
+		Type:                  TransactionReversalDebit,
+		Amount:                credit.Amount,
+		CounterpartyAccountID: &debit.AccountID,
+		CreatedAt:             now,
+		Status:                TransactionStatusCompleted,
+		ReversalOf:            &credit.ID,
+	}
+	reversalCredit = &Transaction{
+		AccountID:             debit.AccountID,
+		Type:                  TransactionReversalCredit,
+		Amount:                debit.Amount,
+		CounterpartyAccountID: &credit.AccountID,
+		CreatedAt:             now,
+		Status:                TransactionStatusCompleted,
+		ReversalOf:            &debit.ID,
+	}
+	for _, t := range []*Transaction{reversalDebit, reversalCredit} {
+		t.ExchangeRate = debit.ExchangeRate
+		t.OriginalAmount = debit.OriginalAmount
+		t.OriginalCurrency = debit.OriginalCurrency
+	}
+	return reversalDebit, reversalCredit
+}
+
+// checkReversal returns an error unless debit is a transfer that has not
+// been reversed, between active accounts, whose recipient can give back
+// amount. The caller holds the locks on both accounts.
+func checkReversal(debit *Transaction, sender, recipient *Account, amount int64) error {
+	if debit.Status == TransactionStatusReversed {
+		return fmt.Errorf("%w: transaction %d", ErrAlreadyReversed, debit.ID)
+	}
+	for _, acc := range []*Account{sender, recipient} {
+		if acc.Status == AccountStatusFrozen {
+			return fmt.Errorf("%w: id %d", ErrAccountFrozen, acc.ID)
+		}
+	}
+	return checkFunds(recipient, amount)
+}
+
+// handleReverseTransfer undoes a transfer, identified by the id of the
+// sender's debit entry. Only the recipient or an admin may reverse it.
+func (s *APIServer) handleReverseTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	debit, err := s.store.GetTransaction(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if debit.Type != TransactionTransferDebit {
+		return fmt.Errorf("%w: no transfer with id %d", ErrTransactionNotFound, id)
+	}
+	claims, _ := claimsFromContext(r.Context())
+	recipient := debit.CounterpartyAccountID != nil && *debit.CounterpartyAccountID == claims.AccountID
+	if !recipient && claims.Role != RoleAdmin {
+		return errPermissionDenied
+	}
+
+	reversal, err := s.store.ReverseTransfer(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "transfer reversed", "transaction_id", id, "account_id", debit.AccountID, "reversed_by", claims.AccountID)
+	s.events.Dispatch(Event{
+		Type:                  EventTransferReversed,
+		AccountID:             debit.AccountID,
+		CounterpartyAccountID: debit.CounterpartyAccountID,
+		Amount:                debit.Amount,
+		Timestamp:             reversal.CreatedAt,
+	})
+	return WriteJSON(w, http.StatusOK, reversal)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	ScheduledTransferPending = "pending"
+	// ScheduledTransferProcessing marks a transfer the worker has claimed.
+	ScheduledTransferProcessing = "processing"
+	ScheduledTransferCompleted  = "completed"
+	ScheduledTransferFailed     = "failed"
+	ScheduledTransferCancelled  = "cancelled"
+)
+
+// scheduledTransferBatch caps how many due transfers the worker claims at a
+// time.
+const scheduledTransferBatch = 100
+
+// ErrScheduledTransferNotFound is returned when no scheduled transfer of the
+// account matches a lookup.
+var ErrScheduledTransferNotFound = errors.New("scheduled transfer not found")
+
+// ErrScheduledTransferNotPending is returned by CancelScheduledTransfer once
+// the transfer has started, finished or been cancelled.
+var ErrScheduledTransferNotPending = errors.New("scheduled transfer is no longer pending")
+
+// ScheduledTransfer is a transfer to be made at ExecuteAt by the scheduled
+// transfer worker.
+type ScheduledTransfer struct {
+	ID          int       `json:"id"`
+	AccountID   int       `json:"accountId"`
+	ToAccountID int       `json:"toAccountId"`
+	Amount      int64     `json:"amount"`
+	ExecuteAt   time.Time `json:"executeAt"`
+	Status      string    `json:"status"`
+	// TransactionID is the sender's debit once the transfer has completed.
+	TransactionID *int `json:"transactionId,omitempty"`
+	// FailureReason says why a failed transfer could not be made.
+	FailureReason string `json:"failureReason,omitempty"`
+	// StandingOrderID is set when the transfer is a run of a standing order.
+	StandingOrderID *int      `json:"standingOrderId,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+type ScheduledTransfersPage struct {
+	ScheduledTransfers []*ScheduledTransfer `json:"scheduledTransfers"`
+	Limit              int                  `json:"limit"`
+	Offset             int                  `json:"offset"`
+}
+
+// runScheduledTransfers queues due standing order runs and makes due
+// scheduled transfers every interval until ctx is done.
+func (s *APIServer) runScheduledTransfers(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.queueStandingOrders(ctx, now.UTC())
+			s.executeDueTransfers(ctx, now.UTC())
+		}
+	}
+}
+
+// executeDueTransfers claims and makes every transfer due by now. Transfers
+// refused for a reason of the sender's making, such as insufficient funds,
+// fail; ones hit by an internal error go back to pending to be retried.
+// Claimed transfers are seen through even once ctx is done, as they would
+// otherwise be left claimed.
+func (s *APIServer) executeDueTransfers(ctx context.Context, now time.Time) {
+	for {
+		due, err := s.store.ClaimDueScheduledTransfers(ctx, now, scheduledTransferBatch)
+		if err != nil {
+			s.logger.Error("could not claim scheduled transfers", "error", err)
+			return
+		}
+		for _, st := range due {
+			s.executeScheduledTransfer(context.WithoutCancel(ctx), st)
+		}
+		if len(due) < scheduledTransferBatch {
+			return
+		}
+	}
+}
+
+func (s *APIServer) executeScheduledTransfer(ctx context.Context, st *ScheduledTransfer) {
+	debit, err := s.store.Transfer(ctx, st.AccountID, st.ToAccountID, st.Amount)
+	switch {
+	case err == nil:
+		st.Status = ScheduledTransferCompleted
+		st.TransactionID = &debit.ID
+		s.logger.Info("scheduled transfer completed", "scheduled_transfer_id", st.ID, "account_id", st.AccountID, "to_account_id", st.ToAccountID, "amount", st.Amount)
+		s.events.Dispatch(Event{
+			Type:                  EventTransferCompleted,
+			AccountID:             st.AccountID,
+			CounterpartyAccountID: &st.ToAccountID,
+			Amount:                st.Amount,
+			Timestamp:             debit.CreatedAt,
+		})
+	case errorStatus(err) == http.StatusInternalServerError:
+		st.Status = ScheduledTransferPending
+		s.logger.Error("scheduled transfer will be retried", "scheduled_transfer_id", st.ID, "error", err)
+	default:
+		st.Status = ScheduledTransferFailed
+		st.FailureReason = err.Error()
+		s.logger.Info("scheduled transfer failed", "scheduled_transfer_id", st.ID, "account_id", st.AccountID, "error", err)
+	}
+	if err := s.store.FinishScheduledTransfer(ctx, st); err != nil {
+		s.logger.Error("could not record scheduled transfer outcome", "scheduled_transfer_id", st.ID, "status", st.Status, "error", err)
+	}
+}
+
+// scheduleTransfer stores a transfer from fromID to toID for tr.ExecuteAt.
+func (s *APIServer) scheduleTransfer(ctx context.Context, store TransactionRepository, fromID, toID int, tr *TransferRequest) (*ScheduledTransfer, error) {
+	now := s.now().UTC()
+	if !tr.ExecuteAt.After(now) {
+		return nil, badRequest("executeAt %s must be in the future", tr.ExecuteAt.Format(time.RFC3339))
+	}
+	if fromID == toID {
+		return nil, badRequest("cannot transfer to the same account")
+	}
+	st := &ScheduledTransfer{
+		AccountID:   fromID,
+		ToAccountID: toID,
+		Amount:      tr.Amount,
+		ExecuteAt:   tr.ExecuteAt.UTC(),
+		Status:      ScheduledTransferPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := store.CreateScheduledTransfer(ctx, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// handleGetScheduledTransfers lists an account's scheduled transfers, newest
+// first.
+func (s *APIServer) handleGetScheduledTransfers(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	limit, offset, err := getPaginationFromRequest(r)
+	if err != nil {
+		return err
+	}
+	transfers, err := s.store.GetScheduledTransfers(r.Context(), id, limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, ScheduledTransfersPage{
+		ScheduledTransfers: transfers,
+		Limit:              limit,
+		Offset:             offset,
+	})
+}
+
+// handleCancelScheduledTransfer cancels one of an account's scheduled
+// transfers that has not been made yet.
+func (s *APIServer) handleCancelScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	transferID, err := getPositiveIntVar(r, "transferID")
+	if err != nil {
+		return err
+	}
+	st, err := s.store.CancelScheduledTransfer(r.Context(), id, transferID)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "scheduled transfer cancelled", "scheduled_transfer_id", transferID, "account_id", id)
+	return WriteJSON(w, http.StatusOK, st)
+}
+
+// checkScheduledTransferOutcome checks that the worker left st in a status
+// a claimed transfer may move to.
+func checkScheduledTransferOutcome(st *ScheduledTransfer) error {
+	switch st.Status {
+	case ScheduledTransferPending, ScheduledTransferCompleted, ScheduledTransferFailed:
+		return nil
+	default:
+		return fmt.Errorf("scheduled transfer %d cannot finish as %s", st.ID, st.Status)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduledTransfer(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	for _, acc := range []*Account{from, to} {
+		require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	}
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	executeAt := time.Now().UTC().Add(time.Hour)
+	rec := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 40, ExecuteAt: &executeAt}, header)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var scheduled ScheduledTransfer
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&scheduled))
+	assert.Equal(t, ScheduledTransferPending, scheduled.Status)
+
+	past := time.Now().UTC().Add(-time.Hour)
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 40, ExecuteAt: &past}, header)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// nothing moves until the transfer is due
+	server.executeDueTransfers(context.Background(), time.Now().UTC())
+	balance, err := server.store.GetBalance(context.Background(), from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(100), balance.Amount)
+
+	server.executeDueTransfers(context.Background(), executeAt.Add(time.Second))
+	balance, err = server.store.GetBalance(context.Background(), from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(60), balance.Amount)
+
+	rec = doJSON(t, router, "GET", fmt.Sprintf("/api/v1/account/%d/scheduled-transfers", from.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var page ScheduledTransfersPage
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.ScheduledTransfers, 1)
+	assert.Equal(t, ScheduledTransferCompleted, page.ScheduledTransfers[0].Status)
+	assert.NotNil(t, page.ScheduledTransfers[0].TransactionID)
+
+	path := fmt.Sprintf("/api/v1/account/%d/scheduled-transfers/%d", from.ID, scheduled.ID)
+	rec = doJSON(t, router, "DELETE", path, nil, header)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// a transfer the sender cannot afford fails instead of retrying forever
+	executeAt = time.Now().UTC().Add(time.Hour)
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 1000, ExecuteAt: &executeAt}, header)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	server.executeDueTransfers(context.Background(), executeAt.Add(time.Second))
+	transfers, err := server.store.GetScheduledTransfers(context.Background(), from.ID, 1, 0)
+	require.Nil(t, err)
+	assert.Equal(t, ScheduledTransferFailed, transfers[0].Status)
+	assert.Contains(t, transfers[0].FailureReason, "insufficient funds")
+
+	rec = doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 10, ExecuteAt: &executeAt}, header)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&scheduled))
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("/api/v1/account/%d/scheduled-transfers/%d", from.ID, scheduled.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"status":"cancelled"`)
+}
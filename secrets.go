@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SecretProviderEnv   = "env"
+	SecretProviderVault = "vault"
+	SecretProviderAWS   = "aws"
+)
+
+// defaultSecretRefreshInterval is how often secrets from Vault or AWS
+// Secrets Manager are read again unless configured otherwise.
+const defaultSecretRefreshInterval = 5 * time.Minute
+
+// SecretProvider supplies credentials such as the JWT secret and the
+// database password. Secret returns the current value of the secret called
+// name.
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// secrets resolves Config.JWTSecretName and Config.DBPasswordSecretName. It
+// reads the environment until configureSecrets selects another provider.
+var secrets SecretProvider = envSecrets{}
+
+// jwtSecretName is the secret HS256 tokens are signed with.
+var jwtSecretName = defaultJWTSecretName
+
+const defaultJWTSecretName = "JWT_SECRET"
+
+// configureSecrets selects the provider in cfg. Secrets from Vault or AWS
+// are cached and read once here, so a misconfigured provider stops the
+// server from starting rather than failing its first requests.
+func configureSecrets(cfg *Config, logger *slog.Logger) error {
+	provider, err := newSecretProvider(cfg)
+	if err != nil {
+		return err
+	}
+	jwtSecretName = defaultJWTSecretName
+	if cfg.JWTSecretName != "" {
+		jwtSecretName = cfg.JWTSecretName
+	}
+	if _, ok := provider.(envSecrets); ok {
+		secrets = provider
+		return nil
+	}
+
+	cache := newSecretCache(provider, logger)
+	var names []string
+	if cfg.JWTAlgorithm == "" || cfg.JWTAlgorithm == "HS256" {
+		names = append(names, jwtSecretName)
+	}
+	if cfg.DBPasswordSecretName != "" {
+		names = append(names, cfg.DBPasswordSecretName)
+	}
+	for _, name := range names {
+		if _, err := cache.Secret(name); err != nil {
+			return err
+		}
+	}
+	secrets = cache
+	return nil
+}
+
+func newSecretProvider(cfg *Config) (SecretProvider, error) {
+	switch cfg.SecretProvider {
+	case "", SecretProviderEnv:
+		return envSecrets{}, nil
+	case SecretProviderVault:
+		if cfg.VaultAddr == "" || cfg.VaultToken == "" {
+			return nil, fmt.Errorf("the vault secret provider needs vaultAddr and vaultToken")
+		}
+		v := &vaultSecrets{
+			addr:   strings.TrimSuffix(cfg.VaultAddr, "/"),
+			token:  cfg.VaultToken,
+			mount:  "secret",
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+		if cfg.VaultMount != "" {
+			v.mount = cfg.VaultMount
+		}
+		return v, nil
+	case SecretProviderAWS:
+		accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if cfg.AWSRegion == "" || accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("the aws secret provider needs awsRegion, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return &awsSecrets{
+			endpoint:     "https://secretsmanager." + cfg.AWSRegion + ".amazonaws.com/",
+			region:       cfg.AWSRegion,
+			accessKey:    accessKey,
+			secretKey:    secretKey,
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			client:       &http.Client{Timeout: 10 * time.Second},
+			now:          time.Now,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported secret provider %q", cfg.SecretProvider)
+	}
+}
+
+// envSecrets reads each secret from the environment variable of the same
+// name on every call.
+type envSecrets struct{}
+
+func (envSecrets) Secret(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+// splitSecretName splits a name of the form "path#field" into the secret's
+// path and the field of it holding the value.
+func splitSecretName(name string) (path, field string) {
+	path, field, _ = strings.Cut(name, "#")
+	return path, field
+}
+
+// vaultSecrets reads secrets from a HashiCorp Vault KV version 2 engine
+// mounted at mount. A name is "path#field", the field defaulting to "value".
+type vaultSecrets struct {
+	addr   string
+	token  string
+	mount  string
+	client *http.Client
+}
+
+func (v *vaultSecrets) Secret(name string) (string, error) {
+	path, field := splitSecretName(name)
+	if field == "" {
+		field = "value"
+	}
+	req, err := http.NewRequest("GET", v.addr+"/v1/"+v.mount+"/data/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret %s from vault: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to read secret %s from vault: %s", path, resp.Status)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("unable to decode secret %s from vault: %v", path, err)
+	}
+	value, ok := body.Data.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
+
+// awsSecrets reads secrets from AWS Secrets Manager. A name is the secret
+// id, whose SecretString is the value, or "id#field" to take a field of a
+// SecretString holding a JSON object.
+type awsSecrets struct {
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time
+}
+
+func (a *awsSecrets) Secret(name string) (string, error) {
+	id, field := splitSecretName(name)
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if a.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.sessionToken)
+	}
+	signAWSRequest(req, body, a.region, "secretsmanager", a.accessKey, a.secretKey, a.now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret %s from aws: %v", id, err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		SecretString string `json:"SecretString"`
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("unable to decode secret %s from aws: %v", id, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to read secret %s from aws: %s %s %s", id, resp.Status, out.Type, out.Message)
+	}
+	if field == "" {
+		return out.SecretString, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(out.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("aws secret %s is not a JSON object: %v", id, err)
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("aws secret %s has no field %s", id, field)
+	}
+	return value, nil
+}
+
+// signAWSRequest signs req with AWS Signature Version 4, covering the host
+// and every header already set on req.
+func signAWSRequest(req *http.Request, body []byte, region, service, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes s as SigV4 expects, spaces as %20.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// secretCache serves secrets from provider without asking it on every
+// request. run reads them again periodically, so rotated secrets are picked
+// up without a restart, and remembers the value each replaced.
+type secretCache struct {
+	provider SecretProvider
+	logger   *slog.Logger
+
+	mu     sync.RWMutex
+	values map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	current  string
+	previous string
+}
+
+func newSecretCache(provider SecretProvider, logger *slog.Logger) *secretCache {
+	return &secretCache{provider: provider, logger: logger, values: make(map[string]cachedSecret)}
+}
+
+func (c *secretCache) Secret(name string) (string, error) {
+	c.mu.RLock()
+	v, ok := c.values[name]
+	c.mu.RUnlock()
+	if ok {
+		return v.current, nil
+	}
+	value, err := c.provider.Secret(name)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.values[name]; ok {
+		return v.current, nil
+	}
+	c.values[name] = cachedSecret{current: value}
+	return value, nil
+}
+
+// previous returns the value name had before it was last rotated, or "".
+func (c *secretCache) previous(name string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.values[name].previous
+}
+
+// refresh reads every cached secret again. A secret that cannot be read
+// keeps its old value.
+func (c *secretCache) refresh() {
+	c.mu.RLock()
+	names := make([]string, 0, len(c.values))
+	for name := range c.values {
+		names = append(names, name)
+	}
+	c.mu.RUnlock()
+
+	for _, name := range names {
+		value, err := c.provider.Secret(name)
+		if err != nil {
+			c.logger.Error("secret refresh failed, keeping the old value", "secret", name, "error", err)
+			continue
+		}
+		c.mu.Lock()
+		if v := c.values[name]; v.current != value {
+			c.values[name] = cachedSecret{current: value, previous: v.current}
+			c.logger.Info("secret rotated", "secret", name)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// run calls refresh every interval until ctx is done.
+func (c *secretCache) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvSecrets(t *testing.T) {
+	t.Setenv("GOBANK_TEST_SECRET", "s3cret")
+	value, err := envSecrets{}.Secret("GOBANK_TEST_SECRET")
+	require.Nil(t, err)
+	assert.Equal(t, "s3cret", value)
+	_, err = envSecrets{}.Secret("GOBANK_TEST_UNSET_SECRET")
+	assert.ErrorContains(t, err, "not set")
+}
+
+func TestVaultSecrets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/gobank/db" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"value": "v1", "password": "hunter2"}, "metadata": {"version": 3}}}`))
+	}))
+	defer ts.Close()
+
+	provider, err := newSecretProvider(&Config{SecretProvider: SecretProviderVault, VaultAddr: ts.URL + "/", VaultToken: "root", VaultMount: "kv"})
+	require.Nil(t, err)
+	value, err := provider.Secret("gobank/db#password")
+	require.Nil(t, err)
+	assert.Equal(t, "hunter2", value)
+	value, err = provider.Secret("gobank/db")
+	require.Nil(t, err)
+	assert.Equal(t, "v1", value)
+
+	_, err = provider.Secret("gobank/db#user")
+	assert.ErrorContains(t, err, "no field user")
+	_, err = provider.Secret("gobank/missing")
+	assert.ErrorContains(t, err, "404")
+
+	_, err = newSecretProvider(&Config{SecretProvider: SecretProviderVault})
+	assert.NotNil(t, err)
+}
+
+func TestAWSSecrets(t *testing.T) {
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+		var req struct{ SecretId string }
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		switch req.SecretId {
+		case "gobank/jwt":
+			w.Write([]byte(`{"Name": "gobank/jwt", "SecretString": "jwt-secret"}`))
+		case "gobank/db":
+			w.Write([]byte(`{"Name": "gobank/db", "SecretString": "{\"username\": \"bank\", \"password\": \"hunter2\"}"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "Secrets Manager can't find the specified secret."}`))
+		}
+	}))
+	defer ts.Close()
+
+	provider := &awsSecrets{
+		endpoint:     ts.URL + "/",
+		region:       "eu-west-1",
+		accessKey:    "AKIDEXAMPLE",
+		secretKey:    "secret",
+		sessionToken: "token",
+		client:       ts.Client(),
+		now:          func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) },
+	}
+	value, err := provider.Secret("gobank/jwt")
+	require.Nil(t, err)
+	assert.Equal(t, "jwt-secret", value)
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/eu-west-1/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature="), auth)
+
+	value, err = provider.Secret("gobank/db#password")
+	require.Nil(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = provider.Secret("gobank/missing")
+	assert.ErrorContains(t, err, "ResourceNotFoundException")
+}
+
+// TestSignAWSRequest checks the signer against the example request in the
+// AWS Signature Version 4 documentation.
+func TestSignAWSRequest(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, nil, "us-east-1", "iam", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+}
+
+// fakeSecrets serves values that tests can change, failing for names it
+// does not have.
+type fakeSecrets struct {
+	mu     sync.Mutex
+	values map[string]string
+	reads  int
+}
+
+func (f *fakeSecrets) Secret(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reads++
+	value, ok := f.values[name]
+	if !ok {
+		return "", errInvalidToken
+	}
+	return value, nil
+}
+
+func (f *fakeSecrets) set(name, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if value == "" {
+		delete(f.values, name)
+		return
+	}
+	f.values[name] = value
+}
+
+func TestSecretCacheRefresh(t *testing.T) {
+	provider := &fakeSecrets{values: map[string]string{"jwt": "one"}}
+	cache := newSecretCache(provider, discardLogger)
+
+	for i := 0; i < 3; i++ {
+		value, err := cache.Secret("jwt")
+		require.Nil(t, err)
+		assert.Equal(t, "one", value)
+	}
+	assert.Equal(t, 1, provider.reads, "values are cached")
+	_, err := cache.Secret("missing")
+	assert.NotNil(t, err)
+
+	provider.set("jwt", "two")
+	cache.refresh()
+	value, _ := cache.Secret("jwt")
+	assert.Equal(t, "two", value)
+	assert.Equal(t, "one", cache.previous("jwt"))
+
+	provider.set("jwt", "")
+	cache.refresh()
+	value, _ = cache.Secret("jwt")
+	assert.Equal(t, "two", value, "a failed refresh keeps the old value")
+}
+
+func TestJWTSecretRotation(t *testing.T) {
+	provider := &fakeSecrets{values: map[string]string{"gobank/jwt": "one"}}
+	cache := newSecretCache(provider, discardLogger)
+	secrets, jwtSecretName = cache, "gobank/jwt"
+	t.Cleanup(func() { secrets, jwtSecretName = envSecrets{}, defaultJWTSecretName })
+
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.ID = 1
+	oldToken, _, err := createJWT(acc)
+	require.Nil(t, err)
+
+	provider.set("gobank/jwt", "two")
+	cache.refresh()
+	newToken, _, err := createJWT(acc)
+	require.Nil(t, err)
+	_, err = validateAccessToken(newToken)
+	assert.Nil(t, err)
+	_, err = validateAccessToken(oldToken)
+	assert.Nil(t, err, "tokens signed before the rotation stay valid")
+
+	provider.set("gobank/jwt", "three")
+	cache.refresh()
+	_, err = validateAccessToken(oldToken)
+	assert.NotNil(t, err, "only the secret before the last rotation is accepted")
+}
+
+func TestConfigureSecrets(t *testing.T) {
+	t.Cleanup(func() { secrets, jwtSecretName = envSecrets{}, defaultJWTSecretName })
+
+	_, err := newSecretProvider(&Config{SecretProvider: "keychain"})
+	assert.ErrorContains(t, err, "unsupported secret provider")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	err = configureSecrets(&Config{SecretProvider: SecretProviderVault, VaultAddr: ts.URL, VaultToken: "root", JWTSecretName: "gobank/jwt"}, discardLogger)
+	assert.ErrorContains(t, err, "gobank/jwt", "secrets are read at startup")
+
+	require.Nil(t, configureSecrets(&Config{}, discardLogger))
+	assert.Equal(t, envSecrets{}, secrets)
+	assert.Equal(t, defaultJWTSecretName, jwtSecretName)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// seedPassword is the password of every seeded account, so that any of them
+// can be logged in as.
+const seedPassword = "password123"
+
+// errSeedDisabled keeps seeding away from databases whose config does not
+// opt in with AllowSeed.
+var errSeedDisabled = errors.New("seeding is disabled, set allowSeed in the config of a development environment")
+
+var (
+	seedFirstNames = []string{"Ada", "Alan", "Barbara", "Claude", "Dennis", "Edsger", "Frances", "Grace", "Hedy", "John", "Katherine", "Ken", "Linus", "Margaret", "Radia", "Tim"}
+	seedLastNames  = []string{"Allen", "Berners-Lee", "Dijkstra", "Hamilton", "Hopper", "Johnson", "Lamarr", "Liskov", "Lovelace", "McCarthy", "Perlman", "Ritchie", "Shannon", "Thompson", "Torvalds", "Turing"}
+)
+
+// runSeedCommand fills store with fake accounts holding random balances and
+// with random transfers between them, for local development and demos. It
+// refuses to run unless cfg.AllowSeed is set.
+func runSeedCommand(ctx context.Context, cfg *Config, store Storage, args []string, out io.Writer) error {
+	if !cfg.AllowSeed {
+		return errSeedDisabled
+	}
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flags.SetOutput(out)
+	numAccounts := flags.Int("accounts", 50, "number of accounts to create")
+	numTransfers := flags.Int("transfers", 200, "number of transfers to make between them")
+	randSeed := flags.Int64("seed", time.Now().UnixNano(), "seed for the random data")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *numAccounts < 1 || *numAccounts > maxImportAccounts || *numTransfers < 0 || flags.NArg() > 0 {
+		return fmt.Errorf("usage: gobank seed [-accounts 1-%d] [-transfers n] [-seed n]", maxImportAccounts)
+	}
+	rng := rand.New(rand.NewSource(*randSeed))
+
+	hash, err := hashPassword(seedPassword)
+	if err != nil {
+		return err
+	}
+	// Numbering emails from the number of accounts already there lets the
+	// command run more than once.
+	existing, err := store.CountAccounts(ctx, AccountFilter{})
+	if err != nil {
+		return err
+	}
+	accounts := make([]*Account, *numAccounts)
+	for i := range accounts {
+		first := seedFirstNames[rng.Intn(len(seedFirstNames))]
+		last := seedLastNames[rng.Intn(len(seedLastNames))]
+		number, err := newAccountNumber()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		accounts[i] = &Account{
+			Number:            number,
+			FirstName:         first,
+			LastName:          last,
+			Email:             fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(first), strings.ToLower(last), existing+i+1),
+			EncryptedPassword: hash,
+			Balance:           rng.Int63n(1_000_000),
+			Currency:          DefaultCurrency,
+			CreatedAt:         now,
+			UpdatedAt:         now,
+			Version:           1,
+			Role:              RoleUser,
+			Status:            AccountStatusActive,
+			EmailVerified:     true,
+		}
+	}
+	if err := store.CreateAccounts(ctx, accounts); err != nil {
+		return err
+	}
+
+	// Transfers the accounts cannot afford, or that their limits refuse,
+	// are skipped rather than retried.
+	transfers := 0
+	for i := 0; i < *numTransfers && len(accounts) > 1; i++ {
+		from := accounts[rng.Intn(len(accounts))]
+		to := accounts[rng.Intn(len(accounts))]
+		if from == to {
+			continue
+		}
+		_, err := store.Transfer(ctx, from.ID, to.ID, 1+rng.Int63n(10_000))
+		if err != nil && errorStatus(err) >= 500 {
+			return err
+		}
+		if err == nil {
+			transfers++
+		}
+	}
+	fmt.Fprintf(out, "created %d accounts with password %q and %d transfers\n", len(accounts), seedPassword, transfers)
+	return nil
+}
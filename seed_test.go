@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSeedCommand(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	var out bytes.Buffer
+
+	err := runSeedCommand(ctx, &Config{}, store, nil, &out)
+	assert.ErrorIs(t, err, errSeedDisabled)
+
+	cfg := &Config{AllowSeed: true}
+	require.Nil(t, runSeedCommand(ctx, cfg, store, []string{"-accounts", "5", "-transfers", "20", "-seed", "1"}, &out))
+	assert.Contains(t, out.String(), "created 5 accounts")
+	assert.NotContains(t, out.String(), " 0 transfers")
+	require.Nil(t, runSeedCommand(ctx, cfg, store, []string{"-accounts", "5", "-transfers", "0"}, &out), "seeding again picks new emails")
+
+	accounts, err := store.GetAccounts(ctx, AccountFilter{}, 0, 20, 0)
+	require.Nil(t, err)
+	require.Len(t, accounts, 10)
+	assert.True(t, validatePassword(seedPassword, accounts[0].EncryptedPassword))
+
+	assert.NotNil(t, runSeedCommand(ctx, cfg, store, []string{"-accounts", "0"}, &out))
+	assert.NotNil(t, runSeedCommand(ctx, cfg, store, []string{"extra"}, &out))
+}
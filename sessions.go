@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// maxUserAgentLen bounds the user agents stored for sessions and logins.
+const maxUserAgentLen = 512
+
+// ErrSessionNotFound is returned when an account has no active session with
+// the given id.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a device or browser an account is logged in on. It lives as
+// long as its refresh token family: it starts at login, is updated on every
+// refresh and ends when the family expires or is revoked.
+type Session struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"accountId"`
+	FamilyID  string    `json:"-"`
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"createdAt"`
+	// LastUsedAt is when the session last logged in or refreshed its
+	// tokens.
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	// Current is set on the session of the access token listing them.
+	Current bool `json:"current"`
+}
+
+// newSession returns the session of refresh's family as used by the client
+// making r.
+func newSession(r *http.Request, refresh *RefreshToken) *Session {
+	return &Session{
+		AccountID:  refresh.AccountID,
+		FamilyID:   refresh.FamilyID,
+		UserAgent:  truncateUserAgent(r.UserAgent()),
+		IP:         clientIP(r),
+		CreatedAt:  refresh.CreatedAt,
+		LastUsedAt: refresh.CreatedAt,
+		ExpiresAt:  refresh.ExpiresAt,
+	}
+}
+
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > maxUserAgentLen {
+		return userAgent[:maxUserAgentLen]
+	}
+	return userAgent
+}
+
+// handleGetSessions lists the active sessions of the authenticated account,
+// most recently used first.
+func (s *APIServer) handleGetSessions(w http.ResponseWriter, r *http.Request) error {
+	claims, _ := claimsFromContext(r.Context())
+	sessions, err := s.store.GetSessions(r.Context(), claims.AccountID, s.now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		session.Current = session.ID == claims.SessionID
+	}
+	return WriteJSON(w, http.StatusOK, sessions)
+}
+
+// handleRevokeSession logs the authenticated account out of one of its
+// sessions: its refresh tokens and access tokens stop being accepted.
+func (s *APIServer) handleRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	claims, _ := claimsFromContext(r.Context())
+	sessionID, err := getPositiveIntVar(r, "sessionID")
+	if err != nil {
+		return err
+	}
+	if err := s.store.RevokeSession(r.Context(), claims.AccountID, sessionID, s.now().UTC()); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "session revoked", "account_id", claims.AccountID, "session_id", sessionID)
+	return writeNoContent(w)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	server, router := newTestServer(t)
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	login := func(userAgent string) LoginResponse {
+		rec := doJSON(t, router, "POST", "/api/v1/login", LoginRequest{Email: "abc@abc.com", Password: "password123"}, http.Header{"User-Agent": {userAgent}})
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp LoginResponse
+		require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+	laptop := login("Firefox")
+	phone := login("Safari")
+	auth := func(resp LoginResponse) http.Header {
+		return http.Header{"Authorization": {"Bearer " + resp.Token}}
+	}
+
+	rec := doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: phone.RefreshToken}, http.Header{"User-Agent": {"Safari/2"}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&phone))
+
+	rec = doJSON(t, router, "GET", "/api/v1/sessions", nil, auth(laptop))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var sessions []Session
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	require.Len(t, sessions, 2, "refreshing keeps the session")
+	assert.Equal(t, "Safari/2", sessions[0].UserAgent)
+	assert.False(t, sessions[0].Current)
+	assert.Equal(t, "Firefox", sessions[1].UserAgent)
+	assert.True(t, sessions[1].Current)
+	assert.Equal(t, "192.0.2.1", sessions[1].IP)
+
+	other, err := NewAccount("c", "d", "other@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), other))
+	otherToken, _, err := createJWT(other)
+	require.Nil(t, err)
+	path := fmt.Sprintf("/api/v1/sessions/%d", sessions[0].ID)
+	rec = doJSON(t, router, "DELETE", path, nil, http.Header{"Authorization": {"Bearer " + otherToken}})
+	assert.Equal(t, http.StatusNotFound, rec.Code, "only the account's own sessions")
+
+	rec = doJSON(t, router, "DELETE", path, nil, auth(laptop))
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, auth(phone))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "the access token is revoked")
+	rec = doJSON(t, router, "POST", "/api/v1/token/refresh", RefreshTokenRequest{RefreshToken: phone.RefreshToken}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "the refresh token is revoked")
+	rec = doJSON(t, router, "DELETE", path, nil, auth(laptop))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doJSON(t, router, "GET", "/api/v1/sessions", nil, auth(laptop))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].Current)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+)
+
+const (
+	StandingOrderActive    = "active"
+	StandingOrderPaused    = "paused"
+	StandingOrderCancelled = "cancelled"
+	// StandingOrderFinished is set once the order has reached its end date
+	// or number of runs.
+	StandingOrderFinished = "finished"
+)
+
+// ErrStandingOrderNotFound is returned when no standing order of the account
+// matches a lookup.
+var ErrStandingOrderNotFound = errors.New("standing order not found")
+
+// ErrStandingOrderTransition is returned when a standing order cannot be
+// paused, resumed or cancelled from its current status.
+var ErrStandingOrderTransition = errors.New("standing order cannot change status")
+
+// StandingOrder is a transfer repeated weekly or monthly. Each run is queued
+// as a ScheduledTransfer when it falls due, which records its outcome.
+type StandingOrder struct {
+	ID          int    `json:"id"`
+	AccountID   int    `json:"accountId"`
+	ToAccountID int    `json:"toAccountId"`
+	Amount      int64  `json:"amount"`
+	Frequency   string `json:"frequency"`
+	// StartAt is the first run. Monthly orders run on its day of the month,
+	// or the last day of shorter months.
+	StartAt   time.Time `json:"startAt"`
+	NextRunAt time.Time `json:"nextRunAt"`
+	// EndAt and MaxRuns optionally end the order after a date or a number
+	// of runs. Runs counts the runs queued so far.
+	EndAt     *time.Time `json:"endAt,omitempty"`
+	MaxRuns   *int       `json:"maxRuns,omitempty"`
+	Runs      int        `json:"runs"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+type StandingOrderRequest struct {
+	// ToAccount is the account number of the receiving account.
+	ToAccount int64      `json:"toAccount" validate:"required"`
+	Amount    int64      `json:"amount" validate:"required,min=1"`
+	Frequency string     `json:"frequency" validate:"required,oneof=weekly monthly"`
+	StartAt   time.Time  `json:"startAt" validate:"required"`
+	EndAt     *time.Time `json:"endAt,omitempty"`
+	MaxRuns   *int       `json:"maxRuns,omitempty" validate:"omitempty,min=1"`
+}
+
+type StandingOrdersPage struct {
+	StandingOrders []*StandingOrder `json:"standingOrders"`
+	Limit          int              `json:"limit"`
+	Offset         int              `json:"offset"`
+}
+
+// runAfter returns the run that follows after on the order's schedule.
+func (o *StandingOrder) runAfter(after time.Time) time.Time {
+	if o.Frequency == FrequencyWeekly {
+		return after.AddDate(0, 0, 7)
+	}
+	// step from the first of the month so short months do not roll over
+	year, month, _ := after.Date()
+	first := time.Date(year, month+1, 1, o.StartAt.Hour(), o.StartAt.Minute(), o.StartAt.Second(), o.StartAt.Nanosecond(), time.UTC)
+	day := o.StartAt.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// ended reports whether the order has no runs left.
+func (o *StandingOrder) ended() bool {
+	return (o.MaxRuns != nil && o.Runs >= *o.MaxRuns) || (o.EndAt != nil && o.NextRunAt.After(*o.EndAt))
+}
+
+// queueRun advances a due active order past its next run and returns the
+// scheduled transfer that makes that run.
+func (o *StandingOrder) queueRun(now time.Time) *ScheduledTransfer {
+	st := &ScheduledTransfer{
+		AccountID:       o.AccountID,
+		ToAccountID:     o.ToAccountID,
+		Amount:          o.Amount,
+		ExecuteAt:       o.NextRunAt,
+		Status:          ScheduledTransferPending,
+		StandingOrderID: &o.ID,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	o.Runs++
+	o.NextRunAt = o.runAfter(o.NextRunAt)
+	if o.ended() {
+		o.Status = StandingOrderFinished
+	}
+	o.UpdatedAt = now
+	return st
+}
+
+// transition moves o to status. Resuming skips the runs missed while the
+// order was paused.
+func (o *StandingOrder) transition(status string, now time.Time) error {
+	allowed := map[string][]string{
+		StandingOrderPaused:    {StandingOrderActive},
+		StandingOrderActive:    {StandingOrderPaused},
+		StandingOrderCancelled: {StandingOrderActive, StandingOrderPaused},
+	}
+	for _, from := range allowed[status] {
+		if o.Status != from {
+			continue
+		}
+		if o.Status == StandingOrderPaused && status == StandingOrderActive {
+			for !o.NextRunAt.After(now) {
+				o.NextRunAt = o.runAfter(o.NextRunAt)
+			}
+			if o.ended() {
+				status = StandingOrderFinished
+			}
+		}
+		o.Status = status
+		o.UpdatedAt = now
+		return nil
+	}
+	return fmt.Errorf("%w: standing order %d is %s", ErrStandingOrderTransition, o.ID, o.Status)
+}
+
+// queueStandingOrders queues a scheduled transfer for every standing order
+// run due by now, catching up on runs missed while the worker was down.
+func (s *APIServer) queueStandingOrders(ctx context.Context, now time.Time) {
+	for {
+		queued, err := s.store.QueueDueStandingOrders(ctx, now, scheduledTransferBatch)
+		if err != nil {
+			s.logger.Error("could not queue standing orders", "error", err)
+			return
+		}
+		// an order that was behind by several runs is due again
+		if queued == 0 {
+			return
+		}
+	}
+}
+
+// handleGetStandingOrders lists an account's standing orders.
+func (s *APIServer) handleGetStandingOrders(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	limit, offset, err := getPaginationFromRequest(r)
+	if err != nil {
+		return err
+	}
+	orders, err := s.store.GetStandingOrders(r.Context(), id, limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, StandingOrdersPage{StandingOrders: orders, Limit: limit, Offset: offset})
+}
+
+// handleCreateStandingOrder creates a standing order for an account.
+func (s *APIServer) handleCreateStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	req := new(StandingOrderRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	now := s.now().UTC()
+	if !req.StartAt.After(now) {
+		return badRequest("startAt %s must be in the future", req.StartAt.Format(time.RFC3339))
+	}
+	if req.EndAt != nil && req.EndAt.Before(req.StartAt) {
+		return badRequest("endAt %s must not be before startAt", req.EndAt.Format(time.RFC3339))
+	}
+	to, err := s.store.GetAccountByNumber(r.Context(), req.ToAccount)
+	if err != nil {
+		return err
+	}
+	if to.ID == id {
+		return badRequest("cannot transfer to the same account")
+	}
+
+	order := &StandingOrder{
+		AccountID:   id,
+		ToAccountID: to.ID,
+		Amount:      req.Amount,
+		Frequency:   req.Frequency,
+		StartAt:     req.StartAt.UTC(),
+		NextRunAt:   req.StartAt.UTC(),
+		MaxRuns:     req.MaxRuns,
+		Status:      StandingOrderActive,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if req.EndAt != nil {
+		endAt := req.EndAt.UTC()
+		order.EndAt = &endAt
+	}
+	if err := s.store.CreateStandingOrder(r.Context(), order); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "standing order created", "standing_order_id", order.ID, "account_id", id, "to_account_id", to.ID, "amount", order.Amount, "frequency", order.Frequency)
+	return WriteJSON(w, http.StatusCreated, order)
+}
+
+// handleSetStandingOrderStatus returns a handler that pauses, resumes or
+// cancels one of an account's standing orders.
+func (s *APIServer) handleSetStandingOrderStatus(status string) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := s.getIDFromRequest(r)
+		if err != nil {
+			return err
+		}
+		orderID, err := getPositiveIntVar(r, "orderID")
+		if err != nil {
+			return err
+		}
+		order, err := s.store.SetStandingOrderStatus(r.Context(), id, orderID, status, s.now().UTC())
+		if err != nil {
+			return err
+		}
+		s.logger.InfoContext(r.Context(), "standing order status changed", "standing_order_id", orderID, "account_id", id, "status", order.Status)
+		return WriteJSON(w, http.StatusOK, order)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandingOrderRunAfter(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)
+	monthly := &StandingOrder{Frequency: FrequencyMonthly, StartAt: start}
+	feb := monthly.runAfter(start)
+	assert.Equal(t, time.Date(2024, time.February, 29, 9, 0, 0, 0, time.UTC), feb)
+	// the short month does not drag later runs to the 29th
+	assert.Equal(t, time.Date(2024, time.March, 31, 9, 0, 0, 0, time.UTC), monthly.runAfter(feb))
+	assert.Equal(t, time.Date(2025, time.January, 31, 9, 0, 0, 0, time.UTC), monthly.runAfter(time.Date(2024, time.December, 31, 9, 0, 0, 0, time.UTC)))
+
+	weekly := &StandingOrder{Frequency: FrequencyWeekly, StartAt: start}
+	assert.Equal(t, start.AddDate(0, 0, 7), weekly.runAfter(start))
+}
+
+func TestStandingOrderQueueRunEnds(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxRuns := 2
+	o := &StandingOrder{ID: 1, Frequency: FrequencyWeekly, StartAt: start, NextRunAt: start, MaxRuns: &maxRuns, Status: StandingOrderActive}
+
+	st := o.queueRun(start)
+	assert.Equal(t, start, st.ExecuteAt)
+	assert.Equal(t, StandingOrderActive, o.Status)
+	o.queueRun(start)
+	assert.Equal(t, StandingOrderFinished, o.Status)
+
+	endAt := start.AddDate(0, 0, 10)
+	o = &StandingOrder{ID: 2, Frequency: FrequencyWeekly, StartAt: start, NextRunAt: start, EndAt: &endAt, Status: StandingOrderActive}
+	o.queueRun(start)
+	assert.Equal(t, StandingOrderActive, o.Status)
+	o.queueRun(start)
+	assert.Equal(t, StandingOrderFinished, o.Status)
+}
+
+func TestStandingOrderTransition(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	o := &StandingOrder{Frequency: FrequencyWeekly, StartAt: start, NextRunAt: start, Status: StandingOrderActive}
+
+	require.Nil(t, o.transition(StandingOrderPaused, start))
+	assert.ErrorIs(t, o.transition(StandingOrderPaused, start), ErrStandingOrderTransition)
+
+	// resuming skips the runs missed while paused
+	now := start.AddDate(0, 0, 20)
+	require.Nil(t, o.transition(StandingOrderActive, now))
+	assert.Equal(t, start.AddDate(0, 0, 21), o.NextRunAt)
+
+	require.Nil(t, o.transition(StandingOrderCancelled, now))
+	assert.ErrorIs(t, o.transition(StandingOrderActive, now), ErrStandingOrderTransition)
+}
+
+func TestStandingOrders(t *testing.T) {
+	server, router := newTestServer(t)
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	for _, acc := range []*Account{from, to} {
+		require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	}
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	path := fmt.Sprintf("/api/v1/account/%d/standing-orders", from.ID)
+
+	startAt := time.Now().UTC().Add(time.Hour)
+	maxRuns := 2
+	rec := doJSON(t, router, "POST", path, StandingOrderRequest{ToAccount: to.Number, Amount: 10, Frequency: FrequencyWeekly, StartAt: startAt, MaxRuns: &maxRuns}, header)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var order StandingOrder
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(t, StandingOrderActive, order.Status)
+
+	rec = doJSON(t, router, "POST", path, StandingOrderRequest{ToAccount: to.Number, Amount: 10, Frequency: "daily", StartAt: startAt}, header)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	// both runs fall due by the time the worker catches up
+	later := startAt.AddDate(0, 0, 8)
+	server.queueStandingOrders(context.Background(), later)
+	server.executeDueTransfers(context.Background(), later)
+	balance, err := server.store.GetBalance(context.Background(), from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(80), balance.Amount)
+
+	transfers, err := server.store.GetScheduledTransfers(context.Background(), from.ID, 10, 0)
+	require.Nil(t, err)
+	require.Len(t, transfers, 2)
+	for _, st := range transfers {
+		assert.Equal(t, ScheduledTransferCompleted, st.Status)
+		require.NotNil(t, st.StandingOrderID)
+		assert.Equal(t, order.ID, *st.StandingOrderID)
+	}
+
+	rec = doJSON(t, router, "GET", path, nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"status":"finished"`)
+	rec = doJSON(t, router, "POST", fmt.Sprintf("%s/%d/pause", path, order.ID), nil, header)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = doJSON(t, router, "POST", path, StandingOrderRequest{ToAccount: to.Number, Amount: 10, Frequency: FrequencyMonthly, StartAt: startAt}, header)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	rec = doJSON(t, router, "POST", fmt.Sprintf("%s/%d/pause", path, order.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "POST", fmt.Sprintf("%s/%d/resume", path, order.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("%s/%d", path, order.ID), nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"status":"cancelled"`)
+	rec = doJSON(t, router, "DELETE", fmt.Sprintf("%s/%d", path, order.ID+100), nil, header)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -1,141 +1,730 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"log/slog"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
-	"gopkg.in/yaml.v3"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Storage is everything the server persists. Its methods are grouped into
+// repositories so code that needs only part of it can depend on less, and
+// UnitOfWork composes calls across them in one transaction.
 type Storage interface {
-	CreateAccount(*Account) error
-	DeleteAccount(int) error
-	UpdateAccount(*Account) error
-	GetAccountByID(int) (*Account, error)
-	GetAccountByEmail(string) (*Account, error)
-	GetAccounts() ([]*Account, error)
+	AccountRepository
+	TransactionRepository
+	TokenRepository
+	UnitOfWork
+	CreateLoginAttempt(context.Context, *LoginAttempt) error
+	GetLoginAttempts(ctx context.Context, accountID, limit, offset int) ([]*LoginAttempt, error)
+	GetLoginIPs(ctx context.Context, accountID int) ([]string, error)
+	RecordLoginFailure(ctx context.Context, key string, threshold int, lockout time.Duration, now time.Time) (time.Time, error)
+	LoginLockedUntil(ctx context.Context, key string, now time.Time) (time.Time, error)
+	ClearLoginFailures(ctx context.Context, key string) error
+	CreatePasskey(context.Context, *Passkey) error
+	GetPasskeys(ctx context.Context, accountID int) ([]*Passkey, error)
+	UpdatePasskey(context.Context, *Passkey) error
+	DeletePasskey(ctx context.Context, accountID, id int) error
+	PurgeExpired(ctx context.Context, now time.Time) (int, error)
 }
 
-type Config struct {
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	User     string `yaml:"user"`
-	Password string `yaml:"password"`
-	DBName   string `yaml:"dbName"`
-	Schema 	 string `yaml:"schema"`
+// AccountRepository stores accounts and their settings.
+type AccountRepository interface {
+	CreateAccount(context.Context, *Account) error
+	CreateAccounts(context.Context, []*Account) error
+	DeleteAccount(context.Context, int) error
+	RestoreAccount(context.Context, int) error
+	HardDeleteAccount(context.Context, int) ([]int, error)
+	UpdateAccount(context.Context, *Account) error
+	GetAccountByID(context.Context, int) (*Account, error)
+	GetAccountByEmail(context.Context, string) (*Account, error)
+	GetAccountByNumber(context.Context, int64) (*Account, error)
+	GetAccounts(ctx context.Context, filter AccountFilter, afterID, limit, offset int) ([]*Account, error)
+	CountAccounts(ctx context.Context, filter AccountFilter) (int, error)
+	EachAccount(ctx context.Context, fn func(*Account) error) error
+	GetBalance(context.Context, int) (Balance, error)
+	UpdatePassword(ctx context.Context, id int, hash string) error
+	SetAccountStatus(ctx context.Context, id int, status string) error
+	SetOverdraftLimit(ctx context.Context, id int, limit int64) error
+	SetTransferLimits(ctx context.Context, id int, daily, perTransfer *int64) error
+	SetTOTPSecret(ctx context.Context, id int, secret string) error
+	EnableTOTP(ctx context.Context, id int, backupCodeHashes []string) error
+	UseBackupCode(ctx context.Context, accountID int, codeHash string, now time.Time) error
 }
 
-type PostgresStore struct {
-	db *sql.DB
+// AccountFilter narrows GetAccounts and CountAccounts to the accounts
+// matching all of its set fields. The zero value matches every account that
+// is not deleted.
+type AccountFilter struct {
+	// Search matches accounts whose name or email contains it, ignoring
+	// case. Wildcard characters match literally.
+	Search string
+	// Email matches the account with that address, ignoring case.
+	Email string
+	// Name matches accounts whose "first last" name contains it, ignoring
+	// case.
+	Name string
+	// CreatedAfter matches accounts opened after it, when set.
+	CreatedAfter time.Time
+	// MinBalance matches accounts with at least this booked balance, when
+	// set.
+	MinBalance *int64
 }
 
-func getPostgresInfo() (*Config, error) {
-	// get config details from yaml file
-	f, err := os.ReadFile("config.yml")
+// TransactionRepository moves money: transfers, scheduled transfers,
+// standing orders, holds and journals, the ledger they write, and the
+// results remembered for Idempotency-Key replays.
+type TransactionRepository interface {
+	Transfer(ctx context.Context, fromID, toID int, amount int64) (*Transaction, error)
+	GetTransactions(ctx context.Context, accountID int, since, until time.Time, limit, offset int) ([]*Transaction, error)
+	GetTransaction(ctx context.Context, id int) (*Transaction, error)
+	ReverseTransfer(ctx context.Context, debitID int) (*Transaction, error)
+	CreateScheduledTransfer(context.Context, *ScheduledTransfer) error
+	GetScheduledTransfers(ctx context.Context, accountID, limit, offset int) ([]*ScheduledTransfer, error)
+	CancelScheduledTransfer(ctx context.Context, accountID, id int) (*ScheduledTransfer, error)
+	ClaimDueScheduledTransfers(ctx context.Context, now time.Time, limit int) ([]*ScheduledTransfer, error)
+	FinishScheduledTransfer(context.Context, *ScheduledTransfer) error
+	CreateStandingOrder(context.Context, *StandingOrder) error
+	GetStandingOrders(ctx context.Context, accountID, limit, offset int) ([]*StandingOrder, error)
+	SetStandingOrderStatus(ctx context.Context, accountID, id int, status string, now time.Time) (*StandingOrder, error)
+	QueueDueStandingOrders(ctx context.Context, now time.Time, limit int) (int, error)
+	CreateHold(context.Context, *Hold) error
+	GetHolds(ctx context.Context, accountID, limit, offset int) ([]*Hold, error)
+	CaptureHold(ctx context.Context, accountID, id int) (*Hold, error)
+	ReleaseHold(ctx context.Context, accountID, id int) (*Hold, error)
+	PostJournal(context.Context, *Journal) ([]*Transaction, error)
+	GetLedgerEntries(ctx context.Context, accountID, limit, offset int) ([]*LedgerEntry, error)
+	GetIdempotentResult(ctx context.Context, accountID int, key string) (*IdempotentResult, error)
+	StoreIdempotentResult(context.Context, *IdempotentResult) error
+}
 
-	if err != nil {
-		return &Config{}, fmt.Errorf("unable to open config yaml file for postgres server connection: %s", err)
-	}
+// TokenRepository stores the tokens accounts authenticate with: email
+// verification and password reset links, refresh tokens and the sessions
+// they belong to, revoked access tokens, API keys and passkey ceremonies.
+type TokenRepository interface {
+	CreateVerificationToken(ctx context.Context, accountID int, tokenHash string, expiresAt time.Time) error
+	ConsumeVerificationToken(ctx context.Context, tokenHash string) (int, error)
+	CreatePasswordResetToken(ctx context.Context, accountID int, tokenHash string, expiresAt time.Time) error
+	ResetPassword(ctx context.Context, tokenHash, hash string, now time.Time) (int, error)
+	CreateRefreshToken(context.Context, *RefreshToken) error
+	RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, tokenHash string, now time.Time) error
+	UpsertSession(context.Context, *Session) error
+	GetSessions(ctx context.Context, accountID int, now time.Time) ([]*Session, error)
+	RevokeSession(ctx context.Context, accountID, id int, now time.Time) error
+	RevokeOtherSessions(ctx context.Context, accountID, keep int, now time.Time) error
+	IsSessionRevoked(ctx context.Context, id int) (bool, error)
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+	CreateAPIKey(context.Context, *APIKey) error
+	GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	RevokeAPIKey(ctx context.Context, accountID, id int, now time.Time) error
+	CreatePasskeySession(context.Context, *PasskeySession) error
+	ConsumePasskeySession(ctx context.Context, tokenHash, purpose string, now time.Time) (*PasskeySession, error)
+}
 
-	var cfg Config
-	err = yaml.Unmarshal(f, &cfg)
-	if err != nil {
-		return &Config{}, fmt.Errorf("unable to decode config yaml file for postgres server connection: %s", err)
-	}
+// UnitOfWork runs several repository calls as one transaction.
+type UnitOfWork interface {
+	// InTx calls fn with a Storage whose calls all take part in one
+	// transaction, committed when fn returns nil and rolled back otherwise.
+	// fn may be run more than once, so it should not have effects outside
+	// the store.
+	InTx(ctx context.Context, fn func(Storage) error) error
+}
+
+// ErrAccountNotFound is returned when no account matches a lookup.
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrAccountExists is returned by CreateAccount when the email address is
+// already registered.
+var ErrAccountExists = errors.New("account already exists")
+
+// ErrConflict is returned by UpdateAccount when the account was modified since
+// the caller read it.
+var ErrConflict = errors.New("account was modified concurrently")
+
+// ErrInsufficientFunds is returned by Transfer when the sender's balance does
+// not cover the amount.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// ErrOverdraftLimitExceeded is returned by Transfer when the amount would take
+// an account with an overdraft below its limit.
+var ErrOverdraftLimitExceeded = fmt.Errorf("overdraft limit exceeded: %w", ErrInsufficientFunds)
+
+// ErrAccountFrozen is returned by Transfer when either account is frozen.
+var ErrAccountFrozen = errors.New("account is frozen")
+
+// ErrCurrencyMismatch is returned by Transfer when the accounts hold different
+// currencies.
+var ErrCurrencyMismatch = errors.New("accounts hold different currencies")
+
+// BatchError reports which account of a CreateAccounts batch failed. None of
+// the batch is stored.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("account %d of batch: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrVerificationTokenInvalid is returned by ConsumeVerificationToken when the
+// token is unknown, already used or expired.
+var ErrVerificationTokenInvalid = errors.New("verification token is invalid or expired")
 
-	return &cfg, nil
+// ErrIdempotentResultNotFound is returned by GetIdempotentResult when the key
+// has not been used or its result has expired.
+var ErrIdempotentResultNotFound = errors.New("idempotent result not found")
+
+type PostgresStore struct {
+	pool *pgxpool.Pool
+	// db runs the queries: pool, or the transaction of a store handed out
+	// by InTx.
+	db pgxQuerier
+	// replicas serve reads that can tolerate lag. Nil when there are none
+	// and in transactions.
+	replicas                *replicaSet
+	dailyTransferLimit      int64
+	perTransferLimit        int64
+	deletedAccountRetention time.Duration
+	loginHistoryRetention   time.Duration
+	idempotencyKeyTTL       time.Duration
+	retry                   retryPolicy
+	logger                  *slog.Logger
+	// rates converts cross-currency transfers. Nil rejects them.
+	rates RateProvider
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
-	// get db server config details
-	postgresConfig, err := getPostgresInfo()
+func NewPostgresStore(postgresConfig *Config, logger *slog.Logger) (*PostgresStore, error) {
+	rates, err := newRateProvider(postgresConfig)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing config yaml file:%v", err)
+		return nil, err
 	}
-
-	// connect to db server
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s search_path =%s sslmode=disable",
-		postgresConfig.Host,
-		postgresConfig.Port,
-		postgresConfig.User,
-		postgresConfig.Password,
-		postgresConfig.DBName,
-		postgresConfig.Schema)
-	db, err := sql.Open("postgres", psqlInfo)
+	poolConfig, err := postgresPoolConfig(postgresConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	// connect to db server, waiting for it to come up
+	db, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating postgres pool: %v", err)
+	}
+	connect := backoff{
+		base:  postgresConfig.DBConnectBaseDelay,
+		max:   postgresConfig.DBConnectMaxDelay,
+		sleep: time.Sleep,
+		now:   time.Now,
+	}
+	attempt := 0
+	err = connect.retryUntil(postgresConfig.DBConnectMaxWait, func() error {
+		attempt++
+		err := db.Ping(context.Background())
+		if err != nil {
+			logger.Warn("could not reach postgres", "attempt", attempt, "error", err)
+		}
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error creating postgres db: %v\n", err)
+		db.Close()
+		return nil, fmt.Errorf("error pinging postgres db: %v", err)
 	}
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("error pinging postgres db: %v\n", err)
+	replicas, err := newReplicaSet(postgresConfig, logger)
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 	return &PostgresStore{
-		db: db,
+		pool:                    db,
+		db:                      db,
+		replicas:                replicas,
+		dailyTransferLimit:      postgresConfig.DailyTransferLimit,
+		perTransferLimit:        postgresConfig.PerTransferLimit,
+		deletedAccountRetention: postgresConfig.DeletedAccountRetention,
+		loginHistoryRetention:   postgresConfig.LoginHistoryRetention,
+		idempotencyKeyTTL:       postgresConfig.IdempotencyKeyTTL,
+		rates:                   rates,
+		retry: retryPolicy{
+			attempts:  postgresConfig.DBRetryAttempts,
+			baseDelay: postgresConfig.DBRetryBaseDelay,
+			sleep:     time.Sleep,
+		},
+		logger: logger,
 	}, nil
 }
 
-func (s *PostgresStore) CreateAccount(acc *Account) error {
-	query := "INSERT INTO account (first_name, last_name, email, encrypted_password, balance, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
-	stmt, err := s.db.Prepare(query)
-	result, err := stmt.Exec(
+// monitor pings the database every interval until ctx is done, logging when
+// it stops answering and when it is back. The pool dials new connections by
+// itself, but ones opened before an outage may be dead, so it is reset once
+// the database answers again. Read replicas are checked too.
+func (s *PostgresStore) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var down time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.replicas.check(ctx, interval, s.logger)
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			err := s.pool.Ping(pingCtx)
+			cancel()
+			switch {
+			case err != nil && ctx.Err() != nil:
+				return
+			case err != nil && down.IsZero():
+				down = now
+				s.logger.Error("postgres is unreachable", "error", err)
+			case err == nil && !down.IsZero():
+				s.pool.Reset()
+				s.logger.Info("postgres is reachable again", "down_for", now.Sub(down))
+				down = time.Time{}
+			}
+		}
+	}
+}
+
+// pgxQuerier is implemented by both pgxpool.Pool and pgx.Tx. Begin on a
+// pgx.Tx starts a savepoint, so methods that open their own transaction
+// nest inside an InTx one.
+type pgxQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// InTx runs fn in one database transaction. Deadlocks and serialization
+// failures rerun the whole of fn with backoff, so the calls fn makes do not
+// retry on their own. Rows being read through EachAccount must be finished
+// with before fn makes another call, as the transaction has one connection.
+func (s *PostgresStore) InTx(ctx context.Context, fn func(Storage) error) error {
+	return s.retry.do(func() error {
+		tx, err := s.db.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("could not start transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		txStore := *s
+		txStore.db = tx
+		txStore.replicas = nil
+		txStore.retry.attempts = 1
+		if err := fn(&txStore); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("could not commit transaction: %w", err)
+		}
+		return nil
+	})
+}
+
+// postgresPoolConfig describes the pool for cfg, timing its queries into
+// dbQueryMetrics and logging slow ones to logger. It does not connect. When
+// Config.DBPasswordSecretName is set, each new connection reads the current
+// password from secrets, so a rotated password is picked up as
+// ConnMaxLifetime recycles the pool.
+func postgresPoolConfig(cfg *Config, logger *slog.Logger) (*pgxpool.Config, error) {
+	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s dbname=%s search_path=%s sslmode=disable",
+		cfg.Host,
+		cfg.Port,
+		cfg.User,
+		cfg.DBName,
+		cfg.Schema)
+	poolConfig, err := pgxpool.ParseConfig(psqlInfo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid postgres config: %v", err)
+	}
+	poolConfig.ConnConfig.Password = cfg.Password
+	if cfg.DBPasswordSecretName != "" {
+		poolConfig.BeforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+			password, err := secrets.Secret(cfg.DBPasswordSecretName)
+			if err != nil {
+				return fmt.Errorf("unable to read the database password: %v", err)
+			}
+			connConfig.Password = password
+			return nil
+		}
+	}
+	poolConfig.MaxConns = int32(cfg.MaxOpenConns)
+	poolConfig.MinConns = int32(cfg.MinConns)
+	poolConfig.MaxConnLifetime = cfg.ConnMaxLifetime
+	poolConfig.MaxConnIdleTime = cfg.ConnMaxIdleTime
+	poolConfig.HealthCheckPeriod = cfg.HealthCheckPeriod
+	poolConfig.ConnConfig.Tracer = &queryTracer{
+		metrics:       dbQueryMetrics,
+		slowThreshold: cfg.SlowQueryThreshold,
+		logger:        logger,
+	}
+	return poolConfig, nil
+}
+
+// maxAccountNumberAttempts bounds how many fresh account numbers CreateAccount
+// tries when the generated one is already taken.
+const maxAccountNumberAttempts = 5
+
+const (
+	insertAccountColumns = "number, first_name, last_name, email, phone, encrypted_password, balance, currency, created_at, updated_at, version, daily_transfer_limit, per_transfer_limit, role, status, email_verified, overdraft_limit"
+	insertAccountQuery   = "INSERT INTO account (" + insertAccountColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id"
+)
+
+// insertAccountArgs returns acc's values in insertAccountQuery order.
+func insertAccountArgs(acc *Account) []any {
+	return []any{
+		acc.Number,
 		acc.FirstName,
 		acc.LastName,
 		acc.Email,
+		acc.Phone,
 		acc.EncryptedPassword,
 		acc.Balance,
+		acc.Currency,
 		acc.CreatedAt,
-	)
+		acc.UpdatedAt,
+		acc.Version,
+		acc.DailyTransferLimit,
+		acc.PerTransferLimit,
+		acc.Role,
+		acc.Status,
+		acc.EmailVerified,
+		acc.OverdraftLimit,
+	}
+}
+
+// CreateAccount inserts acc along with the ledger entries for its opening
+// balance.
+func (s *PostgresStore) CreateAccount(ctx context.Context, acc *Account) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not create account for %s %s: %v", acc.FirstName, acc.LastName, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertAccountInTx(ctx, tx, acc); err != nil {
+		acc.ID = 0
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		acc.ID = 0
+		return fmt.Errorf("could not create account for %s %s: %v", acc.FirstName, acc.LastName, err)
+	}
+	return nil
+}
+
+// accountInsertBatchSize is how many accounts CreateAccounts inserts per
+// statement. At 17 parameters each this stays well below postgres's limit of
+// 65535 parameters per statement.
+const accountInsertBatchSize = 500
+
+// CreateAccounts inserts accounts in a single transaction, so either all of
+// them are stored or, on a *BatchError, none are. They are sent
+// accountInsertBatchSize at a time in multi-row INSERTs.
+func (s *PostgresStore) CreateAccounts(ctx context.Context, accounts []*Account) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start account batch: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for start := 0; start < len(accounts); start += accountInsertBatchSize {
+		end := min(start+accountInsertBatchSize, len(accounts))
+		if err := insertAccountBatchInTx(ctx, tx, accounts[start:end]); err != nil {
+			for _, inserted := range accounts[:end] {
+				inserted.ID = 0
+			}
+			var batchErr *BatchError
+			if errors.As(err, &batchErr) {
+				batchErr.Index += start
+			}
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit account batch: %v", err)
+	}
+	return nil
+}
+
+// insertAccountBatchInTx inserts accounts and their opening ledger entries
+// inside tx with one multi-row INSERT. When that fails, on a taken email or
+// account number say, it is rolled back and the accounts are inserted one at
+// a time instead, which retries account number collisions and finds which
+// account is at fault.
+func insertAccountBatchInTx(ctx context.Context, tx pgx.Tx, accounts []*Account) error {
+	if _, err := tx.Exec(ctx, "SAVEPOINT insert_accounts"); err != nil {
+		return fmt.Errorf("could not insert account batch: %v", err)
+	}
+	err := insertAccountRows(ctx, tx, accounts)
+	if err == nil {
+		if _, err := tx.Exec(ctx, "RELEASE SAVEPOINT insert_accounts"); err != nil {
+			return fmt.Errorf("could not insert account batch: %v", err)
+		}
+		for i, acc := range accounts {
+			if j := openingJournal(acc); j != nil {
+				if err := insertLedgerEntries(ctx, tx, j, acc.CreatedAt); err != nil {
+					return &BatchError{Index: i, Err: err}
+				}
+			}
+		}
+		return nil
+	}
+	if _, err := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT insert_accounts"); err != nil {
+		return fmt.Errorf("could not insert account batch: %v", err)
+	}
+	for i, acc := range accounts {
+		acc.ID = 0
+		if err := insertAccountInTx(ctx, tx, acc); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+// insertAccountRows inserts accounts with a single statement and sets their
+// IDs. Rows are matched back to accounts by number, as RETURNING does not
+// promise to follow the order of VALUES.
+func insertAccountRows(ctx context.Context, tx pgx.Tx, accounts []*Account) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO account (" + insertAccountColumns + ") VALUES ")
+	args := make([]any, 0, len(accounts)*17)
+	byNumber := make(map[int64]*Account, len(accounts))
+	for i, acc := range accounts {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(")
+		for j, arg := range insertAccountArgs(acc) {
+			if j > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, arg)
+			fmt.Fprintf(&query, "$%d", len(args))
+		}
+		query.WriteString(")")
+		byNumber[acc.Number] = acc
+	}
+	query.WriteString(" RETURNING id, number")
+
+	rows, err := tx.Query(ctx, query.String(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var number int64
+		if err := rows.Scan(&id, &number); err != nil {
+			return err
+		}
+		if acc, ok := byNumber[number]; ok {
+			acc.ID = id
+		}
+	}
+	return rows.Err()
+}
+
+// insertAccountInTx inserts acc and its opening ledger entries inside tx. A
+// failed statement aborts a postgres transaction, so each attempt runs under
+// a savepoint that is rolled back before retrying with a fresh account number.
+func insertAccountInTx(ctx context.Context, tx pgx.Tx, acc *Account) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if _, err = tx.Exec(ctx, "SAVEPOINT insert_account"); err != nil {
+			return fmt.Errorf("could not create account for %s %s: %v", acc.FirstName, acc.LastName, err)
+		}
+		err = tx.QueryRow(ctx, insertAccountQuery, insertAccountArgs(acc)...).Scan(&acc.ID)
+		if err == nil {
+			_, err = tx.Exec(ctx, "RELEASE SAVEPOINT insert_account")
+			break
+		}
+		if _, rbErr := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT insert_account"); rbErr != nil {
+			return fmt.Errorf("could not create account for %s %s: %v", acc.FirstName, acc.LastName, rbErr)
+		}
+		if !isUniqueViolation(err, "account_number_key") || attempt == maxAccountNumberAttempts {
+			break
+		}
+		if acc.Number, err = newAccountNumber(); err != nil {
+			break
+		}
+	}
+	if isUniqueViolation(err, "account_email_key") {
+		return fmt.Errorf("%w: %s", ErrAccountExists, acc.Email)
+	}
 	if err != nil {
 		return fmt.Errorf("could not create account for %s %s: %v", acc.FirstName, acc.LastName, err)
 	}
-	fmt.Printf("account creation => %v\n", result)
+	if j := openingJournal(acc); j != nil {
+		return insertLedgerEntries(ctx, tx, j, acc.CreatedAt)
+	}
 	return nil
 }
 
-func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
-	query := "SELECT * FROM account WHERE id=$1"
-	rows, err := s.db.Query(query, id)
+func (s *PostgresStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	query := "SELECT " + accountColumns + " FROM account WHERE id=$1 AND deleted_at IS NULL"
+	rows, err := s.queryRead(ctx, query, id)
 	if err != nil {
-		// TODO if record not found send different error to the generic one below
 		return nil, fmt.Errorf("could not get account with id %d: %v", id, err)
 	}
-	rows.Next()
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("could not get account with id %d: %v", id, err)
+		}
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
 
 	acc, err := s.scanIntoAccount(rows)
 	if err != nil {
-		// TODO if record not found send different error to the generic one below
 		return nil, fmt.Errorf("could not parse sql result for account with id %d: %v", id, err)
 	}
 
 	return acc, nil
 }
 
-func (s *PostgresStore) UpdateAccount(*Account) error {
+func (s *PostgresStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	updatedAt := time.Now().UTC()
+	query := "UPDATE account SET first_name=$1, last_name=$2, email=$3, phone=$4, updated_at=$5, version=version+1 WHERE id=$6 AND version=$7 AND deleted_at IS NULL"
+	result, err := s.db.Exec(ctx, query, acc.FirstName, acc.LastName, acc.Email, acc.Phone, updatedAt, acc.ID, acc.Version)
+	if isUniqueViolation(err, "account_email_key") {
+		return fmt.Errorf("%w: %s", ErrAccountExists, acc.Email)
+	}
+	if err != nil {
+		return fmt.Errorf("could not update account with id %d: %v", acc.ID, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		if _, err := s.GetAccountByID(ctx, acc.ID); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: account with id %d is no longer at version %d", ErrConflict, acc.ID, acc.Version)
+	}
+	acc.UpdatedAt = updatedAt
+	acc.Version++
 	return nil
 }
 
-func (s *PostgresStore) DeleteAccount(id int) error {
-	query := "DELETE FROM account WHERE id=$1"
-	_, err := s.db.Query(query, id)
+// DeleteAccount soft deletes an account by stamping deleted_at. The row and
+// its ledger entries stay in place but the account disappears from reads.
+func (s *PostgresStore) DeleteAccount(ctx context.Context, id int) error {
+	query := "UPDATE account SET deleted_at=$1 WHERE id=$2 AND deleted_at IS NULL"
+	result, err := s.db.Exec(ctx, query, time.Now().UTC(), id)
 	if err != nil {
 		return fmt.Errorf("could not delete account with id %d: %v", id, err)
 	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	return nil
+}
+
+// RestoreAccount undoes DeleteAccount. It returns ErrAccountNotFound unless
+// the account is soft deleted and not yet purged.
+func (s *PostgresStore) RestoreAccount(ctx context.Context, id int) error {
+	result, err := s.db.Exec(ctx, "UPDATE account SET deleted_at=NULL WHERE id=$1 AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return fmt.Errorf("could not restore account with id %d: %v", id, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: deleted id %d", ErrAccountNotFound, id)
+	}
 	return nil
 }
 
+// HardDeleteAccount permanently removes an account, soft deleted or not,
+// along with its transactions and idempotency keys. Other accounts'
+// transactions keep their amounts but lose the counterparty reference. Its
+// ledger entries are kept so the books still balance. It returns the other
+// accounts whose holds for this one it released.
+func (s *PostgresStore) HardDeleteAccount(ctx context.Context, id int) ([]int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start purge of account with id %d: %v", id, err)
+	}
+	defer tx.Rollback(ctx)
+
+	// holds other accounts placed for this one can no longer be captured
+	query := `UPDATE account a SET held = a.held - h.total
+		FROM (SELECT account_id, SUM(amount) AS total FROM holds WHERE to_account_id=$1 AND status=$2 GROUP BY account_id) h
+		WHERE a.id = h.account_id
+		RETURNING a.id`
+	rows, err := tx.Query(ctx, query, id, HoldActive)
+	if err != nil {
+		return nil, fmt.Errorf("could not release holds for account with id %d: %v", id, err)
+	}
+	released, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("could not release holds for account with id %d: %v", id, err)
+	}
+	for _, query := range []string{
+		"DELETE FROM idempotency_keys WHERE account_id=$1",
+		"DELETE FROM holds WHERE account_id=$1 OR to_account_id=$1",
+		"DELETE FROM email_verification_tokens WHERE account_id=$1",
+		"DELETE FROM password_reset_tokens WHERE account_id=$1",
+		"DELETE FROM totp_backup_codes WHERE account_id=$1",
+		"DELETE FROM passkeys WHERE account_id=$1",
+		"DELETE FROM api_keys WHERE account_id=$1",
+		"DELETE FROM passkey_sessions WHERE account_id=$1",
+		"DELETE FROM refresh_tokens WHERE account_id=$1",
+		"DELETE FROM sessions WHERE account_id=$1",
+		"DELETE FROM login_attempts WHERE account_id=$1",
+		"DELETE FROM scheduled_transfers WHERE account_id=$1 OR to_account_id=$1",
+		"DELETE FROM standing_orders WHERE account_id=$1 OR to_account_id=$1",
+		"UPDATE transactions SET counterparty_account_id=NULL WHERE counterparty_account_id=$1",
+		"UPDATE transactions SET reversal_of=NULL WHERE reversal_of IN (SELECT id FROM transactions WHERE account_id=$1)",
+		"DELETE FROM transactions WHERE account_id=$1",
+	} {
+		if _, err := tx.Exec(ctx, query, id); err != nil {
+			return nil, fmt.Errorf("could not purge account with id %d: %v", id, err)
+		}
+	}
+	result, err := tx.Exec(ctx, "DELETE FROM account WHERE id=$1", id)
+	if err != nil {
+		return nil, fmt.Errorf("could not purge account with id %d: %v", id, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit purge of account with id %d: %v", id, err)
+	}
+	return released, nil
+}
+
 func (s *PostgresStore) CreateAccountTable() error {
 	return nil
 }
 
-func (s *PostgresStore) GetAccounts() ([]*Account, error) {
-	query := "SELECT * FROM account"
-	rows, err := s.db.Query(query)
+// GetAccounts returns a page of the accounts filter matches in id order: up
+// to limit of them, after skipping offset. A positive afterID starts the
+// page after that account instead, so deep pages are found through the
+// primary key rather than by reading past every row before them.
+func (s *PostgresStore) GetAccounts(ctx context.Context, filter AccountFilter, afterID, limit, offset int) ([]*Account, error) {
+	where, args := filter.where()
+	args = append(args, afterID, limit, offset)
+	query := fmt.Sprintf("SELECT %s FROM account%s AND id > $%d ORDER BY id LIMIT $%d OFFSET $%d", accountColumns, where, len(args)-2, len(args)-1, len(args))
+	rows, err := s.queryRead(ctx, query, args...)
 	if err != nil {
-		return []*Account{}, fmt.Errorf("could not get accounts from db: %v", err)
+		return nil, fmt.Errorf("could not get accounts from db: %v", err)
 	}
-	var accounts []*Account
+	defer rows.Close()
+	accounts := []*Account{}
 	for rows.Next() {
 		acc, err := s.scanIntoAccount(rows)
 		if err != nil {
@@ -143,57 +732,1711 @@ func (s *PostgresStore) GetAccounts() ([]*Account, error) {
 		}
 		accounts = append(accounts, acc)
 	}
-	return accounts, nil
+	return accounts, rows.Err()
 }
 
-func (s *PostgresStore) Init() error {
-	return s.createAccountTable()
+// CountAccounts returns how many accounts filter matches.
+func (s *PostgresStore) CountAccounts(ctx context.Context, filter AccountFilter) (int, error) {
+	where, args := filter.where()
+	rows, err := s.queryRead(ctx, "SELECT count(*) FROM account"+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("could not count accounts: %v", err)
+	}
+	total, err := pgx.CollectOneRow(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, fmt.Errorf("could not count accounts: %v", err)
+	}
+	return total, nil
+}
+
+// where returns the WHERE clause selecting the accounts f matches, with
+// its arguments numbered from $1.
+func (f AccountFilter) where() (string, []any) {
+	conditions := []string{"deleted_at IS NULL"}
+	var args []any
+	if f.Search != "" {
+		args = append(args, "%"+escapeLike(f.Search)+"%")
+		n := len(args)
+		conditions = append(conditions, fmt.Sprintf("(first_name ILIKE $%d OR last_name ILIKE $%d OR email ILIKE $%d)", n, n, n))
+	}
+	if f.Email != "" {
+		args = append(args, normalizeEmail(f.Email))
+		conditions = append(conditions, fmt.Sprintf("lower(email) = $%d", len(args)))
+	}
+	if f.Name != "" {
+		args = append(args, "%"+escapeLike(f.Name)+"%")
+		conditions = append(conditions, fmt.Sprintf("first_name || ' ' || last_name ILIKE $%d", len(args)))
+	}
+	if !f.CreatedAfter.IsZero() {
+		args = append(args, f.CreatedAfter)
+		conditions = append(conditions, fmt.Sprintf("created_at > $%d", len(args)))
+	}
+	if f.MinBalance != nil {
+		args = append(args, *f.MinBalance)
+		conditions = append(conditions, fmt.Sprintf("balance >= $%d", len(args)))
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// EachAccount calls fn for every account in id order as rows arrive from the
+// database, so callers can stream all accounts without holding them in
+// memory. It stops at the first error fn returns.
+func (s *PostgresStore) EachAccount(ctx context.Context, fn func(*Account) error) error {
+	query := "SELECT " + accountColumns + " FROM account WHERE deleted_at IS NULL ORDER BY id"
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("could not get accounts from db: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		acc, err := s.scanIntoAccount(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(acc); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read accounts from db: %v", err)
+	}
+	return nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
-func (s *PostgresStore) createAccountTable() error {
-	query := `CREATE TABLE IF NOT EXISTS account (
-		id serial primary key,
-		first_name varchar(50),
-		last_name varchar(50),
-		email varchar(50),
-		encrypted_password text,
-		balance numeric,
-		created_at timestamp
-	)`
-	_, err := s.db.Exec(query)
-	return err
+func (s *PostgresStore) Init() error {
+	return s.Migrate()
 }
 
-func (s *PostgresStore) scanIntoAccount(rows *sql.Rows) (*Account, error) {
+// accountColumns lists the account columns in the order scanIntoAccount reads
+// them. Queries must select these rather than * so new columns cannot shift
+// the scan.
+const accountColumns = "id, number, first_name, last_name, email, phone, encrypted_password, balance, held, currency, created_at, updated_at, version, daily_transfer_limit, per_transfer_limit, role, status, email_verified, overdraft_limit, totp_secret, totp_enabled, deleted_at"
+
+func (s *PostgresStore) scanIntoAccount(rows pgx.Rows) (*Account, error) {
 	acc := new(Account)
 	err := rows.Scan(
 		&acc.ID,
+		&acc.Number,
 		&acc.FirstName,
 		&acc.LastName,
 		&acc.Email,
+		&acc.Phone,
 		&acc.EncryptedPassword,
 		&acc.Balance,
-		&acc.CreatedAt)
+		&acc.Held,
+		&acc.Currency,
+		&acc.CreatedAt,
+		&acc.UpdatedAt,
+		&acc.Version,
+		&acc.DailyTransferLimit,
+		&acc.PerTransferLimit,
+		&acc.Role,
+		&acc.Status,
+		&acc.EmailVerified,
+		&acc.OverdraftLimit,
+		&acc.TOTPSecret,
+		&acc.TOTPEnabled,
+		&acc.DeletedAt)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse response from db: %v", err)
 	}
 	return acc, nil
 }
 
-func (s *PostgresStore) GetAccountByEmail(email string) (*Account, error) {
-	query := "SELECT * FROM account WHERE email=$1"
-	rows, err := s.db.Query(query, email)
+func (s *PostgresStore) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	email = normalizeEmail(email)
+	query := "SELECT " + accountColumns + " FROM account WHERE lower(email)=$1 AND deleted_at IS NULL"
+	rows, err := s.queryRead(ctx, query, email)
 	if err != nil {
-		// TODO if record not found send different error to the generic one below
 		return nil, fmt.Errorf("could not get account with email %s: %v", email, err)
 	}
-	rows.Next()
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("could not get account with email %s: %v", email, err)
+		}
+		return nil, fmt.Errorf("%w: email %s", ErrAccountNotFound, email)
+	}
 
 	acc, err := s.scanIntoAccount(rows)
 	if err != nil {
-		// TODO if record not found send different error to the generic one below
 		return nil, fmt.Errorf("could not parse sql result for account with email %s: %v", email, err)
 	}
 
 	return acc, nil
-}
\ No newline at end of file
+}
+
+func (s *PostgresStore) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	query := "SELECT " + accountColumns + " FROM account WHERE number=$1 AND deleted_at IS NULL"
+	rows, err := s.db.Query(ctx, query, number)
+	if err != nil {
+		return nil, fmt.Errorf("could not get account with number %d: %v", number, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("could not get account with number %d: %v", number, err)
+		}
+		return nil, fmt.Errorf("%w: number %d", ErrAccountNotFound, number)
+	}
+
+	acc, err := s.scanIntoAccount(rows)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse sql result for account with number %d: %v", number, err)
+	}
+
+	return acc, nil
+}
+
+// isUniqueViolation reports whether err is a postgres unique_violation on the
+// named constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
+// Transfer moves amount from one account to another, writing a debit and a
+// credit ledger entry in the same database transaction as the balance
+// updates. It returns the sender's debit entry. Deadlocks and serialization
+// failures are retried with backoff.
+func (s *PostgresStore) Transfer(ctx context.Context, fromID, toID int, amount int64) (*Transaction, error) {
+	var debit *Transaction
+	err := s.retry.do(func() error {
+		var err error
+		debit, err = s.transfer(ctx, fromID, toID, amount)
+		return err
+	})
+	return debit, err
+}
+
+func (s *PostgresStore) transfer(ctx context.Context, fromID, toID int, amount int64) (*Transaction, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start transfer: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	debit, err := s.transferInTx(ctx, tx, fromID, toID, amount, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit transfer: %w", err)
+	}
+	return debit, nil
+}
+
+// transferInTx moves amount from fromID to toID within tx. released is the
+// part of the sender's held money the transfer captures; it is taken off
+// Held before the sender's available balance is checked.
+func (s *PostgresStore) transferInTx(ctx context.Context, tx pgx.Tx, fromID, toID int, amount, released int64) (*Transaction, error) {
+	if fromID == toID {
+		return nil, fmt.Errorf("cannot transfer to the same account")
+	}
+
+	// lock both rows in id order so concurrent transfers cannot deadlock
+	rows, err := tx.Query(ctx, "SELECT id, balance, held, currency, daily_transfer_limit, per_transfer_limit, status, overdraft_limit FROM account WHERE id IN ($1, $2) AND deleted_at IS NULL ORDER BY id FOR UPDATE", fromID, toID)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock accounts for transfer: %w", err)
+	}
+	locked := make(map[int]*Account)
+	for rows.Next() {
+		acc := new(Account)
+		if err := rows.Scan(&acc.ID, &acc.Balance, &acc.Held, &acc.Currency, &acc.DailyTransferLimit, &acc.PerTransferLimit, &acc.Status, &acc.OverdraftLimit); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not read balances for transfer: %w", err)
+		}
+		locked[acc.ID] = acc
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read balances for transfer: %w", err)
+	}
+	for _, id := range []int{fromID, toID} {
+		if _, ok := locked[id]; !ok {
+			return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+		}
+	}
+	for _, id := range []int{fromID, toID} {
+		if locked[id].Status == AccountStatusFrozen {
+			return nil, fmt.Errorf("%w: id %d", ErrAccountFrozen, id)
+		}
+	}
+	now := time.Now().UTC()
+	debit, credit, err := transferEntries(locked[fromID], locked[toID], amount, s.rates, now)
+	if err != nil {
+		return nil, err
+	}
+	locked[fromID].Held -= released
+	if err := checkFunds(locked[fromID], amount); err != nil {
+		return nil, err
+	}
+	if err := checkPerTransferLimit(locked[fromID], s.perTransferLimit, amount); err != nil {
+		return nil, err
+	}
+	var spent int64
+	query := "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE account_id=$1 AND type=$2 AND created_at > $3"
+	if err := tx.QueryRow(ctx, query, fromID, TransactionTransferDebit, now.Add(-transferLimitWindow)).Scan(&spent); err != nil {
+		return nil, fmt.Errorf("could not total recent transfers for account with id %d: %w", fromID, err)
+	}
+	if err := checkDailyLimit(locked[fromID], s.dailyTransferLimit, spent, amount); err != nil {
+		return nil, err
+	}
+
+	query = "UPDATE account SET balance=balance-$1, held=held-$2, updated_at=$3, version=version+1 WHERE id=$4"
+	if _, err := tx.Exec(ctx, query, amount, released, now, fromID); err != nil {
+		return nil, fmt.Errorf("could not debit account with id %d: %w", fromID, err)
+	}
+	query = "UPDATE account SET balance=balance+$1, updated_at=$2, version=version+1 WHERE id=$3"
+	if _, err := tx.Exec(ctx, query, credit.Amount, now, toID); err != nil {
+		return nil, fmt.Errorf("could not credit account with id %d: %w", toID, err)
+	}
+
+	for _, t := range []*Transaction{debit, credit} {
+		if err := insertTransaction(ctx, tx, t); err != nil {
+			return nil, err
+		}
+	}
+	if err := insertLedgerEntries(ctx, tx, transferJournal(debit, credit, locked[fromID].Currency, locked[toID].Currency), now); err != nil {
+		return nil, err
+	}
+	return debit, nil
+}
+
+// insertTransaction records a ledger entry. It takes the pgx.Tx of the
+// balance change it describes so both commit or roll back together.
+func insertTransaction(ctx context.Context, tx pgx.Tx, t *Transaction) error {
+	query := "INSERT INTO transactions (account_id, type, amount, counterparty_account_id, exchange_rate, original_amount, original_currency, created_at, status, reversal_of) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id"
+	err := tx.QueryRow(ctx, query, t.AccountID, t.Type, t.Amount, t.CounterpartyAccountID, t.ExchangeRate, t.OriginalAmount, t.OriginalCurrency, t.CreatedAt, t.Status, t.ReversalOf).Scan(&t.ID)
+	if err != nil {
+		return fmt.Errorf("could not record %s for account with id %d: %w", t.Type, t.AccountID, err)
+	}
+	return nil
+}
+
+// GetTransactions returns an account's transactions created in [since,
+// until), newest first. A zero since or until leaves that end open.
+func (s *PostgresStore) GetTransactions(ctx context.Context, accountID int, since, until time.Time, limit, offset int) ([]*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions
+		WHERE account_id=$1 AND ($2::timestamp IS NULL OR created_at >= $2) AND ($3::timestamp IS NULL OR created_at < $3)
+		ORDER BY created_at DESC, id DESC LIMIT $4 OFFSET $5`
+	sinceArg := pgtype.Timestamp{Time: since.UTC(), Valid: !since.IsZero()}
+	untilArg := pgtype.Timestamp{Time: until.UTC(), Valid: !until.IsZero()}
+	rows, err := s.db.Query(ctx, query, accountID, sinceArg, untilArg, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("could not get transactions for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+
+	transactions := []*Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse transactions for account with id %d: %v", accountID, err)
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// transactionColumns lists the columns scanTransaction reads, in order.
+const transactionColumns = "id, account_id, type, amount, counterparty_account_id, exchange_rate, original_amount, original_currency, created_at, status, reversal_of"
+
+func scanTransaction(row interface{ Scan(...any) error }) (*Transaction, error) {
+	t := new(Transaction)
+	err := row.Scan(&t.ID, &t.AccountID, &t.Type, &t.Amount, &t.CounterpartyAccountID, &t.ExchangeRate, &t.OriginalAmount, &t.OriginalCurrency, &t.CreatedAt, &t.Status, &t.ReversalOf)
+	return t, err
+}
+
+func (s *PostgresStore) GetTransaction(ctx context.Context, id int) (*Transaction, error) {
+	t, err := scanTransaction(s.db.QueryRow(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id=$1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: id %d", ErrTransactionNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get transaction with id %d: %v", id, err)
+	}
+	return t, nil
+}
+
+// ReverseTransfer undoes the transfer whose sender debit has id debitID. Both
+// original entries are marked reversed and compensating entries are written
+// in one database transaction. It returns the sender's compensating credit.
+// Deadlocks and serialization failures are retried with backoff.
+func (s *PostgresStore) ReverseTransfer(ctx context.Context, debitID int) (*Transaction, error) {
+	var reversal *Transaction
+	err := s.retry.do(func() error {
+		var err error
+		reversal, err = s.reverseTransfer(ctx, debitID)
+		return err
+	})
+	return reversal, err
+}
+
+func (s *PostgresStore) reverseTransfer(ctx context.Context, debitID int) (*Transaction, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start reversal: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// locking the debit makes concurrent reversals of one transfer take turns
+	query := "SELECT " + transactionColumns + " FROM transactions WHERE id=$1 AND type=$2 FOR UPDATE"
+	debit, err := scanTransaction(tx.QueryRow(ctx, query, debitID, TransactionTransferDebit))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no transfer with id %d", ErrTransactionNotFound, debitID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get transfer with id %d: %w", debitID, err)
+	}
+	if debit.CounterpartyAccountID == nil {
+		return nil, fmt.Errorf("%w: the recipient of transfer %d was purged", ErrAccountNotFound, debitID)
+	}
+	query = "SELECT " + transactionColumns + ` FROM transactions
+		WHERE type=$1 AND account_id=$2 AND counterparty_account_id=$3 AND created_at=$4 AND id > $5
+		ORDER BY id LIMIT 1 FOR UPDATE`
+	credit, err := scanTransaction(tx.QueryRow(ctx, query, TransactionTransferCredit, *debit.CounterpartyAccountID, debit.AccountID, debit.CreatedAt, debit.ID))
+	if err != nil {
+		return nil, fmt.Errorf("could not find the credit of transfer %d: %w", debitID, err)
+	}
+
+	rows, err := tx.Query(ctx, "SELECT id, balance, held, currency, status, overdraft_limit FROM account WHERE id IN ($1, $2) AND deleted_at IS NULL ORDER BY id FOR UPDATE", debit.AccountID, credit.AccountID)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock accounts for reversal: %w", err)
+	}
+	locked := make(map[int]*Account)
+	for rows.Next() {
+		acc := new(Account)
+		if err := rows.Scan(&acc.ID, &acc.Balance, &acc.Held, &acc.Currency, &acc.Status, &acc.OverdraftLimit); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not read balances for reversal: %w", err)
+		}
+		locked[acc.ID] = acc
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read balances for reversal: %w", err)
+	}
+	for _, id := range []int{debit.AccountID, credit.AccountID} {
+		if _, ok := locked[id]; !ok {
+			return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+		}
+	}
+	sender, recipient := locked[debit.AccountID], locked[credit.AccountID]
+	if err := checkReversal(debit, sender, recipient, credit.Amount); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	reversalDebit, reversalCredit := reversalEntries(debit, credit, now)
+	query = "UPDATE account SET balance=balance+$1, updated_at=$2, version=version+1 WHERE id=$3"
+	if _, err := tx.Exec(ctx, query, -credit.Amount, now, recipient.ID); err != nil {
+		return nil, fmt.Errorf("could not debit account with id %d: %w", recipient.ID, err)
+	}
+	if _, err := tx.Exec(ctx, query, debit.Amount, now, sender.ID); err != nil {
+		return nil, fmt.Errorf("could not credit account with id %d: %w", sender.ID, err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE transactions SET status=$1 WHERE id IN ($2, $3)", TransactionStatusReversed, debit.ID, credit.ID); err != nil {
+		return nil, fmt.Errorf("could not mark transfer %d reversed: %w", debitID, err)
+	}
+	for _, t := range []*Transaction{reversalDebit, reversalCredit} {
+		if err := insertTransaction(ctx, tx, t); err != nil {
+			return nil, err
+		}
+	}
+	if err := insertLedgerEntries(ctx, tx, movementJournal(JournalReversal, reversalDebit, reversalCredit, recipient.Currency, sender.Currency), now); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit reversal: %w", err)
+	}
+	return reversalCredit, nil
+}
+
+// GetBalance sums the account's ledger entries rather than reading the
+// balance column, which only caches that sum.
+func (s *PostgresStore) GetBalance(ctx context.Context, id int) (Balance, error) {
+	var balance Balance
+	query := `SELECT COALESCE(SUM(CASE l.direction WHEN 'credit' THEN l.amount ELSE -l.amount END), 0), a.currency, a.held
+		FROM account a LEFT JOIN ledger_entries l ON l.account_id = a.id
+		WHERE a.id=$1 AND a.deleted_at IS NULL GROUP BY a.currency, a.held`
+	err := s.db.QueryRow(ctx, query, id).Scan(&balance.Amount, &balance.Currency, &balance.Held)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Balance{}, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	if err != nil {
+		return Balance{}, fmt.Errorf("could not get balance for account with id %d: %v", id, err)
+	}
+	return balance, nil
+}
+
+// PostJournal posts a deposit, withdrawal or fee journal built by Ledger. The
+// entries, the cached balances and a transaction for each customer entry are
+// written in one database transaction, and those transactions are returned.
+// Deadlocks and serialization failures are retried with backoff.
+func (s *PostgresStore) PostJournal(ctx context.Context, j *Journal) ([]*Transaction, error) {
+	var transactions []*Transaction
+	err := s.retry.do(func() error {
+		var err error
+		transactions, err = s.postJournal(ctx, j)
+		return err
+	})
+	return transactions, err
+}
+
+func (s *PostgresStore) postJournal(ctx context.Context, j *Journal) ([]*Transaction, error) {
+	changes := j.balanceChanges()
+	ids := make([]int64, 0, len(changes))
+	for id := range changes {
+		ids = append(ids, int64(id))
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start %s: %w", j.Kind, err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "SELECT id, balance, held, currency, status, overdraft_limit FROM account WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id FOR UPDATE", ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock accounts for %s: %w", j.Kind, err)
+	}
+	locked := make(map[int]*Account)
+	for rows.Next() {
+		acc := new(Account)
+		if err := rows.Scan(&acc.ID, &acc.Balance, &acc.Held, &acc.Currency, &acc.Status, &acc.OverdraftLimit); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not read balances for %s: %w", j.Kind, err)
+		}
+		locked[acc.ID] = acc
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read balances for %s: %w", j.Kind, err)
+	}
+	if err := checkJournal(j, locked); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	query := "UPDATE account SET balance=balance+$1, updated_at=$2, version=version+1 WHERE id=$3"
+	for id, change := range changes {
+		if _, err := tx.Exec(ctx, query, change, now, id); err != nil {
+			return nil, fmt.Errorf("could not update balance of account with id %d: %w", id, err)
+		}
+	}
+	transactions := journalTransactions(j, now)
+	for _, t := range transactions {
+		if err := insertTransaction(ctx, tx, t); err != nil {
+			return nil, err
+		}
+	}
+	if err := insertLedgerEntries(ctx, tx, j, now); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit %s: %w", j.Kind, err)
+	}
+	return transactions, nil
+}
+
+// insertLedgerEntries posts j under a new journal id inside tx, the
+// transaction of the balance change it records.
+func insertLedgerEntries(ctx context.Context, tx pgx.Tx, j *Journal, now time.Time) error {
+	var journalID int64
+	if err := tx.QueryRow(ctx, "SELECT nextval('ledger_journal_id_seq')").Scan(&journalID); err != nil {
+		return fmt.Errorf("could not allocate %s journal: %w", j.Kind, err)
+	}
+	j.stamp(journalID, now)
+	query := "INSERT INTO ledger_entries (journal_id, kind, account_id, system_account, direction, amount, currency, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+	for _, e := range j.Entries {
+		systemAccount := pgtype.Text{String: e.SystemAccount, Valid: e.SystemAccount != ""}
+		err := tx.QueryRow(ctx, query, e.JournalID, e.Kind, e.AccountID, systemAccount, e.Direction, e.Amount, e.Currency, e.CreatedAt).Scan(&e.ID)
+		if err != nil {
+			return fmt.Errorf("could not record %s journal %d: %w", j.Kind, journalID, err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error {
+	return insertScheduledTransfer(ctx, s.db, st)
+}
+
+// insertScheduledTransfer runs on the pool or, for standing order runs,
+// inside the transaction that advances the order.
+func insertScheduledTransfer(ctx context.Context, db interface {
+	QueryRow(context.Context, string, ...any) pgx.Row
+}, st *ScheduledTransfer) error {
+	query := `INSERT INTO scheduled_transfers (account_id, to_account_id, amount, execute_at, status, standing_order_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	err := db.QueryRow(ctx, query, st.AccountID, st.ToAccountID, st.Amount, st.ExecuteAt, st.Status, st.StandingOrderID, st.CreatedAt, st.UpdatedAt).Scan(&st.ID)
+	if err != nil {
+		return fmt.Errorf("could not schedule transfer for account with id %d: %v", st.AccountID, err)
+	}
+	return nil
+}
+
+// scheduledTransferColumns lists the columns scanScheduledTransfer reads, in
+// order.
+const scheduledTransferColumns = "id, account_id, to_account_id, amount, execute_at, status, transaction_id, failure_reason, standing_order_id, created_at, updated_at"
+
+func scanScheduledTransfer(row interface{ Scan(...any) error }) (*ScheduledTransfer, error) {
+	st := new(ScheduledTransfer)
+	err := row.Scan(&st.ID, &st.AccountID, &st.ToAccountID, &st.Amount, &st.ExecuteAt, &st.Status, &st.TransactionID, &st.FailureReason, &st.StandingOrderID, &st.CreatedAt, &st.UpdatedAt)
+	return st, err
+}
+
+func scanScheduledTransfers(rows pgx.Rows) ([]*ScheduledTransfer, error) {
+	defer rows.Close()
+	transfers := []*ScheduledTransfer{}
+	for rows.Next() {
+		st, err := scanScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, st)
+	}
+	return transfers, rows.Err()
+}
+
+// GetScheduledTransfers returns the transfers an account has scheduled,
+// newest first.
+func (s *PostgresStore) GetScheduledTransfers(ctx context.Context, accountID, limit, offset int) ([]*ScheduledTransfer, error) {
+	query := "SELECT " + scheduledTransferColumns + " FROM scheduled_transfers WHERE account_id=$1 ORDER BY id DESC LIMIT $2 OFFSET $3"
+	rows, err := s.db.Query(ctx, query, accountID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("could not get scheduled transfers for account with id %d: %v", accountID, err)
+	}
+	transfers, err := scanScheduledTransfers(rows)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse scheduled transfers for account with id %d: %v", accountID, err)
+	}
+	return transfers, nil
+}
+
+// CancelScheduledTransfer cancels the account's scheduled transfer with id
+// if the worker has not picked it up yet.
+func (s *PostgresStore) CancelScheduledTransfer(ctx context.Context, accountID, id int) (*ScheduledTransfer, error) {
+	query := "UPDATE scheduled_transfers SET status=$1, updated_at=$2 WHERE id=$3 AND account_id=$4 AND status=$5 RETURNING " + scheduledTransferColumns
+	st, err := scanScheduledTransfer(s.db.QueryRow(ctx, query, ScheduledTransferCancelled, time.Now().UTC(), id, accountID, ScheduledTransferPending))
+	if errors.Is(err, pgx.ErrNoRows) {
+		var status string
+		err = s.db.QueryRow(ctx, "SELECT status FROM scheduled_transfers WHERE id=$1 AND account_id=$2", id, accountID).Scan(&status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: id %d", ErrScheduledTransferNotFound, id)
+		}
+		if err == nil {
+			return nil, fmt.Errorf("%w: scheduled transfer %d is %s", ErrScheduledTransferNotPending, id, status)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not cancel scheduled transfer with id %d: %v", id, err)
+	}
+	return st, nil
+}
+
+// ClaimDueScheduledTransfers marks up to limit pending transfers due by now
+// as processing and returns them, oldest due first. Rows claimed by another
+// instance are skipped rather than waited for.
+func (s *PostgresStore) ClaimDueScheduledTransfers(ctx context.Context, now time.Time, limit int) ([]*ScheduledTransfer, error) {
+	query := `UPDATE scheduled_transfers SET status=$1, updated_at=$2 WHERE id IN (
+			SELECT id FROM scheduled_transfers WHERE status=$3 AND execute_at <= $2
+			ORDER BY execute_at LIMIT $4 FOR UPDATE SKIP LOCKED
+		) RETURNING ` + scheduledTransferColumns
+	rows, err := s.db.Query(ctx, query, ScheduledTransferProcessing, now, ScheduledTransferPending, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not claim scheduled transfers: %v", err)
+	}
+	transfers, err := scanScheduledTransfers(rows)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse claimed scheduled transfers: %v", err)
+	}
+	return transfers, nil
+}
+
+// FinishScheduledTransfer records the outcome of a claimed transfer: its
+// status, transaction and failure reason.
+func (s *PostgresStore) FinishScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error {
+	if err := checkScheduledTransferOutcome(st); err != nil {
+		return err
+	}
+	st.UpdatedAt = time.Now().UTC()
+	query := "UPDATE scheduled_transfers SET status=$1, transaction_id=$2, failure_reason=$3, updated_at=$4 WHERE id=$5 AND status=$6"
+	_, err := s.db.Exec(ctx, query, st.Status, st.TransactionID, st.FailureReason, st.UpdatedAt, st.ID, ScheduledTransferProcessing)
+	if err != nil {
+		return fmt.Errorf("could not update scheduled transfer with id %d: %v", st.ID, err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateStandingOrder(ctx context.Context, o *StandingOrder) error {
+	query := `INSERT INTO standing_orders (account_id, to_account_id, amount, frequency, start_at, next_run_at, end_at, max_runs, runs, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`
+	err := s.db.QueryRow(ctx, query, o.AccountID, o.ToAccountID, o.Amount, o.Frequency, o.StartAt, o.NextRunAt, o.EndAt, o.MaxRuns, o.Runs, o.Status, o.CreatedAt, o.UpdatedAt).Scan(&o.ID)
+	if err != nil {
+		return fmt.Errorf("could not create standing order for account with id %d: %v", o.AccountID, err)
+	}
+	return nil
+}
+
+// standingOrderColumns lists the columns scanStandingOrder reads, in order.
+const standingOrderColumns = "id, account_id, to_account_id, amount, frequency, start_at, next_run_at, end_at, max_runs, runs, status, created_at, updated_at"
+
+func scanStandingOrder(row interface{ Scan(...any) error }) (*StandingOrder, error) {
+	o := new(StandingOrder)
+	err := row.Scan(&o.ID, &o.AccountID, &o.ToAccountID, &o.Amount, &o.Frequency, &o.StartAt, &o.NextRunAt, &o.EndAt, &o.MaxRuns, &o.Runs, &o.Status, &o.CreatedAt, &o.UpdatedAt)
+	return o, err
+}
+
+// updateStandingOrderInTx writes back the fields the scheduler and status
+// changes move.
+func updateStandingOrderInTx(ctx context.Context, tx pgx.Tx, o *StandingOrder) error {
+	query := "UPDATE standing_orders SET next_run_at=$1, runs=$2, status=$3, updated_at=$4 WHERE id=$5"
+	if _, err := tx.Exec(ctx, query, o.NextRunAt, o.Runs, o.Status, o.UpdatedAt, o.ID); err != nil {
+		return fmt.Errorf("could not update standing order with id %d: %v", o.ID, err)
+	}
+	return nil
+}
+
+// GetStandingOrders returns an account's standing orders, newest first.
+func (s *PostgresStore) GetStandingOrders(ctx context.Context, accountID, limit, offset int) ([]*StandingOrder, error) {
+	query := "SELECT " + standingOrderColumns + " FROM standing_orders WHERE account_id=$1 ORDER BY id DESC LIMIT $2 OFFSET $3"
+	rows, err := s.db.Query(ctx, query, accountID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("could not get standing orders for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+
+	orders := []*StandingOrder{}
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse standing orders for account with id %d: %v", accountID, err)
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// SetStandingOrderStatus pauses, resumes or cancels the account's standing
+// order with id.
+func (s *PostgresStore) SetStandingOrderStatus(ctx context.Context, accountID, id int, status string, now time.Time) (*StandingOrder, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start standing order update: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := "SELECT " + standingOrderColumns + " FROM standing_orders WHERE id=$1 AND account_id=$2 FOR UPDATE"
+	o, err := scanStandingOrder(tx.QueryRow(ctx, query, id, accountID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: id %d", ErrStandingOrderNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get standing order with id %d: %v", id, err)
+	}
+	if err := o.transition(status, now); err != nil {
+		return nil, err
+	}
+	if err := updateStandingOrderInTx(ctx, tx, o); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit standing order update: %v", err)
+	}
+	return o, nil
+}
+
+// QueueDueStandingOrders queues the next run of up to limit active orders
+// due by now as scheduled transfers, advancing each order in the same
+// transaction so a run is queued exactly once. It returns how many were
+// queued. Orders locked by another instance are skipped.
+func (s *PostgresStore) QueueDueStandingOrders(ctx context.Context, now time.Time, limit int) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not start queueing standing orders: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := "SELECT " + standingOrderColumns + " FROM standing_orders WHERE status=$1 AND next_run_at <= $2 ORDER BY next_run_at LIMIT $3 FOR UPDATE SKIP LOCKED"
+	rows, err := tx.Query(ctx, query, StandingOrderActive, now, limit)
+	if err != nil {
+		return 0, fmt.Errorf("could not find due standing orders: %v", err)
+	}
+	var due []*StandingOrder
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("could not parse due standing orders: %v", err)
+		}
+		due = append(due, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not find due standing orders: %v", err)
+	}
+
+	for _, o := range due {
+		if err := insertScheduledTransfer(ctx, tx, o.queueRun(now)); err != nil {
+			return 0, err
+		}
+		if err := updateStandingOrderInTx(ctx, tx, o); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("could not commit queued standing orders: %v", err)
+	}
+	return len(due), nil
+}
+
+// CreateHold reserves h.Amount of the account's available balance and
+// stores h.
+func (s *PostgresStore) CreateHold(ctx context.Context, h *Hold) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start hold: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	acc := new(Account)
+	query := "SELECT id, balance, held, status, overdraft_limit FROM account WHERE id=$1 AND deleted_at IS NULL FOR UPDATE"
+	err = tx.QueryRow(ctx, query, h.AccountID).Scan(&acc.ID, &acc.Balance, &acc.Held, &acc.Status, &acc.OverdraftLimit)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, h.AccountID)
+	}
+	if err != nil {
+		return fmt.Errorf("could not lock account with id %d for hold: %v", h.AccountID, err)
+	}
+	if err := checkHold(acc, h.Amount); err != nil {
+		return err
+	}
+	query = "UPDATE account SET held=held+$1, updated_at=$2, version=version+1 WHERE id=$3"
+	if _, err := tx.Exec(ctx, query, h.Amount, h.CreatedAt, h.AccountID); err != nil {
+		return fmt.Errorf("could not reserve funds of account with id %d: %v", h.AccountID, err)
+	}
+	query = `INSERT INTO holds (account_id, to_account_id, amount, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	if err := tx.QueryRow(ctx, query, h.AccountID, h.ToAccountID, h.Amount, h.Status, h.CreatedAt, h.UpdatedAt).Scan(&h.ID); err != nil {
+		return fmt.Errorf("could not create hold for account with id %d: %v", h.AccountID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit hold: %v", err)
+	}
+	return nil
+}
+
+// holdColumns lists the columns scanHold reads, in order.
+const holdColumns = "id, account_id, to_account_id, amount, status, transaction_id, created_at, updated_at"
+
+func scanHold(row interface{ Scan(...any) error }) (*Hold, error) {
+	h := new(Hold)
+	err := row.Scan(&h.ID, &h.AccountID, &h.ToAccountID, &h.Amount, &h.Status, &h.TransactionID, &h.CreatedAt, &h.UpdatedAt)
+	return h, err
+}
+
+// GetHolds returns the holds placed on an account, newest first.
+func (s *PostgresStore) GetHolds(ctx context.Context, accountID, limit, offset int) ([]*Hold, error) {
+	query := "SELECT " + holdColumns + " FROM holds WHERE account_id=$1 ORDER BY id DESC LIMIT $2 OFFSET $3"
+	rows, err := s.db.Query(ctx, query, accountID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("could not get holds for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+	holds := []*Hold{}
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse holds for account with id %d: %v", accountID, err)
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// lockHold reads the account's hold with id, locking it until tx ends.
+func lockHold(ctx context.Context, tx pgx.Tx, accountID, id int) (*Hold, error) {
+	query := "SELECT " + holdColumns + " FROM holds WHERE id=$1 AND account_id=$2 FOR UPDATE"
+	h, err := scanHold(tx.QueryRow(ctx, query, id, accountID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: id %d", ErrHoldNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get hold with id %d: %v", id, err)
+	}
+	return h, nil
+}
+
+func updateHoldInTx(ctx context.Context, tx pgx.Tx, h *Hold) error {
+	query := "UPDATE holds SET status=$1, transaction_id=$2, updated_at=$3 WHERE id=$4"
+	if _, err := tx.Exec(ctx, query, h.Status, h.TransactionID, h.UpdatedAt, h.ID); err != nil {
+		return fmt.Errorf("could not update hold with id %d: %v", h.ID, err)
+	}
+	return nil
+}
+
+// CaptureHold makes the transfer the account's active hold with id reserved
+// money for, in the same database transaction that marks it captured.
+// Deadlocks and serialization failures are retried with backoff.
+func (s *PostgresStore) CaptureHold(ctx context.Context, accountID, id int) (*Hold, error) {
+	var h *Hold
+	err := s.retry.do(func() error {
+		var err error
+		h, err = s.captureHold(ctx, accountID, id)
+		return err
+	})
+	return h, err
+}
+
+func (s *PostgresStore) captureHold(ctx context.Context, accountID, id int) (*Hold, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start capture: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	h, err := lockHold(ctx, tx, accountID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.resolve(HoldCaptured, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	debit, err := s.transferInTx(ctx, tx, h.AccountID, h.ToAccountID, h.Amount, h.Amount)
+	if err != nil {
+		return nil, err
+	}
+	h.TransactionID = &debit.ID
+	if err := updateHoldInTx(ctx, tx, h); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit capture: %w", err)
+	}
+	return h, nil
+}
+
+// ReleaseHold frees the money the account's active hold with id reserved.
+func (s *PostgresStore) ReleaseHold(ctx context.Context, accountID, id int) (*Hold, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start release: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	h, err := lockHold(ctx, tx, accountID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.resolve(HoldReleased, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	query := "UPDATE account SET held=held-$1, updated_at=$2, version=version+1 WHERE id=$3"
+	if _, err := tx.Exec(ctx, query, h.Amount, h.UpdatedAt, h.AccountID); err != nil {
+		return nil, fmt.Errorf("could not release funds of account with id %d: %v", h.AccountID, err)
+	}
+	if err := updateHoldInTx(ctx, tx, h); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("could not commit release: %v", err)
+	}
+	return h, nil
+}
+
+// GetLedgerEntries returns the ledger entries posted to an account, newest
+// first.
+func (s *PostgresStore) GetLedgerEntries(ctx context.Context, accountID, limit, offset int) ([]*LedgerEntry, error) {
+	query := "SELECT id, journal_id, kind, account_id, direction, amount, currency, created_at FROM ledger_entries WHERE account_id=$1 ORDER BY id DESC LIMIT $2 OFFSET $3"
+	rows, err := s.db.Query(ctx, query, accountID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("could not get ledger entries for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+
+	entries := []*LedgerEntry{}
+	for rows.Next() {
+		e := new(LedgerEntry)
+		if err := rows.Scan(&e.ID, &e.JournalID, &e.Kind, &e.AccountID, &e.Direction, &e.Amount, &e.Currency, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not parse ledger entries for account with id %d: %v", accountID, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) UpdatePassword(ctx context.Context, id int, hash string) error {
+	query := "UPDATE account SET encrypted_password=$1, updated_at=$2, version=version+1 WHERE id=$3 AND deleted_at IS NULL"
+	result, err := s.db.Exec(ctx, query, hash, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("could not update password for account with id %d: %v", id, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	return nil
+}
+
+// SetAccountStatus freezes or unfreezes an account.
+func (s *PostgresStore) SetAccountStatus(ctx context.Context, id int, status string) error {
+	query := "UPDATE account SET status=$1, updated_at=$2, version=version+1 WHERE id=$3 AND deleted_at IS NULL"
+	result, err := s.db.Exec(ctx, query, status, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("could not set status of account with id %d: %v", id, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetOverdraftLimit(ctx context.Context, id int, limit int64) error {
+	query := "UPDATE account SET overdraft_limit=$1, updated_at=$2, version=version+1 WHERE id=$3 AND deleted_at IS NULL"
+	result, err := s.db.Exec(ctx, query, limit, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("could not set overdraft limit of account with id %d: %v", id, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetTransferLimits(ctx context.Context, id int, daily, perTransfer *int64) error {
+	query := "UPDATE account SET daily_transfer_limit=$1, per_transfer_limit=$2, updated_at=$3, version=version+1 WHERE id=$4 AND deleted_at IS NULL"
+	result, err := s.db.Exec(ctx, query, daily, perTransfer, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("could not set transfer limits of account with id %d: %v", id, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	return nil
+}
+
+// SetTOTPSecret enrolls the account in two-factor authentication with
+// secret, pending EnableTOTP, or clears it when secret is empty. Either way
+// two-factor authentication is off and the backup codes are dropped.
+func (s *PostgresStore) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not set totp secret of account with id %d: %v", id, err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := "UPDATE account SET totp_secret=$1, totp_enabled=false, updated_at=$2, version=version+1 WHERE id=$3 AND deleted_at IS NULL"
+	result, err := tx.Exec(ctx, query, secret, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("could not set totp secret of account with id %d: %v", id, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM totp_backup_codes WHERE account_id=$1", id); err != nil {
+		return fmt.Errorf("could not drop backup codes of account with id %d: %v", id, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not set totp secret of account with id %d: %v", id, err)
+	}
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication for an account with an
+// enrolled secret and stores the hashes of its backup codes.
+func (s *PostgresStore) EnableTOTP(ctx context.Context, id int, backupCodeHashes []string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not enable two-factor authentication for account with id %d: %v", id, err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := "UPDATE account SET totp_enabled=true, updated_at=$1, version=version+1 WHERE id=$2 AND totp_secret <> '' AND deleted_at IS NULL"
+	result, err := tx.Exec(ctx, query, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("could not enable two-factor authentication for account with id %d: %v", id, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM totp_backup_codes WHERE account_id=$1", id); err != nil {
+		return fmt.Errorf("could not replace backup codes of account with id %d: %v", id, err)
+	}
+	for _, hash := range backupCodeHashes {
+		if _, err := tx.Exec(ctx, "INSERT INTO totp_backup_codes (account_id, code_hash) VALUES ($1, $2)", id, hash); err != nil {
+			return fmt.Errorf("could not store backup code of account with id %d: %v", id, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not enable two-factor authentication for account with id %d: %v", id, err)
+	}
+	return nil
+}
+
+// UseBackupCode marks an unused backup code of the account used, or returns
+// ErrBackupCodeInvalid.
+func (s *PostgresStore) UseBackupCode(ctx context.Context, accountID int, codeHash string, now time.Time) error {
+	query := "UPDATE totp_backup_codes SET used_at=$1 WHERE account_id=$2 AND code_hash=$3 AND used_at IS NULL"
+	result, err := s.db.Exec(ctx, query, now, accountID, codeHash)
+	if err != nil {
+		return fmt.Errorf("could not use backup code of account with id %d: %v", accountID, err)
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return ErrBackupCodeInvalid
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateVerificationToken(ctx context.Context, accountID int, tokenHash string, expiresAt time.Time) error {
+	query := "INSERT INTO email_verification_tokens (token_hash, account_id, expires_at) VALUES ($1, $2, $3)"
+	if _, err := s.db.Exec(ctx, query, tokenHash, accountID, expiresAt); err != nil {
+		return fmt.Errorf("could not store verification token for account with id %d: %v", accountID, err)
+	}
+	return nil
+}
+
+// ConsumeVerificationToken deletes an unexpired token and marks its account's
+// email verified, returning the account id.
+func (s *PostgresStore) ConsumeVerificationToken(ctx context.Context, tokenHash string) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not start email verification: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var accountID int
+	query := "DELETE FROM email_verification_tokens WHERE token_hash=$1 AND expires_at > $2 RETURNING account_id"
+	err = tx.QueryRow(ctx, query, tokenHash, time.Now().UTC()).Scan(&accountID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not consume verification token: %v", err)
+	}
+	query = "UPDATE account SET email_verified=true, updated_at=$1, version=version+1 WHERE id=$2 AND deleted_at IS NULL"
+	result, err := tx.Exec(ctx, query, time.Now().UTC(), accountID)
+	if err != nil {
+		return 0, fmt.Errorf("could not verify email of account with id %d: %v", accountID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return 0, ErrVerificationTokenInvalid
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("could not commit email verification: %v", err)
+	}
+	return accountID, nil
+}
+
+func (s *PostgresStore) CreatePasswordResetToken(ctx context.Context, accountID int, tokenHash string, expiresAt time.Time) error {
+	query := "INSERT INTO password_reset_tokens (token_hash, account_id, expires_at) VALUES ($1, $2, $3)"
+	if _, err := s.db.Exec(ctx, query, tokenHash, accountID, expiresAt); err != nil {
+		return fmt.Errorf("could not store password reset token for account with id %d: %v", accountID, err)
+	}
+	return nil
+}
+
+// ResetPassword consumes an unexpired reset token, sets its account's
+// password hash and revokes the account's refresh tokens, returning the
+// account id. Every other reset token of the account is dropped as well.
+func (s *PostgresStore) ResetPassword(ctx context.Context, tokenHash, hash string, now time.Time) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not start password reset: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var accountID int
+	query := "DELETE FROM password_reset_tokens WHERE token_hash=$1 AND expires_at > $2 RETURNING account_id"
+	err = tx.QueryRow(ctx, query, tokenHash, now).Scan(&accountID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrPasswordResetTokenInvalid
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not consume password reset token: %v", err)
+	}
+	query = "UPDATE account SET encrypted_password=$1, updated_at=$2, version=version+1 WHERE id=$3 AND deleted_at IS NULL"
+	result, err := tx.Exec(ctx, query, hash, now, accountID)
+	if err != nil {
+		return 0, fmt.Errorf("could not reset password for account with id %d: %v", accountID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return 0, ErrPasswordResetTokenInvalid
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM password_reset_tokens WHERE account_id=$1", accountID); err != nil {
+		return 0, fmt.Errorf("could not reset password for account with id %d: %v", accountID, err)
+	}
+	if err := revokeAccountSessions(ctx, tx, accountID, 0, now); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("could not commit password reset: %v", err)
+	}
+	return accountID, nil
+}
+
+func (s *PostgresStore) CreateRefreshToken(ctx context.Context, t *RefreshToken) error {
+	query := "INSERT INTO refresh_tokens (token_hash, account_id, family_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)"
+	if _, err := s.db.Exec(ctx, query, t.TokenHash, t.AccountID, t.FamilyID, t.ExpiresAt, t.CreatedAt); err != nil {
+		return fmt.Errorf("could not store refresh token for account with id %d: %v", t.AccountID, err)
+	}
+	return nil
+}
+
+// RotateRefreshToken marks the token with tokenHash used and stores next in
+// its place, in the same family and for the same account. Presenting a
+// token that was already rotated revokes its whole family and returns
+// ErrRefreshTokenReused. next.AccountID is set whenever the token is known.
+func (s *PostgresStore) RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start refresh token rotation: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	t := &RefreshToken{TokenHash: tokenHash}
+	query := "SELECT account_id, family_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash=$1 FOR UPDATE"
+	err = tx.QueryRow(ctx, query, tokenHash).Scan(&t.AccountID, &t.FamilyID, &t.ExpiresAt, &t.UsedAt, &t.RevokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("could not get refresh token: %v", err)
+	}
+	next.AccountID, next.FamilyID = t.AccountID, t.FamilyID
+	if err := t.checkRotation(next.CreatedAt); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			if err := revokeRefreshTokenFamily(ctx, tx, t.FamilyID, next.CreatedAt); err != nil {
+				return err
+			}
+			if err := tx.Commit(ctx); err != nil {
+				return fmt.Errorf("could not commit refresh token revocation: %v", err)
+			}
+		}
+		return err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET used_at=$1 WHERE token_hash=$2", next.CreatedAt, tokenHash); err != nil {
+		return fmt.Errorf("could not mark refresh token used: %v", err)
+	}
+	query = "INSERT INTO refresh_tokens (token_hash, account_id, family_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)"
+	if _, err := tx.Exec(ctx, query, next.TokenHash, next.AccountID, next.FamilyID, next.ExpiresAt, next.CreatedAt); err != nil {
+		return fmt.Errorf("could not store refresh token for account with id %d: %v", next.AccountID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit refresh token rotation: %v", err)
+	}
+	return nil
+}
+
+// RevokeRefreshTokenFamily revokes the token with tokenHash and every other
+// token of its family, along with the family's session. Unknown tokens are
+// ignored.
+func (s *PostgresStore) RevokeRefreshTokenFamily(ctx context.Context, tokenHash string, now time.Time) error {
+	var family string
+	err := s.db.QueryRow(ctx, "SELECT family_id FROM refresh_tokens WHERE token_hash=$1", tokenHash).Scan(&family)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get refresh token: %v", err)
+	}
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start refresh token revocation: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	if err := revokeRefreshTokenFamily(ctx, tx, family, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit refresh token revocation: %v", err)
+	}
+	return nil
+}
+
+// revokeRefreshTokenFamily revokes every token of family not revoked yet and
+// the family's session.
+func revokeRefreshTokenFamily(ctx context.Context, tx pgx.Tx, family string, now time.Time) error {
+	if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET revoked_at=$1 WHERE family_id=$2 AND revoked_at IS NULL", now, family); err != nil {
+		return fmt.Errorf("could not revoke refresh token family: %v", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE sessions SET revoked_at=$1 WHERE family_id=$2 AND revoked_at IS NULL", now, family); err != nil {
+		return fmt.Errorf("could not revoke session: %v", err)
+	}
+	return nil
+}
+
+// revokeAccountSessions revokes every refresh token and session of an
+// account that is not revoked yet, except the session keep and its refresh
+// tokens. A keep of 0 spares none.
+func revokeAccountSessions(ctx context.Context, tx pgx.Tx, accountID, keep int, now time.Time) error {
+	query := `UPDATE refresh_tokens SET revoked_at=$1 WHERE account_id=$2 AND revoked_at IS NULL
+		AND family_id NOT IN (SELECT family_id FROM sessions WHERE id=$3)`
+	if _, err := tx.Exec(ctx, query, now, accountID, keep); err != nil {
+		return fmt.Errorf("could not revoke refresh tokens of account with id %d: %v", accountID, err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE sessions SET revoked_at=$1 WHERE account_id=$2 AND id<>$3 AND revoked_at IS NULL", now, accountID, keep); err != nil {
+		return fmt.Errorf("could not revoke sessions of account with id %d: %v", accountID, err)
+	}
+	return nil
+}
+
+// UpsertSession stores sess, or updates the user agent, IP, last use and
+// expiry of the session of sess.FamilyID, and sets sess.ID and
+// sess.CreatedAt.
+func (s *PostgresStore) UpsertSession(ctx context.Context, sess *Session) error {
+	query := `INSERT INTO sessions (account_id, family_id, user_agent, ip, created_at, last_used_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (family_id) DO UPDATE SET
+			user_agent = EXCLUDED.user_agent,
+			ip = EXCLUDED.ip,
+			last_used_at = EXCLUDED.last_used_at,
+			expires_at = EXCLUDED.expires_at
+		RETURNING id, created_at`
+	err := s.db.QueryRow(ctx, query, sess.AccountID, sess.FamilyID, sess.UserAgent, sess.IP, sess.CreatedAt, sess.LastUsedAt, sess.ExpiresAt).Scan(&sess.ID, &sess.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("could not store session for account with id %d: %v", sess.AccountID, err)
+	}
+	return nil
+}
+
+// GetSessions returns the sessions of an account that are neither revoked
+// nor expired at now, most recently used first.
+func (s *PostgresStore) GetSessions(ctx context.Context, accountID int, now time.Time) ([]*Session, error) {
+	query := `SELECT id, account_id, family_id, user_agent, ip, created_at, last_used_at, expires_at, revoked_at FROM sessions
+		WHERE account_id=$1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY last_used_at DESC, id DESC`
+	rows, err := s.db.Query(ctx, query, accountID, now)
+	if err != nil {
+		return nil, fmt.Errorf("could not get sessions for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		sess := new(Session)
+		err := rows.Scan(&sess.ID, &sess.AccountID, &sess.FamilyID, &sess.UserAgent, &sess.IP, &sess.CreatedAt, &sess.LastUsedAt, &sess.ExpiresAt, &sess.RevokedAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse sessions for account with id %d: %v", accountID, err)
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes an active session of the account along with its
+// refresh token family.
+func (s *PostgresStore) RevokeSession(ctx context.Context, accountID, id int, now time.Time) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start session revocation: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var family string
+	query := "SELECT family_id FROM sessions WHERE id=$1 AND account_id=$2 AND revoked_at IS NULL FOR UPDATE"
+	err = tx.QueryRow(ctx, query, id, accountID).Scan(&family)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: id %d", ErrSessionNotFound, id)
+	}
+	if err != nil {
+		return fmt.Errorf("could not get session with id %d: %v", id, err)
+	}
+	if err := revokeRefreshTokenFamily(ctx, tx, family, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit session revocation: %v", err)
+	}
+	return nil
+}
+
+// RevokeOtherSessions logs an account out of every session but keep, which
+// may be 0 to log it out everywhere.
+func (s *PostgresStore) RevokeOtherSessions(ctx context.Context, accountID, keep int, now time.Time) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start revoking sessions: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := revokeAccountSessions(ctx, tx, accountID, keep, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit revoking sessions: %v", err)
+	}
+	return nil
+}
+
+// IsSessionRevoked reports whether the session with id was revoked. Sessions
+// that are not stored, e.g. purged after expiring, are not.
+func (s *PostgresStore) IsSessionRevoked(ctx context.Context, id int) (bool, error) {
+	var revoked bool
+	if err := s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM sessions WHERE id=$1 AND revoked_at IS NOT NULL)", id).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("could not check session revocation: %v", err)
+	}
+	return revoked, nil
+}
+
+// RevokeAccessToken denylists the access token with jti until it expires.
+func (s *PostgresStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	query := "INSERT INTO revoked_access_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING"
+	if _, err := s.db.Exec(ctx, query, jti, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("could not revoke access token: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	if err := s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti=$1)", jti).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("could not check access token revocation: %v", err)
+	}
+	return revoked, nil
+}
+
+// RecordLoginFailure counts a failed login for key, starting over when the
+// last failure is more than lockout ago. The threshold-th failure locks key
+// for lockout and returns when the lock ends; otherwise it returns the zero
+// time.
+func (s *PostgresStore) RecordLoginFailure(ctx context.Context, key string, threshold int, lockout time.Duration, now time.Time) (time.Time, error) {
+	expiresAt := now.Add(lockout).UTC()
+	query := `INSERT INTO login_failures (key, failures, expires_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.expires_at <= $3 THEN 1 ELSE login_failures.failures + 1 END,
+			expires_at = EXCLUDED.expires_at
+		RETURNING failures`
+	var failures int
+	if err := s.db.QueryRow(ctx, query, key, expiresAt, now.UTC()).Scan(&failures); err != nil {
+		return time.Time{}, fmt.Errorf("could not record login failure: %v", err)
+	}
+	if failures < threshold {
+		return time.Time{}, nil
+	}
+	if _, err := s.db.Exec(ctx, "UPDATE login_failures SET failures=0, locked_until=$2 WHERE key=$1", key, expiresAt); err != nil {
+		return time.Time{}, fmt.Errorf("could not lock login: %v", err)
+	}
+	return expiresAt, nil
+}
+
+// LoginLockedUntil returns when the lock on key ends, or the zero time when
+// it is not locked.
+func (s *PostgresStore) LoginLockedUntil(ctx context.Context, key string, now time.Time) (time.Time, error) {
+	var lockedUntil time.Time
+	err := s.db.QueryRow(ctx, "SELECT locked_until FROM login_failures WHERE key=$1 AND locked_until > $2", key, now.UTC()).Scan(&lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not check login lock: %v", err)
+	}
+	return lockedUntil, nil
+}
+
+// ClearLoginFailures forgets the failures counted for key and lifts its lock.
+func (s *PostgresStore) ClearLoginFailures(ctx context.Context, key string) error {
+	if _, err := s.db.Exec(ctx, "DELETE FROM login_failures WHERE key=$1", key); err != nil {
+		return fmt.Errorf("could not clear login failures: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateLoginAttempt(ctx context.Context, a *LoginAttempt) error {
+	query := "INSERT INTO login_attempts (account_id, ip, user_agent, result, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+	err := s.db.QueryRow(ctx, query, a.AccountID, a.IP, a.UserAgent, a.Result, a.CreatedAt).Scan(&a.ID)
+	if err != nil {
+		return fmt.Errorf("could not record login for account with id %d: %v", a.AccountID, err)
+	}
+	return nil
+}
+
+// GetLoginAttempts returns a page of an account's login attempts, newest
+// first.
+func (s *PostgresStore) GetLoginAttempts(ctx context.Context, accountID, limit, offset int) ([]*LoginAttempt, error) {
+	query := "SELECT id, account_id, ip, user_agent, result, created_at FROM login_attempts WHERE account_id=$1 ORDER BY id DESC LIMIT $2 OFFSET $3"
+	rows, err := s.db.Query(ctx, query, accountID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("could not get logins for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+
+	logins := []*LoginAttempt{}
+	for rows.Next() {
+		a := new(LoginAttempt)
+		if err := rows.Scan(&a.ID, &a.AccountID, &a.IP, &a.UserAgent, &a.Result, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not parse logins for account with id %d: %v", accountID, err)
+		}
+		logins = append(logins, a)
+	}
+	return logins, rows.Err()
+}
+
+// GetLoginIPs returns the IPs an account has successfully logged in from.
+func (s *PostgresStore) GetLoginIPs(ctx context.Context, accountID int) ([]string, error) {
+	rows, err := s.db.Query(ctx, "SELECT DISTINCT ip FROM login_attempts WHERE account_id=$1 AND result=$2", accountID, LoginResultSuccess)
+	if err != nil {
+		return nil, fmt.Errorf("could not get login IPs for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, fmt.Errorf("could not parse login IPs for account with id %d: %v", accountID, err)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, rows.Err()
+}
+
+func (s *PostgresStore) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	query := "INSERT INTO api_keys (account_id, name, prefix, scopes, key_hash, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id"
+	err := s.db.QueryRow(ctx, query, k.AccountID, k.Name, k.Prefix, k.Scopes, k.KeyHash, k.CreatedAt).Scan(&k.ID)
+	if err != nil {
+		return fmt.Errorf("could not store api key for account with id %d: %v", k.AccountID, err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error) {
+	query := "SELECT id, account_id, name, prefix, scopes, key_hash, created_at, revoked_at FROM api_keys WHERE account_id=$1 ORDER BY id"
+	rows, err := s.db.Query(ctx, query, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get api keys for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanIntoAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse api keys for account with id %d: %v", accountID, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByHash returns the unrevoked key with the given hash.
+func (s *PostgresStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	query := "SELECT id, account_id, name, prefix, scopes, key_hash, created_at, revoked_at FROM api_keys WHERE key_hash=$1 AND revoked_at IS NULL"
+	k, err := scanIntoAPIKey(s.db.QueryRow(ctx, query, keyHash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get api key: %v", err)
+	}
+	return k, nil
+}
+
+func (s *PostgresStore) RevokeAPIKey(ctx context.Context, accountID, id int, now time.Time) error {
+	result, err := s.db.Exec(ctx, "UPDATE api_keys SET revoked_at=$1 WHERE id=$2 AND account_id=$3 AND revoked_at IS NULL", now, id, accountID)
+	if err != nil {
+		return fmt.Errorf("could not revoke api key with id %d: %v", id, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: id %d", ErrAPIKeyNotFound, id)
+	}
+	return nil
+}
+
+func scanIntoAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	k := new(APIKey)
+	err := row.Scan(&k.ID, &k.AccountID, &k.Name, &k.Prefix, &k.Scopes, &k.KeyHash, &k.CreatedAt, &k.RevokedAt)
+	return k, err
+}
+
+func (s *PostgresStore) CreatePasskey(ctx context.Context, p *Passkey) error {
+	credential, err := json.Marshal(p.Credential)
+	if err != nil {
+		return fmt.Errorf("could not encode passkey for account with id %d: %v", p.AccountID, err)
+	}
+	query := "INSERT INTO passkeys (account_id, credential_id, credential, created_at) VALUES ($1, $2, $3, $4) RETURNING id"
+	err = s.db.QueryRow(ctx, query, p.AccountID, p.Credential.ID, credential, p.CreatedAt).Scan(&p.ID)
+	if isUniqueViolation(err, "passkeys_credential_id_key") {
+		return ErrPasskeyExists
+	}
+	if err != nil {
+		return fmt.Errorf("could not store passkey for account with id %d: %v", p.AccountID, err)
+	}
+	return nil
+}
+
+// GetPasskeys returns the passkeys registered to an account, oldest first.
+func (s *PostgresStore) GetPasskeys(ctx context.Context, accountID int) ([]*Passkey, error) {
+	query := "SELECT id, account_id, credential, created_at, last_used_at FROM passkeys WHERE account_id=$1 ORDER BY id"
+	rows, err := s.db.Query(ctx, query, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get passkeys for account with id %d: %v", accountID, err)
+	}
+	defer rows.Close()
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		p := new(Passkey)
+		var credential []byte
+		if err := rows.Scan(&p.ID, &p.AccountID, &credential, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("could not parse passkeys for account with id %d: %v", accountID, err)
+		}
+		if err := json.Unmarshal(credential, &p.Credential); err != nil {
+			return nil, fmt.Errorf("could not decode passkey with id %d: %v", p.ID, err)
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+// UpdatePasskey stores the credential of a passkey after a login, which
+// carries its new signature counter, and when it was last used.
+func (s *PostgresStore) UpdatePasskey(ctx context.Context, p *Passkey) error {
+	credential, err := json.Marshal(p.Credential)
+	if err != nil {
+		return fmt.Errorf("could not encode passkey with id %d: %v", p.ID, err)
+	}
+	query := "UPDATE passkeys SET credential=$1, last_used_at=$2 WHERE id=$3 AND account_id=$4"
+	result, err := s.db.Exec(ctx, query, credential, p.LastUsedAt, p.ID, p.AccountID)
+	if err != nil {
+		return fmt.Errorf("could not update passkey with id %d: %v", p.ID, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: id %d", ErrPasskeyNotFound, p.ID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeletePasskey(ctx context.Context, accountID, id int) error {
+	result, err := s.db.Exec(ctx, "DELETE FROM passkeys WHERE id=$1 AND account_id=$2", id, accountID)
+	if err != nil {
+		return fmt.Errorf("could not delete passkey with id %d: %v", id, err)
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("%w: id %d", ErrPasskeyNotFound, id)
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreatePasskeySession(ctx context.Context, session *PasskeySession) error {
+	data, err := json.Marshal(session.Data)
+	if err != nil {
+		return fmt.Errorf("could not encode passkey session for account with id %d: %v", session.AccountID, err)
+	}
+	query := "INSERT INTO passkey_sessions (token_hash, account_id, purpose, data, expires_at) VALUES ($1, $2, $3, $4, $5)"
+	if _, err := s.db.Exec(ctx, query, session.TokenHash, session.AccountID, session.Purpose, data, session.ExpiresAt); err != nil {
+		return fmt.Errorf("could not store passkey session for account with id %d: %v", session.AccountID, err)
+	}
+	return nil
+}
+
+// ConsumePasskeySession deletes and returns an unexpired session started
+// for purpose.
+func (s *PostgresStore) ConsumePasskeySession(ctx context.Context, tokenHash, purpose string, now time.Time) (*PasskeySession, error) {
+	session := &PasskeySession{TokenHash: tokenHash, Purpose: purpose}
+	var data []byte
+	query := "DELETE FROM passkey_sessions WHERE token_hash=$1 AND purpose=$2 AND expires_at > $3 RETURNING account_id, data, expires_at"
+	err := s.db.QueryRow(ctx, query, tokenHash, purpose, now).Scan(&session.AccountID, &data, &session.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPasskeySessionInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not consume passkey session: %v", err)
+	}
+	if err := json.Unmarshal(data, &session.Data); err != nil {
+		return nil, fmt.Errorf("could not decode passkey session: %v", err)
+	}
+	return session, nil
+}
+
+// PurgeExpired deletes verification, password reset and refresh tokens and
+// passkey sessions that expired by now,
+// denylist entries of access tokens that have expired anyway, idempotency
+// keys past their TTL and accounts soft deleted more than the
+// retention period ago. It returns how many rows were removed.
+func (s *PostgresStore) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	var purged int64
+	for _, purge := range []struct {
+		query string
+		arg   time.Time
+	}{
+		{"DELETE FROM email_verification_tokens WHERE expires_at <= $1", now},
+		{"DELETE FROM password_reset_tokens WHERE expires_at <= $1", now},
+		{"DELETE FROM refresh_tokens WHERE expires_at <= $1", now},
+		{"DELETE FROM sessions WHERE expires_at <= $1", now},
+		{"DELETE FROM revoked_access_tokens WHERE expires_at <= $1", now},
+		{"DELETE FROM passkey_sessions WHERE expires_at <= $1", now},
+		{"DELETE FROM login_failures WHERE expires_at <= $1", now},
+		{"DELETE FROM idempotency_keys WHERE created_at <= $1", now.Add(-s.idempotencyKeyTTL)},
+		{"DELETE FROM login_attempts WHERE created_at <= $1", now.Add(-s.loginHistoryRetention)},
+	} {
+		result, err := s.db.Exec(ctx, purge.query, purge.arg)
+		if err != nil {
+			return int(purged), fmt.Errorf("could not purge expired rows: %v", err)
+		}
+		n := result.RowsAffected()
+		purged += n
+	}
+
+	rows, err := s.db.Query(ctx, "SELECT id FROM account WHERE deleted_at <= $1", now.Add(-s.deletedAccountRetention))
+	if err != nil {
+		return int(purged), fmt.Errorf("could not find accounts to purge: %v", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return int(purged), fmt.Errorf("could not find accounts to purge: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return int(purged), fmt.Errorf("could not find accounts to purge: %v", err)
+	}
+	for _, id := range ids {
+		if _, err := s.HardDeleteAccount(ctx, id); err != nil && !errors.Is(err, ErrAccountNotFound) {
+			return int(purged), err
+		}
+		purged++
+	}
+	return int(purged), nil
+}
+
+// GetIdempotentResult returns the stored result for an account's key if it is
+// younger than the configured TTL.
+func (s *PostgresStore) GetIdempotentResult(ctx context.Context, accountID int, key string) (*IdempotentResult, error) {
+	result := &IdempotentResult{AccountID: accountID, Key: key}
+	query := "SELECT request_hash, status_code, body, created_at FROM idempotency_keys WHERE account_id=$1 AND key=$2 AND created_at > $3"
+	err := s.db.QueryRow(ctx, query, accountID, key, time.Now().UTC().Add(-s.idempotencyKeyTTL)).Scan(&result.RequestHash, &result.StatusCode, &result.Body, &result.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrIdempotentResultNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get idempotent result for account with id %d: %v", accountID, err)
+	}
+	return result, nil
+}
+
+// StoreIdempotentResult records result, replacing an expired one for the same
+// key.
+func (s *PostgresStore) StoreIdempotentResult(ctx context.Context, result *IdempotentResult) error {
+	query := `INSERT INTO idempotency_keys (account_id, key, request_hash, status_code, body, created_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (account_id, key) DO UPDATE SET request_hash=EXCLUDED.request_hash, status_code=EXCLUDED.status_code, body=EXCLUDED.body, created_at=EXCLUDED.created_at`
+	_, err := s.db.Exec(ctx, query, result.AccountID, result.Key, result.RequestHash, result.StatusCode, result.Body, result.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("could not store idempotent result for account with id %d: %v", result.AccountID, err)
+	}
+	return nil
+}
@@ -0,0 +1,1550 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStorage runs the same behavioural checks against any Storage so the
+// in-memory store stays in step with PostgresStore.
+func testStorage(t *testing.T, newStore func(t *testing.T) Storage) {
+	ctx := context.Background()
+	newTestAccount := func(t *testing.T, email string) *Account {
+		acc, err := NewAccount("first", "last", email, "password123")
+		require.Nil(t, err)
+		return acc
+	}
+
+	t.Run("CreateAssignsIncrementingIDs", func(t *testing.T) {
+		store := newStore(t)
+		first := newTestAccount(t, "first@abc.com")
+		second := newTestAccount(t, "second@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, first))
+		require.Nil(t, store.CreateAccount(ctx, second))
+		assert.Greater(t, first.ID, 0)
+		assert.Greater(t, second.ID, first.ID)
+	})
+
+	t.Run("InTxCommitsOrRollsBack", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		failed := errors.New("failed")
+		err := store.InTx(ctx, func(tx Storage) error {
+			if _, err := tx.Transfer(ctx, from.ID, to.ID, 30); err != nil {
+				return err
+			}
+			require.Nil(t, tx.CreateVerificationToken(ctx, from.ID, hashOpaqueToken("rolled-back"), time.Now().Add(time.Hour)))
+			return failed
+		})
+		assert.ErrorIs(t, err, failed)
+		balance, err := store.GetBalance(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(100), balance.Amount)
+		_, err = store.ConsumeVerificationToken(ctx, hashOpaqueToken("rolled-back"))
+		assert.ErrorIs(t, err, ErrVerificationTokenInvalid)
+
+		err = store.InTx(ctx, func(tx Storage) error {
+			if _, err := tx.Transfer(ctx, from.ID, to.ID, 30); err != nil {
+				return err
+			}
+			return tx.InTx(ctx, func(tx Storage) error {
+				_, err := tx.Transfer(ctx, from.ID, to.ID, 20)
+				return err
+			})
+		})
+		require.Nil(t, err)
+		balance, err = store.GetBalance(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(50), balance.Amount)
+	})
+
+	t.Run("ConcurrentCreateWithSameEmail", func(t *testing.T) {
+		store := newStore(t)
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			acc := newTestAccount(t, "race@abc.com")
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = store.CreateAccount(ctx, acc)
+			}(i)
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range errs {
+			if err == nil {
+				succeeded++
+			} else {
+				assert.True(t, errors.Is(err, ErrAccountExists), err)
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	})
+
+	t.Run("GetAccountByID", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "byid@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		found, err := store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Equal(t, acc.Email, found.Email)
+		assert.Equal(t, acc.EncryptedPassword, found.EncryptedPassword)
+		assert.Equal(t, RoleUser, found.Role)
+
+		found, err = store.GetAccountByID(ctx, acc.ID+1000)
+		assert.True(t, errors.Is(err, ErrAccountNotFound), err)
+		assert.Nil(t, found)
+	})
+
+	t.Run("GetAccountByEmail", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "byemail@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		found, err := store.GetAccountByEmail(ctx, "byemail@abc.com")
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, found.ID)
+
+		found, err = store.GetAccountByEmail(ctx, "missing@abc.com")
+		assert.True(t, errors.Is(err, ErrAccountNotFound), err)
+		assert.Nil(t, found)
+	})
+
+	t.Run("GetBalance", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "balance@abc.com")
+		acc.Balance = 250
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		balance, err := store.GetBalance(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Equal(t, Money{Amount: 250, Currency: DefaultCurrency}, balance.Money)
+
+		_, err = store.GetBalance(ctx, acc.ID+1000)
+		assert.True(t, errors.Is(err, ErrAccountNotFound), err)
+	})
+
+	t.Run("EmailIsCaseInsensitive", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "case@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		found, err := store.GetAccountByEmail(ctx, "Case@ABC.com")
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, found.ID)
+
+		variant := newTestAccount(t, "other@abc.com")
+		variant.Email = "CASE@abc.com"
+		assert.ErrorIs(t, store.CreateAccount(ctx, variant), ErrAccountExists)
+	})
+
+	t.Run("GetAccountByNumber", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "bynumber@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		found, err := store.GetAccountByNumber(ctx, acc.Number)
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, found.ID)
+
+		found, err = store.GetAccountByNumber(ctx, 1)
+		assert.NotNil(t, err)
+		assert.Nil(t, found)
+	})
+
+	t.Run("CreateRetriesAccountNumberCollision", func(t *testing.T) {
+		store := newStore(t)
+		first := newTestAccount(t, "first@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, first))
+
+		second := newTestAccount(t, "second@abc.com")
+		second.Number = first.Number
+		require.Nil(t, store.CreateAccount(ctx, second))
+		assert.NotEqual(t, first.Number, second.Number)
+	})
+
+	t.Run("UpdateAccountMovesUpdatedAt", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "update@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		created, err := store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+
+		time.Sleep(time.Millisecond)
+		created.FirstName = "renamed"
+		created.Phone = 5551234567
+		require.Nil(t, store.UpdateAccount(ctx, created))
+
+		updated, err := store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "renamed", updated.FirstName)
+		assert.Equal(t, int64(5551234567), updated.Phone)
+		assert.True(t, updated.UpdatedAt.After(created.CreatedAt), "updatedAt %v should be after %v", updated.UpdatedAt, created.CreatedAt)
+
+		assert.NotNil(t, store.UpdateAccount(ctx, &Account{ID: acc.ID + 1000}))
+	})
+
+	t.Run("ConcurrentUpdatesConflict", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "conflict@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		var wg sync.WaitGroup
+		errs := make([]error, 5)
+		for i := range errs {
+			stale, err := store.GetAccountByID(ctx, acc.ID)
+			require.Nil(t, err)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				stale.FirstName = fmt.Sprintf("writer %d", i)
+				errs[i] = store.UpdateAccount(ctx, stale)
+			}(i)
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range errs {
+			if err == nil {
+				succeeded++
+			} else {
+				assert.True(t, errors.Is(err, ErrConflict), err)
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+
+		updated, err := store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Equal(t, acc.Version+1, updated.Version)
+	})
+
+	t.Run("TransferWritesLedgerAtomically", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		debit, err := store.Transfer(ctx, from.ID, to.ID, 30)
+		require.Nil(t, err)
+		assert.Equal(t, TransactionTransferDebit, debit.Type)
+
+		_, err = store.Transfer(ctx, from.ID, to.ID, 71)
+		assert.True(t, errors.Is(err, ErrInsufficientFunds), err)
+
+		fromAfter, err := store.GetAccountByID(ctx, from.ID)
+		require.Nil(t, err)
+		toAfter, err := store.GetAccountByID(ctx, to.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(70), fromAfter.Balance)
+		assert.Equal(t, int64(30), toAfter.Balance)
+
+		fromLedger, err := store.GetTransactions(ctx, from.ID, time.Time{}, time.Time{}, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, fromLedger, 1)
+		assert.Equal(t, TransactionTransferDebit, fromLedger[0].Type)
+		assert.Equal(t, int64(30), fromLedger[0].Amount)
+		assert.Equal(t, to.ID, *fromLedger[0].CounterpartyAccountID)
+
+		toLedger, err := store.GetTransactions(ctx, to.ID, time.Time{}, time.Time{}, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, toLedger, 1)
+		assert.Equal(t, TransactionTransferCredit, toLedger[0].Type)
+		assert.Equal(t, from.ID, *toLedger[0].CounterpartyAccountID)
+	})
+
+	t.Run("TransferEnforcesDailyLimit", func(t *testing.T) {
+		store := newStore(t)
+		limit := int64(100)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 1000
+		from.DailyTransferLimit = &limit
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		for _, amount := range []int64{40, 35, 25} {
+			_, err := store.Transfer(ctx, from.ID, to.ID, amount)
+			require.Nil(t, err)
+		}
+
+		_, err := store.Transfer(ctx, from.ID, to.ID, 1)
+		var limitErr *DailyLimitError
+		require.True(t, errors.As(err, &limitErr), err)
+		assert.Equal(t, int64(0), limitErr.Remaining)
+
+		fromAfter, err := store.GetAccountByID(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(900), fromAfter.Balance)
+		assert.Equal(t, limit, *fromAfter.DailyTransferLimit)
+	})
+
+	t.Run("SetTransferLimits", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 1000
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		daily, perTransfer := int64(100), int64(60)
+		require.Nil(t, store.SetTransferLimits(ctx, from.ID, &daily, &perTransfer))
+		fromAfter, err := store.GetAccountByID(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, daily, *fromAfter.DailyTransferLimit)
+		assert.Equal(t, perTransfer, *fromAfter.PerTransferLimit)
+
+		_, err = store.Transfer(ctx, from.ID, to.ID, 61)
+		var perTransferErr *PerTransferLimitError
+		require.True(t, errors.As(err, &perTransferErr), err)
+		assert.Equal(t, perTransfer, perTransferErr.Limit)
+
+		_, err = store.Transfer(ctx, from.ID, to.ID, 60)
+		require.Nil(t, err)
+		_, err = store.Transfer(ctx, from.ID, to.ID, 50)
+		var dailyErr *DailyLimitError
+		require.True(t, errors.As(err, &dailyErr), err)
+		assert.Equal(t, int64(40), dailyErr.Remaining)
+
+		require.Nil(t, store.SetTransferLimits(ctx, from.ID, nil, nil))
+		fromAfter, err = store.GetAccountByID(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Nil(t, fromAfter.DailyTransferLimit)
+		assert.Nil(t, fromAfter.PerTransferLimit)
+		_, err = store.Transfer(ctx, from.ID, to.ID, 500)
+		require.Nil(t, err)
+
+		assert.ErrorIs(t, store.SetTransferLimits(ctx, -1, nil, nil), ErrAccountNotFound)
+	})
+
+	t.Run("GetTransactionsPaginates", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		for amount := int64(1); amount <= 5; amount++ {
+			_, err := store.Transfer(ctx, from.ID, to.ID, amount)
+			require.Nil(t, err)
+		}
+
+		page, err := store.GetTransactions(ctx, from.ID, time.Time{}, time.Time{}, 2, 1)
+		require.Nil(t, err)
+		require.Len(t, page, 2)
+		assert.Equal(t, int64(4), page[0].Amount)
+		assert.Equal(t, int64(3), page[1].Amount)
+	})
+
+	t.Run("GetTransactionsFiltersByDate", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		before := time.Now().UTC().Add(-time.Minute)
+		_, err := store.Transfer(ctx, from.ID, to.ID, 10)
+		require.Nil(t, err)
+		after := time.Now().UTC().Add(time.Minute)
+
+		found, err := store.GetTransactions(ctx, from.ID, before, after, 10, 0)
+		require.Nil(t, err)
+		assert.Len(t, found, 1)
+		found, err = store.GetTransactions(ctx, from.ID, after, time.Time{}, 10, 0)
+		require.Nil(t, err)
+		assert.Empty(t, found)
+		found, err = store.GetTransactions(ctx, from.ID, time.Time{}, before, 10, 0)
+		require.Nil(t, err)
+		assert.Empty(t, found)
+	})
+
+	t.Run("IdempotentResults", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "idempotent@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		_, err := store.GetIdempotentResult(ctx, acc.ID, "key")
+		assert.True(t, errors.Is(err, ErrIdempotentResultNotFound), err)
+
+		require.Nil(t, store.StoreIdempotentResult(ctx, &IdempotentResult{
+			AccountID:   acc.ID,
+			Key:         "key",
+			RequestHash: "hash",
+			StatusCode:  200,
+			Body:        []byte(`{"id":1}`),
+			CreatedAt:   time.Now().UTC(),
+		}))
+		result, err := store.GetIdempotentResult(ctx, acc.ID, "key")
+		require.Nil(t, err)
+		assert.Equal(t, "hash", result.RequestHash)
+		assert.Equal(t, 200, result.StatusCode)
+		assert.Equal(t, `{"id":1}`, string(result.Body))
+
+		require.Nil(t, store.StoreIdempotentResult(ctx, &IdempotentResult{
+			AccountID:  acc.ID,
+			Key:        "expired",
+			StatusCode: 200,
+			Body:       []byte(`{}`),
+			CreatedAt:  time.Now().UTC().Add(-defaultIdempotencyKeyTTL - time.Minute),
+		}))
+		_, err = store.GetIdempotentResult(ctx, acc.ID, "expired")
+		assert.True(t, errors.Is(err, ErrIdempotentResultNotFound), err)
+	})
+
+	t.Run("SearchAccounts", func(t *testing.T) {
+		store := newStore(t)
+		for _, email := range []string{"alice@abc.com", "bob@abc.com", "100%_real@abc.com"} {
+			require.Nil(t, store.CreateAccount(ctx, newTestAccount(t, email)))
+		}
+
+		accounts, err := store.GetAccounts(ctx, AccountFilter{Search: "ALICE"}, 0, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, accounts, 1)
+		assert.Equal(t, "alice@abc.com", accounts[0].Email)
+
+		accounts, err = store.GetAccounts(ctx, AccountFilter{Search: "%"}, 0, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, accounts, 1)
+		assert.Equal(t, "100%_real@abc.com", accounts[0].Email)
+
+		accounts, err = store.GetAccounts(ctx, AccountFilter{Search: "_"}, 0, 10, 0)
+		require.Nil(t, err)
+		assert.Len(t, accounts, 1)
+
+		accounts, err = store.GetAccounts(ctx, AccountFilter{Search: "abc.com"}, 0, 2, 1)
+		require.Nil(t, err)
+		require.Len(t, accounts, 2)
+		assert.Equal(t, "bob@abc.com", accounts[0].Email)
+		total, err := store.CountAccounts(ctx, AccountFilter{Search: "ALICE"})
+		require.Nil(t, err)
+		assert.Equal(t, 1, total)
+	})
+
+	t.Run("GetAccounts", func(t *testing.T) {
+		store := newStore(t)
+		for _, email := range []string{"a@abc.com", "b@abc.com", "c@abc.com"} {
+			require.Nil(t, store.CreateAccount(ctx, newTestAccount(t, email)))
+		}
+
+		accounts, err := store.GetAccounts(ctx, AccountFilter{}, 0, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, accounts, 3)
+		assert.Equal(t, "a@abc.com", accounts[0].Email)
+		assert.Equal(t, "c@abc.com", accounts[2].Email)
+
+		page, err := store.GetAccounts(ctx, AccountFilter{}, 0, 1, 1)
+		require.Nil(t, err)
+		require.Len(t, page, 1)
+		assert.Equal(t, "b@abc.com", page[0].Email)
+		page, err = store.GetAccounts(ctx, AccountFilter{}, accounts[0].ID, 5, 0)
+		require.Nil(t, err)
+		require.Len(t, page, 2, "after skips up to and including that account")
+		assert.Equal(t, "b@abc.com", page[0].Email)
+		total, err := store.CountAccounts(ctx, AccountFilter{})
+		require.Nil(t, err)
+		assert.Equal(t, 3, total)
+	})
+
+	t.Run("FilterAccounts", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now().UTC().Truncate(time.Second)
+		alice, bob, carol := newTestAccount(t, "alice@abc.com"), newTestAccount(t, "bob@abc.com"), newTestAccount(t, "carol@abc.com")
+		alice.FirstName, alice.LastName, alice.Balance, alice.CreatedAt = "Alice", "Smith", 500, now.Add(-48*time.Hour)
+		bob.FirstName, bob.LastName, bob.Balance, bob.CreatedAt = "Bob", "Smith", 50, now.Add(-time.Hour)
+		carol.FirstName, carol.LastName, carol.Balance, carol.CreatedAt = "Carol", "Jones", 5000, now.Add(-time.Minute)
+		for _, acc := range []*Account{alice, bob, carol} {
+			require.Nil(t, store.CreateAccount(ctx, acc))
+		}
+
+		minBalance := int64(100)
+		for _, tc := range []struct {
+			name   string
+			filter AccountFilter
+			want   []string
+		}{
+			{name: "email", filter: AccountFilter{Email: "BOB@abc.com"}, want: []string{"bob@abc.com"}},
+			{name: "name", filter: AccountFilter{Name: "e sm"}, want: []string{"alice@abc.com"}},
+			{name: "created after", filter: AccountFilter{CreatedAfter: now.Add(-2 * time.Hour)}, want: []string{"bob@abc.com", "carol@abc.com"}},
+			{name: "min balance", filter: AccountFilter{MinBalance: &minBalance}, want: []string{"alice@abc.com", "carol@abc.com"}},
+			{name: "combined", filter: AccountFilter{Name: "smith", MinBalance: &minBalance}, want: []string{"alice@abc.com"}},
+			{name: "none", filter: AccountFilter{Email: "nobody@abc.com"}},
+		} {
+			accounts, err := store.GetAccounts(ctx, tc.filter, 0, 10, 0)
+			require.Nil(t, err, tc.name)
+			var emails []string
+			for _, acc := range accounts {
+				emails = append(emails, acc.Email)
+			}
+			assert.Equal(t, tc.want, emails, tc.name)
+			total, err := store.CountAccounts(ctx, tc.filter)
+			require.Nil(t, err, tc.name)
+			assert.Equal(t, len(tc.want), total, tc.name)
+		}
+	})
+
+	t.Run("EachAccount", func(t *testing.T) {
+		store := newStore(t)
+		for _, email := range []string{"a@abc.com", "b@abc.com", "c@abc.com"} {
+			require.Nil(t, store.CreateAccount(ctx, newTestAccount(t, email)))
+		}
+
+		var emails []string
+		require.Nil(t, store.EachAccount(ctx, func(acc *Account) error {
+			emails = append(emails, acc.Email)
+			return nil
+		}))
+		assert.Equal(t, []string{"a@abc.com", "b@abc.com", "c@abc.com"}, emails)
+
+		stop := errors.New("stop")
+		visited := 0
+		err := store.EachAccount(ctx, func(acc *Account) error {
+			visited++
+			return stop
+		})
+		assert.ErrorIs(t, err, stop)
+		assert.Equal(t, 1, visited)
+	})
+
+	t.Run("CreateAccounts", func(t *testing.T) {
+		store := newStore(t)
+		batch := []*Account{newTestAccount(t, "a@abc.com"), newTestAccount(t, "b@abc.com")}
+		require.Nil(t, store.CreateAccounts(ctx, batch))
+
+		for _, acc := range batch {
+			found, err := store.GetAccountByID(ctx, acc.ID)
+			require.Nil(t, err)
+			assert.Equal(t, acc.Email, found.Email)
+		}
+	})
+
+	t.Run("CreateAccountsRollsBackOnFailure", func(t *testing.T) {
+		store := newStore(t)
+		require.Nil(t, store.CreateAccount(ctx, newTestAccount(t, "taken@abc.com")))
+
+		for _, batch := range [][]*Account{
+			{newTestAccount(t, "a@abc.com"), newTestAccount(t, "taken@abc.com"), newTestAccount(t, "c@abc.com")},
+			{newTestAccount(t, "a@abc.com"), newTestAccount(t, "a@abc.com")},
+		} {
+			err := store.CreateAccounts(ctx, batch)
+			var batchErr *BatchError
+			require.ErrorAs(t, err, &batchErr)
+			assert.Equal(t, 1, batchErr.Index)
+			assert.ErrorIs(t, err, ErrAccountExists)
+
+			accounts, err := store.GetAccounts(ctx, AccountFilter{}, 0, maxPageLimit, 0)
+			require.Nil(t, err)
+			assert.Len(t, accounts, 1)
+		}
+	})
+
+	t.Run("DeleteAccount", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "delete@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		require.Nil(t, store.DeleteAccount(ctx, acc.ID))
+		_, err := store.GetAccountByID(ctx, acc.ID)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+		_, err = store.GetAccountByEmail(ctx, acc.Email)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+		_, err = store.GetAccountByNumber(ctx, acc.Number)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+		accounts, err := store.GetAccounts(ctx, AccountFilter{}, 0, maxPageLimit, 0)
+		require.Nil(t, err)
+		assert.Empty(t, accounts)
+
+		assert.ErrorIs(t, store.DeleteAccount(ctx, acc.ID), ErrAccountNotFound)
+		assert.ErrorIs(t, store.DeleteAccount(ctx, 9999), ErrAccountNotFound)
+	})
+
+	t.Run("SoftDeletedAccountCannotTransfer", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		require.Nil(t, store.DeleteAccount(ctx, to.ID))
+		_, err := store.Transfer(ctx, from.ID, to.ID, 10)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+	})
+
+	t.Run("RestoreAccount", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "restore@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		assert.ErrorIs(t, store.RestoreAccount(ctx, acc.ID), ErrAccountNotFound, "only deleted accounts can be restored")
+
+		require.Nil(t, store.DeleteAccount(ctx, acc.ID))
+		require.Nil(t, store.RestoreAccount(ctx, acc.ID))
+		found, err := store.GetAccountByEmail(ctx, "restore@abc.com")
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, found.ID)
+		assert.Nil(t, found.DeletedAt)
+
+		_, err = store.HardDeleteAccount(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.ErrorIs(t, store.RestoreAccount(ctx, acc.ID), ErrAccountNotFound)
+	})
+
+	t.Run("TransferRejectsCurrencyMismatch", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		to.Currency = "EUR"
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		_, err := store.Transfer(ctx, from.ID, to.ID, 10)
+		assert.ErrorIs(t, err, ErrCurrencyMismatch)
+
+		balance, err := store.GetBalance(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(100), balance.Amount)
+	})
+
+	t.Run("LedgerRecordsEveryBalanceChange", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		ledger := NewLedger(store)
+
+		_, err := store.Transfer(ctx, from.ID, to.ID, 30)
+		require.Nil(t, err)
+		deposit, err := ledger.Deposit(ctx, to.ID, 50)
+		require.Nil(t, err)
+		assert.Equal(t, TransactionDeposit, deposit.Type)
+		_, err = ledger.Withdraw(ctx, from.ID, 20)
+		require.Nil(t, err)
+		fee, err := ledger.ChargeFee(ctx, from.ID, 5)
+		require.Nil(t, err)
+		assert.Equal(t, int64(5), fee.Amount)
+
+		_, err = ledger.Withdraw(ctx, from.ID, 1000)
+		assert.ErrorIs(t, err, ErrInsufficientFunds)
+		_, err = ledger.Deposit(ctx, to.ID+1000, 10)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+		require.Nil(t, store.SetAccountStatus(ctx, to.ID, AccountStatusFrozen))
+		_, err = ledger.Deposit(ctx, to.ID, 10)
+		assert.ErrorIs(t, err, ErrAccountFrozen)
+
+		for id, want := range map[int]int64{from.ID: 45, to.ID: 80} {
+			balance, err := store.GetBalance(ctx, id)
+			require.Nil(t, err)
+			assert.Equal(t, want, balance.Amount)
+			acc, err := store.GetAccountByID(ctx, id)
+			require.Nil(t, err)
+			assert.Equal(t, want, acc.Balance)
+		}
+
+		entries, err := store.GetLedgerEntries(ctx, from.ID, 10, 0)
+		require.Nil(t, err)
+		var kinds []string
+		for _, e := range entries {
+			kinds = append(kinds, e.Kind)
+		}
+		assert.Equal(t, []string{JournalFee, JournalWithdrawal, JournalTransfer, JournalOpening}, kinds)
+		assert.Equal(t, LedgerDebit, entries[0].Direction)
+		assert.NotZero(t, entries[0].JournalID)
+
+		entries, err = store.GetLedgerEntries(ctx, from.ID, 1, 3)
+		require.Nil(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, LedgerCredit, entries[0].Direction)
+		assert.Equal(t, int64(100), entries[0].Amount)
+
+		transactions, err := store.GetTransactions(ctx, from.ID, time.Time{}, time.Time{}, 1, 0)
+		require.Nil(t, err)
+		assert.Equal(t, TransactionFee, transactions[0].Type)
+	})
+
+	t.Run("ReverseTransfer", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		debit, err := store.Transfer(ctx, from.ID, to.ID, 40)
+		require.Nil(t, err)
+		assert.Equal(t, TransactionStatusCompleted, debit.Status)
+
+		reversal, err := store.ReverseTransfer(ctx, debit.ID)
+		require.Nil(t, err)
+		assert.Equal(t, TransactionReversalCredit, reversal.Type)
+		assert.Equal(t, from.ID, reversal.AccountID)
+		assert.Equal(t, int64(40), reversal.Amount)
+		require.NotNil(t, reversal.ReversalOf)
+		assert.Equal(t, debit.ID, *reversal.ReversalOf)
+
+		original, err := store.GetTransaction(ctx, debit.ID)
+		require.Nil(t, err)
+		assert.Equal(t, TransactionStatusReversed, original.Status)
+		for id, want := range map[int]int64{from.ID: 100, to.ID: 0} {
+			balance, err := store.GetBalance(ctx, id)
+			require.Nil(t, err)
+			assert.Equal(t, want, balance.Amount)
+		}
+		received, err := store.GetTransactions(ctx, to.ID, time.Time{}, time.Time{}, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, received, 2)
+		assert.Equal(t, TransactionReversalDebit, received[0].Type)
+		assert.Equal(t, TransactionStatusReversed, received[1].Status)
+
+		_, err = store.ReverseTransfer(ctx, debit.ID)
+		assert.ErrorIs(t, err, ErrAlreadyReversed)
+		_, err = store.ReverseTransfer(ctx, reversal.ID)
+		assert.ErrorIs(t, err, ErrTransactionNotFound)
+		_, err = store.GetTransaction(ctx, reversal.ID+1000)
+		assert.ErrorIs(t, err, ErrTransactionNotFound)
+
+		// the recipient must still have the money to give back
+		debit, err = store.Transfer(ctx, from.ID, to.ID, 40)
+		require.Nil(t, err)
+		_, err = store.Transfer(ctx, to.ID, from.ID, 30)
+		require.Nil(t, err)
+		_, err = store.ReverseTransfer(ctx, debit.ID)
+		assert.ErrorIs(t, err, ErrInsufficientFunds)
+	})
+
+	t.Run("ScheduledTransfers", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		schedule := func(executeAt time.Time) *ScheduledTransfer {
+			st := &ScheduledTransfer{AccountID: from.ID, ToAccountID: to.ID, Amount: 10, ExecuteAt: executeAt, Status: ScheduledTransferPending, CreatedAt: now, UpdatedAt: now}
+			require.Nil(t, store.CreateScheduledTransfer(ctx, st))
+			return st
+		}
+		later := schedule(now.Add(time.Hour))
+		soon := schedule(now.Add(time.Minute))
+		cancelled := schedule(now.Add(time.Minute))
+
+		_, err := store.CancelScheduledTransfer(ctx, from.ID, cancelled.ID)
+		require.Nil(t, err)
+		_, err = store.CancelScheduledTransfer(ctx, from.ID, cancelled.ID)
+		assert.ErrorIs(t, err, ErrScheduledTransferNotPending)
+		_, err = store.CancelScheduledTransfer(ctx, to.ID, later.ID)
+		assert.ErrorIs(t, err, ErrScheduledTransferNotFound)
+
+		due, err := store.ClaimDueScheduledTransfers(ctx, now.Add(2*time.Minute), 10)
+		require.Nil(t, err)
+		require.Len(t, due, 1)
+		assert.Equal(t, soon.ID, due[0].ID)
+		assert.Equal(t, ScheduledTransferProcessing, due[0].Status)
+		_, err = store.CancelScheduledTransfer(ctx, from.ID, soon.ID)
+		assert.ErrorIs(t, err, ErrScheduledTransferNotPending)
+
+		due[0].Status = ScheduledTransferFailed
+		due[0].FailureReason = "insufficient funds"
+		require.Nil(t, store.FinishScheduledTransfer(ctx, due[0]))
+		due, err = store.ClaimDueScheduledTransfers(ctx, now.Add(2*time.Minute), 10)
+		require.Nil(t, err)
+		assert.Empty(t, due)
+
+		transfers, err := store.GetScheduledTransfers(ctx, from.ID, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, transfers, 3)
+		assert.Equal(t, ScheduledTransferCancelled, transfers[0].Status)
+		assert.Equal(t, ScheduledTransferFailed, transfers[1].Status)
+		assert.Equal(t, "insufficient funds", transfers[1].FailureReason)
+		assert.Equal(t, ScheduledTransferPending, transfers[2].Status)
+		assert.True(t, later.ExecuteAt.Equal(transfers[2].ExecuteAt))
+	})
+
+	t.Run("StandingOrders", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		start := time.Now().UTC().Truncate(time.Microsecond)
+		order := &StandingOrder{AccountID: from.ID, ToAccountID: to.ID, Amount: 5, Frequency: FrequencyWeekly, StartAt: start, NextRunAt: start, Status: StandingOrderActive, CreatedAt: start, UpdatedAt: start}
+		require.Nil(t, store.CreateStandingOrder(ctx, order))
+
+		queued, err := store.QueueDueStandingOrders(ctx, start.Add(-time.Minute), 10)
+		require.Nil(t, err)
+		assert.Equal(t, 0, queued)
+		queued, err = store.QueueDueStandingOrders(ctx, start, 10)
+		require.Nil(t, err)
+		assert.Equal(t, 1, queued)
+		queued, err = store.QueueDueStandingOrders(ctx, start, 10)
+		require.Nil(t, err)
+		assert.Equal(t, 0, queued)
+
+		orders, err := store.GetStandingOrders(ctx, from.ID, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, orders, 1)
+		assert.Equal(t, 1, orders[0].Runs)
+		assert.True(t, start.AddDate(0, 0, 7).Equal(orders[0].NextRunAt))
+		transfers, err := store.GetScheduledTransfers(ctx, from.ID, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, transfers, 1)
+		assert.True(t, start.Equal(transfers[0].ExecuteAt))
+
+		paused, err := store.SetStandingOrderStatus(ctx, from.ID, order.ID, StandingOrderPaused, start)
+		require.Nil(t, err)
+		assert.Equal(t, StandingOrderPaused, paused.Status)
+		queued, err = store.QueueDueStandingOrders(ctx, start.AddDate(0, 0, 8), 10)
+		require.Nil(t, err)
+		assert.Equal(t, 0, queued)
+		_, err = store.SetStandingOrderStatus(ctx, to.ID, order.ID, StandingOrderCancelled, start)
+		assert.ErrorIs(t, err, ErrStandingOrderNotFound)
+		_, err = store.SetStandingOrderStatus(ctx, from.ID, order.ID, StandingOrderPaused, start)
+		assert.ErrorIs(t, err, ErrStandingOrderTransition)
+	})
+
+	t.Run("Holds", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		newHold := func(amount int64) *Hold {
+			return &Hold{AccountID: from.ID, ToAccountID: to.ID, Amount: amount, Status: HoldActive, CreatedAt: now, UpdatedAt: now}
+		}
+
+		captured, released := newHold(60), newHold(30)
+		require.Nil(t, store.CreateHold(ctx, captured))
+		require.Nil(t, store.CreateHold(ctx, released))
+		assert.ErrorIs(t, store.CreateHold(ctx, newHold(11)), ErrInsufficientFunds)
+		balance, err := store.GetBalance(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, Balance{Money: Money{Amount: 100, Currency: DefaultCurrency}, Held: 90}, balance, "holds do not change the booked balance")
+		_, err = store.Transfer(ctx, from.ID, to.ID, 11)
+		assert.ErrorIs(t, err, ErrInsufficientFunds, "held money is not available")
+
+		fromAfter, err := store.GetAccountByID(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(100), fromAfter.Balance)
+		assert.Equal(t, int64(90), fromAfter.Held)
+
+		hold, err := store.CaptureHold(ctx, from.ID, captured.ID)
+		require.Nil(t, err)
+		assert.Equal(t, HoldCaptured, hold.Status)
+		require.NotNil(t, hold.TransactionID)
+		debit, err := store.GetTransaction(ctx, *hold.TransactionID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(60), debit.Amount)
+		_, err = store.CaptureHold(ctx, from.ID, captured.ID)
+		assert.ErrorIs(t, err, ErrHoldNotActive)
+
+		hold, err = store.ReleaseHold(ctx, from.ID, released.ID)
+		require.Nil(t, err)
+		assert.Equal(t, HoldReleased, hold.Status)
+		_, err = store.CaptureHold(ctx, from.ID, released.ID)
+		assert.ErrorIs(t, err, ErrHoldNotActive)
+		_, err = store.ReleaseHold(ctx, to.ID, released.ID)
+		assert.ErrorIs(t, err, ErrHoldNotFound)
+
+		fromAfter, err = store.GetAccountByID(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(40), fromAfter.Balance)
+		assert.Equal(t, int64(0), fromAfter.Held)
+		toAfter, err := store.GetAccountByID(ctx, to.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(60), toAfter.Balance)
+
+		holds, err := store.GetHolds(ctx, from.ID, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, holds, 2)
+		assert.Equal(t, released.ID, holds[0].ID)
+		assert.Equal(t, captured.ID, holds[1].ID)
+	})
+
+	t.Run("TransferConvertsCurrency", func(t *testing.T) {
+		store := newStore(t)
+		switch s := store.(type) {
+		case *MemoryStore:
+			s.rates = fakeRates{"EUR": 0.5}
+		case *PostgresStore:
+			s.rates = fakeRates{"EUR": 0.5}
+		}
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 1000
+		to := newTestAccount(t, "to@abc.com")
+		to.Currency = "EUR"
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		debit, err := store.Transfer(ctx, from.ID, to.ID, 105)
+		require.Nil(t, err)
+		assert.Equal(t, int64(105), debit.Amount)
+		balance, err := store.GetBalance(ctx, to.ID)
+		require.Nil(t, err)
+		assert.Equal(t, Money{Amount: 53, Currency: "EUR"}, balance.Money)
+
+		transactions, err := store.GetTransactions(ctx, to.ID, time.Time{}, time.Time{}, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, transactions, 1)
+		credit := transactions[0]
+		assert.Equal(t, int64(53), credit.Amount)
+		require.NotNil(t, credit.ExchangeRate)
+		assert.Equal(t, 0.5, *credit.ExchangeRate)
+		require.NotNil(t, credit.OriginalAmount)
+		assert.Equal(t, int64(105), *credit.OriginalAmount)
+		require.NotNil(t, credit.OriginalCurrency)
+		assert.Equal(t, "USD", *credit.OriginalCurrency)
+
+		other := newTestAccount(t, "gbp@abc.com")
+		other.Currency = "GBP"
+		require.Nil(t, store.CreateAccount(ctx, other))
+		_, err = store.Transfer(ctx, from.ID, other.ID, 10)
+		assert.ErrorIs(t, err, ErrCurrencyMismatch)
+	})
+
+	t.Run("FrozenAccountCannotTransfer", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		to.Balance = 100
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+
+		require.Nil(t, store.SetAccountStatus(ctx, from.ID, AccountStatusFrozen))
+		_, err := store.Transfer(ctx, from.ID, to.ID, 10)
+		assert.ErrorIs(t, err, ErrAccountFrozen)
+		_, err = store.Transfer(ctx, to.ID, from.ID, 10)
+		assert.ErrorIs(t, err, ErrAccountFrozen)
+
+		found, err := store.GetAccountByID(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, AccountStatusFrozen, found.Status)
+		assert.Equal(t, int64(100), found.Balance)
+
+		require.Nil(t, store.SetAccountStatus(ctx, from.ID, AccountStatusActive))
+		_, err = store.Transfer(ctx, from.ID, to.ID, 10)
+		assert.Nil(t, err)
+
+		assert.ErrorIs(t, store.SetAccountStatus(ctx, to.ID+1000, AccountStatusFrozen), ErrAccountNotFound)
+	})
+
+	t.Run("VerificationTokens", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "verify@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		require.False(t, acc.EmailVerified)
+
+		require.Nil(t, store.CreateVerificationToken(ctx, acc.ID, hashOpaqueToken("expired"), time.Now().UTC().Add(-time.Minute)))
+		_, err := store.ConsumeVerificationToken(ctx, hashOpaqueToken("expired"))
+		assert.ErrorIs(t, err, ErrVerificationTokenInvalid)
+
+		require.Nil(t, store.CreateVerificationToken(ctx, acc.ID, hashOpaqueToken("valid"), time.Now().UTC().Add(time.Hour)))
+		id, err := store.ConsumeVerificationToken(ctx, hashOpaqueToken("valid"))
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, id)
+		found, err := store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.True(t, found.EmailVerified)
+
+		_, err = store.ConsumeVerificationToken(ctx, hashOpaqueToken("valid"))
+		assert.ErrorIs(t, err, ErrVerificationTokenInvalid)
+	})
+
+	t.Run("PasswordResetTokens", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "reset@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		session := &RefreshToken{TokenHash: hashOpaqueToken("session"), AccountID: acc.ID, FamilyID: "family", ExpiresAt: now.Add(time.Hour), CreatedAt: now}
+		require.Nil(t, store.CreateRefreshToken(ctx, session))
+
+		require.Nil(t, store.CreatePasswordResetToken(ctx, acc.ID, hashOpaqueToken("expired"), now))
+		_, err := store.ResetPassword(ctx, hashOpaqueToken("expired"), "expired-hash", now)
+		assert.ErrorIs(t, err, ErrPasswordResetTokenInvalid)
+
+		require.Nil(t, store.CreatePasswordResetToken(ctx, acc.ID, hashOpaqueToken("valid"), now.Add(time.Hour)))
+		require.Nil(t, store.CreatePasswordResetToken(ctx, acc.ID, hashOpaqueToken("other"), now.Add(time.Hour)))
+		id, err := store.ResetPassword(ctx, hashOpaqueToken("valid"), "new-hash", now)
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, id)
+		found, err := store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "new-hash", found.EncryptedPassword)
+		assert.Equal(t, acc.Version+1, found.Version)
+
+		_, err = store.ResetPassword(ctx, hashOpaqueToken("valid"), "again", now)
+		assert.ErrorIs(t, err, ErrPasswordResetTokenInvalid, "tokens are single use")
+		_, err = store.ResetPassword(ctx, hashOpaqueToken("other"), "again", now)
+		assert.ErrorIs(t, err, ErrPasswordResetTokenInvalid, "other outstanding tokens are dropped")
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, session.TokenHash, &RefreshToken{TokenHash: hashOpaqueToken("next"), ExpiresAt: now.Add(time.Hour), CreatedAt: now}), ErrRefreshTokenInvalid, "sessions are revoked")
+	})
+
+	t.Run("RefreshTokens", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "refresh@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		token := func(name string) *RefreshToken {
+			return &RefreshToken{TokenHash: hashOpaqueToken(name), ExpiresAt: now.Add(time.Hour), CreatedAt: now}
+		}
+
+		first := token("first")
+		first.AccountID, first.FamilyID = acc.ID, "family"
+		require.Nil(t, store.CreateRefreshToken(ctx, first))
+		expired := token("expired")
+		expired.AccountID, expired.FamilyID, expired.ExpiresAt = acc.ID, "other", now
+		require.Nil(t, store.CreateRefreshToken(ctx, expired))
+
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, hashOpaqueToken("unknown"), token("next")), ErrRefreshTokenInvalid)
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, expired.TokenHash, token("next")), ErrRefreshTokenInvalid)
+
+		second := token("second")
+		require.Nil(t, store.RotateRefreshToken(ctx, first.TokenHash, second))
+		assert.Equal(t, acc.ID, second.AccountID)
+		assert.Equal(t, "family", second.FamilyID)
+
+		replayed := token("replayed")
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, first.TokenHash, replayed), ErrRefreshTokenReused)
+		assert.Equal(t, acc.ID, replayed.AccountID)
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, second.TokenHash, token("third")), ErrRefreshTokenInvalid, "the family is revoked")
+
+		fresh := token("fresh")
+		fresh.AccountID, fresh.FamilyID = acc.ID, "fresh"
+		require.Nil(t, store.CreateRefreshToken(ctx, fresh))
+		require.Nil(t, store.RevokeRefreshTokenFamily(ctx, fresh.TokenHash, now))
+		require.Nil(t, store.RevokeRefreshTokenFamily(ctx, hashOpaqueToken("unknown"), now))
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, fresh.TokenHash, token("next")), ErrRefreshTokenInvalid)
+
+		purged, err := store.PurgeExpired(ctx, now.Add(2*time.Hour))
+		require.Nil(t, err)
+		assert.Equal(t, 4, purged)
+	})
+
+	t.Run("RevokedAccessTokens", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now().UTC().Truncate(time.Microsecond)
+
+		revoked, err := store.IsAccessTokenRevoked(ctx, "jti")
+		require.Nil(t, err)
+		assert.False(t, revoked)
+
+		require.Nil(t, store.RevokeAccessToken(ctx, "jti", now.Add(time.Minute)))
+		require.Nil(t, store.RevokeAccessToken(ctx, "jti", now.Add(time.Minute)), "revoking twice is harmless")
+		revoked, err = store.IsAccessTokenRevoked(ctx, "jti")
+		require.Nil(t, err)
+		assert.True(t, revoked)
+
+		purged, err := store.PurgeExpired(ctx, now.Add(2*time.Minute))
+		require.Nil(t, err)
+		assert.Equal(t, 1, purged)
+		revoked, err = store.IsAccessTokenRevoked(ctx, "jti")
+		require.Nil(t, err)
+		assert.False(t, revoked)
+	})
+
+	t.Run("LoginFailures", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now().UTC().Truncate(time.Microsecond)
+
+		for i := 0; i < 2; i++ {
+			lockedUntil, err := store.RecordLoginFailure(ctx, "email:a@abc.com", 3, time.Minute, now)
+			require.Nil(t, err)
+			assert.True(t, lockedUntil.IsZero())
+		}
+		lockedUntil, err := store.RecordLoginFailure(ctx, "email:a@abc.com", 3, time.Minute, now.Add(2*time.Minute))
+		require.Nil(t, err)
+		assert.True(t, lockedUntil.IsZero(), "old failures are forgotten")
+		lockedUntil, err = store.RecordLoginFailure(ctx, "email:b@abc.com", 1, time.Minute, now)
+		require.Nil(t, err)
+		assert.True(t, now.Add(time.Minute).Equal(lockedUntil))
+
+		lockedUntil, err = store.LoginLockedUntil(ctx, "email:b@abc.com", now.Add(time.Second))
+		require.Nil(t, err)
+		assert.True(t, now.Add(time.Minute).Equal(lockedUntil))
+		lockedUntil, err = store.LoginLockedUntil(ctx, "email:b@abc.com", now.Add(time.Minute))
+		require.Nil(t, err)
+		assert.True(t, lockedUntil.IsZero(), "the lock has ended")
+		lockedUntil, err = store.LoginLockedUntil(ctx, "email:a@abc.com", now)
+		require.Nil(t, err)
+		assert.True(t, lockedUntil.IsZero())
+
+		require.Nil(t, store.ClearLoginFailures(ctx, "email:b@abc.com"))
+		lockedUntil, err = store.LoginLockedUntil(ctx, "email:b@abc.com", now)
+		require.Nil(t, err)
+		assert.True(t, lockedUntil.IsZero(), "unlocked")
+
+		purged, err := store.PurgeExpired(ctx, now.Add(4*time.Minute))
+		require.Nil(t, err)
+		assert.Equal(t, 1, purged)
+	})
+
+	t.Run("SetTOTPSecret", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "totp@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+
+		assert.ErrorIs(t, store.EnableTOTP(ctx, acc.ID, nil), ErrAccountNotFound, "nothing is enrolled")
+		require.Nil(t, store.SetTOTPSecret(ctx, acc.ID, "JBSWY3DPEHPK3PXP"))
+		found, err := store.GetAccountByEmail(ctx, "totp@abc.com")
+		require.Nil(t, err)
+		assert.Equal(t, "JBSWY3DPEHPK3PXP", found.TOTPSecret)
+		assert.False(t, found.TOTPEnabled)
+
+		now := time.Now().UTC()
+		require.Nil(t, store.EnableTOTP(ctx, acc.ID, []string{hashOpaqueToken("one"), hashOpaqueToken("two")}))
+		found, err = store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.True(t, found.TOTPEnabled)
+		require.Nil(t, store.UseBackupCode(ctx, acc.ID, hashOpaqueToken("one"), now))
+		assert.ErrorIs(t, store.UseBackupCode(ctx, acc.ID, hashOpaqueToken("one"), now), ErrBackupCodeInvalid)
+		assert.ErrorIs(t, store.UseBackupCode(ctx, acc.ID, hashOpaqueToken("unknown"), now), ErrBackupCodeInvalid)
+
+		require.Nil(t, store.SetTOTPSecret(ctx, acc.ID, ""))
+		found, err = store.GetAccountByID(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Empty(t, found.TOTPSecret)
+		assert.False(t, found.TOTPEnabled)
+		assert.ErrorIs(t, store.UseBackupCode(ctx, acc.ID, hashOpaqueToken("two"), now), ErrBackupCodeInvalid, "disabling drops the backup codes")
+
+		assert.ErrorIs(t, store.SetTOTPSecret(ctx, acc.ID+1000, "x"), ErrAccountNotFound)
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "session@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+
+		refresh := &RefreshToken{TokenHash: hashOpaqueToken("laptop"), AccountID: acc.ID, FamilyID: "laptop", ExpiresAt: now.Add(time.Hour), CreatedAt: now}
+		require.Nil(t, store.CreateRefreshToken(ctx, refresh))
+		laptop := &Session{AccountID: acc.ID, FamilyID: "laptop", UserAgent: "Firefox", IP: "192.0.2.1", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}
+		require.Nil(t, store.UpsertSession(ctx, laptop))
+		assert.NotZero(t, laptop.ID)
+		phone := &Session{AccountID: acc.ID, FamilyID: "phone", UserAgent: "Safari", IP: "192.0.2.2", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Minute)}
+		require.Nil(t, store.UpsertSession(ctx, phone))
+
+		later := now.Add(time.Minute)
+		refreshed := &Session{AccountID: acc.ID, FamilyID: "laptop", UserAgent: "Firefox", IP: "192.0.2.3", CreatedAt: later, LastUsedAt: later, ExpiresAt: later.Add(time.Hour)}
+		require.Nil(t, store.UpsertSession(ctx, refreshed))
+		assert.Equal(t, laptop.ID, refreshed.ID)
+		assert.Equal(t, now, refreshed.CreatedAt.UTC(), "creation is kept")
+
+		sessions, err := store.GetSessions(ctx, acc.ID, now)
+		require.Nil(t, err)
+		require.Len(t, sessions, 2)
+		assert.Equal(t, laptop.ID, sessions[0].ID, "most recently used first")
+		assert.Equal(t, "192.0.2.3", sessions[0].IP)
+		sessions, err = store.GetSessions(ctx, acc.ID, now.Add(time.Minute))
+		require.Nil(t, err)
+		assert.Len(t, sessions, 1, "the phone session expired")
+
+		assert.ErrorIs(t, store.RevokeSession(ctx, acc.ID+1000, laptop.ID, later), ErrSessionNotFound)
+		revoked, err := store.IsSessionRevoked(ctx, laptop.ID)
+		require.Nil(t, err)
+		assert.False(t, revoked)
+		require.Nil(t, store.RevokeSession(ctx, acc.ID, laptop.ID, later))
+		assert.ErrorIs(t, store.RevokeSession(ctx, acc.ID, laptop.ID, later), ErrSessionNotFound, "already revoked")
+		revoked, err = store.IsSessionRevoked(ctx, laptop.ID)
+		require.Nil(t, err)
+		assert.True(t, revoked)
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, refresh.TokenHash, &RefreshToken{TokenHash: hashOpaqueToken("next"), CreatedAt: later}), ErrRefreshTokenInvalid, "the family is revoked")
+		sessions, err = store.GetSessions(ctx, acc.ID, now)
+		require.Nil(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, phone.ID, sessions[0].ID)
+
+		require.Nil(t, store.RevokeRefreshTokenFamily(ctx, refresh.TokenHash, later))
+		phoneToken := &RefreshToken{TokenHash: hashOpaqueToken("phone"), AccountID: acc.ID, FamilyID: "phone", ExpiresAt: now.Add(time.Minute), CreatedAt: now}
+		require.Nil(t, store.CreateRefreshToken(ctx, phoneToken))
+		require.Nil(t, store.RevokeRefreshTokenFamily(ctx, phoneToken.TokenHash, later))
+		revoked, err = store.IsSessionRevoked(ctx, phone.ID)
+		require.Nil(t, err)
+		assert.True(t, revoked, "logging out revokes the session")
+	})
+
+	t.Run("RevokeOtherSessions", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "session@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		sessions := map[string]*Session{}
+		for _, family := range []string{"laptop", "phone"} {
+			require.Nil(t, store.CreateRefreshToken(ctx, &RefreshToken{TokenHash: hashOpaqueToken(family), AccountID: acc.ID, FamilyID: family, ExpiresAt: now.Add(time.Hour), CreatedAt: now}))
+			sessions[family] = &Session{AccountID: acc.ID, FamilyID: family, CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}
+			require.Nil(t, store.UpsertSession(ctx, sessions[family]))
+		}
+
+		require.Nil(t, store.RevokeOtherSessions(ctx, acc.ID, sessions["laptop"].ID, now))
+		revoked, err := store.IsSessionRevoked(ctx, sessions["phone"].ID)
+		require.Nil(t, err)
+		assert.True(t, revoked)
+		assert.ErrorIs(t, store.RotateRefreshToken(ctx, hashOpaqueToken("phone"), &RefreshToken{TokenHash: hashOpaqueToken("phone-next"), CreatedAt: now}), ErrRefreshTokenInvalid)
+		revoked, err = store.IsSessionRevoked(ctx, sessions["laptop"].ID)
+		require.Nil(t, err)
+		assert.False(t, revoked, "the kept session stays")
+		require.Nil(t, store.RotateRefreshToken(ctx, hashOpaqueToken("laptop"), &RefreshToken{TokenHash: hashOpaqueToken("laptop-next"), ExpiresAt: now.Add(time.Hour), CreatedAt: now}))
+
+		require.Nil(t, store.RevokeOtherSessions(ctx, acc.ID, 0, now))
+		revoked, err = store.IsSessionRevoked(ctx, sessions["laptop"].ID)
+		require.Nil(t, err)
+		assert.True(t, revoked)
+	})
+	t.Run("LoginAttempts", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "logins@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+
+		for _, a := range []*LoginAttempt{
+			{AccountID: acc.ID, IP: "192.0.2.1", UserAgent: "Firefox", Result: LoginResultFailure, CreatedAt: now.Add(-100 * 24 * time.Hour)},
+			{AccountID: acc.ID, IP: "192.0.2.1", UserAgent: "Firefox", Result: LoginResultSuccess, CreatedAt: now},
+			{AccountID: acc.ID, IP: "192.0.2.2", UserAgent: "Safari", Result: LoginResultFailure, CreatedAt: now},
+			{AccountID: acc.ID, IP: "192.0.2.1", UserAgent: "Firefox", Result: LoginResultSuccess, CreatedAt: now},
+		} {
+			require.Nil(t, store.CreateLoginAttempt(ctx, a))
+			assert.NotZero(t, a.ID)
+		}
+
+		ips, err := store.GetLoginIPs(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Equal(t, []string{"192.0.2.1"}, ips, "only successful logins, once each")
+		logins, err := store.GetLoginAttempts(ctx, acc.ID, 2, 1)
+		require.Nil(t, err)
+		require.Len(t, logins, 2)
+		assert.Equal(t, "Safari", logins[0].UserAgent, "newest first")
+		assert.Equal(t, now, logins[0].CreatedAt.UTC())
+
+		purged, err := store.PurgeExpired(ctx, now)
+		require.Nil(t, err)
+		assert.Equal(t, 1, purged, "attempts older than the retention")
+		logins, err = store.GetLoginAttempts(ctx, acc.ID, 10, 0)
+		require.Nil(t, err)
+		assert.Len(t, logins, 3)
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "apikey@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+
+		key := &APIKey{AccountID: acc.ID, Name: "payroll", Prefix: "gbk_abcdef", Scopes: []string{ScopeRead, ScopeTransfer}, KeyHash: hashOpaqueToken("key"), CreatedAt: now}
+		require.Nil(t, store.CreateAPIKey(ctx, key))
+		assert.NotZero(t, key.ID)
+
+		found, err := store.GetAPIKeyByHash(ctx, hashOpaqueToken("key"))
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, found.AccountID)
+		assert.Equal(t, []string{ScopeRead, ScopeTransfer}, found.Scopes)
+		_, err = store.GetAPIKeyByHash(ctx, hashOpaqueToken("other"))
+		assert.ErrorIs(t, err, ErrAPIKeyNotFound)
+
+		assert.ErrorIs(t, store.RevokeAPIKey(ctx, acc.ID+1000, key.ID, now), ErrAPIKeyNotFound)
+		require.Nil(t, store.RevokeAPIKey(ctx, acc.ID, key.ID, now))
+		assert.ErrorIs(t, store.RevokeAPIKey(ctx, acc.ID, key.ID, now), ErrAPIKeyNotFound, "already revoked")
+		_, err = store.GetAPIKeyByHash(ctx, hashOpaqueToken("key"))
+		assert.ErrorIs(t, err, ErrAPIKeyNotFound)
+
+		keys, err := store.GetAPIKeys(ctx, acc.ID)
+		require.Nil(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, "payroll", keys[0].Name)
+		require.NotNil(t, keys[0].RevokedAt)
+		assert.Equal(t, now, keys[0].RevokedAt.UTC())
+	})
+
+	t.Run("Passkeys", func(t *testing.T) {
+		store := newStore(t)
+		acc := newTestAccount(t, "passkey@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		now := time.Now().UTC().Truncate(time.Microsecond)
+
+		passkey := &Passkey{AccountID: acc.ID, Credential: webauthn.Credential{ID: []byte("credential"), PublicKey: []byte("key")}, CreatedAt: now}
+		require.Nil(t, store.CreatePasskey(ctx, passkey))
+		assert.NotZero(t, passkey.ID)
+		duplicate := *passkey
+		assert.ErrorIs(t, store.CreatePasskey(ctx, &duplicate), ErrPasskeyExists)
+
+		passkey.Credential.Authenticator.SignCount = 7
+		passkey.LastUsedAt = &now
+		require.Nil(t, store.UpdatePasskey(ctx, passkey))
+		passkeys, err := store.GetPasskeys(ctx, acc.ID)
+		require.Nil(t, err)
+		require.Len(t, passkeys, 1)
+		assert.Equal(t, []byte("key"), passkeys[0].Credential.PublicKey)
+		assert.Equal(t, uint32(7), passkeys[0].Credential.Authenticator.SignCount)
+		assert.Equal(t, now, passkeys[0].LastUsedAt.UTC())
+
+		assert.ErrorIs(t, store.DeletePasskey(ctx, acc.ID+1000, passkey.ID), ErrPasskeyNotFound)
+		require.Nil(t, store.DeletePasskey(ctx, acc.ID, passkey.ID))
+		passkeys, err = store.GetPasskeys(ctx, acc.ID)
+		require.Nil(t, err)
+		assert.Empty(t, passkeys)
+
+		session := &PasskeySession{TokenHash: hashOpaqueToken("session"), AccountID: acc.ID, Purpose: passkeyLogin,
+			Data: webauthn.SessionData{Challenge: "challenge", UserID: []byte("1")}, ExpiresAt: now.Add(time.Minute)}
+		require.Nil(t, store.CreatePasskeySession(ctx, session))
+		_, err = store.ConsumePasskeySession(ctx, session.TokenHash, passkeyRegistration, now)
+		assert.ErrorIs(t, err, ErrPasskeySessionInvalid, "sessions are bound to their ceremony")
+		found, err := store.ConsumePasskeySession(ctx, session.TokenHash, passkeyLogin, now)
+		require.Nil(t, err)
+		assert.Equal(t, acc.ID, found.AccountID)
+		assert.Equal(t, "challenge", found.Data.Challenge)
+		_, err = store.ConsumePasskeySession(ctx, session.TokenHash, passkeyLogin, now)
+		assert.ErrorIs(t, err, ErrPasskeySessionInvalid)
+	})
+
+	t.Run("TransferWithinOverdraftLimit", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		require.Nil(t, store.SetOverdraftLimit(ctx, from.ID, 50))
+
+		_, err := store.Transfer(ctx, from.ID, to.ID, 140)
+		require.Nil(t, err)
+		balance, err := store.GetBalance(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(-40), balance.Amount)
+
+		_, err = store.Transfer(ctx, from.ID, to.ID, 11)
+		assert.ErrorIs(t, err, ErrOverdraftLimitExceeded)
+		balance, err = store.GetBalance(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(-40), balance.Amount)
+
+		_, err = store.Transfer(ctx, from.ID, to.ID, 10)
+		assert.Nil(t, err)
+	})
+
+	t.Run("HardDeleteAccount", func(t *testing.T) {
+		store := newStore(t)
+		from := newTestAccount(t, "from@abc.com")
+		from.Balance = 100
+		to := newTestAccount(t, "to@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, from))
+		require.Nil(t, store.CreateAccount(ctx, to))
+		_, err := store.Transfer(ctx, from.ID, to.ID, 10)
+		require.Nil(t, err)
+
+		now := time.Now().UTC()
+		require.Nil(t, store.CreateHold(ctx, &Hold{AccountID: to.ID, ToAccountID: from.ID, Amount: 5, Status: HoldActive, CreatedAt: now, UpdatedAt: now}))
+
+		// the soft deleted row is still there to purge
+		require.Nil(t, store.DeleteAccount(ctx, from.ID))
+		released, err := store.HardDeleteAccount(ctx, from.ID)
+		require.Nil(t, err)
+		assert.Equal(t, []int{to.ID}, released, "holds for the purged account are released")
+		_, err = store.HardDeleteAccount(ctx, from.ID)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+		found, err := store.GetAccountByID(ctx, to.ID)
+		require.Nil(t, err)
+		assert.Equal(t, int64(0), found.Held)
+
+		transactions, err := store.GetTransactions(ctx, from.ID, time.Time{}, time.Time{}, 10, 0)
+		require.Nil(t, err)
+		assert.Empty(t, transactions)
+		transactions, err = store.GetTransactions(ctx, to.ID, time.Time{}, time.Time{}, 10, 0)
+		require.Nil(t, err)
+		require.Len(t, transactions, 1)
+		assert.Nil(t, transactions[0].CounterpartyAccountID)
+	})
+
+	t.Run("PurgeExpired", func(t *testing.T) {
+		store := newStore(t)
+		deleted := newTestAccount(t, "deleted@abc.com")
+		live := newTestAccount(t, "live@abc.com")
+		require.Nil(t, store.CreateAccount(ctx, deleted))
+		require.Nil(t, store.CreateAccount(ctx, live))
+		require.Nil(t, store.DeleteAccount(ctx, deleted.ID))
+		now := time.Now().UTC()
+		require.Nil(t, store.CreateVerificationToken(ctx, live.ID, hashOpaqueToken("token"), now.Add(time.Hour)))
+
+		// nothing has expired yet
+		purged, err := store.PurgeExpired(ctx, now)
+		require.Nil(t, err)
+		assert.Equal(t, 0, purged)
+
+		purged, err = store.PurgeExpired(ctx, now.Add(defaultDeletedAccountRetention+time.Hour))
+		require.Nil(t, err)
+		assert.Equal(t, 2, purged)
+		_, err = store.HardDeleteAccount(ctx, deleted.ID)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+		_, err = store.ConsumeVerificationToken(ctx, hashOpaqueToken("token"))
+		assert.ErrorIs(t, err, ErrVerificationTokenInvalid)
+		_, err = store.GetAccountByID(ctx, live.ID)
+		assert.Nil(t, err)
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return NewMemoryStore()
+	})
+}
+
+func TestMemoryStoreRollbackKeepsOtherWrites(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, from))
+	to, err := NewAccount("e", "f", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, to))
+
+	acc, err := NewAccount("c", "d", "signup@abc.com", "password123")
+	require.Nil(t, err)
+	signup := make(chan error)
+	err = store.InTx(ctx, func(tx Storage) error {
+		go func() { signup <- store.CreateAccount(ctx, acc) }()
+		// give the signup the chance to land while the transaction runs
+		time.Sleep(10 * time.Millisecond)
+		_, err := tx.Transfer(ctx, from.ID, to.ID, 30)
+		return err
+	})
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	require.Nil(t, <-signup)
+	_, err = store.GetAccountByEmail(ctx, "signup@abc.com")
+	assert.Nil(t, err, "a rollback only undoes the transaction's writes")
+}
+
+func TestNewStore(t *testing.T) {
+	cfg := &Config{Storage: StorageMemory, DailyTransferLimit: 500, ExchangeRates: map[string]map[string]float64{"USD": {"EUR": 0.9}}}
+	store, err := newStore(cfg, discardLogger)
+	require.Nil(t, err)
+	require.IsType(t, &MemoryStore{}, store)
+	assert.Equal(t, int64(500), store.(*MemoryStore).dailyTransferLimit)
+	assert.NotNil(t, store.(*MemoryStore).rates)
+
+	_, err = newStore(&Config{Storage: "sqlite"}, discardLogger)
+	assert.ErrorContains(t, err, "unsupported storage")
+}
+
+// TestPostgresStore needs a disposable database described by config.yml.
+func TestPostgresStore(t *testing.T) {
+	if os.Getenv("GOBANK_TEST_POSTGRES") == "" {
+		t.Skip("set GOBANK_TEST_POSTGRES to run against the database in config.yml")
+	}
+	testStorage(t, func(t *testing.T) Storage {
+		cfg, err := loadConfig("config.yml")
+		require.Nil(t, err)
+		store, err := NewPostgresStore(cfg, discardLogger)
+		require.Nil(t, err)
+		require.Nil(t, store.Init())
+		_, err = store.db.Exec(context.Background(), "TRUNCATE account, transactions, ledger_entries, scheduled_transfers, standing_orders, holds, idempotency_keys, email_verification_tokens, password_reset_tokens, totp_backup_codes, passkeys, passkey_sessions, api_keys, refresh_tokens, sessions, login_attempts, revoked_access_tokens, login_failures RESTART IDENTITY")
+		require.Nil(t, err)
+		t.Cleanup(func() { store.pool.Close() })
+		return store
+	})
+}
+
+func TestPostgresStoreReadsSurviveNewColumns(t *testing.T) {
+	if os.Getenv("GOBANK_TEST_POSTGRES") == "" {
+		t.Skip("set GOBANK_TEST_POSTGRES to run against the database in config.yml")
+	}
+	cfg, err := loadConfig("config.yml")
+	require.Nil(t, err)
+	store, err := NewPostgresStore(cfg, discardLogger)
+	require.Nil(t, err)
+	defer store.pool.Close()
+	require.Nil(t, store.Init())
+	_, err = store.db.Exec(context.Background(), "TRUNCATE account, transactions, ledger_entries, scheduled_transfers, standing_orders, holds, idempotency_keys, email_verification_tokens, password_reset_tokens, totp_backup_codes, passkeys, passkey_sessions, api_keys, refresh_tokens, sessions, login_attempts, revoked_access_tokens, login_failures RESTART IDENTITY")
+	require.Nil(t, err)
+
+	acc, err := NewAccount("first", "last", "columns@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(context.Background(), acc))
+
+	// with SELECT * the extra column would make the scan fail
+	_, err = store.db.Exec(context.Background(), "ALTER TABLE account ADD COLUMN regression_extra text DEFAULT 'extra'")
+	require.Nil(t, err)
+	defer store.db.Exec(context.Background(), "ALTER TABLE account DROP COLUMN regression_extra")
+
+	found, err := store.GetAccountByID(context.Background(), acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, acc.Email, found.Email)
+	found, err = store.GetAccountByEmail(context.Background(), acc.Email)
+	require.Nil(t, err)
+	assert.Equal(t, acc.ID, found.ID)
+	accounts, err := store.GetAccounts(context.Background(), AccountFilter{}, 0, maxPageLimit, 0)
+	require.Nil(t, err)
+	assert.Len(t, accounts, 1)
+}
+
+func TestEscapeLike(t *testing.T) {
+	assert.Equal(t, `100\%\_real\\`, escapeLike(`100%_real\`))
+}
+
+// BenchmarkPostgresCreateAccount needs a disposable database described by
+// config.yml. It compares the statement cache pgx uses by default with
+// sending every insert unprepared.
+func BenchmarkPostgresCreateAccount(b *testing.B) {
+	if os.Getenv("GOBANK_TEST_POSTGRES") == "" {
+		b.Skip("set GOBANK_TEST_POSTGRES to run against the database in config.yml")
+	}
+	ctx := context.Background()
+	cfg, err := loadConfig("config.yml")
+	require.Nil(b, err)
+	store, err := NewPostgresStore(cfg, discardLogger)
+	require.Nil(b, err)
+	defer store.pool.Close()
+	require.Nil(b, store.Init())
+	// hashing dominates NewAccount, so every account shares one hash
+	template, err := NewAccount("first", "last", "bench@abc.com", "password123")
+	require.Nil(b, err)
+
+	for _, mode := range []struct {
+		name string
+		mode pgx.QueryExecMode
+	}{
+		{"CachedStatements", pgx.QueryExecModeCacheStatement},
+		{"Unprepared", pgx.QueryExecModeExec},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			poolConfig := store.pool.Config()
+			poolConfig.ConnConfig.DefaultQueryExecMode = mode.mode
+			pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+			require.Nil(b, err)
+			defer pool.Close()
+			bench := *store
+			bench.pool, bench.db = pool, pool
+			_, err = pool.Exec(ctx, "TRUNCATE account CASCADE")
+			require.Nil(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				acc := *template
+				acc.Email = fmt.Sprintf("bench%d@abc.com", i)
+				acc.Number, err = newAccountNumber()
+				require.Nil(b, err)
+				require.Nil(b, bench.CreateAccount(ctx, &acc))
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// twoFactorChallengePurpose marks the short-lived tokens login hands out
+	// while it waits for a TOTP code.
+	twoFactorChallengePurpose = "2fa_challenge"
+	twoFactorChallengeTTL     = 5 * time.Minute
+	totpIssuer                = "gobank"
+	// backupCodeCount is how many backup codes activating two-factor
+	// authentication hands out.
+	backupCodeCount = 10
+	// sealedTOTPPrefix marks secrets sealed by sealTOTPSecret. Secrets stored
+	// before they were encrypted have no prefix and are read as they are.
+	sealedTOTPPrefix = "v1:"
+)
+
+// ErrBackupCodeInvalid is returned by UseBackupCode when the code is not an
+// unused backup code of the account.
+var ErrBackupCodeInvalid = errors.New("backup code is invalid or already used")
+
+// errIncorrectCode answers a second factor that did not check out.
+var errIncorrectCode = unauthorized("INCORRECT_CODE", "incorrect code")
+
+// totpOptions match what authenticator apps assume for the URLs totp.Generate
+// produces, and accept a code from one step either side of now to allow for
+// clock drift.
+var totpOptions = totp.ValidateOpts{
+	Period:    30,
+	Skew:      1,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// totpCipher returns the AEAD sealing TOTP secrets at rest, keyed by the
+// TOTP_ENCRYPTION_KEY environment variable.
+func totpCipher() (cipher.AEAD, error) {
+	secret := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if secret == "" {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY is not set")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret encrypts secret for storage. The account id is
+// authenticated along with it, so a sealed secret cannot be copied to
+// another account.
+func sealTOTPSecret(accountID int, secret string) (string, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return "", fmt.Errorf("could not seal totp secret: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("could not seal totp secret: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(strconv.Itoa(accountID)))
+	return sealedTOTPPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openTOTPSecret reverses sealTOTPSecret.
+func openTOTPSecret(accountID int, stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, sealedTOTPPrefix)
+	if !ok {
+		return stored, nil
+	}
+	aead, err := totpCipher()
+	if err != nil {
+		return "", fmt.Errorf("could not open totp secret: %w", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("could not open totp secret of account %d: malformed", accountID)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(accountID)))
+	if err != nil {
+		return "", fmt.Errorf("could not open totp secret of account %d: %w", accountID, err)
+	}
+	return string(secret), nil
+}
+
+// validTOTP reports whether code is the current code of acc's authenticator
+// app.
+func (s *APIServer) validTOTP(acc *Account, code string) (bool, error) {
+	secret, err := openTOTPSecret(acc.ID, acc.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	ok, err := totp.ValidateCustom(code, secret, s.now().UTC(), totpOptions)
+	return err == nil && ok, nil
+}
+
+// checkSecondFactor accepts a code from acc's authenticator app or one of
+// its backup codes, which is used up. It returns errIncorrectCode otherwise.
+func (s *APIServer) checkSecondFactor(ctx context.Context, acc *Account, code string) error {
+	ok, err := s.validTOTP(acc, code)
+	if err != nil || ok {
+		return err
+	}
+	err = s.store.UseBackupCode(ctx, acc.ID, hashOpaqueToken(normalizeBackupCode(code)), s.now().UTC())
+	if errors.Is(err, ErrBackupCodeInvalid) {
+		return errIncorrectCode
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(ctx, "backup code used", "account_id", acc.ID)
+	return nil
+}
+
+// newBackupCodes returns backupCodeCount codes formatted for reading, such
+// as "abcd-efgh", along with the hashes to store.
+func newBackupCodes() (codes, hashes []string, err error) {
+	for i := 0; i < backupCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashOpaqueToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeBackupCode undoes the formatting of newBackupCodes so codes can
+// be typed with or without the dash and in any case.
+func normalizeBackupCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// writeTwoFactorChallenge answers a login whose password checked out but
+// which still needs a TOTP code.
+func (s *APIServer) writeTwoFactorChallenge(w http.ResponseWriter, acc *Account) error {
+	challenge, expiresAt, err := signJWT(acc, twoFactorChallengePurpose, 0, twoFactorChallengeTTL)
+	if err != nil {
+		return fmt.Errorf("could not sign two-factor challenge for account %d: %w", acc.ID, err)
+	}
+	return WriteJSON(w, http.StatusAccepted, TwoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		Challenge:         challenge,
+		ExpiresAt:         expiresAt.UTC(),
+	})
+}
+
+// handleLoginTwoFactor exchanges a login challenge and a TOTP code for an
+// access token.
+func (s *APIServer) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	var req TwoFactorLoginRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	token, err := validateJWT(req.Challenge)
+	if err != nil || !token.Valid || token.Claims.(*AccountClaims).Purpose != twoFactorChallengePurpose {
+		return unauthorized("TWO_FACTOR_CHALLENGE_INVALID", "invalid or expired challenge")
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), token.Claims.(*AccountClaims).AccountID)
+	if err != nil {
+		return unauthorized("TWO_FACTOR_CHALLENGE_INVALID", "invalid or expired challenge")
+	}
+	if !acc.TOTPEnabled {
+		return errIncorrectCode
+	}
+	// Wrong codes count towards the same locks as wrong passwords, so a
+	// challenge cannot be used to guess codes without limit.
+	email, ip := normalizeEmail(acc.Email), clientIP(r)
+	if err := s.checkLoginLock(r.Context(), email, ip); err != nil {
+		return err
+	}
+	if err := s.checkSecondFactor(r.Context(), acc, req.Code); err != nil {
+		if errors.Is(err, errIncorrectCode) {
+			s.recordLogin(r.Context(), acc, ip, r.UserAgent(), LoginResultFailure)
+			return s.loginFailed(r.Context(), email, ip, acc, err)
+		}
+		return err
+	}
+	if err := s.store.ClearLoginFailures(r.Context(), loginEmailKeyPrefix+email); err != nil {
+		return err
+	}
+	return s.writeLoginToken(w, r, acc)
+}
+
+// handleEnrollTwoFactor enrolls an account in two-factor authentication.
+// Enrolling again before activation replaces the pending secret.
+func (s *APIServer) handleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if acc.TOTPEnabled {
+		return &HTTPError{Status: http.StatusConflict, Code: "TWO_FACTOR_ALREADY_ENABLED", Message: "two-factor authentication is already enabled"}
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: acc.Email})
+	if err != nil {
+		return err
+	}
+	sealed, err := sealTOTPSecret(id, key.Secret())
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetTOTPSecret(r.Context(), id, sealed); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "two-factor authentication enrolled", "account_id", id)
+	return WriteJSON(w, http.StatusOK, TwoFactorEnrollment{Secret: key.Secret(), URL: key.URL()})
+}
+
+// handleDisableTwoFactor turns two-factor authentication off given a
+// current or backup code.
+func (s *APIServer) handleDisableTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	var req DisableTwoFactorRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	if !acc.TOTPEnabled {
+		return badRequest("two-factor authentication is not enabled")
+	}
+	if err := s.checkSecondFactor(r.Context(), acc, req.Code); errors.Is(err, errIncorrectCode) {
+		return forbidden("INCORRECT_CODE", "incorrect code")
+	} else if err != nil {
+		return err
+	}
+	if err := s.store.SetTOTPSecret(r.Context(), id, ""); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "two-factor authentication disabled", "account_id", id)
+	return writeNoContent(w)
+}
+
+// handleActivateTwoFactor turns on two-factor authentication once the
+// account proves its app produces codes for the enrolled secret, and hands
+// out backup codes.
+func (s *APIServer) handleActivateTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.getIDFromRequest(r)
+	if err != nil {
+		return err
+	}
+	var req ActivateTwoFactorRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if acc.TOTPEnabled {
+		return &HTTPError{Status: http.StatusConflict, Code: "TWO_FACTOR_ALREADY_ENABLED", Message: "two-factor authentication is already enabled"}
+	}
+	if acc.TOTPSecret == "" {
+		return badRequest("enroll in two-factor authentication first")
+	}
+	ok, err := s.validTOTP(acc, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return forbidden("INCORRECT_CODE", "incorrect code")
+	}
+	codes, hashes, err := newBackupCodes()
+	if err != nil {
+		return fmt.Errorf("could not create backup codes: %w", err)
+	}
+	if err := s.store.EnableTOTP(r.Context(), id, hashes); err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "two-factor authentication enabled", "account_id", id)
+	return WriteJSON(w, http.StatusOK, TwoFactorActivation{BackupCodes: codes})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwoFactorEnrollLoginAndVerify(t *testing.T) {
+	server, router := newTestServer(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	server.now = func() time.Time { return now }
+	acc, err := NewAccount("a", "b", "abc@abc.com", "password123")
+	require.Nil(t, err)
+	acc.EmailVerified = true
+	require.Nil(t, server.store.CreateAccount(context.Background(), acc))
+	token, _, err := createJWT(acc)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	path := fmt.Sprintf("/api/v1/account/%d/2fa", acc.ID)
+	login := LoginRequest{Email: "abc@abc.com", Password: "password123"}
+
+	rec := doJSON(t, router, "POST", path, nil, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var enrollment TwoFactorEnrollment
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&enrollment))
+	assert.Contains(t, enrollment.URL, "otpauth://totp/gobank:abc@abc.com")
+	stored, err := server.store.GetAccountByID(context.Background(), acc.ID)
+	require.Nil(t, err)
+	assert.NotContains(t, stored.TOTPSecret, enrollment.Secret, "the secret is encrypted at rest")
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", login, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "two-factor authentication is not on until activated")
+
+	rec = doJSON(t, router, "POST", path+"/activate", ActivateTwoFactorRequest{Code: "000000"}, header)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	code, err := totp.GenerateCodeCustom(enrollment.Secret, now, totpOptions)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", path+"/activate", ActivateTwoFactorRequest{Code: code}, header)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var activation TwoFactorActivation
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&activation))
+	assert.Len(t, activation.BackupCodes, backupCodeCount)
+	rec = doJSON(t, router, "POST", path+"/activate", ActivateTwoFactorRequest{Code: code}, header)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doJSON(t, router, "POST", path, nil, header)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", login, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var challenge TwoFactorChallengeResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&challenge))
+	assert.True(t, challenge.TwoFactorRequired)
+	assert.Empty(t, rec.Header().Get("Authorization"))
+
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"Authorization": {"Bearer " + challenge.Challenge}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "a challenge is not an access token")
+
+	code, err = totp.GenerateCodeCustom(enrollment.Secret, now.Add(-10*time.Minute), totpOptions)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: challenge.Challenge, Code: code}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "code from a stale time step")
+
+	rec = doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: token, Code: code}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "an access token is not a challenge")
+
+	code, err = totp.GenerateCodeCustom(enrollment.Secret, now, totpOptions)
+	require.Nil(t, err)
+	rec = doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: challenge.Challenge, Code: code}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp LoginResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, acc.ID, resp.AccountID)
+	rec = doJSON(t, router, "GET", "/api/v1/me", nil, http.Header{"Authorization": {"Bearer " + resp.Token}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", login, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&challenge))
+	backupCode := strings.ToUpper(activation.BackupCodes[0])
+	rec = doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: challenge.Challenge, Code: backupCode}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "a backup code stands in for an app code")
+	rec = doJSON(t, router, "POST", "/api/v1/login/2fa", TwoFactorLoginRequest{Challenge: challenge.Challenge, Code: backupCode}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "backup codes are single use")
+
+	rec = doJSON(t, router, "DELETE", path, DisableTwoFactorRequest{Code: "000000"}, header)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doJSON(t, router, "DELETE", path, DisableTwoFactorRequest{Code: code}, header)
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, router, "POST", "/api/v1/login", login, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestSealTOTPSecret(t *testing.T) {
+	t.Setenv("TOTP_ENCRYPTION_KEY", "test-totp-key")
+	sealed, err := sealTOTPSecret(1, "JBSWY3DPEHPK3PXP")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(sealed, sealedTOTPPrefix))
+
+	secret, err := openTOTPSecret(1, sealed)
+	require.Nil(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", secret)
+	_, err = openTOTPSecret(2, sealed)
+	assert.NotNil(t, err, "sealed secrets are bound to their account")
+
+	secret, err = openTOTPSecret(1, "JBSWY3DPEHPK3PXP")
+	require.Nil(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", secret, "secrets stored before encryption are read as they are")
+
+	t.Setenv("TOTP_ENCRYPTION_KEY", "other-key")
+	_, err = openTOTPSecret(1, sealed)
+	assert.NotNil(t, err)
+}
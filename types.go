@@ -1,49 +1,429 @@
 package main
 
 import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 type CreateAccountRequest struct {
 	FirstName string `json:"firstName" validate:"required,min=1"`
 	LastName  string `json:"lastName" validate:"required,min=1"`
-	Email string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8"`
+	Email     string `json:"email" validate:"required,email"`
+	Password  string `json:"password" validate:"required,min=8,strongpassword"`
+	// Currency is an ISO 4217 code and defaults to DefaultCurrency.
+	Currency string `json:"currency,omitempty" validate:"omitempty,currency"`
+}
+
+// maxBatchAccounts caps how many accounts one batch create request may open.
+const maxBatchAccounts = 100
+
+const (
+	BatchItemCreated    = "created"
+	BatchItemInvalid    = "invalid"
+	BatchItemFailed     = "failed"
+	BatchItemRolledBack = "rolled_back"
+)
+
+// BatchItemResult reports the outcome for one entry of a batch create, in
+// request order.
+type BatchItemResult struct {
+	Index   int               `json:"index"`
+	Status  string            `json:"status"`
+	Account *Account          `json:"account,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+type BatchCreateAccountsResponse struct {
+	Results []BatchItemResult `json:"results"`
 }
 
 type Account struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"firstName"`
-	LastName  string    `json:"lastName"`
-	Email 		string 		`json:"email"`
-	Phone    int64     `json:"phone"`
+	ID                int    `json:"id"`
+	Number            int64  `json:"number"`
+	FirstName         string `json:"firstName"`
+	LastName          string `json:"lastName"`
+	Email             string `json:"email"`
+	Phone             int64  `json:"phone"`
 	EncryptedPassword string `json:"-"`
-	Balance   int64     `json:"balance"`
+	// Balance is in the minor units of Currency. It is the booked balance:
+	// money reserved by active holds is still included.
+	Balance int64 `json:"balance"`
+	// Held is the total reserved by the account's active holds. The
+	// available balance is Balance less Held.
+	Held      int64     `json:"held"`
+	Currency  string    `json:"currency"`
 	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Version increases on every update and guards against lost updates.
+	Version int `json:"version"`
+	// DailyTransferLimit overrides the configured daily cap on outgoing
+	// transfers for this account when set.
+	DailyTransferLimit *int64 `json:"dailyTransferLimit,omitempty"`
+	// PerTransferLimit overrides the configured cap on a single outgoing
+	// transfer for this account when set.
+	PerTransferLimit *int64 `json:"perTransferLimit,omitempty"`
+	// OverdraftLimit is how far below zero the balance may go, in minor
+	// units. Zero means no overdraft.
+	OverdraftLimit int64  `json:"overdraftLimit"`
+	Role           string `json:"role"`
+	// Status is AccountStatusActive or AccountStatusFrozen. Frozen accounts
+	// can be read but cannot send or receive money.
+	Status string `json:"status"`
+	// EmailVerified is false until the account opens the link it was sent at
+	// signup. Unverified accounts cannot log in.
+	EmailVerified bool `json:"emailVerified"`
+	// TOTPSecret is the sealed secret of an enrolled authenticator app, see
+	// sealTOTPSecret. Once TOTPEnabled is set by confirming a code, login
+	// needs a code from the app as well as the password.
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"-"`
+	// DeletedAt is set once the account is soft deleted.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+const (
+	AccountStatusActive = "active"
+	AccountStatusFrozen = "frozen"
+)
+
+type UpdateAccountRequest struct {
+	FirstName string `json:"firstName" validate:"required,min=1"`
+	LastName  string `json:"lastName" validate:"required,min=1"`
+	// Phone replaces the account's phone number when set.
+	Phone *int64 `json:"phone,omitempty" validate:"omitempty,min=0"`
+	// Version must match the stored account, otherwise the update is rejected
+	// with a conflict.
+	Version int `json:"version" validate:"required,min=1"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword" validate:"required,min=8,strongpassword"`
+}
+
+type SetOverdraftLimitRequest struct {
+	OverdraftLimit int64 `json:"overdraftLimit" validate:"min=0"`
+}
+
+// SetTransferLimitsRequest overrides an account's transfer limits. A limit
+// left out falls back to the configured default.
+type SetTransferLimitsRequest struct {
+	DailyTransferLimit *int64 `json:"dailyTransferLimit,omitempty" validate:"omitempty,min=0"`
+	PerTransferLimit   *int64 `json:"perTransferLimit,omitempty" validate:"omitempty,min=0"`
+}
+
+// LedgerAdjustmentRequest moves money into or out of an account from outside
+// the bank. Amount is in minor units of the account's currency.
+type LedgerAdjustmentRequest struct {
+	Type   string `json:"type" validate:"required,oneof=deposit withdrawal fee"`
+	Amount int64  `json:"amount" validate:"required,min=1"`
 }
 
 type TransferRequest struct {
-	ToAccount int `json:"toAccount"`
-	Amount    int `json:"amount"`
+	// ToAccount is the account number of the receiving account.
+	ToAccount int64 `json:"toAccount" validate:"required"`
+	Amount    int64 `json:"amount" validate:"required,min=1"`
+	// ExecuteAt schedules the transfer for a future time instead of making
+	// it now.
+	ExecuteAt *time.Time `json:"executeAt,omitempty"`
+}
+
+const (
+	TransactionTransferDebit  = "transfer_debit"
+	TransactionTransferCredit = "transfer_credit"
+	TransactionDeposit        = "deposit"
+	TransactionWithdrawal     = "withdrawal"
+	TransactionFee            = "fee"
+	TransactionReversalDebit  = "reversal_debit"
+	TransactionReversalCredit = "reversal_credit"
+)
+
+const (
+	TransactionStatusCompleted = "completed"
+	TransactionStatusReversed  = "reversed"
+)
+
+// Transaction is a ledger entry recording a single change to an account's
+// balance. Amount is always positive, Type says which way the money moved.
+type Transaction struct {
+	ID                    int       `json:"id"`
+	AccountID             int       `json:"accountId"`
+	Type                  string    `json:"type"`
+	Amount                int64     `json:"amount"`
+	CounterpartyAccountID *int      `json:"counterpartyAccountId,omitempty"`
+	CreatedAt             time.Time `json:"createdAt"`
+
+	// Status is TransactionStatusReversed once a transfer has been reversed.
+	// ReversalOf is set on the compensating entries and points at the entry
+	// they undo.
+	Status     string `json:"status"`
+	ReversalOf *int   `json:"reversalOf,omitempty"`
+
+	// ExchangeRate, OriginalAmount and OriginalCurrency are set on both
+	// entries of a cross-currency transfer: the rate applied and the amount
+	// sent, in the sender's currency. Amount is always in the currency of
+	// the entry's own account.
+	ExchangeRate     *float64 `json:"exchangeRate,omitempty"`
+	OriginalAmount   *int64   `json:"originalAmount,omitempty"`
+	OriginalCurrency *string  `json:"originalCurrency,omitempty"`
+}
+
+// transferLimitWindow is the rolling window daily transfer limits are
+// measured over.
+const transferLimitWindow = 24 * time.Hour
+
+const (
+	LimitDaily       = "daily"
+	LimitPerTransfer = "per_transfer"
+)
+
+// DailyLimitError is returned by Transfer when the amount would take the
+// sender's outgoing transfers over the last transferLimitWindow over its
+// limit.
+type DailyLimitError struct {
+	Limit     int64
+	Remaining int64
+}
+
+func (e *DailyLimitError) Error() string {
+	return fmt.Sprintf("daily limit exceeded: %d of %d remaining in the last 24h", e.Remaining, e.Limit)
+}
+
+// PerTransferLimitError is returned by Transfer when the amount is more than
+// the sender may send in a single transfer.
+type PerTransferLimitError struct {
+	Limit int64
+}
+
+func (e *PerTransferLimitError) Error() string {
+	return fmt.Sprintf("per-transfer limit exceeded: at most %d per transfer", e.Limit)
+}
+
+// LimitExceededResponse is the body of a transfer refused for breaking one
+// of the sender's limits. Remaining is how much could still be sent.
+type LimitExceededResponse struct {
+	APIError
+	Limit     string `json:"limit"`
+	Max       int64  `json:"max"`
+	Remaining int64  `json:"remaining"`
+}
+
+// checkDailyLimit returns a *DailyLimitError when sending amount on top of
+// spent, the total sent within transferLimitWindow, breaks the account's
+// limit. An account without an override uses defaultLimit, where zero means
+// unlimited.
+func checkDailyLimit(acc *Account, defaultLimit, spent, amount int64) error {
+	limit := defaultLimit
+	if acc.DailyTransferLimit != nil {
+		limit = *acc.DailyTransferLimit
+	} else if limit == 0 {
+		return nil
+	}
+	if spent+amount > limit {
+		remaining := limit - spent
+		if remaining < 0 {
+			remaining = 0
+		}
+		return &DailyLimitError{Limit: limit, Remaining: remaining}
+	}
+	return nil
+}
+
+// checkPerTransferLimit returns a *PerTransferLimitError when amount is more
+// than the account may send at once. An account without an override uses
+// defaultLimit, where zero means unlimited.
+func checkPerTransferLimit(acc *Account, defaultLimit, amount int64) error {
+	limit := defaultLimit
+	if acc.PerTransferLimit != nil {
+		limit = *acc.PerTransferLimit
+	} else if limit == 0 {
+		return nil
+	}
+	if amount > limit {
+		return &PerTransferLimitError{Limit: limit}
+	}
+	return nil
+}
+
+// checkFunds returns an error when sending amount would take acc's available
+// balance below its overdraft limit. Accounts without an overdraft get
+// ErrInsufficientFunds, others ErrOverdraftLimitExceeded, which wraps it.
+func checkFunds(acc *Account, amount int64) error {
+	if acc.Balance-acc.Held-amount >= -acc.OverdraftLimit {
+		return nil
+	}
+	if acc.OverdraftLimit == 0 {
+		return fmt.Errorf("%w: account with id %d", ErrInsufficientFunds, acc.ID)
+	}
+	return fmt.Errorf("%w: account with id %d may not go below -%d", ErrOverdraftLimitExceeded, acc.ID, acc.OverdraftLimit)
+}
+
+// defaultIdempotencyKeyTTL is how long a stored Idempotency-Key result is
+// replayed unless configured otherwise.
+const defaultIdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotentResult is the response recorded for an account's Idempotency-Key
+// so a retried request can be answered without running it again.
+type IdempotentResult struct {
+	AccountID int
+	Key       string
+	// RequestHash identifies the request the key was first used with, so
+	// reusing the key for a different request can be refused.
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// Balance is an account's booked balance along with the part of it that
+// active holds reserve.
+type Balance struct {
+	Money
+	Held int64
+}
+
+type BalanceResponse struct {
+	// Balance is the booked balance, Available what is left of it once
+	// active holds are taken out.
+	Balance   int64  `json:"balance"`
+	Available int64  `json:"available"`
+	Held      int64  `json:"held"`
+	Currency  string `json:"currency"`
+	Formatted string `json:"formatted"`
+}
+
+type TransactionsPage struct {
+	Transactions []*Transaction `json:"transactions"`
+	Limit        int            `json:"limit"`
+	Offset       int            `json:"offset"`
+	// From and To echo the date range the page was filtered to, if any.
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+}
+
+// AccountsPage is a page of GET /account. Total counts every account the
+// filters match, not just those on the page. Pass the last account's id as
+// after to get the next page without counting past the earlier ones. Page is
+// set when the page was asked for by number.
+type AccountsPage struct {
+	Accounts []*Account `json:"accounts"`
+	Total    int        `json:"total"`
+	Limit    int        `json:"limit"`
+	Offset   int        `json:"offset"`
+	After    int        `json:"after,omitempty"`
+	Page     int        `json:"page,omitempty"`
+}
+
+type LedgerEntriesPage struct {
+	Entries []*LedgerEntry `json:"entries"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+}
+
+// normalizeEmail trims and lowercases an email address so that lookups and
+// the uniqueness check ignore case.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
 func NewAccount(firstName, lastName, email, password string) (*Account, error) {
-	encpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	encpw, err := hashPassword(password)
 	if err != nil {
 		return nil, err
 	}
+	number, err := newAccountNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
 	return &Account{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:    email,
-		CreatedAt: time.Now().UTC(),
-		EncryptedPassword: string(encpw),
+		Number:            number,
+		FirstName:         firstName,
+		LastName:          lastName,
+		Email:             normalizeEmail(email),
+		Currency:          DefaultCurrency,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		Version:           1,
+		Role:              RoleUser,
+		Status:            AccountStatusActive,
+		EncryptedPassword: encpw,
 	}, nil
 }
 
+const (
+	minAccountNumber = 1_000_000_000
+	maxAccountNumber = 9_999_999_999
+)
+
+// newAccountNumber returns a random 10 digit account number.
+func newAccountNumber() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxAccountNumber-minAccountNumber+1))
+	if err != nil {
+		return 0, err
+	}
+	return minAccountNumber + n.Int64(), nil
+}
+
 type LoginRequest struct {
-	Email string `json:"email" validate:"required,email"`
+	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
-}
\ No newline at end of file
+}
+
+type LoginResponse struct {
+	// Token and RefreshToken are omitted when they are delivered as cookies.
+	Token     string    `json:"token,omitempty"`
+	AccountID int       `json:"accountId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// RefreshToken can be exchanged once at POST /token/refresh for a new
+	// token until RefreshExpiresAt.
+	RefreshToken     string    `json:"refreshToken,omitempty"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
+
+// TwoFactorChallengeResponse is returned by login instead of a token when
+// the account has two-factor authentication enabled. The challenge is
+// exchanged for a token at POST /login/2fa along with a code.
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool      `json:"twoFactorRequired"`
+	Challenge         string    `json:"challenge"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+}
+
+// TwoFactorLoginRequest completes a login with a code from the
+// authenticator app or one of the account's backup codes.
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge" validate:"required"`
+	Code      string `json:"code" validate:"required,min=6,max=16"`
+}
+
+// TwoFactorEnrollment is the secret to load into an authenticator app,
+// also given as an otpauth:// URL for QR codes. It is not required at login
+// until a code from the app is confirmed at POST /account/{id}/2fa/activate.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"`
+}
+
+type ActivateTwoFactorRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+// TwoFactorActivation lists the single-use backup codes that can stand in
+// for an app code. They are only ever shown once.
+type TwoFactorActivation struct {
+	BackupCodes []string `json:"backupCodes"`
+}
+
+type DisableTwoFactorRequest struct {
+	Code string `json:"code" validate:"required,min=6,max=16"`
+}
@@ -7,8 +7,44 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestNewAccount(t *testing.T){
+func TestNewAccount(t *testing.T) {
 	acc, err := NewAccount("a", "b", "qwerty", "abc@abc.com")
 	assert.Nil(t, err)
-	fmt.Printf("%+v\n",acc)
-}
\ No newline at end of file
+	fmt.Printf("%+v\n", acc)
+}
+
+func TestNewAccountNumber(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		number, err := newAccountNumber()
+		assert.Nil(t, err)
+		assert.Len(t, fmt.Sprint(number), 10)
+	}
+}
+
+func TestCheckDailyLimit(t *testing.T) {
+	override := int64(50)
+	assert.Nil(t, checkDailyLimit(&Account{}, 0, 1000, 1000))
+	assert.Nil(t, checkDailyLimit(&Account{}, 100, 60, 40))
+	assert.Equal(t, &DailyLimitError{Limit: 100, Remaining: 40}, checkDailyLimit(&Account{}, 100, 60, 41))
+	assert.Equal(t, &DailyLimitError{Limit: 50, Remaining: 0}, checkDailyLimit(&Account{DailyTransferLimit: &override}, 0, 60, 1))
+}
+
+func TestCheckPerTransferLimit(t *testing.T) {
+	override := int64(50)
+	assert.Nil(t, checkPerTransferLimit(&Account{}, 0, 1000))
+	assert.Nil(t, checkPerTransferLimit(&Account{}, 100, 100))
+	assert.Equal(t, &PerTransferLimitError{Limit: 100}, checkPerTransferLimit(&Account{}, 100, 101))
+	assert.Equal(t, &PerTransferLimitError{Limit: 50}, checkPerTransferLimit(&Account{PerTransferLimit: &override}, 0, 51))
+}
+
+func TestCheckFunds(t *testing.T) {
+	assert.Nil(t, checkFunds(&Account{Balance: 100}, 100))
+	assert.ErrorIs(t, checkFunds(&Account{Balance: 100}, 101), ErrInsufficientFunds)
+	assert.NotErrorIs(t, checkFunds(&Account{Balance: 100}, 101), ErrOverdraftLimitExceeded)
+
+	overdraft := &Account{Balance: 100, OverdraftLimit: 50}
+	assert.Nil(t, checkFunds(overdraft, 150))
+	err := checkFunds(overdraft, 151)
+	assert.ErrorIs(t, err, ErrOverdraftLimitExceeded)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator"
+)
+
+var validate = newValidator()
+
+// ValidationErrorResponse is the body of a request refused for invalid
+// fields. Fields maps each to what is wrong with it.
+type ValidationErrorResponse struct {
+	APIError
+	Fields map[string]string `json:"fields"`
+}
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	// report fields by the name clients send rather than the Go field name
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	v.RegisterValidation("strongpassword", isStrongPassword)
+	v.RegisterValidation("currency", func(fl validator.FieldLevel) bool {
+		return isSupportedCurrency(fl.Field().String())
+	})
+	return v
+}
+
+// isStrongPassword requires at least one letter and one digit.
+func isStrongPassword(fl validator.FieldLevel) bool {
+	var hasLetter, hasDigit bool
+	for _, r := range fl.Field().String() {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	return hasLetter && hasDigit
+}
+
+// validationMessages maps each failed field to a human readable description
+// of the rule it broke.
+func validationMessages(err error) map[string]string {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil
+	}
+	fields := make(map[string]string, len(validationErrs))
+	for _, fieldErr := range validationErrs {
+		fields[fieldErr.Field()] = validationMessage(fieldErr)
+	}
+	return fields
+}
+
+func validationMessage(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email"
+	case "min":
+		if fieldErr.Kind() == reflect.String {
+			return fmt.Sprintf("min %s characters", fieldErr.Param())
+		}
+		return fmt.Sprintf("must be at least %s", fieldErr.Param())
+	case "max":
+		if fieldErr.Kind() == reflect.String {
+			return fmt.Sprintf("max %s characters", fieldErr.Param())
+		}
+		return fmt.Sprintf("must be at most %s", fieldErr.Param())
+	case "strongpassword":
+		return "must contain a letter and a digit"
+	case "currency":
+		return "must be a supported ISO 4217 currency code"
+	default:
+		return fmt.Sprintf("failed %s validation", fieldErr.Tag())
+	}
+}
+
+// writeValidationErrors responds with 422 and the per field failures from a
+// validate.Struct error.
+func writeValidationErrors(w http.ResponseWriter, err error) error {
+	return writeProblem(w, http.StatusUnprocessableEntity, ValidationErrorResponse{
+		APIError: newAPIError(http.StatusUnprocessableEntity, "VALIDATION_FAILED", "invalid request"),
+		Fields:   validationMessages(err),
+	})
+}
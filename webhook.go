@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	EventAccountCreated    = "account.created"
+	EventTransferCompleted = "transfer.completed"
+	EventTransferReversed  = "transfer.reversed"
+	EventAccountLocked     = "account.locked"
+	EventAccountUnlocked   = "account.unlocked"
+	EventLoginFromNewIP    = "login.new_ip"
+)
+
+// Event is the JSON payload delivered to the webhook URL.
+type Event struct {
+	Type      string `json:"type"`
+	AccountID int    `json:"accountId"`
+	// CounterpartyAccountID is the receiving account of a transfer, also for
+	// its reversal.
+	CounterpartyAccountID *int      `json:"counterpartyAccountId,omitempty"`
+	Amount                int64     `json:"amount,omitempty"`
+	Timestamp             time.Time `json:"timestamp"`
+	// IP is the client of a login from a new IP.
+	IP string `json:"ip,omitempty"`
+}
+
+// EventDispatcher notifies downstream systems of events. Dispatch must not
+// block the request that raised the event.
+type EventDispatcher interface {
+	Dispatch(Event)
+}
+
+// noopDispatcher drops every event. It is used when no webhook is configured.
+type noopDispatcher struct{}
+
+func (noopDispatcher) Dispatch(Event) {}
+
+// webhookDispatcher POSTs each event to a URL from its own goroutine,
+// retrying failed deliveries with backoff.
+type webhookDispatcher struct {
+	url    string
+	client *http.Client
+	retry  retryPolicy
+	logger *slog.Logger
+}
+
+func newEventDispatcher(cfg *Config, logger *slog.Logger) EventDispatcher {
+	if cfg.WebhookURL == "" {
+		return noopDispatcher{}
+	}
+	return &webhookDispatcher{
+		url:    cfg.WebhookURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+		retry: retryPolicy{
+			attempts:  cfg.WebhookRetryAttempts,
+			baseDelay: cfg.WebhookRetryBaseDelay,
+			sleep:     time.Sleep,
+			retryable: func(error) bool { return true },
+		},
+		logger: logger,
+	}
+}
+
+func (d *webhookDispatcher) Dispatch(event Event) {
+	go func() {
+		if err := d.retry.do(func() error { return d.deliver(event) }); err != nil {
+			d.logger.Error("webhook delivery failed", "event", event.Type, "account_id", event.AccountID, "error", err)
+		}
+	}()
+}
+
+func (d *webhookDispatcher) deliver(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		d.logger.Warn("webhook delivery attempt failed", "event", event.Type, "error", err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.logger.Warn("webhook delivery attempt failed", "event", event.Type, "status", resp.StatusCode)
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
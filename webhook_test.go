@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDispatcher records dispatched events.
+type fakeDispatcher struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (d *fakeDispatcher) Dispatch(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, event)
+}
+
+func (d *fakeDispatcher) ofType(eventType string) []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var events []Event
+	for _, e := range d.events {
+		if e.Type == eventType {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestTransferDispatchesOneEvent(t *testing.T) {
+	server, router := newTestServer(t)
+	events := &fakeDispatcher{}
+	server.events = events
+	from, err := NewAccount("a", "b", "from@abc.com", "password123")
+	require.Nil(t, err)
+	from.Balance = 100
+	to, err := NewAccount("c", "d", "to@abc.com", "password123")
+	require.Nil(t, err)
+	require.Nil(t, server.store.CreateAccount(context.Background(), from))
+	require.Nil(t, server.store.CreateAccount(context.Background(), to))
+	token, _, err := createJWT(from)
+	require.Nil(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}, "Idempotency-Key": {"once"}}
+
+	for i := 0; i < 2; i++ {
+		rec := doJSON(t, router, "POST", "/api/v1/transfer", TransferRequest{ToAccount: to.Number, Amount: 25}, header)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	transfers := events.ofType(EventTransferCompleted)
+	require.Len(t, transfers, 1)
+	assert.Equal(t, from.ID, transfers[0].AccountID)
+	assert.Equal(t, to.ID, *transfers[0].CounterpartyAccountID)
+	assert.Equal(t, int64(25), transfers[0].Amount)
+}
+
+func TestCreateAccountDispatchesEvent(t *testing.T) {
+	server, router := newTestServer(t)
+	events := &fakeDispatcher{}
+	server.events = events
+
+	rec := doJSON(t, router, "POST", "/api/v1/account", CreateAccountRequest{
+		FirstName: "a",
+		LastName:  "b",
+		Email:     "abc@abc.com",
+		Password:  "password123",
+	}, nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	created := events.ofType(EventAccountCreated)
+	require.Len(t, created, 1)
+	assert.Equal(t, 1, created[0].AccountID)
+}
+
+func TestWebhookDispatcherRetriesFailedDeliveries(t *testing.T) {
+	delivered := make(chan Event, 1)
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delivered <- event
+	}))
+	defer hook.Close()
+
+	var delays []time.Duration
+	d := newEventDispatcher(&Config{WebhookURL: hook.URL, WebhookRetryAttempts: 3, WebhookRetryBaseDelay: time.Second}, discardLogger).(*webhookDispatcher)
+	d.retry.sleep = func(delay time.Duration) { delays = append(delays, delay) }
+
+	d.Dispatch(Event{Type: EventTransferCompleted, AccountID: 7, Amount: 10, Timestamp: time.Now().UTC()})
+
+	select {
+	case event := <-delivered:
+		assert.Equal(t, EventTransferCompleted, event.Type)
+		assert.Equal(t, 7, event.AccountID)
+		assert.Equal(t, int64(10), event.Amount)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, delays)
+}
+
+func TestNewEventDispatcherWithoutURL(t *testing.T) {
+	assert.IsType(t, noopDispatcher{}, newEventDispatcher(&Config{}, discardLogger))
+}